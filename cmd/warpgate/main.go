@@ -18,6 +18,10 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "warm" {
+		os.Exit(runWarm(os.Args[2:]))
+	}
+
 	configPath := flag.String("config", "./configs/warpgate.yaml", "path to config file")
 	flag.Parse()
 
@@ -53,11 +57,13 @@ func main() {
 
 			log.Printf("Listener %q starting on %s (%s)", ls.Name, ls.Server.Addr, scheme)
 
-			var err error
-			if ls.TLS.Enabled {
-				err = ls.Server.ListenAndServeTLS(ls.TLS.CertFile, ls.TLS.KeyFile)
-			} else {
-				err = ls.Server.ListenAndServe()
+			ln, err := ls.Listen()
+			if err == nil {
+				if ls.TLS.Enabled {
+					err = ls.Server.ServeTLS(ln, ls.TLS.CertFile, ls.TLS.KeyFile)
+				} else {
+					err = ls.Server.Serve(ln)
+				}
 			}
 
 			if err != nil && err != http.ErrServerClosed {
@@ -84,5 +90,8 @@ func main() {
 	}
 
 	wg.Wait()
+	if err := builder.Shutdown(ctx); err != nil {
+		log.Printf("tracing shutdown error: %v", err)
+	}
 	log.Println("All listeners stopped")
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"warpgate/internal/config"
+	"warpgate/internal/proxy"
+	"warpgate/internal/warm"
+)
+
+const warmUsage = `usage: warpgate warm [flags] <file|->
+
+Pre-fetches the URLs listed in file (one per line) or sitemap, so that their
+responses are cached. With -admin the list is sent to the admin API of a
+running instance; otherwise the URLs are fetched in this process, which only
+helps caches that outlive it (disk or redis).
+
+`
+
+// runWarm implements the warm subcommand and returns the exit code.
+func runWarm(args []string) int {
+	fs := flag.NewFlagSet("warm", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), warmUsage)
+		fs.PrintDefaults()
+	}
+	configPath := fs.String("config", "./configs/warpgate.yaml", "path to config file")
+	adminURL := fs.String("admin", "", "base URL of a running instance's admin API, e.g. http://127.0.0.1:9090")
+	concurrency := fs.Int("concurrency", 8, "number of URLs fetched at once")
+	rate := fs.Float64("rate", 0, "maximum fetches started per second (0 for no limit)")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for each URL")
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+
+	data, err := readInput(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warm: %v\n", err)
+		return 1
+	}
+	urls, err := warm.ParseList(bytes.NewReader(data))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warm: %v\n", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	opts := warm.Options{Concurrency: *concurrency, Rate: *rate, Timeout: *timeout}
+	var report warm.Report
+	if *adminURL != "" {
+		report, err = warmRemote(ctx, *adminURL, urls, opts)
+	} else {
+		report, err = warmLocal(ctx, *configPath, urls, opts)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warm: %v\n", err)
+		return 1
+	}
+
+	printReport(os.Stdout, report)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+func readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return io.ReadAll(os.Stdin)
+	}
+	return os.ReadFile(path)
+}
+
+func warmLocal(ctx context.Context, configPath string, urls []string, opts warm.Options) (warm.Report, error) {
+	cfg, err := config.Load(configPath)
+	if err != nil {
+		return warm.Report{}, fmt.Errorf("load config: %w", err)
+	}
+	engine, err := proxy.NewBuilder(cfg, nil).BuildEngine(ctx)
+	if err != nil {
+		return warm.Report{}, fmt.Errorf("build proxy: %w", err)
+	}
+	engine.CacheStatus = cfg.Cache.StatusName
+	return engine.Warm(ctx, urls, opts), nil
+}
+
+func warmRemote(ctx context.Context, adminURL string, urls []string, opts warm.Options) (warm.Report, error) {
+	body, err := json.Marshal(struct {
+		URLs        []string `json:"urls"`
+		Concurrency int      `json:"concurrency"`
+		Rate        float64  `json:"rate"`
+		Timeout     string   `json:"timeout"`
+	}{urls, opts.Concurrency, opts.Rate, opts.Timeout.String()})
+	if err != nil {
+		return warm.Report{}, err
+	}
+
+	endpoint, err := url.JoinPath(adminURL, "/cache/warm")
+	if err != nil {
+		return warm.Report{}, fmt.Errorf("invalid admin URL: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return warm.Report{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return warm.Report{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return warm.Report{}, fmt.Errorf("admin API: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var report warm.Report
+	if err := json.NewDecoder(resp.Body).Decode(&report); err != nil {
+		return warm.Report{}, fmt.Errorf("decode report: %w", err)
+	}
+	return report, nil
+}
+
+func printReport(w io.Writer, report warm.Report) {
+	for _, r := range report.Results {
+		outcome := "ok  "
+		if !r.OK() {
+			outcome = "FAIL"
+		}
+		status := "-"
+		if r.Status > 0 {
+			status = strconv.Itoa(r.Status)
+		}
+		line := fmt.Sprintf("%s %s %8dB %6dms %s", outcome, status, r.Bytes, r.DurationMs, r.URL)
+		if r.CacheStatus != "" {
+			line += " [" + r.CacheStatus + "]"
+		}
+		if r.Error != "" {
+			line += ": " + r.Error
+		}
+		fmt.Fprintln(w, line)
+	}
+	fmt.Fprintf(w, "warmed %d of %d URLs, %d failed\n", report.Succeeded, report.Total, report.Failed)
+}
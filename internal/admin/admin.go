@@ -0,0 +1,186 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"warpgate/internal/cache"
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+	"warpgate/internal/warm"
+)
+
+// Purger evicts cached responses.
+type Purger interface {
+	PurgeURL(ctx context.Context, rawURL string) int
+	PurgePattern(ctx context.Context, pattern string) int
+	PurgeTag(ctx context.Context, tag string) int
+}
+
+// Warmer pre-fetches URLs into the cache.
+type Warmer interface {
+	Warm(ctx context.Context, urls []string, opts warm.Options) warm.Report
+}
+
+// Server serves the administrative API. It is meant to be bound to a
+// private address, separate from the proxy listeners.
+type Server struct {
+	purger Purger
+	warmer Warmer
+	logger logging.Logger
+	mux    *http.ServeMux
+}
+
+func New(p Purger, w Warmer, logger logging.Logger) *Server {
+	s := &Server{
+		purger: p,
+		warmer: w,
+		logger: logger,
+		mux:    http.NewServeMux(),
+	}
+	s.mux.Handle("/metrics", metrics.Handler())
+	s.mux.HandleFunc("/cache/purge", s.handlePurge)
+	s.mux.HandleFunc("/cache/warm", s.handleWarm)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// PurgeRequest selects cached responses to evict. URLs are matched exactly
+// (with all their variants), prefixes and patterns match URLs starting with
+// or matching the given string ('*' is a wildcard, which '\' escapes), and
+// tags match the surrogate keys responses were tagged with upstream.
+type PurgeRequest struct {
+	URLs     []string `json:"urls,omitempty"`
+	Prefixes []string `json:"prefixes,omitempty"`
+	Patterns []string `json:"patterns,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+}
+
+type PurgeResponse struct {
+	Purged int `json:"purged"`
+}
+
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req PurgeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<20)).Decode(&req); err != nil {
+		http.Error(w, "invalid purge request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.URLs)+len(req.Prefixes)+len(req.Patterns)+len(req.Tags) == 0 {
+		http.Error(w, "purge request selects nothing", http.StatusBadRequest)
+		return
+	}
+
+	ctx := r.Context()
+	n := 0
+	for _, u := range req.URLs {
+		n += s.purger.PurgeURL(ctx, u)
+	}
+	for _, p := range req.Prefixes {
+		n += s.purger.PurgePattern(ctx, cache.EscapePattern(p)+"*")
+	}
+	for _, p := range req.Patterns {
+		n += s.purger.PurgePattern(ctx, p)
+	}
+	for _, t := range req.Tags {
+		n += s.purger.PurgeTag(ctx, t)
+	}
+
+	if s.logger != nil {
+		s.logger.Info("cache purge",
+			"urls", req.URLs,
+			"prefixes", req.Prefixes,
+			"patterns", req.Patterns,
+			"tags", req.Tags,
+			"purged", n,
+		)
+	}
+
+	writeJSON(w, http.StatusOK, PurgeResponse{Purged: n})
+}
+
+// WarmRequest lists URLs to pre-fetch. Zero options use the defaults of
+// warm.Options.
+type WarmRequest struct {
+	URLs        []string `json:"urls"`
+	Concurrency int      `json:"concurrency,omitempty"`
+	Rate        float64  `json:"rate,omitempty"`
+	Timeout     string   `json:"timeout,omitempty"`
+}
+
+// handleWarm fetches the requested URLs and answers with a report once they
+// have all been fetched. The body is either a JSON WarmRequest or, with any
+// other content type, a URL list or sitemap, with options in the query
+// string.
+func (s *Server) handleWarm(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	body := http.MaxBytesReader(w, r.Body, 10<<20)
+	var req WarmRequest
+	if ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); ct == "application/json" {
+		if err := json.NewDecoder(body).Decode(&req); err != nil {
+			http.Error(w, "invalid warm request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		urls, err := warm.ParseList(body)
+		if err != nil {
+			http.Error(w, "invalid warm request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		q := r.URL.Query()
+		req.URLs = urls
+		req.Concurrency, _ = strconv.Atoi(q.Get("concurrency"))
+		req.Rate, _ = strconv.ParseFloat(q.Get("rate"), 64)
+		req.Timeout = q.Get("timeout")
+	}
+	if len(req.URLs) == 0 {
+		http.Error(w, "warm request lists no URLs", http.StatusBadRequest)
+		return
+	}
+
+	opts := warm.Options{Concurrency: req.Concurrency, Rate: req.Rate}
+	if req.Timeout != "" {
+		d, err := time.ParseDuration(req.Timeout)
+		if err != nil {
+			http.Error(w, "invalid warm request: bad timeout: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		opts.Timeout = d
+	}
+
+	report := s.warmer.Warm(r.Context(), req.URLs, opts)
+
+	if s.logger != nil {
+		s.logger.Info("cache warm",
+			"total", report.Total,
+			"succeeded", report.Succeeded,
+			"failed", report.Failed,
+		)
+	}
+
+	writeJSON(w, http.StatusOK, report)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
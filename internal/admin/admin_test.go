@@ -0,0 +1,157 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"warpgate/internal/warm"
+)
+
+type fakePurger struct {
+	calls []string
+}
+
+func (f *fakePurger) PurgeURL(_ context.Context, u string) int {
+	f.calls = append(f.calls, "url:"+u)
+	return 1
+}
+
+func (f *fakePurger) PurgePattern(_ context.Context, p string) int {
+	f.calls = append(f.calls, "pattern:"+p)
+	return 2
+}
+
+func (f *fakePurger) PurgeTag(_ context.Context, t string) int {
+	f.calls = append(f.calls, "tag:"+t)
+	return 3
+}
+
+func TestPurge(t *testing.T) {
+	p := &fakePurger{}
+	s := New(p, nil, nil)
+
+	body := `{"urls":["http://a/x"],"prefixes":["http://a/static/"],"patterns":["http://a/*.css"],"tags":["product-1"]}`
+	req := httptest.NewRequest(http.MethodPost, "/cache/purge", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+	}
+
+	var resp PurgeResponse
+	if err := json.NewDecoder(rr.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode response: %v", err)
+	}
+	if resp.Purged != 8 {
+		t.Errorf("expected purged=8, got %d", resp.Purged)
+	}
+
+	want := []string{"url:http://a/x", "pattern:http://a/static/*", "pattern:http://a/*.css", "tag:product-1"}
+	if strings.Join(p.calls, " ") != strings.Join(want, " ") {
+		t.Errorf("unexpected purge calls %v, want %v", p.calls, want)
+	}
+}
+
+func TestPurge_RejectsBadRequests(t *testing.T) {
+	s := New(&fakePurger{}, nil, nil)
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		want   int
+	}{
+		{"WrongMethod", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"InvalidJSON", http.MethodPost, "{", http.StatusBadRequest},
+		{"Empty", http.MethodPost, "{}", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, httptest.NewRequest(tt.method, "/cache/purge", strings.NewReader(tt.body)))
+			if rr.Code != tt.want {
+				t.Errorf("expected %d, got %d", tt.want, rr.Code)
+			}
+		})
+	}
+}
+
+type fakeWarmer struct {
+	urls []string
+	opts warm.Options
+}
+
+func (f *fakeWarmer) Warm(_ context.Context, urls []string, opts warm.Options) warm.Report {
+	f.urls, f.opts = urls, opts
+	report := warm.Report{Total: len(urls), Succeeded: len(urls)}
+	for _, u := range urls {
+		report.Results = append(report.Results, warm.Result{URL: u, Status: http.StatusOK})
+	}
+	return report
+}
+
+func TestWarm(t *testing.T) {
+	tests := []struct {
+		name        string
+		target      string
+		contentType string
+		body        string
+	}{
+		{"JSON", "/cache/warm", "application/json", `{"urls":["http://a/x","http://a/y"],"concurrency":4,"rate":2.5,"timeout":"5s"}`},
+		{"List", "/cache/warm?concurrency=4&rate=2.5&timeout=5s", "text/plain", "http://a/x\nhttp://a/y\n"},
+		{"Sitemap", "/cache/warm?concurrency=4&rate=2.5&timeout=5s", "application/xml",
+			`<urlset><url><loc>http://a/x</loc></url><url><loc>http://a/y</loc></url></urlset>`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wm := &fakeWarmer{}
+			s := New(&fakePurger{}, wm, nil)
+
+			req := httptest.NewRequest(http.MethodPost, tt.target, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			rr := httptest.NewRecorder()
+			s.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", rr.Code, rr.Body.String())
+			}
+			var report warm.Report
+			if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+				t.Fatalf("decode report: %v", err)
+			}
+			if report.Total != 2 || len(report.Results) != 2 {
+				t.Errorf("unexpected report %+v", report)
+			}
+			if strings.Join(wm.urls, " ") != "http://a/x http://a/y" {
+				t.Errorf("unexpected urls %v", wm.urls)
+			}
+			want := warm.Options{Concurrency: 4, Rate: 2.5, Timeout: 5 * time.Second}
+			if wm.opts != want {
+				t.Errorf("options = %+v, want %+v", wm.opts, want)
+			}
+		})
+	}
+}
+
+func TestWarm_RejectsBadRequests(t *testing.T) {
+	s := New(&fakePurger{}, &fakeWarmer{}, nil)
+
+	rr := httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/cache/warm", nil))
+	if rr.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET: expected 405, got %d", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.ServeHTTP(rr, httptest.NewRequest(http.MethodPost, "/cache/warm", strings.NewReader("# nothing\n")))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("empty list: expected 400, got %d", rr.Code)
+	}
+}
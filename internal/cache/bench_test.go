@@ -0,0 +1,128 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+)
+
+const benchKeys = 10_000
+
+type benchCache struct {
+	name string
+	new  func(b *testing.B) Cache
+}
+
+func benchCaches() []benchCache {
+	opts := func(p Policy) Options {
+		return Options{MaxEntries: benchKeys, Policy: p}
+	}
+	unsharded := func(p Policy) func(b *testing.B) Cache {
+		return func(b *testing.B) Cache {
+			c, err := NewInMemoryCacheWithOptions(opts(p))
+			if err != nil {
+				b.Fatal(err)
+			}
+			return c
+		}
+	}
+	sharded := func(p Policy) func(b *testing.B) Cache {
+		return func(b *testing.B) Cache {
+			c, err := NewShardedCache(16, opts(p))
+			if err != nil {
+				b.Fatal(err)
+			}
+			return c
+		}
+	}
+	return []benchCache{
+		{"lru", unsharded(PolicyLRU)},
+		{"clock", unsharded(PolicyClock)},
+		{"sharded-lru", sharded(PolicyLRU)},
+		{"sharded-clock", sharded(PolicyClock)},
+		{"sharded-s3fifo", sharded(PolicyS3FIFO)},
+	}
+}
+
+func benchKeyNames() []string {
+	keys := make([]string, benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("GET http://example.com/objects/%d", i)
+	}
+	return keys
+}
+
+func fill(c Cache, keys []string) {
+	ctx := context.Background()
+	resp := makeResponse(200, "payload", 0)
+	for _, k := range keys {
+		c.Set(ctx, k, resp)
+	}
+}
+
+// BenchmarkGetParallel measures cache hit throughput across goroutines.
+func BenchmarkGetParallel(b *testing.B) {
+	keys := benchKeyNames()
+	for _, bc := range benchCaches() {
+		b.Run(bc.name, func(b *testing.B) {
+			c := bc.new(b)
+			fill(c, keys)
+			ctx := context.Background()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					c.Get(ctx, keys[r.IntN(len(keys))])
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkMixedParallel measures a read-heavy workload with 10% writes over
+// a key space twice the cache size, so writes also evict.
+func BenchmarkMixedParallel(b *testing.B) {
+	keys := make([]string, 2*benchKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("GET http://example.com/objects/%d", i)
+	}
+	resp := makeResponse(200, "payload", 0)
+	for _, bc := range benchCaches() {
+		b.Run(bc.name, func(b *testing.B) {
+			c := bc.new(b)
+			fill(c, keys[:benchKeys])
+			ctx := context.Background()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					k := keys[r.IntN(len(keys))]
+					if r.IntN(10) == 0 {
+						c.Set(ctx, k, resp)
+					} else {
+						c.Get(ctx, k)
+					}
+				}
+			})
+		})
+	}
+}
+
+// BenchmarkSetParallel measures insert throughput with constant eviction.
+func BenchmarkSetParallel(b *testing.B) {
+	resp := makeResponse(200, "payload", 0)
+	for _, bc := range benchCaches() {
+		b.Run(bc.name, func(b *testing.B) {
+			c := bc.new(b)
+			ctx := context.Background()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), rand.Uint64()))
+				for pb.Next() {
+					c.Set(ctx, fmt.Sprintf("GET http://example.com/objects/%d", r.IntN(4*benchKeys)), resp)
+				}
+			})
+		})
+	}
+}
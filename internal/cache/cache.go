@@ -1,7 +1,9 @@
 package cache
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"net/http"
 	"time"
 )
@@ -11,10 +13,113 @@ type CachedResponse struct {
 	Header     http.Header
 	Body       []byte
 	ExpiresAt  time.Time
+
+	// ETag and LastModified are the validators used to revalidate the entry
+	// upstream once it is no longer fresh.
+	ETag         string
+	LastModified string
+
+	// StoredAt is when the response was received and InitialAge the age it
+	// already had then, together giving the Age reported on cache hits.
+	StoredAt   time.Time
+	InitialAge time.Duration
+
+	// MustRevalidate forbids serving the response once stale, even to
+	// clients that accept stale responses.
+	MustRevalidate bool
+
+	// Vary, when set, marks the entry as the index of a response that
+	// varies on these request headers. Each variant is stored under its own
+	// secondary key and this entry carries no response of its own.
+	Vary []string
+
+	// Tags are the surrogate keys the response was tagged with upstream,
+	// used to purge related entries together.
+	Tags []string
+
+	// KeepUntil, when later than ExpiresAt, keeps a stale entry in the cache
+	// so that it can be revalidated rather than fetched again in full.
+	KeepUntil time.Time
+
+	// Responses read from a DiskCache do not hold their body in Body; it is
+	// streamed from the object file named by digest through open instead.
+	open     func() (io.ReadSeekCloser, error)
+	bodySize int64
+	digest   string
+}
+
+// Open returns a reader for the response body.
+func (r *CachedResponse) Open() (io.ReadSeekCloser, error) {
+	if r.open != nil {
+		return r.open()
+	}
+	return bytesReader{bytes.NewReader(r.Body)}, nil
+}
+
+type bytesReader struct {
+	*bytes.Reader
+}
+
+func (bytesReader) Close() error { return nil }
+
+// Size returns the length of the response body.
+func (r *CachedResponse) Size() int64 {
+	if r.open != nil {
+		return r.bodySize
+	}
+	return int64(len(r.Body))
+}
+
+// ShareBody makes r use the body of src, whether it is held in memory or
+// streamed from disk, without reading it.
+func (r *CachedResponse) ShareBody(src *CachedResponse) {
+	r.Body = src.Body
+	r.open = src.open
+	r.bodySize = src.bodySize
+	r.digest = src.digest
+}
+
+// Fresh reports whether the response can be served without revalidation.
+func (r *CachedResponse) Fresh(now time.Time) bool {
+	return r.ExpiresAt.IsZero() || now.Before(r.ExpiresAt)
+}
+
+// Age returns the current age of the response.
+func (r *CachedResponse) Age(now time.Time) time.Duration {
+	if r.StoredAt.IsZero() {
+		return r.InitialAge
+	}
+	return r.InitialAge + now.Sub(r.StoredAt)
+}
+
+// HasValidators reports whether the response can be revalidated with a
+// conditional request.
+func (r *CachedResponse) HasValidators() bool {
+	return r.ETag != "" || r.LastModified != ""
+}
+
+// expired reports whether a cache should drop the response entirely.
+func (r *CachedResponse) expired(now time.Time) bool {
+	if r.ExpiresAt.IsZero() {
+		return false
+	}
+	until := r.ExpiresAt
+	if r.KeepUntil.After(until) {
+		until = r.KeepUntil
+	}
+	return now.After(until)
 }
 
 type Cache interface {
 	Get(ctx context.Context, key string) (*CachedResponse, bool)
 	Set(ctx context.Context, key string, resp *CachedResponse)
 	Delete(ctx context.Context, key string)
+
+	// DeleteMatching removes every entry whose key matches pattern (see
+	// MatchPattern) and returns how many were removed.
+	DeleteMatching(ctx context.Context, pattern string) int
+
+	// DeleteTagged removes every entry carrying tag and returns how many
+	// were removed.
+	DeleteTagged(ctx context.Context, tag string) int
 }
@@ -0,0 +1,719 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"warpgate/internal/metrics"
+)
+
+// DiskOptions configures a DiskCache.
+type DiskOptions struct {
+	// Name labels the cache in metrics.
+	Name string
+	// Dir is the directory the cache owns. It is created if missing.
+	Dir string
+	// MaxEntries bounds the number of entries. Zero means no entry limit.
+	MaxEntries int
+	// MaxBytes bounds the accounted size of the cached entries, bodies
+	// included. Zero means no byte budget.
+	MaxBytes int64
+	// Policy selects which entry is evicted when a budget is exceeded.
+	Policy Policy
+}
+
+// DiskCache stores responses on local disk so that they survive restarts and
+// can exceed available memory.
+//
+// Bodies are stored as content-addressed object files named by their SHA-256
+// digest, so identical bodies cached under different keys share one file.
+// Each entry's metadata is kept in a small record file named by the hash of
+// its key; the in-memory index is rebuilt from the records on startup.
+// Bodies are never loaded into CachedResponse.Body: responses returned by Get
+// stream them from the object file through Open.
+//
+// c.mu guards the index only. Files are written outside any lock, and their
+// renames and removals are ordered with the index changes they belong to by
+// the lock of the file, so that a slow disk never holds up a cache hit.
+type DiskCache struct {
+	mu         sync.Mutex
+	files      [256]sync.Mutex
+	dead       []*entry
+	name       string
+	dir        string
+	items      map[string]*entry
+	tags       map[string]map[string]struct{}
+	refs       map[string]int
+	policy     evictionPolicy
+	bytes      int64
+	maxEntries int
+	maxBytes   int64
+}
+
+// diskRecord is the on-disk form of an entry's metadata.
+type diskRecord struct {
+	Key            string        `json:"key"`
+	Digest         string        `json:"digest,omitempty"`
+	Size           int64         `json:"size"`
+	StatusCode     int           `json:"status"`
+	Header         http.Header   `json:"header,omitempty"`
+	ExpiresAt      time.Time     `json:"expiresAt"`
+	ETag           string        `json:"etag,omitempty"`
+	LastModified   string        `json:"lastModified,omitempty"`
+	StoredAt       time.Time     `json:"storedAt"`
+	InitialAge     time.Duration `json:"initialAge,omitempty"`
+	MustRevalidate bool          `json:"mustRevalidate,omitempty"`
+	Vary           []string      `json:"vary,omitempty"`
+	Tags           []string      `json:"tags,omitempty"`
+	KeepUntil      time.Time     `json:"keepUntil"`
+}
+
+// NewDiskCache opens the cache in opts.Dir, recovering the entries stored by
+// a previous run. Expired and damaged entries and unreferenced object files
+// are removed.
+func NewDiskCache(opts DiskOptions) (*DiskCache, error) {
+	if opts.Dir == "" {
+		return nil, errors.New("disk cache directory is required")
+	}
+	if opts.Name == "" {
+		opts.Name = "disk"
+	}
+	policy, err := newPolicy(opts.Policy, max(opts.MaxEntries, 1<<16))
+	if err != nil {
+		return nil, err
+	}
+	c := &DiskCache{
+		name:       opts.Name,
+		dir:        opts.Dir,
+		items:      make(map[string]*entry),
+		tags:       make(map[string]map[string]struct{}),
+		refs:       make(map[string]int),
+		policy:     policy,
+		maxEntries: opts.MaxEntries,
+		maxBytes:   opts.MaxBytes,
+	}
+	for _, sub := range []string{"objects", "meta", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(c.dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+	c.mu.Lock()
+	err = c.recover()
+	c.unlock()
+	if err != nil {
+		return nil, fmt.Errorf("recover disk cache index: %w", err)
+	}
+	return c, nil
+}
+
+func (c *DiskCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	if e.resp.expired(time.Now()) {
+		c.drop(e, evictExpired)
+		return nil, false
+	}
+	c.policy.accessed(e)
+	return e.resp, true
+}
+
+// Set writes the response body to its object file, unless a file with the
+// same content is already stored, and then records the entry. If the body
+// or record cannot be written the response is not cached.
+func (c *DiskCache) Set(ctx context.Context, key string, resp *CachedResponse) {
+	digest, size, err := c.writeObject(resp)
+	if err != nil {
+		return
+	}
+	_ = c.record(key, resp, digest, size)
+}
+
+// SetStream begins storing resp under key, writing its body straight to a
+// temporary object file that is moved into place on Commit.
+func (c *DiskCache) SetStream(ctx context.Context, key string, resp *CachedResponse, limit int64) Writer {
+	ow, err := c.newObjectWriter(limit)
+	if err != nil {
+		return failedWriter{err}
+	}
+	return &diskWriter{
+		objectWriter: ow,
+		key:          key,
+		resp:         resp,
+	}
+}
+
+type diskWriter struct {
+	*objectWriter
+	key  string
+	resp *CachedResponse
+}
+
+func (w *diskWriter) Commit() error {
+	digest, size, err := w.finish()
+	if err != nil {
+		return err
+	}
+	return w.c.record(w.key, w.resp, digest, size)
+}
+
+// record adds an entry for resp, whose body is held by the referenced object
+// file, dropping the reference if the entry cannot be stored.
+func (c *DiskCache) record(key string, resp *CachedResponse, digest string, size int64) error {
+	rec := &diskRecord{
+		Key:            key,
+		Digest:         digest,
+		Size:           size,
+		StatusCode:     resp.StatusCode,
+		Header:         resp.Header,
+		ExpiresAt:      resp.ExpiresAt,
+		ETag:           resp.ETag,
+		LastModified:   resp.LastModified,
+		StoredAt:       resp.StoredAt,
+		InitialAge:     resp.InitialAge,
+		MustRevalidate: resp.MustRevalidate,
+		Vary:           resp.Vary,
+		Tags:           resp.Tags,
+		KeepUntil:      resp.KeepUntil,
+	}
+	stored := c.newResponse(rec)
+	esize := entrySize(key, stored)
+	if c.maxBytes > 0 && esize > c.maxBytes {
+		c.release(digest)
+		return ErrTooLarge
+	}
+
+	tmp, err := c.writeRecord(rec)
+	if err != nil {
+		c.release(digest)
+		return err
+	}
+	l := c.fileLock(recordName(key))
+	l.Lock()
+	if err := os.Rename(tmp, c.recordPath(key)); err != nil {
+		l.Unlock()
+		_ = os.Remove(tmp)
+		c.release(digest)
+		return err
+	}
+	// The entry is indexed before the file lock is released, so that the
+	// removal of a dropped entry under the same key leaves the new file be.
+	c.mu.Lock()
+	l.Unlock()
+	defer c.unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.drop(e, "")
+	}
+	for c.maxEntries > 0 && len(c.items) >= c.maxEntries {
+		if !c.evict(evictEntries) {
+			break
+		}
+	}
+	for c.maxBytes > 0 && c.bytes+esize > c.maxBytes {
+		if !c.evict(evictBytes) {
+			break
+		}
+	}
+
+	c.insert(key, stored, esize)
+	return nil
+}
+
+func (c *DiskCache) Delete(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if e, ok := c.items[key]; ok {
+		c.drop(e, "")
+	}
+}
+
+func (c *DiskCache) DeleteMatching(ctx context.Context, pattern string) int {
+	c.mu.Lock()
+	defer c.unlock()
+
+	n := 0
+	for key, e := range c.items {
+		if MatchPattern(pattern, key) {
+			c.drop(e, evictPurged)
+			n++
+		}
+	}
+	return n
+}
+
+func (c *DiskCache) DeleteTagged(ctx context.Context, tag string) int {
+	c.mu.Lock()
+	defer c.unlock()
+
+	n := 0
+	for key := range c.tags[tag] {
+		if e, ok := c.items[key]; ok {
+			c.drop(e, evictPurged)
+			n++
+		}
+	}
+	return n
+}
+
+// Len returns the number of cached entries.
+func (c *DiskCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// Bytes returns the accounted size of the cached entries.
+func (c *DiskCache) Bytes() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.bytes
+}
+
+// writeObject stores the body of resp and takes a reference to its object
+// file, returning the digest and size of the body. Bodies already held by
+// this cache are referenced again without being copied.
+func (c *DiskCache) writeObject(resp *CachedResponse) (string, int64, error) {
+	if resp.digest != "" {
+		c.mu.Lock()
+		if c.refs[resp.digest] > 0 {
+			c.refs[resp.digest]++
+			c.mu.Unlock()
+			return resp.digest, resp.bodySize, nil
+		}
+		c.mu.Unlock()
+	}
+	if resp.Size() == 0 {
+		return "", 0, nil
+	}
+
+	body, err := resp.Open()
+	if err != nil {
+		return "", 0, err
+	}
+	defer body.Close()
+
+	w, err := c.newObjectWriter(0)
+	if err != nil {
+		return "", 0, err
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		w.Abort()
+		return "", 0, err
+	}
+	return w.finish()
+}
+
+// objectWriter writes a body to a temporary file, hashing it on the way.
+type objectWriter struct {
+	c     *DiskCache
+	tmp   *os.File
+	hash  hash.Hash
+	size  int64
+	limit int64
+	err   error
+}
+
+func (c *DiskCache) newObjectWriter(limit int64) (*objectWriter, error) {
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "object-*")
+	if err != nil {
+		return nil, err
+	}
+	return &objectWriter{
+		c:     c,
+		tmp:   tmp,
+		hash:  sha256.New(),
+		limit: limit,
+	}, nil
+}
+
+func (w *objectWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.limit > 0 && w.size+int64(len(p)) > w.limit {
+		w.Abort()
+		w.err = ErrTooLarge
+		return 0, w.err
+	}
+	n, err := w.tmp.Write(p)
+	w.hash.Write(p[:n])
+	w.size += int64(n)
+	if err != nil {
+		w.Abort()
+		w.err = err
+	}
+	return n, err
+}
+
+// Abort removes the temporary file.
+func (w *objectWriter) Abort() {
+	if w.err == nil {
+		w.err = errAborted
+	}
+	if w.tmp != nil {
+		_ = w.tmp.Close()
+		_ = os.Remove(w.tmp.Name())
+		w.tmp = nil
+	}
+}
+
+// finish moves the written body into place as a content-addressed object,
+// or reuses an identical object already stored, and takes a reference to
+// it. Empty bodies need no object and have no digest.
+func (w *objectWriter) finish() (string, int64, error) {
+	if w.err != nil {
+		return "", 0, w.err
+	}
+	defer w.Abort()
+
+	if err := w.tmp.Close(); err != nil {
+		return "", 0, err
+	}
+	if w.size == 0 {
+		return "", 0, nil
+	}
+	digest := hex.EncodeToString(w.hash.Sum(nil))
+
+	c := w.c
+	l := c.fileLock(digest)
+	l.Lock()
+	defer l.Unlock()
+
+	c.mu.Lock()
+	stored := c.refs[digest] > 0
+	if stored {
+		c.refs[digest]++
+	}
+	c.mu.Unlock()
+	if stored {
+		return digest, w.size, nil
+	}
+
+	path := c.objectPath(digest)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return "", 0, err
+	}
+	if err := os.Rename(w.tmp.Name(), path); err != nil {
+		return "", 0, err
+	}
+	c.mu.Lock()
+	c.refs[digest]++
+	c.mu.Unlock()
+	return digest, w.size, nil
+}
+
+// release drops a reference to an object file, removing the file with the
+// last reference. The caller does not hold c.mu.
+func (c *DiskCache) release(digest string) {
+	if digest == "" {
+		return
+	}
+	l := c.fileLock(digest)
+	l.Lock()
+	defer l.Unlock()
+
+	c.mu.Lock()
+	c.refs[digest]--
+	last := c.refs[digest] <= 0
+	if last {
+		delete(c.refs, digest)
+	}
+	c.mu.Unlock()
+	if last {
+		_ = os.Remove(c.objectPath(digest))
+	}
+}
+
+// removeRecord removes the record file of key, unless key has been stored
+// again since its entry was dropped. The caller does not hold c.mu.
+func (c *DiskCache) removeRecord(key string) {
+	l := c.fileLock(recordName(key))
+	l.Lock()
+	defer l.Unlock()
+
+	c.mu.Lock()
+	_, live := c.items[key]
+	c.mu.Unlock()
+	if !live {
+		_ = os.Remove(c.recordPath(key))
+	}
+}
+
+// unlock releases c.mu, then removes the files of the entries dropped while
+// it was held.
+func (c *DiskCache) unlock() {
+	dead := c.dead
+	c.dead = nil
+	c.mu.Unlock()
+	for _, e := range dead {
+		c.removeRecord(e.key)
+		c.release(e.resp.digest)
+	}
+}
+
+// fileLock returns the lock ordering the renames and removals of the file
+// named name, which is a hex digest.
+func (c *DiskCache) fileLock(name string) *sync.Mutex {
+	b, _ := hex.DecodeString(name[:2])
+	return &c.files[b[0]]
+}
+
+// writeRecord writes rec to a temporary file and returns its name, ready to
+// be moved into place.
+func (c *DiskCache) writeRecord(rec *diskRecord) (string, error) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(c.recordPath(rec.Key)), 0o755); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Join(c.dir, "tmp"), "meta-*")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// newResponse builds the metadata-only response kept in the index for rec.
+func (c *DiskCache) newResponse(rec *diskRecord) *CachedResponse {
+	resp := &CachedResponse{
+		StatusCode:     rec.StatusCode,
+		Header:         rec.Header,
+		ExpiresAt:      rec.ExpiresAt,
+		ETag:           rec.ETag,
+		LastModified:   rec.LastModified,
+		StoredAt:       rec.StoredAt,
+		InitialAge:     rec.InitialAge,
+		MustRevalidate: rec.MustRevalidate,
+		Vary:           rec.Vary,
+		Tags:           rec.Tags,
+		KeepUntil:      rec.KeepUntil,
+		bodySize:       rec.Size,
+		digest:         rec.Digest,
+	}
+	if rec.Digest == "" {
+		resp.open = func() (io.ReadSeekCloser, error) {
+			return bytesReader{bytes.NewReader(nil)}, nil
+		}
+		return resp
+	}
+	path := c.objectPath(rec.Digest)
+	resp.open = func() (io.ReadSeekCloser, error) {
+		return os.Open(path)
+	}
+	return resp
+}
+
+// insert adds an entry for resp to the index. The caller holds c.mu.
+func (c *DiskCache) insert(key string, resp *CachedResponse, size int64) {
+	e := &entry{
+		key:  key,
+		resp: resp,
+		size: size,
+	}
+	c.items[e.key] = e
+	c.bytes += size
+	c.tag(e)
+	c.policy.added(e)
+	metrics.AddCacheSize(c.name, 1, size)
+}
+
+func (c *DiskCache) evict(reason string) bool {
+	v := c.policy.victim()
+	if v == nil {
+		return false
+	}
+	c.drop(v, reason)
+	return true
+}
+
+// drop removes e from the cache and its indexes, counting it as an eviction
+// when reason is set. Its files are removed once c.mu is released by unlock.
+func (c *DiskCache) drop(e *entry, reason string) {
+	c.policy.removed(e)
+	c.untag(e)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+	c.dead = append(c.dead, e)
+	metrics.AddCacheSize(c.name, -1, -e.size)
+	if reason != "" {
+		metrics.IncCacheEviction(c.name, reason)
+	}
+}
+
+func (c *DiskCache) tag(e *entry) {
+	for _, t := range e.resp.Tags {
+		keys, ok := c.tags[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.tags[t] = keys
+		}
+		keys[e.key] = struct{}{}
+	}
+}
+
+func (c *DiskCache) untag(e *entry) {
+	for _, t := range e.resp.Tags {
+		keys := c.tags[t]
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.tags, t)
+		}
+	}
+}
+
+// recover rebuilds the index from the record files. Entries are re-added
+// oldest first so that eviction order roughly survives the restart.
+func (c *DiskCache) recover() error {
+	tmpDir := filepath.Join(c.dir, "tmp")
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tmpDir, 0o755); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var records []*diskRecord
+	err := filepath.WalkDir(filepath.Join(c.dir, "meta"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rec, ok := c.readRecord(path, now)
+		if !ok {
+			_ = os.Remove(path)
+			return nil
+		}
+		records = append(records, rec)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StoredAt.Before(records[j].StoredAt)
+	})
+	for _, rec := range records {
+		resp := c.newResponse(rec)
+		if rec.Digest != "" {
+			c.refs[rec.Digest]++
+		}
+		c.insert(rec.Key, resp, entrySize(rec.Key, resp))
+	}
+
+	err = filepath.WalkDir(filepath.Join(c.dir, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		if c.refs[d.Name()] == 0 {
+			_ = os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for c.maxEntries > 0 && len(c.items) > c.maxEntries {
+		if !c.evict(evictEntries) {
+			break
+		}
+	}
+	for c.maxBytes > 0 && c.bytes > c.maxBytes {
+		if !c.evict(evictBytes) {
+			break
+		}
+	}
+	return nil
+}
+
+// readRecord loads the record at path, rejecting it if it is unreadable,
+// stored under the wrong name, expired, names an object by anything but a
+// digest, or its object file is missing or truncated.
+func (c *DiskCache) readRecord(path string, now time.Time) (*diskRecord, bool) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	var rec diskRecord
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return nil, false
+	}
+	if c.recordPath(rec.Key) != path {
+		return nil, false
+	}
+	resp := CachedResponse{ExpiresAt: rec.ExpiresAt, KeepUntil: rec.KeepUntil}
+	if resp.expired(now) {
+		return nil, false
+	}
+	if rec.Digest != "" {
+		if !validDigest(rec.Digest) {
+			return nil, false
+		}
+		fi, err := os.Stat(c.objectPath(rec.Digest))
+		if err != nil || fi.Size() != rec.Size {
+			return nil, false
+		}
+	}
+	return &rec, true
+}
+
+// validDigest reports whether d is a SHA-256 digest in lowercase hex, so
+// that a damaged record cannot name a path outside the objects directory.
+func validDigest(d string) bool {
+	if len(d) != 2*sha256.Size {
+		return false
+	}
+	for i := 0; i < len(d); i++ {
+		if !('0' <= d[i] && d[i] <= '9' || 'a' <= d[i] && d[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *DiskCache) objectPath(digest string) string {
+	return filepath.Join(c.dir, "objects", digest[:2], digest)
+}
+
+func (c *DiskCache) recordPath(key string) string {
+	name := recordName(key)
+	return filepath.Join(c.dir, "meta", name[:2], name)
+}
+
+// recordName returns the name of the record file of key.
+func recordName(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
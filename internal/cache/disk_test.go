@@ -0,0 +1,282 @@
+package cache
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestDiskCache(t *testing.T, opts DiskOptions) *DiskCache {
+	t.Helper()
+	c, err := NewDiskCache(opts)
+	if err != nil {
+		t.Fatalf("NewDiskCache: %v", err)
+	}
+	return c
+}
+
+func readBody(t *testing.T, resp *CachedResponse) string {
+	t.Helper()
+	r, err := resp.Open()
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer r.Close()
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("read body: %v", err)
+	}
+	return string(b)
+}
+
+func countFiles(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	err := filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatalf("walk %s: %v", dir, err)
+	}
+	return n
+}
+
+func TestDiskCache_StreamsBody(t *testing.T) {
+	c := newTestDiskCache(t, DiskOptions{Dir: t.TempDir()})
+	ctx := context.Background()
+
+	resp := makeResponse(200, "hello disk", time.Minute)
+	resp.Header.Set("Content-Type", "text/plain")
+	resp.ETag = `"v1"`
+	c.Set(ctx, "key1", resp)
+
+	got, ok := c.Get(ctx, "key1")
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if got.Body != nil {
+		t.Error("disk cache loaded the body into memory")
+	}
+	if got.Size() != int64(len("hello disk")) {
+		t.Errorf("Size() = %d, want %d", got.Size(), len("hello disk"))
+	}
+	if body := readBody(t, got); body != "hello disk" {
+		t.Errorf("body = %q, want %q", body, "hello disk")
+	}
+	if got.Header.Get("Content-Type") != "text/plain" || got.ETag != `"v1"` {
+		t.Errorf("metadata not preserved: %v %q", got.Header, got.ETag)
+	}
+}
+
+func TestDiskCache_ContentAddressed(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestDiskCache(t, DiskOptions{Dir: dir})
+	ctx := context.Background()
+
+	c.Set(ctx, "key1", makeResponse(200, "same body", time.Minute))
+	c.Set(ctx, "key2", makeResponse(200, "same body", time.Minute))
+	if _, err := os.Stat(c.recordPath("tampered")); !os.IsNotExist(err) {
+		t.Errorf("record naming a path rather than a digest kept: %v", err)
+	}
+	if n := countFiles(t, filepath.Join(dir, "objects")); n != 1 {
+		t.Fatalf("%d object files for identical bodies, want 1", n)
+	}
+
+	c.Delete(ctx, "key1")
+	got, ok := c.Get(ctx, "key2")
+	if !ok || readBody(t, got) != "same body" {
+		t.Fatal("shared object removed with the first entry")
+	}
+
+	c.Delete(ctx, "key2")
+	if n := countFiles(t, filepath.Join(dir, "objects")); n != 0 {
+		t.Errorf("%d object files left after deleting all entries", n)
+	}
+	if n := countFiles(t, filepath.Join(dir, "meta")); n != 0 {
+		t.Errorf("%d record files left after deleting all entries", n)
+	}
+}
+
+func TestDiskCache_RecoversIndex(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+
+	c := newTestDiskCache(t, DiskOptions{Dir: dir})
+	kept := makeResponse(200, "kept", time.Minute)
+	kept.Tags = []string{"product-1"}
+	c.Set(ctx, "kept", kept)
+	c.Set(ctx, "expired", makeResponse(200, "expired", time.Millisecond))
+	c.Set(ctx, "truncated", makeResponse(200, "truncated body", time.Minute))
+	c.Set(ctx, "index", &CachedResponse{Vary: []string{"Accept"}, ExpiresAt: time.Now().Add(time.Minute)})
+	c.Set(ctx, "tampered", makeResponse(200, "tampered", time.Minute))
+
+	got, _ := c.Get(ctx, "truncated")
+	if err := os.WriteFile(c.objectPath(got.digest), []byte("trunc"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tampered, err := os.ReadFile(c.recordPath("tampered"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ = c.Get(ctx, "tampered")
+	tampered = []byte(strings.Replace(string(tampered), got.digest, "../"+filepath.Base(dir)+"/objects/"+got.digest[:2]+"/"+got.digest, 1))
+	if err := os.WriteFile(c.recordPath("tampered"), tampered, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "objects", "orphan"), []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "meta", "garbage"), []byte("{"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	c = newTestDiskCache(t, DiskOptions{Dir: dir})
+	if c.Len() != 2 {
+		t.Fatalf("recovered %d entries, want 2", c.Len())
+	}
+	got, ok := c.Get(ctx, "kept")
+	if !ok || readBody(t, got) != "kept" {
+		t.Fatal("entry not recovered")
+	}
+	if got, ok := c.Get(ctx, "index"); !ok || len(got.Vary) != 1 {
+		t.Error("variant index entry not recovered")
+	}
+	for _, key := range []string{"expired", "truncated", "tampered"} {
+		if _, ok := c.Get(ctx, key); ok {
+			t.Errorf("%s entry recovered", key)
+		}
+	}
+	if _, err := os.Stat(c.recordPath("tampered")); !os.IsNotExist(err) {
+		t.Errorf("record naming a path rather than a digest kept: %v", err)
+	}
+	if n := countFiles(t, filepath.Join(dir, "objects")); n != 1 {
+		t.Errorf("%d object files after recovery, want 1", n)
+	}
+	if n := c.DeleteTagged(ctx, "product-1"); n != 1 {
+		t.Errorf("DeleteTagged after recovery removed %d entries, want 1", n)
+	}
+}
+
+func TestDiskCache_MaxBytes(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestDiskCache(t, DiskOptions{Dir: dir, MaxBytes: 3 * (entryOverhead + 1024)})
+	ctx := context.Background()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		c.Set(ctx, key, makeResponse(200, strings.Repeat(key, 1000), time.Minute))
+	}
+	if c.Bytes() > 3*(entryOverhead+1024) {
+		t.Fatalf("Bytes() = %d exceeds budget", c.Bytes())
+	}
+	if _, ok := c.Get(ctx, "a"); ok {
+		t.Error("expected the oldest entry to be evicted")
+	}
+	if n := countFiles(t, filepath.Join(dir, "objects")); n != c.Len() {
+		t.Errorf("%d object files for %d entries", n, c.Len())
+	}
+
+	c.Set(ctx, "huge", makeResponse(200, strings.Repeat("x", 4096), time.Minute))
+	if _, ok := c.Get(ctx, "huge"); ok {
+		t.Error("entry larger than the budget was stored")
+	}
+	if n := countFiles(t, filepath.Join(dir, "tmp")); n != 0 {
+		t.Errorf("%d temporary files left behind", n)
+	}
+}
+
+func TestTieredCache(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	disk := newTestDiskCache(t, DiskOptions{Dir: dir})
+	front := NewInMemoryCache(10)
+	c := NewTieredCache(front, disk, 16)
+
+	c.Set(ctx, "small", makeResponse(200, "small", time.Minute))
+	c.Set(ctx, "large", makeResponse(200, strings.Repeat("x", 64), time.Minute))
+
+	if _, ok := front.Get(ctx, "large"); ok {
+		t.Error("large body stored in the front tier")
+	}
+	if _, ok := disk.Get(ctx, "small"); !ok {
+		t.Error("small body not written through to the back tier")
+	}
+
+	// A restart empties the front tier; hits are promoted again.
+	disk = newTestDiskCache(t, DiskOptions{Dir: dir})
+	front = NewInMemoryCache(10)
+	c = NewTieredCache(front, disk, 16)
+
+	got, ok := c.Get(ctx, "small")
+	if !ok || string(got.Body) != "small" {
+		t.Fatalf("Get(small) = %v, %v", got, ok)
+	}
+	if _, ok := front.Get(ctx, "small"); !ok {
+		t.Error("back tier hit not promoted")
+	}
+	got, ok = c.Get(ctx, "large")
+	if !ok || readBody(t, got) != strings.Repeat("x", 64) {
+		t.Fatal("large body not served from the back tier")
+	}
+
+	if n := c.DeleteMatching(ctx, "*"); n != 2 {
+		t.Errorf("DeleteMatching removed %d entries, want 2", n)
+	}
+	if _, ok := c.Get(ctx, "small"); ok {
+		t.Error("entry survived purge")
+	}
+}
+
+func TestDiskCache_HitsDoNotWaitForFiles(t *testing.T) {
+	c := newTestDiskCache(t, DiskOptions{Dir: t.TempDir()})
+	ctx := context.Background()
+	c.Set(ctx, "a", makeResponse(200, "a", time.Minute))
+
+	// Stand in for a slow disk by holding every file lock while another
+	// entry is being stored.
+	for i := range c.files {
+		c.files[i].Lock()
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		c.Set(ctx, "b", makeResponse(200, "b", time.Minute))
+	}()
+
+	if got, ok := c.Get(ctx, "a"); !ok || readBody(t, got) != "a" {
+		t.Errorf("Get(a) = %v, %v while another entry was being stored", got, ok)
+	}
+	for i := range c.files {
+		c.files[i].Unlock()
+	}
+	<-done
+	if _, ok := c.Get(ctx, "b"); !ok {
+		t.Error("entry stored behind the file locks is missing")
+	}
+}
+
+func TestTieredCache_BackCommitFails(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDiskCache(t, DiskOptions{Dir: t.TempDir(), MaxBytes: entryOverhead})
+	front := NewInMemoryCache(10)
+	c := NewTieredCache(front, disk, 16)
+	front.Set(ctx, "k", makeResponse(200, "old", time.Minute))
+
+	w := c.SetStream(ctx, "k", makeResponse(200, "", time.Minute), 0)
+	if _, err := w.Write([]byte("new")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := w.Commit(); err == nil {
+		t.Fatal("Commit succeeded although the back tier rejected the entry")
+	}
+	if _, ok := front.Get(ctx, "k"); ok {
+		t.Error("front tier holds an entry the back tier does not")
+	}
+}
@@ -3,35 +3,98 @@ package cache
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"warpgate/internal/metrics"
+)
+
+// Eviction reasons reported in metrics.
+const (
+	evictEntries = "entries"
+	evictBytes   = "bytes"
+	evictExpired = "expired"
+	evictPurged  = "purged"
 )
 
+// entryOverhead approximates the fixed per-entry cost (entry, response and
+// index bookkeeping) counted against MaxBytes.
+const entryOverhead = 256
+
 type entry struct {
 	key  string
 	resp *CachedResponse
-	prev *entry
-	next *entry
+	size int64
+
+	// Policy bookkeeping. ref is updated atomically by policies that
+	// record hits under the read lock.
+	prev  *entry
+	next  *entry
+	freq  int
+	tick  uint64
+	index int
+	queue uint8
+	ref   atomic.Int32
+}
+
+// Options configures an InMemoryCache.
+type Options struct {
+	// Name labels the cache in metrics.
+	Name string
+	// MaxEntries bounds the number of entries.
+	MaxEntries int
+	// MaxBytes bounds the accounted size of keys, headers and bodies. Zero
+	// means no byte budget.
+	MaxBytes int64
+	// Policy selects which entry is evicted when a budget is exceeded.
+	Policy Policy
 }
 
 type InMemoryCache struct {
 	mu         sync.RWMutex
+	name       string
 	items      map[string]*entry
-	head       *entry
-	tail       *entry
+	tags       map[string]map[string]struct{}
+	policy     evictionPolicy
+	sharedHits bool
+	bytes      int64
 	maxEntries int
+	maxBytes   int64
 }
 
 func NewInMemoryCache(maxEntries int) *InMemoryCache {
-	if maxEntries <= 0 {
-		maxEntries = 1024
+	c, _ := NewInMemoryCacheWithOptions(Options{MaxEntries: maxEntries})
+	return c
+}
+
+func NewInMemoryCacheWithOptions(opts Options) (*InMemoryCache, error) {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 1024
 	}
-	return &InMemoryCache{
-		items:      make(map[string]*entry, maxEntries),
-		maxEntries: maxEntries,
+	if opts.Name == "" {
+		opts.Name = "memory"
+	}
+	policy, err := newPolicy(opts.Policy, opts.MaxEntries)
+	if err != nil {
+		return nil, err
 	}
+	_, sharedHits := policy.(concurrentPolicy)
+	return &InMemoryCache{
+		name:       opts.Name,
+		items:      make(map[string]*entry, opts.MaxEntries),
+		tags:       make(map[string]map[string]struct{}),
+		policy:     policy,
+		sharedHits: sharedHits,
+		maxEntries: opts.MaxEntries,
+		maxBytes:   opts.MaxBytes,
+	}, nil
 }
 
 func (c *InMemoryCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	if c.sharedHits {
+		return c.getShared(key)
+	}
+
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	e, ok := c.items[key]
@@ -40,37 +103,76 @@ func (c *InMemoryCache) Get(ctx context.Context, key string) (*CachedResponse, b
 	}
 	resp := e.resp
 
-	if !resp.ExpiresAt.IsZero() && time.Now().After(resp.ExpiresAt) {
-		c.remove(e)
-		delete(c.items, key)
+	if resp.expired(time.Now()) {
+		c.drop(e, evictExpired)
 		return nil, false
 	}
 
-	c.moveToFront(e)
+	c.policy.accessed(e)
 
 	return resp, true
 }
 
+// getShared serves hits under the read lock for policies that record access
+// atomically. Expired entries are removed under the write lock.
+func (c *InMemoryCache) getShared(key string) (*CachedResponse, bool) {
+	c.mu.RLock()
+	e, ok := c.items[key]
+	if !ok {
+		c.mu.RUnlock()
+		return nil, false
+	}
+	resp := e.resp
+	if !resp.expired(time.Now()) {
+		c.policy.accessed(e)
+		c.mu.RUnlock()
+		return resp, true
+	}
+	c.mu.RUnlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cur, ok := c.items[key]; ok && cur == e {
+		c.drop(e, evictExpired)
+	}
+	return nil, false
+}
+
 func (c *InMemoryCache) Set(ctx context.Context, key string, resp *CachedResponse) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	size := entrySize(key, resp)
+
 	if e, ok := c.items[key]; ok {
-		e.resp = resp
-		c.moveToFront(e)
+		c.drop(e, "")
+	}
+
+	if c.maxBytes > 0 && size > c.maxBytes {
 		return
 	}
 
+	for len(c.items) >= c.maxEntries {
+		if !c.evict(evictEntries) {
+			break
+		}
+	}
+	for c.maxBytes > 0 && c.bytes+size > c.maxBytes {
+		if !c.evict(evictBytes) {
+			break
+		}
+	}
+
 	e := &entry{
 		key:  key,
 		resp: resp,
+		size: size,
 	}
 	c.items[key] = e
-	c.addToFront(e)
-
-	if len(c.items) > c.maxEntries {
-		c.evictOldest()
-	}
+	c.bytes += size
+	c.tag(e)
+	c.policy.added(e)
+	metrics.AddCacheSize(c.name, 1, size)
 }
 
 func (c *InMemoryCache) Delete(ctx context.Context, key string) {
@@ -81,50 +183,108 @@ func (c *InMemoryCache) Delete(ctx context.Context, key string) {
 	if !ok {
 		return
 	}
-	c.remove(e)
-	delete(c.items, key)
+	c.drop(e, "")
 }
 
-func (c *InMemoryCache) addToFront(e *entry) {
-	e.prev = nil
-	e.next = c.head
-	if c.head != nil {
-		c.head.prev = e
+func (c *InMemoryCache) DeleteMatching(ctx context.Context, pattern string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key, e := range c.items {
+		if MatchPattern(pattern, key) {
+			c.drop(e, evictPurged)
+			n++
+		}
 	}
-	c.head = e
-	if c.tail == nil {
-		c.tail = e
+	return n
+}
+
+func (c *InMemoryCache) DeleteTagged(ctx context.Context, tag string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := 0
+	for key := range c.tags[tag] {
+		if e, ok := c.items[key]; ok {
+			c.drop(e, evictPurged)
+			n++
+		}
 	}
+	return n
 }
 
-func (c *InMemoryCache) moveToFront(e *entry) {
-	if c.head == e {
-		return
+// Len returns the number of cached entries.
+func (c *InMemoryCache) Len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.items)
+}
+
+// Bytes returns the accounted size of the cached entries.
+func (c *InMemoryCache) Bytes() int64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.bytes
+}
+
+func (c *InMemoryCache) evict(reason string) bool {
+	v := c.policy.victim()
+	if v == nil {
+		return false
 	}
-	c.remove(e)
-	c.addToFront(e)
+	c.drop(v, reason)
+	return true
 }
 
-func (c *InMemoryCache) remove(e *entry) {
-	if e.prev != nil {
-		e.prev.next = e.next
-	} else {
-		c.head = e.next
+// drop removes e from the cache and its indexes, counting it as an eviction
+// when reason is set.
+func (c *InMemoryCache) drop(e *entry, reason string) {
+	c.policy.removed(e)
+	c.untag(e)
+	delete(c.items, e.key)
+	c.bytes -= e.size
+	metrics.AddCacheSize(c.name, -1, -e.size)
+	if reason != "" {
+		metrics.IncCacheEviction(c.name, reason)
 	}
-	if e.next != nil {
-		e.next.prev = e.prev
-	} else {
-		c.tail = e.prev
+}
+
+func (c *InMemoryCache) tag(e *entry) {
+	for _, t := range e.resp.Tags {
+		keys, ok := c.tags[t]
+		if !ok {
+			keys = make(map[string]struct{})
+			c.tags[t] = keys
+		}
+		keys[e.key] = struct{}{}
 	}
-	e.prev = nil
-	e.next = nil
 }
 
-func (c *InMemoryCache) evictOldest() {
-	if c.tail == nil {
-		return
+func (c *InMemoryCache) untag(e *entry) {
+	for _, t := range e.resp.Tags {
+		keys := c.tags[t]
+		delete(keys, e.key)
+		if len(keys) == 0 {
+			delete(c.tags, t)
+		}
+	}
+}
+
+// entrySize approximates the memory held by a cached response.
+func entrySize(key string, resp *CachedResponse) int64 {
+	n := int64(entryOverhead+len(key)+len(resp.ETag)+len(resp.LastModified)) + resp.Size()
+	for k, values := range resp.Header {
+		n += int64(len(k))
+		for _, v := range values {
+			n += int64(len(v))
+		}
+	}
+	for _, t := range resp.Tags {
+		n += int64(len(t))
+	}
+	for _, v := range resp.Vary {
+		n += int64(len(v))
 	}
-	oldest := c.tail
-	c.remove(oldest)
-	delete(c.items, oldest.key)
+	return n
 }
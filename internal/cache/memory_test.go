@@ -170,6 +170,101 @@ func TestTTLEvictionOnGet(t *testing.T) {
 	}
 }
 
+func TestStaleEntryKeptForRevalidation(t *testing.T) {
+	c := NewInMemoryCache(10)
+	ctx := context.Background()
+
+	resp := makeResponse(200, "stale", time.Millisecond)
+	resp.ETag = `"v1"`
+	resp.KeepUntil = time.Now().Add(time.Hour)
+	c.Set(ctx, "key", resp)
+
+	time.Sleep(2 * time.Millisecond)
+
+	got, ok := c.Get(ctx, "key")
+	if !ok {
+		t.Fatal("stale entry with KeepUntil was dropped")
+	}
+	if got.Fresh(time.Now()) {
+		t.Error("expected entry past ExpiresAt to be reported stale")
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"GET http://a/x", "GET http://a/x", true},
+		{"GET http://a/x", "GET http://a/xy", false},
+		{"* http://a/x", "HEAD http://a/x", true},
+		{"* http://a/static/*", "GET http://a/static/css/site.css", true},
+		{"* http://a/static/*", "GET http://a/other", false},
+		{"* http://a/*.css", "GET http://a/css/site.css", true},
+		{"* http://a/*.css", "GET http://a/css/site.js", false},
+		{"*", "anything", true},
+		{`* http://a/\*`, "GET http://a/*", true},
+		{`* http://a/\*`, "GET http://a/x", false},
+		{`* http://a/\\x*`, `GET http://a/\xy`, true},
+		{"* " + EscapePattern("http://a/*?q=*") + "|*", "GET http://a/*?q=*|vary", true},
+		{"* " + EscapePattern("http://a/*?q=*") + "|*", "GET http://a/b?q=c|vary", false},
+	}
+	for _, tt := range tests {
+		if got := MatchPattern(tt.pattern, tt.key); got != tt.want {
+			t.Errorf("MatchPattern(%q, %q) = %v, want %v", tt.pattern, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestDeleteMatching(t *testing.T) {
+	c := NewInMemoryCache(10)
+	ctx := context.Background()
+
+	c.Set(ctx, "GET http://a/static/1", makeResponse(200, "1", 0))
+	c.Set(ctx, "GET http://a/static/2", makeResponse(200, "2", 0))
+	c.Set(ctx, "GET http://a/api", makeResponse(200, "3", 0))
+
+	if n := c.DeleteMatching(ctx, "* http://a/static/*"); n != 2 {
+		t.Fatalf("DeleteMatching removed %d entries, want 2", n)
+	}
+	if _, ok := c.Get(ctx, "GET http://a/static/1"); ok {
+		t.Error("matching entry survived DeleteMatching")
+	}
+	if _, ok := c.Get(ctx, "GET http://a/api"); !ok {
+		t.Error("non-matching entry removed by DeleteMatching")
+	}
+}
+
+func TestDeleteTagged(t *testing.T) {
+	c := NewInMemoryCache(10)
+	ctx := context.Background()
+
+	tagged := func(body string, tags ...string) *CachedResponse {
+		r := makeResponse(200, body, 0)
+		r.Tags = tags
+		return r
+	}
+	c.Set(ctx, "p1", tagged("1", "product-1", "catalog"))
+	c.Set(ctx, "p2", tagged("2", "product-2", "catalog"))
+	c.Set(ctx, "home", tagged("3"))
+
+	if n := c.DeleteTagged(ctx, "product-1"); n != 1 {
+		t.Fatalf("DeleteTagged(product-1) removed %d entries, want 1", n)
+	}
+	if _, ok := c.Get(ctx, "p1"); ok {
+		t.Error("tagged entry survived DeleteTagged")
+	}
+
+	// Replacing an entry drops its old tags.
+	c.Set(ctx, "p2", tagged("2b", "product-2"))
+	if n := c.DeleteTagged(ctx, "catalog"); n != 0 {
+		t.Fatalf("DeleteTagged(catalog) removed %d entries after retag, want 0", n)
+	}
+	if _, ok := c.Get(ctx, "home"); !ok {
+		t.Error("untagged entry removed")
+	}
+}
+
 func TestConcurrency(t *testing.T) {
 	c := NewInMemoryCache(100)
 	ctx := context.Background()
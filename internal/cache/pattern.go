@@ -0,0 +1,66 @@
+package cache
+
+import "strings"
+
+// MatchPattern reports whether key matches pattern, in which '*' matches any
+// run of characters (including none), '\' makes the character after it
+// match itself, and every other character matches itself.
+func MatchPattern(pattern, key string) bool {
+	parts := patternParts(pattern)
+	if len(parts) == 1 {
+		return parts[0] == key
+	}
+
+	if !strings.HasPrefix(key, parts[0]) {
+		return false
+	}
+	key = key[len(parts[0]):]
+
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(key, part)
+		if i < 0 {
+			return false
+		}
+		key = key[i+len(part):]
+	}
+	return strings.HasSuffix(key, last)
+}
+
+// EscapePattern returns a pattern matching s literally.
+func EscapePattern(s string) string {
+	if !strings.ContainsAny(s, `*\`) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if r == '*' || r == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// patternParts splits pattern at its wildcards into the literal text
+// between them, with escapes resolved.
+func patternParts(pattern string) []string {
+	if !strings.Contains(pattern, `\`) {
+		return strings.Split(pattern, "*")
+	}
+	var parts []string
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			b.WriteByte(pattern[i])
+		case c == '*':
+			parts = append(parts, b.String())
+			b.Reset()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return append(parts, b.String())
+}
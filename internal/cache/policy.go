@@ -0,0 +1,336 @@
+package cache
+
+import (
+	"container/heap"
+	"fmt"
+)
+
+// Policy names an eviction policy for InMemoryCache.
+type Policy string
+
+const (
+	// PolicyLRU evicts the least recently used entry.
+	PolicyLRU Policy = "lru"
+	// PolicyLFU evicts the least frequently used entry, breaking ties by
+	// recency.
+	PolicyLFU Policy = "lfu"
+	// PolicyS3FIFO is the scan-resistant S3-FIFO policy: new entries go
+	// through a small probationary queue and only entries accessed again
+	// while there are promoted to the main queue.
+	PolicyS3FIFO Policy = "s3fifo"
+	// PolicyClock approximates LRU with a reference bit per entry and a
+	// sweeping hand, so cache hits need no exclusive lock.
+	PolicyClock Policy = "clock"
+)
+
+// evictionPolicy orders entries for eviction. The cache serializes all calls.
+type evictionPolicy interface {
+	added(e *entry)
+	accessed(e *entry)
+	removed(e *entry)
+	// victim returns the entry to evict next, leaving it in place until
+	// removed is called for it.
+	victim() *entry
+}
+
+// concurrentPolicy is implemented by policies whose accessed method only
+// updates atomic entry state, letting cache hits proceed under a read lock.
+type concurrentPolicy interface {
+	evictionPolicy
+	concurrentAccess()
+}
+
+func newPolicy(p Policy, maxEntries int) (evictionPolicy, error) {
+	switch p {
+	case "", PolicyLRU:
+		return &lruPolicy{}, nil
+	case PolicyLFU:
+		return &lfuPolicy{}, nil
+	case PolicyS3FIFO:
+		return newS3FIFOPolicy(maxEntries), nil
+	case PolicyClock:
+		return &clockPolicy{}, nil
+	default:
+		return nil, fmt.Errorf("unknown eviction policy %q", p)
+	}
+}
+
+// entryList is an intrusive doubly linked list of entries, most recent at
+// the front.
+type entryList struct {
+	head  *entry
+	tail  *entry
+	len   int
+	bytes int64
+}
+
+func (l *entryList) pushFront(e *entry) {
+	e.prev = nil
+	e.next = l.head
+	if l.head != nil {
+		l.head.prev = e
+	}
+	l.head = e
+	if l.tail == nil {
+		l.tail = e
+	}
+	l.len++
+	l.bytes += e.size
+}
+
+func (l *entryList) remove(e *entry) {
+	if e.prev != nil {
+		e.prev.next = e.next
+	} else {
+		l.head = e.next
+	}
+	if e.next != nil {
+		e.next.prev = e.prev
+	} else {
+		l.tail = e.prev
+	}
+	e.prev = nil
+	e.next = nil
+	l.len--
+	l.bytes -= e.size
+}
+
+func (l *entryList) moveToFront(e *entry) {
+	if l.head == e {
+		return
+	}
+	l.remove(e)
+	l.pushFront(e)
+}
+
+type lruPolicy struct {
+	list entryList
+}
+
+func (p *lruPolicy) added(e *entry)    { p.list.pushFront(e) }
+func (p *lruPolicy) accessed(e *entry) { p.list.moveToFront(e) }
+func (p *lruPolicy) removed(e *entry)  { p.list.remove(e) }
+func (p *lruPolicy) victim() *entry    { return p.list.tail }
+
+// lfuPolicy keeps entries in a min-heap ordered by access count, then by
+// last access.
+type lfuPolicy struct {
+	entries lfuHeap
+	clock   uint64
+}
+
+func (p *lfuPolicy) added(e *entry) {
+	p.clock++
+	e.freq = 1
+	e.tick = p.clock
+	heap.Push(&p.entries, e)
+}
+
+func (p *lfuPolicy) accessed(e *entry) {
+	p.clock++
+	e.freq++
+	e.tick = p.clock
+	heap.Fix(&p.entries, e.index)
+}
+
+func (p *lfuPolicy) removed(e *entry) {
+	heap.Remove(&p.entries, e.index)
+}
+
+func (p *lfuPolicy) victim() *entry {
+	if len(p.entries) == 0 {
+		return nil
+	}
+	return p.entries[0]
+}
+
+type lfuHeap []*entry
+
+func (h lfuHeap) Len() int { return len(h) }
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].tick < h[j].tick
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	e := x.(*entry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	e.index = -1
+	*h = old[:n-1]
+	return e
+}
+
+const (
+	queueSmall = iota + 1
+	queueMain
+)
+
+// s3fifoPolicy implements S3-FIFO (Yang et al., SOSP '23). The small queue
+// holds roughly a tenth of the cached bytes; the ghost queue remembers keys
+// recently evicted from it so that they are admitted straight to main when
+// they come back.
+type s3fifoPolicy struct {
+	small entryList
+	main  entryList
+
+	ghost      map[string]struct{}
+	ghostOrder []string
+	ghostCap   int
+
+	// pending is the victim handed out last, and whether it is being evicted
+	// from the small queue and so should be remembered as a ghost.
+	pending      *entry
+	pendingGhost bool
+}
+
+func newS3FIFOPolicy(maxEntries int) *s3fifoPolicy {
+	return &s3fifoPolicy{
+		ghost:    make(map[string]struct{}),
+		ghostCap: max(maxEntries, 1),
+	}
+}
+
+func (p *s3fifoPolicy) concurrentAccess() {}
+
+func (p *s3fifoPolicy) added(e *entry) {
+	e.ref.Store(0)
+	if _, ok := p.ghost[e.key]; ok {
+		delete(p.ghost, e.key)
+		e.queue = queueMain
+		p.main.pushFront(e)
+		return
+	}
+	e.queue = queueSmall
+	p.small.pushFront(e)
+}
+
+func (p *s3fifoPolicy) accessed(e *entry) {
+	for {
+		n := e.ref.Load()
+		if n >= 3 || e.ref.CompareAndSwap(n, n+1) {
+			return
+		}
+	}
+}
+
+func (p *s3fifoPolicy) removed(e *entry) {
+	switch e.queue {
+	case queueSmall:
+		p.small.remove(e)
+	case queueMain:
+		p.main.remove(e)
+	}
+	e.queue = 0
+	if e == p.pending {
+		if p.pendingGhost {
+			p.remember(e.key)
+		}
+		p.pending = nil
+	}
+}
+
+func (p *s3fifoPolicy) victim() *entry {
+	for {
+		total := p.small.bytes + p.main.bytes
+		if p.small.tail != nil && (p.small.bytes*10 >= total || p.main.tail == nil) {
+			e := p.small.tail
+			if e.ref.Load() > 1 {
+				p.small.remove(e)
+				e.ref.Store(0)
+				e.queue = queueMain
+				p.main.pushFront(e)
+				continue
+			}
+			p.pending, p.pendingGhost = e, true
+			return e
+		}
+
+		e := p.main.tail
+		if e == nil {
+			return nil
+		}
+		if n := e.ref.Load(); n > 0 {
+			e.ref.Store(n - 1)
+			p.main.moveToFront(e)
+			continue
+		}
+		p.pending, p.pendingGhost = e, false
+		return e
+	}
+}
+
+func (p *s3fifoPolicy) remember(key string) {
+	if _, ok := p.ghost[key]; ok {
+		return
+	}
+	p.ghost[key] = struct{}{}
+	p.ghostOrder = append(p.ghostOrder, key)
+	for len(p.ghostOrder) > p.ghostCap {
+		oldest := p.ghostOrder[0]
+		p.ghostOrder = p.ghostOrder[1:]
+		delete(p.ghost, oldest)
+	}
+}
+
+// clockPolicy is the CLOCK approximation of LRU. Entries are kept in
+// insertion order; the hand sweeps from oldest to newest, clearing reference
+// bits and evicting the first entry whose bit is already clear.
+type clockPolicy struct {
+	list entryList
+	hand *entry
+}
+
+func (p *clockPolicy) concurrentAccess() {}
+
+func (p *clockPolicy) added(e *entry) {
+	e.ref.Store(0)
+	p.list.pushFront(e)
+}
+
+func (p *clockPolicy) accessed(e *entry) {
+	if e.ref.Load() == 0 {
+		e.ref.Store(1)
+	}
+}
+
+func (p *clockPolicy) removed(e *entry) {
+	if p.hand == e {
+		p.hand = e.prev
+	}
+	p.list.remove(e)
+}
+
+func (p *clockPolicy) victim() *entry {
+	// Two sweeps clear every reference bit, so a victim is always found.
+	for i := 0; i <= 2*p.list.len; i++ {
+		if p.hand == nil {
+			p.hand = p.list.tail
+		}
+		if p.hand == nil {
+			return nil
+		}
+		e := p.hand
+		if e.ref.Swap(0) == 0 {
+			return e
+		}
+		p.hand = e.prev
+	}
+	return p.list.tail
+}
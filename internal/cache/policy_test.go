@@ -0,0 +1,139 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func newTestCache(t *testing.T, opts Options) *InMemoryCache {
+	t.Helper()
+	c, err := NewInMemoryCacheWithOptions(opts)
+	if err != nil {
+		t.Fatalf("NewInMemoryCacheWithOptions: %v", err)
+	}
+	return c
+}
+
+func TestUnknownPolicy(t *testing.T) {
+	if _, err := NewInMemoryCacheWithOptions(Options{Policy: "random"}); err == nil {
+		t.Fatal("expected error for unknown eviction policy")
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	body := strings.Repeat("x", 1000)
+	size := entrySize("key_0", makeResponse(200, body, 0))
+	c := newTestCache(t, Options{MaxEntries: 100, MaxBytes: 3 * size})
+	ctx := context.Background()
+
+	for i := 0; i < 5; i++ {
+		c.Set(ctx, fmt.Sprintf("key_%d", i), makeResponse(200, body, 0))
+	}
+
+	if c.Len() != 3 {
+		t.Fatalf("expected 3 entries within byte budget, got %d", c.Len())
+	}
+	if c.Bytes() > 3*size {
+		t.Fatalf("cache holds %d bytes, budget %d", c.Bytes(), 3*size)
+	}
+	if _, ok := c.Get(ctx, "key_0"); ok {
+		t.Error("expected oldest entry to be evicted for bytes")
+	}
+	if _, ok := c.Get(ctx, "key_4"); !ok {
+		t.Error("expected newest entry to be kept")
+	}
+}
+
+func TestMaxBytesRejectsOversizedEntry(t *testing.T) {
+	c := newTestCache(t, Options{MaxEntries: 10, MaxBytes: 512})
+	ctx := context.Background()
+
+	c.Set(ctx, "small", makeResponse(200, "ok", 0))
+	c.Set(ctx, "huge", makeResponse(200, strings.Repeat("x", 4096), 0))
+
+	if _, ok := c.Get(ctx, "huge"); ok {
+		t.Error("entry larger than MaxBytes was stored")
+	}
+	if _, ok := c.Get(ctx, "small"); !ok {
+		t.Error("oversized entry evicted existing entries")
+	}
+}
+
+func TestBytesAccounting(t *testing.T) {
+	c := newTestCache(t, Options{MaxEntries: 10})
+	ctx := context.Background()
+
+	c.Set(ctx, "a", makeResponse(200, "aaaa", 0))
+	c.Set(ctx, "b", makeResponse(200, "bb", 0))
+	c.Set(ctx, "a", makeResponse(200, "a", 0))
+	c.Delete(ctx, "b")
+
+	if want := entrySize("a", makeResponse(200, "a", 0)); c.Bytes() != want {
+		t.Fatalf("Bytes() = %d, want %d", c.Bytes(), want)
+	}
+}
+
+func TestLFUEviction(t *testing.T) {
+	c := newTestCache(t, Options{MaxEntries: 3, Policy: PolicyLFU})
+	ctx := context.Background()
+
+	c.Set(ctx, "hot", makeResponse(200, "h", 0))
+	c.Set(ctx, "warm", makeResponse(200, "w", 0))
+	c.Set(ctx, "cold", makeResponse(200, "c", 0))
+	for i := 0; i < 5; i++ {
+		c.Get(ctx, "hot")
+	}
+	c.Get(ctx, "warm")
+	c.Get(ctx, "warm")
+	c.Get(ctx, "cold")
+
+	c.Set(ctx, "new", makeResponse(200, "n", 0))
+
+	if _, ok := c.Get(ctx, "cold"); ok {
+		t.Error("expected least frequently used entry to be evicted")
+	}
+	for _, k := range []string{"hot", "warm", "new"} {
+		if _, ok := c.Get(ctx, k); !ok {
+			t.Errorf("%s was evicted incorrectly", k)
+		}
+	}
+}
+
+func TestS3FIFOScanResistance(t *testing.T) {
+	for _, policy := range []Policy{PolicyLRU, PolicyS3FIFO} {
+		t.Run(string(policy), func(t *testing.T) {
+			c := newTestCache(t, Options{MaxEntries: 20, Policy: policy})
+			ctx := context.Background()
+
+			for i := 0; i < 10; i++ {
+				c.Set(ctx, fmt.Sprintf("hot_%d", i), makeResponse(200, "h", 0))
+			}
+			for round := 0; round < 3; round++ {
+				for i := 0; i < 10; i++ {
+					c.Get(ctx, fmt.Sprintf("hot_%d", i))
+				}
+			}
+
+			// A one-hit scan larger than the cache.
+			for i := 0; i < 50; i++ {
+				c.Set(ctx, fmt.Sprintf("scan_%d", i), makeResponse(200, "s", 0))
+			}
+
+			survivors := 0
+			for i := 0; i < 10; i++ {
+				if _, ok := c.Get(ctx, fmt.Sprintf("hot_%d", i)); ok {
+					survivors++
+				}
+			}
+
+			if policy == PolicyS3FIFO && survivors != 10 {
+				t.Errorf("S3-FIFO kept %d/10 hot entries through a scan", survivors)
+			}
+			if policy == PolicyLRU && survivors != 0 {
+				t.Errorf("LRU kept %d/10 hot entries through a scan, expected the scan to flush them", survivors)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"warpgate/internal/metrics"
+	"warpgate/internal/resp"
+)
+
+// tagScriptSrc adds ARGV[1] to the tag sets KEYS. A set lives as long as its
+// longest-lived member, ARGV[2] being the member's TTL in milliseconds or 0
+// for none. Once a set holds a member without TTL it never expires, so that
+// the member can always be purged by tag.
+const tagScriptSrc = `
+local ttl = tonumber(ARGV[2])
+for _, key in ipairs(KEYS) do
+  local cur = redis.call('PTTL', key)
+  redis.call('SADD', key, ARGV[1])
+  if ttl <= 0 then
+    redis.call('PERSIST', key)
+  elseif cur == -2 or (cur >= 0 and cur < ttl) then
+    redis.call('PEXPIRE', key, ttl)
+  end
+end
+return 0
+`
+
+var tagScript = resp.NewScript(tagScriptSrc)
+
+// RedisOptions configures a RedisCache.
+type RedisOptions struct {
+	// Name labels the cache in metrics.
+	Name string
+	// Prefix is prepended to every key, so that several deployments can
+	// share a server (default "warpgate:").
+	Prefix string
+	// ConsecutiveFailures trips the circuit breaker (default 5).
+	ConsecutiveFailures int
+	// Cooldown is how long the cache stays disabled once tripped before a
+	// request is let through to probe the server again (default 10s).
+	Cooldown time.Duration
+}
+
+// RedisCache stores responses in Redis, or any server speaking its protocol,
+// so that several warpgate instances share one cache and purges apply to
+// all of them.
+//
+// Entries expire on the server when they are no longer needed for
+// revalidation. Surrogate key tags are kept in a set per tag. When the server
+// fails repeatedly a circuit breaker disables the cache for a cooldown: Get
+// misses and Set does nothing, so requests go upstream instead of waiting on
+// the server.
+type RedisCache struct {
+	client   *resp.Client
+	name     string
+	prefix   string
+	failures int
+	cooldown time.Duration
+
+	mu        sync.Mutex
+	failed    int
+	openUntil time.Time
+	probing   bool
+}
+
+// redisRecord is the serialized form of an entry.
+type redisRecord struct {
+	StatusCode     int
+	Header         http.Header
+	Body           []byte
+	ExpiresAt      time.Time
+	ETag           string
+	LastModified   string
+	StoredAt       time.Time
+	InitialAge     time.Duration
+	MustRevalidate bool
+	Vary           []string
+	Tags           []string
+	KeepUntil      time.Time
+}
+
+func NewRedisCache(client *resp.Client, opts RedisOptions) *RedisCache {
+	if opts.Name == "" {
+		opts.Name = "redis"
+	}
+	if opts.Prefix == "" {
+		opts.Prefix = "warpgate:"
+	}
+	if opts.ConsecutiveFailures <= 0 {
+		opts.ConsecutiveFailures = 5
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 10 * time.Second
+	}
+	return &RedisCache{
+		client:   client,
+		name:     opts.Name,
+		prefix:   opts.Prefix,
+		failures: opts.ConsecutiveFailures,
+		cooldown: opts.Cooldown,
+	}
+}
+
+func (c *RedisCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	if !c.allow() {
+		return nil, false
+	}
+	v, err := c.client.Do(ctx, "GET", c.objectKey(key))
+	c.report(ctx, err)
+	data, ok := v.([]byte)
+	if err != nil || !ok {
+		return nil, false
+	}
+
+	var rec redisRecord
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&rec); err != nil {
+		return nil, false
+	}
+	resp := &CachedResponse{
+		StatusCode:     rec.StatusCode,
+		Header:         rec.Header,
+		Body:           rec.Body,
+		ExpiresAt:      rec.ExpiresAt,
+		ETag:           rec.ETag,
+		LastModified:   rec.LastModified,
+		StoredAt:       rec.StoredAt,
+		InitialAge:     rec.InitialAge,
+		MustRevalidate: rec.MustRevalidate,
+		Vary:           rec.Vary,
+		Tags:           rec.Tags,
+		KeepUntil:      rec.KeepUntil,
+	}
+	if resp.expired(time.Now()) {
+		return nil, false
+	}
+	return resp, true
+}
+
+// Set stores resp with a time to live covering its freshness lifetime and
+// KeepUntil. Responses that are already expired are not stored.
+func (c *RedisCache) Set(ctx context.Context, key string, resp *CachedResponse) {
+	var ttl time.Duration
+	if !resp.ExpiresAt.IsZero() {
+		until := resp.ExpiresAt
+		if resp.KeepUntil.After(until) {
+			until = resp.KeepUntil
+		}
+		if ttl = time.Until(until); ttl <= 0 {
+			return
+		}
+	}
+
+	body := resp.Body
+	if resp.open != nil {
+		r, err := resp.Open()
+		if err != nil {
+			return
+		}
+		body, err = io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return
+		}
+	}
+
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(redisRecord{
+		StatusCode:     resp.StatusCode,
+		Header:         resp.Header,
+		Body:           body,
+		ExpiresAt:      resp.ExpiresAt,
+		ETag:           resp.ETag,
+		LastModified:   resp.LastModified,
+		StoredAt:       resp.StoredAt,
+		InitialAge:     resp.InitialAge,
+		MustRevalidate: resp.MustRevalidate,
+		Vary:           resp.Vary,
+		Tags:           resp.Tags,
+		KeepUntil:      resp.KeepUntil,
+	})
+	if err != nil || !c.allow() {
+		return
+	}
+
+	objKey := c.objectKey(key)
+	set := []any{"SET", objKey, buf.Bytes()}
+	var ttlMillis int64
+	if ttl > 0 {
+		ttlMillis = max(ttl.Milliseconds(), 1)
+		set = append(set, "PX", ttlMillis)
+	}
+	_, err = c.client.Do(ctx, set...)
+	if err == nil && len(resp.Tags) > 0 {
+		tagKeys := make([]string, len(resp.Tags))
+		for i, t := range resp.Tags {
+			tagKeys[i] = c.tagKey(t)
+		}
+		_, err = tagScript.Run(ctx, c.client, tagKeys, objKey, ttlMillis)
+	}
+	c.report(ctx, err)
+}
+
+func (c *RedisCache) Delete(ctx context.Context, key string) {
+	if !c.allow() {
+		return
+	}
+	_, err := c.client.Do(ctx, "DEL", c.objectKey(key))
+	c.report(ctx, err)
+}
+
+// DeleteMatching scans the server for matching keys and deletes them.
+func (c *RedisCache) DeleteMatching(ctx context.Context, pattern string) int {
+	if !c.allow() {
+		return 0
+	}
+	match := escapeGlob(c.objectKey("")) + globPattern(pattern)
+
+	n := 0
+	cursor := "0"
+	for {
+		v, err := c.client.Do(ctx, "SCAN", cursor, "MATCH", match, "COUNT", 1000)
+		c.report(ctx, err)
+		if err != nil {
+			return n
+		}
+		reply, ok := v.([]any)
+		if !ok || len(reply) != 2 {
+			return n
+		}
+		next, _ := reply[0].([]byte)
+		keys, _ := reply[1].([]any)
+
+		if len(keys) > 0 {
+			n += c.del(ctx, keys)
+		}
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return n
+		}
+	}
+}
+
+// DeleteTagged deletes the members of the tag's set and the set itself.
+func (c *RedisCache) DeleteTagged(ctx context.Context, tag string) int {
+	if !c.allow() {
+		return 0
+	}
+	tagKey := c.tagKey(tag)
+	v, err := c.client.Do(ctx, "SMEMBERS", tagKey)
+	c.report(ctx, err)
+	if err != nil {
+		return 0
+	}
+	members, _ := v.([]any)
+
+	n := 0
+	if len(members) > 0 {
+		n = c.del(ctx, members)
+	}
+	_, err = c.client.Do(ctx, "DEL", tagKey)
+	c.report(ctx, err)
+	return n
+}
+
+func (c *RedisCache) del(ctx context.Context, keys []any) int {
+	v, err := c.client.Do(ctx, append([]any{"DEL"}, keys...)...)
+	c.report(ctx, err)
+	n, _ := v.(int64)
+	return int(n)
+}
+
+func (c *RedisCache) objectKey(key string) string {
+	return c.prefix + "obj:" + key
+}
+
+func (c *RedisCache) tagKey(tag string) string {
+	return c.prefix + "tag:" + tag
+}
+
+// allow reports whether the server may be used. Once the cooldown of a
+// tripped breaker has passed, a single request is let through as a probe.
+func (c *RedisCache) allow() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.openUntil.IsZero() {
+		return true
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// report records the outcome of a command. Error replies and cancellations
+// by the caller do not count as server failures.
+func (c *RedisCache) report(ctx context.Context, err error) {
+	var reply resp.Error
+	if errors.As(err, &reply) {
+		err = nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probing = false
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	if err == nil {
+		c.failed = 0
+		if !c.openUntil.IsZero() {
+			c.openUntil = time.Time{}
+			metrics.SetCacheBackendOpen(c.name, false)
+		}
+		return
+	}
+
+	metrics.IncCacheBackendError(c.name)
+	c.failed++
+	if c.failed >= c.failures {
+		c.openUntil = time.Now().Add(c.cooldown)
+		metrics.SetCacheBackendOpen(c.name, true)
+	}
+}
+
+// globPattern converts a MatchPattern pattern to a Redis glob pattern.
+func globPattern(pattern string) string {
+	parts := patternParts(pattern)
+	for i, p := range parts {
+		parts[i] = escapeGlob(p)
+	}
+	return strings.Join(parts, "*")
+}
+
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
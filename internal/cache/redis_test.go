@@ -0,0 +1,205 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"warpgate/internal/resp"
+	"warpgate/internal/resp/resptest"
+)
+
+// emulateTagScript mirrors tagScriptSrc.
+func emulateTagScript(tx *resptest.Tx, keys, args []string) any {
+	ms, _ := strconv.ParseInt(args[1], 10, 64)
+	ttl := time.Duration(ms) * time.Millisecond
+	for _, key := range keys {
+		cur, exists := tx.TTL(key)
+		tx.SAdd(key, args[0])
+		switch {
+		case ttl <= 0:
+			tx.Expire(key, 0)
+		case !exists || (cur > 0 && cur < ttl):
+			tx.Expire(key, ttl)
+		}
+	}
+	return int64(0)
+}
+
+func newTestRedisCache(t *testing.T, srv *resptest.Server, opts RedisOptions) *RedisCache {
+	t.Helper()
+	srv.HandleScript(tagScriptSrc, emulateTagScript)
+	client := resp.NewClient(resp.Options{Addr: srv.Addr(), Timeout: 100 * time.Millisecond})
+	t.Cleanup(func() { client.Close() })
+	return NewRedisCache(client, opts)
+}
+
+func TestRedisCache_RoundTrip(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := newTestRedisCache(t, srv, RedisOptions{Prefix: "test:"})
+	ctx := context.Background()
+
+	stored := makeResponse(203, "shared body", time.Minute)
+	stored.Header.Set("Content-Type", "text/plain")
+	stored.Header.Add("Set-Cookie", "a=1")
+	stored.Header.Add("Set-Cookie", "b=2")
+	stored.ETag = `"v1"`
+	stored.StoredAt = time.Now()
+	stored.InitialAge = 5 * time.Second
+	stored.KeepUntil = stored.ExpiresAt.Add(time.Minute)
+	c.Set(ctx, "GET http://a/x", stored)
+
+	if keys := srv.Keys(); len(keys) != 1 || keys[0] != "test:obj:GET http://a/x" {
+		t.Fatalf("server keys = %v", keys)
+	}
+	if ttl := srv.TTL("test:obj:GET http://a/x"); ttl < time.Minute || ttl > 2*time.Minute {
+		t.Errorf("TTL = %v, want about 2m (expiry plus keep-stale window)", ttl)
+	}
+
+	got, ok := c.Get(ctx, "GET http://a/x")
+	if !ok {
+		t.Fatal("expected cache hit")
+	}
+	if got.StatusCode != 203 || string(got.Body) != "shared body" || got.ETag != `"v1"` {
+		t.Errorf("got %d %q %q", got.StatusCode, got.Body, got.ETag)
+	}
+	if v := got.Header.Values("Set-Cookie"); len(v) != 2 || got.Header.Get("Content-Type") != "text/plain" {
+		t.Errorf("header not preserved: %v", got.Header)
+	}
+	if !got.ExpiresAt.Equal(stored.ExpiresAt) || got.InitialAge != stored.InitialAge {
+		t.Errorf("freshness metadata not preserved: %v %v", got.ExpiresAt, got.InitialAge)
+	}
+
+	c.Delete(ctx, "GET http://a/x")
+	if _, ok := c.Get(ctx, "GET http://a/x"); ok {
+		t.Error("entry survived Delete")
+	}
+}
+
+func TestRedisCache_Purge(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := newTestRedisCache(t, srv, RedisOptions{})
+	ctx := context.Background()
+
+	tagged := makeResponse(200, "p1", time.Minute)
+	tagged.Tags = []string{"product-1"}
+	c.Set(ctx, "GET http://a/products/1", tagged)
+	c.Set(ctx, "GET http://a/products/2", makeResponse(200, "p2", time.Minute))
+	c.Set(ctx, "GET http://a/[x]", makeResponse(200, "x", time.Minute))
+	c.Set(ctx, "GET http://a/other", makeResponse(200, "o", time.Minute))
+
+	if n := c.DeleteTagged(ctx, "product-1"); n != 1 {
+		t.Errorf("DeleteTagged removed %d entries, want 1", n)
+	}
+	if n := c.DeleteMatching(ctx, "GET http://a/products/*"); n != 1 {
+		t.Errorf("DeleteMatching removed %d entries, want 1", n)
+	}
+	if n := c.DeleteMatching(ctx, "GET http://a/[x]"); n != 1 {
+		t.Errorf("DeleteMatching with glob characters removed %d entries, want 1", n)
+	}
+	if keys := srv.Keys(); len(keys) != 1 || keys[0] != "warpgate:obj:GET http://a/other" {
+		t.Errorf("server keys after purge = %v", keys)
+	}
+}
+
+func TestRedisCache_TagSetsExpire(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := newTestRedisCache(t, srv, RedisOptions{})
+	ctx := context.Background()
+
+	set := func(key string, ttl time.Duration) {
+		r := makeResponse(200, key, ttl)
+		r.Tags = []string{"t"}
+		c.Set(ctx, key, r)
+	}
+	set("long", 10*time.Minute)
+	if ttl := srv.TTL("warpgate:tag:t"); ttl < 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("new tag set TTL = %v, want about 10m", ttl)
+	}
+	// A shorter-lived entry does not shorten the set's life; a longer one
+	// extends it.
+	set("short", time.Minute)
+	if ttl := srv.TTL("warpgate:tag:t"); ttl < 9*time.Minute {
+		t.Errorf("tag set TTL shortened to %v", ttl)
+	}
+	set("longer", time.Hour)
+	if ttl := srv.TTL("warpgate:tag:t"); ttl < 59*time.Minute {
+		t.Errorf("tag set TTL = %v, want about 1h", ttl)
+	}
+
+	// Once a member never expires, neither does its set.
+	c.Set(ctx, "forever", &CachedResponse{StatusCode: 200, Tags: []string{"t"}})
+	set("after", 2*time.Hour)
+	if ttl := srv.TTL("warpgate:tag:t"); ttl != 0 {
+		t.Errorf("tag set holding a member without TTL expires in %v", ttl)
+	}
+	if n := c.DeleteTagged(ctx, "t"); n != 5 {
+		t.Errorf("DeleteTagged removed %d entries, want 5", n)
+	}
+}
+
+func TestRedisCache_ExpiredNotStored(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := newTestRedisCache(t, srv, RedisOptions{})
+
+	expired := makeResponse(200, "old", 0)
+	expired.ExpiresAt = time.Now().Add(-time.Second)
+	c.Set(context.Background(), "k", expired)
+	if keys := srv.Keys(); len(keys) != 0 {
+		t.Errorf("expired response stored: %v", keys)
+	}
+}
+
+func TestRedisCache_CircuitBreaker(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := newTestRedisCache(t, srv, RedisOptions{ConsecutiveFailures: 2, Cooldown: 50 * time.Millisecond})
+	ctx := context.Background()
+
+	c.Set(ctx, "k", makeResponse(200, "v", time.Minute))
+	srv.Close()
+
+	for i := 0; i < 2; i++ {
+		if _, ok := c.Get(ctx, "k"); ok {
+			t.Fatal("expected a miss while the server is down")
+		}
+	}
+	if c.allow() {
+		t.Fatal("expected the breaker to open after consecutive failures")
+	}
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		c.Get(ctx, "k")
+		c.Set(ctx, "k", makeResponse(200, "v", time.Minute))
+	}
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("open breaker still contacted the server (took %v)", d)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if !c.allow() {
+		t.Fatal("expected a probe after the cooldown")
+	}
+	if c.allow() {
+		t.Fatal("expected a single probe at a time")
+	}
+	c.report(ctx, context.DeadlineExceeded)
+	if c.allow() {
+		t.Fatal("expected a failed probe to reopen the breaker")
+	}
+}
+
+func TestGlobPattern(t *testing.T) {
+	tests := map[string]string{
+		"GET http://a/*":    `GET http://a/*`,
+		"GET http://a/?q":   `GET http://a/\?q`,
+		"GET http://a/[1]*": `GET http://a/\[1\]*`,
+		`GET http://a/\**`:  `GET http://a/\**`,
+	}
+	for in, want := range tests {
+		if got := globPattern(in); got != want {
+			t.Errorf("globPattern(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
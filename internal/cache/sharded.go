@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"context"
+	"hash/maphash"
+)
+
+// ShardedCache spreads keys over independent InMemoryCache shards by hash, so
+// that operations on different keys rarely contend for the same lock.
+// Budgets are split evenly between shards and eviction is per shard.
+type ShardedCache struct {
+	seed   maphash.Seed
+	shards []*InMemoryCache
+}
+
+// NewShardedCache creates a cache of n shards whose combined budgets are
+// those in opts.
+func NewShardedCache(n int, opts Options) (*ShardedCache, error) {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 1024
+	}
+	if n <= 0 {
+		n = 1
+	}
+	n = min(n, opts.MaxEntries)
+
+	shardOpts := opts
+	shardOpts.MaxEntries = (opts.MaxEntries + n - 1) / n
+	if opts.MaxBytes > 0 {
+		shardOpts.MaxBytes = (opts.MaxBytes + int64(n) - 1) / int64(n)
+	}
+
+	c := &ShardedCache{
+		seed:   maphash.MakeSeed(),
+		shards: make([]*InMemoryCache, n),
+	}
+	for i := range c.shards {
+		shard, err := NewInMemoryCacheWithOptions(shardOpts)
+		if err != nil {
+			return nil, err
+		}
+		c.shards[i] = shard
+	}
+	return c, nil
+}
+
+func (c *ShardedCache) shard(key string) *InMemoryCache {
+	return c.shards[maphash.String(c.seed, key)%uint64(len(c.shards))]
+}
+
+func (c *ShardedCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	return c.shard(key).Get(ctx, key)
+}
+
+func (c *ShardedCache) Set(ctx context.Context, key string, resp *CachedResponse) {
+	c.shard(key).Set(ctx, key, resp)
+}
+
+func (c *ShardedCache) Delete(ctx context.Context, key string) {
+	c.shard(key).Delete(ctx, key)
+}
+
+func (c *ShardedCache) DeleteMatching(ctx context.Context, pattern string) int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.DeleteMatching(ctx, pattern)
+	}
+	return n
+}
+
+func (c *ShardedCache) DeleteTagged(ctx context.Context, tag string) int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.DeleteTagged(ctx, tag)
+	}
+	return n
+}
+
+// Len returns the number of cached entries across shards.
+func (c *ShardedCache) Len() int {
+	n := 0
+	for _, s := range c.shards {
+		n += s.Len()
+	}
+	return n
+}
+
+// Bytes returns the accounted size of the cached entries across shards.
+func (c *ShardedCache) Bytes() int64 {
+	var n int64
+	for _, s := range c.shards {
+		n += s.Bytes()
+	}
+	return n
+}
@@ -0,0 +1,116 @@
+package cache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestShardedCache(t *testing.T) {
+	c, err := NewShardedCache(8, Options{MaxEntries: 800, Policy: PolicyClock})
+	if err != nil {
+		t.Fatalf("NewShardedCache: %v", err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		r := makeResponse(200, fmt.Sprintf("body_%d", i), 0)
+		if i%2 == 0 {
+			r.Tags = []string{"even"}
+		}
+		c.Set(ctx, fmt.Sprintf("GET http://a/%d", i), r)
+	}
+	if c.Len() != 100 {
+		t.Fatalf("Len() = %d, want 100", c.Len())
+	}
+
+	for i := 0; i < 100; i++ {
+		got, ok := c.Get(ctx, fmt.Sprintf("GET http://a/%d", i))
+		if !ok || string(got.Body) != fmt.Sprintf("body_%d", i) {
+			t.Fatalf("Get(%d) = %v, %v", i, got, ok)
+		}
+	}
+
+	if n := c.DeleteTagged(ctx, "even"); n != 50 {
+		t.Errorf("DeleteTagged removed %d entries across shards, want 50", n)
+	}
+	if n := c.DeleteMatching(ctx, "GET http://a/1*"); n != 6 {
+		t.Errorf("DeleteMatching removed %d entries across shards, want 6", n)
+	}
+	c.Delete(ctx, "GET http://a/3")
+	if c.Len() != 43 {
+		t.Errorf("Len() = %d after deletes, want 43", c.Len())
+	}
+}
+
+func TestShardedCache_SplitsBudget(t *testing.T) {
+	c, err := NewShardedCache(4, Options{MaxEntries: 40})
+	if err != nil {
+		t.Fatalf("NewShardedCache: %v", err)
+	}
+	ctx := context.Background()
+
+	for i := 0; i < 1000; i++ {
+		c.Set(ctx, fmt.Sprintf("key_%d", i), makeResponse(200, "x", 0))
+	}
+	if c.Len() > 40 {
+		t.Fatalf("sharded cache holds %d entries, budget 40", c.Len())
+	}
+}
+
+func TestClockEviction(t *testing.T) {
+	c := newTestCache(t, Options{MaxEntries: 3, Policy: PolicyClock})
+	ctx := context.Background()
+
+	c.Set(ctx, "key1", makeResponse(200, "1", 0))
+	c.Set(ctx, "key2", makeResponse(200, "2", 0))
+	c.Set(ctx, "key3", makeResponse(200, "3", 0))
+	c.Get(ctx, "key1")
+	c.Get(ctx, "key3")
+
+	c.Set(ctx, "key4", makeResponse(200, "4", 0))
+
+	if _, ok := c.Get(ctx, "key2"); ok {
+		t.Error("expected the unreferenced entry to be evicted")
+	}
+	for _, k := range []string{"key1", "key3", "key4"} {
+		if _, ok := c.Get(ctx, k); !ok {
+			t.Errorf("%s was evicted incorrectly", k)
+		}
+	}
+}
+
+func TestConcurrentPolicies(t *testing.T) {
+	for _, policy := range []Policy{PolicyClock, PolicyS3FIFO} {
+		t.Run(string(policy), func(t *testing.T) {
+			c, err := NewShardedCache(4, Options{MaxEntries: 64, Policy: policy})
+			if err != nil {
+				t.Fatalf("NewShardedCache: %v", err)
+			}
+			ctx := context.Background()
+
+			var wg sync.WaitGroup
+			for g := 0; g < 16; g++ {
+				wg.Add(1)
+				go func(g int) {
+					defer wg.Done()
+					for j := 0; j < 2000; j++ {
+						key := fmt.Sprintf("key_%d", (g*j)%200)
+						if j%4 == 0 {
+							c.Set(ctx, key, makeResponse(200, key, 0))
+						} else if resp, ok := c.Get(ctx, key); ok && string(resp.Body) != key {
+							t.Errorf("Get(%s) returned body %q", key, resp.Body)
+							return
+						}
+					}
+				}(g)
+			}
+			wg.Wait()
+
+			if c.Len() > 64 {
+				t.Fatalf("cache holds %d entries, budget 64", c.Len())
+			}
+		})
+	}
+}
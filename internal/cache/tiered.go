@@ -0,0 +1,150 @@
+package cache
+
+import (
+	"context"
+	"io"
+)
+
+// TieredCache layers a small, fast front cache over a larger back cache,
+// typically an InMemoryCache over a DiskCache. Writes go to both tiers;
+// hits in the back tier are promoted to the front tier when their body is
+// small enough to hold in memory.
+type TieredCache struct {
+	front        Cache
+	back         Cache
+	maxFrontBody int64
+}
+
+// NewTieredCache creates a two-tier cache. Bodies larger than maxFrontBody
+// bytes are only kept in the back tier.
+func NewTieredCache(front, back Cache, maxFrontBody int64) *TieredCache {
+	return &TieredCache{
+		front:        front,
+		back:         back,
+		maxFrontBody: maxFrontBody,
+	}
+}
+
+func (c *TieredCache) Get(ctx context.Context, key string) (*CachedResponse, bool) {
+	if resp, ok := c.front.Get(ctx, key); ok {
+		return resp, true
+	}
+	resp, ok := c.back.Get(ctx, key)
+	if !ok {
+		return nil, false
+	}
+	if promoted, ok := c.load(resp); ok {
+		c.front.Set(ctx, key, promoted)
+		return promoted, true
+	}
+	return resp, true
+}
+
+func (c *TieredCache) Set(ctx context.Context, key string, resp *CachedResponse) {
+	c.back.Set(ctx, key, resp)
+	if promoted, ok := c.load(resp); ok {
+		c.front.Set(ctx, key, promoted)
+	} else {
+		c.front.Delete(ctx, key)
+	}
+}
+
+// SetStream streams the body to the back tier and, while it stays small
+// enough, buffers it for the front tier as well.
+func (c *TieredCache) SetStream(ctx context.Context, key string, resp *CachedResponse, limit int64) Writer {
+	frontLimit := c.maxFrontBody
+	if limit > 0 {
+		frontLimit = min(frontLimit, limit)
+	}
+	return &tieredWriter{
+		ctx:        ctx,
+		key:        key,
+		front:      c.front,
+		back:       NewWriter(ctx, c.back, key, resp, limit),
+		buf:        &bufferWriter{ctx: ctx, cache: c.front, key: key, resp: resp},
+		frontLimit: frontLimit,
+	}
+}
+
+type tieredWriter struct {
+	ctx        context.Context
+	key        string
+	front      Cache
+	back       Writer
+	buf        *bufferWriter
+	frontLimit int64
+}
+
+func (w *tieredWriter) Write(p []byte) (int, error) {
+	n, err := w.back.Write(p)
+	if err != nil {
+		w.buf.Abort()
+		return n, err
+	}
+	if !w.buf.aborted && int64(w.buf.buf.Len()+len(p)) > w.frontLimit {
+		w.buf.Abort()
+	}
+	_, _ = w.buf.Write(p)
+	return n, nil
+}
+
+// Commit stores the response in the front tier only once the back tier has
+// stored it, so that the front tier never holds what the back tier lacks.
+func (w *tieredWriter) Commit() error {
+	if err := w.back.Commit(); err != nil {
+		w.buf.Abort()
+		w.front.Delete(w.ctx, w.key)
+		return err
+	}
+	if w.buf.aborted {
+		w.front.Delete(w.ctx, w.key)
+		return nil
+	}
+	return w.buf.Commit()
+}
+
+func (w *tieredWriter) Abort() {
+	w.back.Abort()
+	w.buf.Abort()
+}
+
+func (c *TieredCache) Delete(ctx context.Context, key string) {
+	c.front.Delete(ctx, key)
+	c.back.Delete(ctx, key)
+}
+
+// DeleteMatching purges both tiers. Entries held in both count once, as the
+// front tier only holds copies of back tier entries.
+func (c *TieredCache) DeleteMatching(ctx context.Context, pattern string) int {
+	return max(c.front.DeleteMatching(ctx, pattern), c.back.DeleteMatching(ctx, pattern))
+}
+
+func (c *TieredCache) DeleteTagged(ctx context.Context, tag string) int {
+	return max(c.front.DeleteTagged(ctx, tag), c.back.DeleteTagged(ctx, tag))
+}
+
+// load returns resp with its body read into memory, if the body is small
+// enough for the front tier.
+func (c *TieredCache) load(resp *CachedResponse) (*CachedResponse, bool) {
+	if resp.Size() > c.maxFrontBody {
+		return nil, false
+	}
+	if resp.open == nil {
+		return resp, true
+	}
+	r, err := resp.Open()
+	if err != nil {
+		return nil, false
+	}
+	defer r.Close()
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, false
+	}
+
+	loaded := *resp
+	loaded.Body = body
+	loaded.open = nil
+	loaded.bodySize = 0
+	return &loaded, true
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"bytes"
+	"context"
+	"errors"
+)
+
+// ErrTooLarge is returned by Writer.Write once the body exceeds the limit the
+// write was started with. The write is aborted and nothing is stored.
+var ErrTooLarge = errors.New("cache: body exceeds size limit")
+
+var errAborted = errors.New("cache: write aborted")
+
+// Writer stores a response as its body is received.
+type Writer interface {
+	// Write appends to the body. After an error the write is aborted and
+	// further calls fail.
+	Write(p []byte) (int, error)
+	// Commit stores the response once the whole body has been written. It
+	// fails if the response could not be stored.
+	Commit() error
+	// Abort discards what has been written.
+	Abort()
+}
+
+// StreamingCache is implemented by caches that can store a body as it is
+// written instead of from a complete CachedResponse.Body.
+type StreamingCache interface {
+	Cache
+	// SetStream begins storing resp under key; its body is written to the
+	// returned Writer. Bodies longer than limit bytes are rejected, unless
+	// limit is zero.
+	SetStream(ctx context.Context, key string, resp *CachedResponse, limit int64) Writer
+}
+
+// NewWriter begins storing resp under key in c, with its body written to the
+// returned Writer. Caches implementing StreamingCache store the body as it
+// arrives; for others it is buffered in memory and stored with Set on Commit.
+// Bodies longer than limit bytes are rejected, unless limit is zero.
+func NewWriter(ctx context.Context, c Cache, key string, resp *CachedResponse, limit int64) Writer {
+	if sc, ok := c.(StreamingCache); ok {
+		return sc.SetStream(ctx, key, resp, limit)
+	}
+	return &bufferWriter{
+		ctx:   ctx,
+		cache: c,
+		key:   key,
+		resp:  resp,
+		limit: limit,
+	}
+}
+
+// bufferWriter collects the body in memory and stores it with Set.
+type bufferWriter struct {
+	ctx     context.Context
+	cache   Cache
+	key     string
+	resp    *CachedResponse
+	limit   int64
+	buf     bytes.Buffer
+	aborted bool
+}
+
+func (w *bufferWriter) Write(p []byte) (int, error) {
+	if w.aborted {
+		return 0, ErrTooLarge
+	}
+	if w.limit > 0 && int64(w.buf.Len()+len(p)) > w.limit {
+		w.Abort()
+		return 0, ErrTooLarge
+	}
+	return w.buf.Write(p)
+}
+
+func (w *bufferWriter) Commit() error {
+	if w.aborted {
+		return errAborted
+	}
+	stored := *w.resp
+	stored.Body = w.buf.Bytes()
+	stored.open = nil
+	stored.bodySize = 0
+	stored.digest = ""
+	w.cache.Set(w.ctx, w.key, &stored)
+	return nil
+}
+
+func (w *bufferWriter) Abort() {
+	w.aborted = true
+	w.buf = bytes.Buffer{}
+}
+
+// failedWriter is returned when a write cannot be started.
+type failedWriter struct {
+	err error
+}
+
+func (w failedWriter) Write(p []byte) (int, error) { return 0, w.err }
+func (w failedWriter) Commit() error               { return w.err }
+func (failedWriter) Abort()                        {}
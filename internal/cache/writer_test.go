@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeAll(t *testing.T, w Writer, chunks ...string) error {
+	t.Helper()
+	for _, c := range chunks {
+		if _, err := w.Write([]byte(c)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestNewWriter_Buffered(t *testing.T) {
+	c := NewInMemoryCache(10)
+	ctx := context.Background()
+
+	w := NewWriter(ctx, c, "k", makeResponse(200, "", time.Minute), 8)
+	if err := writeAll(t, w, "abc", "def"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if _, ok := c.Get(ctx, "k"); ok {
+		t.Fatal("entry visible before Commit")
+	}
+	w.Commit()
+	if got, ok := c.Get(ctx, "k"); !ok || string(got.Body) != "abcdef" {
+		t.Fatalf("Get after Commit = %v, %v", got, ok)
+	}
+
+	w = NewWriter(ctx, c, "big", makeResponse(200, "", time.Minute), 8)
+	if err := writeAll(t, w, "abcde", "fghij"); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	w.Commit()
+	if _, ok := c.Get(ctx, "big"); ok {
+		t.Error("aborted write was stored")
+	}
+}
+
+func TestDiskCache_SetStream(t *testing.T) {
+	dir := t.TempDir()
+	c := newTestDiskCache(t, DiskOptions{Dir: dir})
+	ctx := context.Background()
+
+	w := NewWriter(ctx, c, "k", makeResponse(200, "", time.Minute), 0)
+	if _, ok := w.(*diskWriter); !ok {
+		t.Fatalf("disk cache writer is %T, want a streaming writer", w)
+	}
+	if err := writeAll(t, w, "streamed ", "body"); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	w.Commit()
+	got, ok := c.Get(ctx, "k")
+	if !ok || readBody(t, got) != "streamed body" {
+		t.Fatalf("Get after Commit = %v, %v", got, ok)
+	}
+
+	w = NewWriter(ctx, c, "aborted", makeResponse(200, "", time.Minute), 0)
+	_ = writeAll(t, w, "partial")
+	w.Abort()
+
+	w = NewWriter(ctx, c, "big", makeResponse(200, "", time.Minute), 4)
+	if err := writeAll(t, w, "too large"); err != ErrTooLarge {
+		t.Fatalf("expected ErrTooLarge, got %v", err)
+	}
+	w.Commit()
+
+	if c.Len() != 1 {
+		t.Errorf("Len() = %d, want only the committed entry", c.Len())
+	}
+	if n := countFiles(t, filepath.Join(dir, "tmp")); n != 0 {
+		t.Errorf("%d temporary files left behind", n)
+	}
+	if n := countFiles(t, filepath.Join(dir, "objects")); n != 1 {
+		t.Errorf("%d object files, want 1", n)
+	}
+}
+
+func TestTieredCache_SetStream(t *testing.T) {
+	ctx := context.Background()
+	disk := newTestDiskCache(t, DiskOptions{Dir: t.TempDir()})
+	front := NewInMemoryCache(10)
+	c := NewTieredCache(front, disk, 8)
+
+	front.Set(ctx, "large", makeResponse(200, "old", time.Minute))
+
+	for key, body := range map[string]string{"small": "tiny", "large": strings.Repeat("x", 64)} {
+		w := NewWriter(ctx, c, key, makeResponse(200, "", time.Minute), 0)
+		if err := writeAll(t, w, body[:len(body)/2], body[len(body)/2:]); err != nil {
+			t.Fatalf("Write: %v", err)
+		}
+		w.Commit()
+	}
+
+	if got, ok := front.Get(ctx, "small"); !ok || string(got.Body) != "tiny" {
+		t.Errorf("small body not in the front tier: %v, %v", got, ok)
+	}
+	if _, ok := front.Get(ctx, "large"); ok {
+		t.Error("large body kept in the front tier")
+	}
+	if got, ok := c.Get(ctx, "large"); !ok || readBody(t, got) != strings.Repeat("x", 64) {
+		t.Error("large body not served from the back tier")
+	}
+}
@@ -0,0 +1,196 @@
+// Package clientip resolves the address of the client behind a request,
+// looking through the proxies in front of warpgate only as far as they are
+// trusted.
+package clientip
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Header names the request header listing the hops a request went through.
+const (
+	HeaderXForwardedFor = "X-Forwarded-For"
+	HeaderForwarded     = "Forwarded"
+)
+
+// Options configures a Resolver.
+type Options struct {
+	// TrustedProxies lists the CIDR ranges or addresses of the proxies
+	// whose forwarding headers are believed.
+	TrustedProxies []string
+	// Header is the header the trusted proxies append to:
+	// "X-Forwarded-For" (default) or "Forwarded" (RFC 7239). The other one
+	// is ignored, since any client could have set it.
+	Header string
+}
+
+// Resolver determines the client address of requests.
+//
+// The peer of the connection is the client unless it is a trusted proxy.
+// Then the forwarding header is walked from right to left, each hop having
+// been appended by the one after it, and the first hop that is not a trusted
+// proxy is the client. Hops to the left of it may have been forged by the
+// client and are never looked at.
+//
+// A nil Resolver trusts no proxy.
+type Resolver struct {
+	trusted []netip.Prefix
+	header  string
+}
+
+func NewResolver(opts Options) (*Resolver, error) {
+	r := &Resolver{header: HeaderXForwardedFor}
+	switch {
+	case opts.Header == "", strings.EqualFold(opts.Header, HeaderXForwardedFor):
+	case strings.EqualFold(opts.Header, HeaderForwarded):
+		r.header = HeaderForwarded
+	default:
+		return nil, fmt.Errorf("unsupported client IP header %q", opts.Header)
+	}
+
+	for _, s := range opts.TrustedProxies {
+		p, err := parsePrefix(strings.TrimSpace(s))
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q: %w", s, err)
+		}
+		r.trusted = append(r.trusted, p)
+	}
+	return r, nil
+}
+
+func parsePrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return netip.PrefixFrom(p.Addr().Unmap(), p.Bits()).Masked(), nil
+	}
+	a, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	a = a.Unmap()
+	return netip.PrefixFrom(a, a.BitLen()), nil
+}
+
+// Trusted reports whether addr is a trusted proxy.
+func (r *Resolver) Trusted(addr netip.Addr) bool {
+	if r == nil || !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range r.trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the client address of req, or the zero Addr if even the
+// peer address cannot be parsed.
+func (r *Resolver) Resolve(req *http.Request) netip.Addr {
+	client := Peer(req)
+	if !r.Trusted(client) {
+		return client
+	}
+
+	var hops []string
+	if r.header == HeaderForwarded {
+		hops = forwardedFor(req.Header.Values(HeaderForwarded))
+	} else {
+		hops = splitList(req.Header.Values(HeaderXForwardedFor))
+	}
+
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// An unknown or obfuscated hop hides everything before it.
+			break
+		}
+		client = addr
+		if !r.Trusted(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// Middleware stores the client address of each request in its context, for
+// FromRequest to return to the handlers after it.
+func (r *Resolver) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if addr := r.Resolve(req); addr.IsValid() {
+			req = req.WithContext(NewContext(req.Context(), addr))
+		}
+		next.ServeHTTP(w, req)
+	})
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying the client address addr.
+func NewContext(ctx context.Context, addr netip.Addr) context.Context {
+	return context.WithValue(ctx, contextKey{}, addr)
+}
+
+// FromContext returns the client address stored in ctx, if any.
+func FromContext(ctx context.Context) (netip.Addr, bool) {
+	addr, ok := ctx.Value(contextKey{}).(netip.Addr)
+	return addr, ok
+}
+
+// FromRequest returns the client address resolved for req, falling back to
+// the peer address for requests that did not go through a Resolver.
+func FromRequest(req *http.Request) netip.Addr {
+	if addr, ok := FromContext(req.Context()); ok {
+		return addr
+	}
+	return Peer(req)
+}
+
+// Peer returns the address of the connection req arrived on.
+func Peer(req *http.Request) netip.Addr {
+	raw := req.RemoteAddr
+	if _, rest, ok := strings.Cut(raw, "://"); ok {
+		raw = rest
+	}
+	if ap, err := netip.ParseAddrPort(raw); err == nil {
+		return ap.Addr().Unmap()
+	}
+	if a, err := netip.ParseAddr(strings.Trim(raw, "[]")); err == nil {
+		return a.Unmap()
+	}
+	return netip.Addr{}
+}
+
+// parseHop parses an address as found in X-Forwarded-For, with or without a
+// port.
+func parseHop(s string) (netip.Addr, bool) {
+	if a, err := netip.ParseAddr(s); err == nil {
+		return a.Unmap(), true
+	}
+	if ap, err := netip.ParseAddrPort(s); err == nil {
+		return ap.Addr().Unmap(), true
+	}
+	if a, err := netip.ParseAddr(strings.Trim(s, "[]")); err == nil {
+		return a.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// splitList splits comma-separated header values into trimmed elements.
+func splitList(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, e := range strings.Split(v, ",") {
+			out = append(out, strings.TrimSpace(e))
+		}
+	}
+	return out
+}
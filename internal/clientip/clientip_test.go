@@ -0,0 +1,141 @@
+package clientip
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+)
+
+func TestResolver_Resolve(t *testing.T) {
+	r, err := NewResolver(Options{TrustedProxies: []string{"10.0.0.0/8", "192.0.2.1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		remote string
+		xff    []string
+		want   string
+	}{
+		{"untrusted peer ignores header", "203.0.113.9:1000", []string{"1.1.1.1"}, "203.0.113.9"},
+		{"trusted peer without header", "10.0.0.1:1000", nil, "10.0.0.1"},
+		{"first untrusted hop from the right", "10.0.0.1:1000", []string{"6.6.6.6, 198.51.100.4, 10.1.1.1"}, "198.51.100.4"},
+		{"single addresses are trusted", "192.0.2.1:1000", []string{"198.51.100.4"}, "198.51.100.4"},
+		{"multiple header lines", "10.0.0.1:1000", []string{"6.6.6.6", "198.51.100.4"}, "198.51.100.4"},
+		{"all hops trusted", "10.0.0.1:1000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"garbage stops the walk", "10.0.0.1:1000", []string{"198.51.100.4, nonsense, 10.0.0.2"}, "10.0.0.2"},
+		{"hop with port", "10.0.0.1:1000", []string{"198.51.100.4:5555"}, "198.51.100.4"},
+		{"mapped peer", "[::ffff:10.0.0.1]:1000", []string{"198.51.100.4"}, "198.51.100.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				req.Header.Add("X-Forwarded-For", v)
+			}
+			if got := r.Resolve(req); got.String() != tt.want {
+				t.Errorf("Resolve = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolver_Forwarded(t *testing.T) {
+	r, err := NewResolver(Options{TrustedProxies: []string{"10.0.0.0/8"}, Header: "forwarded"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		forwarded string
+		want      string
+	}{
+		{"token", "for=198.51.100.4;proto=https", "198.51.100.4"},
+		{"quoted ipv6 with port", `for="[2001:db8:cafe::17]:4711", for=10.0.0.2`, "2001:db8:cafe::17"},
+		{"quoted ipv4 with port", `for="198.51.100.4:80";by=10.0.0.2`, "198.51.100.4"},
+		{"rightmost untrusted", "for=6.6.6.6, for=198.51.100.4", "198.51.100.4"},
+		{"obfuscated hop", "for=6.6.6.6, for=_hidden, for=10.0.0.2", "10.0.0.2"},
+		{"element without for", "for=6.6.6.6, proto=http", "10.0.0.1"},
+		{"quoted separators", `for=198.51.100.4;ext="a,b;c", for=10.0.0.2`, "198.51.100.4"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "10.0.0.1:1000"
+			req.Header.Set("Forwarded", tt.forwarded)
+			req.Header.Set("X-Forwarded-For", "7.7.7.7")
+			if got := r.Resolve(req); got.String() != tt.want {
+				t.Errorf("Resolve = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewResolver_RejectsInvalidOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{TrustedProxies: []string{"10.0.0.0/33"}},
+		{TrustedProxies: []string{"proxy.internal"}},
+		{Header: "X-Real-IP"},
+	} {
+		if _, err := NewResolver(opts); err == nil {
+			t.Errorf("NewResolver(%+v) succeeded, want error", opts)
+		}
+	}
+}
+
+func TestResolver_Nil(t *testing.T) {
+	var r *Resolver
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.4")
+	if got := r.Resolve(req); got.String() != "10.0.0.1" {
+		t.Errorf("Resolve = %s, want the peer", got)
+	}
+}
+
+func TestMiddleware_StoresClientInContext(t *testing.T) {
+	r, err := NewResolver(Options{TrustedProxies: []string{"10.0.0.0/8"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got netip.Addr
+	h := r.Middleware(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		got = FromRequest(req)
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "10.0.0.1:1000"
+	req.Header.Set("X-Forwarded-For", "198.51.100.4")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got.String() != "198.51.100.4" {
+		t.Errorf("FromRequest = %s, want 198.51.100.4", got)
+	}
+}
+
+func TestPeer(t *testing.T) {
+	for remote, want := range map[string]string{
+		"192.0.2.1:80":         "192.0.2.1",
+		"192.0.2.1":            "192.0.2.1",
+		"tcp://192.0.2.1:8080": "192.0.2.1",
+		"[2001:db8::1]:443":    "2001:db8::1",
+		"2001:db8::1":          "2001:db8::1",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		if got := Peer(req); got.String() != want {
+			t.Errorf("Peer(%q) = %s, want %s", remote, got, want)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "@"
+	if got := Peer(req); got.IsValid() {
+		t.Errorf("Peer(%q) = %s, want invalid", req.RemoteAddr, got)
+	}
+}
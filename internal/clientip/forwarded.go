@@ -0,0 +1,61 @@
+package clientip
+
+import "strings"
+
+// forwardedFor returns the for= parameter of each element of Forwarded
+// header values (RFC 7239), in order. Elements without one yield "".
+func forwardedFor(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, elem := range splitQuoted(v, ',') {
+			var hop string
+			for _, pair := range splitQuoted(elem, ';') {
+				name, value, ok := strings.Cut(pair, "=")
+				if ok && strings.EqualFold(strings.TrimSpace(name), "for") {
+					hop = unquote(strings.TrimSpace(value))
+					break
+				}
+			}
+			out = append(out, hop)
+		}
+	}
+	return out
+}
+
+// splitQuoted splits s at each sep outside a quoted string.
+func splitQuoted(s string, sep byte) []string {
+	var out []string
+	quoted, escaped := false, false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case !quoted && c == sep:
+			out = append(out, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(out, strings.TrimSpace(s[start:]))
+}
+
+// unquote returns the content of a quoted string, or s if it is a token.
+func unquote(s string) string {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return s
+	}
+	var b strings.Builder
+	s = s[1 : len(s)-1]
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
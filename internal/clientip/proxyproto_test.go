@@ -0,0 +1,128 @@
+package clientip
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveProxy serves the remote address of each request on a PROXY protocol
+// listener trusting the given proxies.
+func serveProxy(t *testing.T, trusted ...string) string {
+	t.Helper()
+	r, err := NewResolver(Options{TrustedProxies: trusted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(w, req.RemoteAddr)
+	})}
+	go func() { _ = srv.Serve(NewProxyListener(ln, r, time.Second)) }()
+	t.Cleanup(func() { _ = srv.Close() })
+	return ln.Addr().String()
+}
+
+// roundTrip sends header followed by a request and returns the response
+// body, or an error if the request was refused.
+func roundTrip(t *testing.T, addr string, header []byte) (string, error) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	_, _ = c.Write(header)
+	_, _ = io.WriteString(c, "GET / HTTP/1.1\r\nHost: example.com\r\nConnection: close\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(c), nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func v2Header(cmd byte, src net.IP, port uint16) []byte {
+	b := append([]byte(nil), v2Signature...)
+	b = append(b, 0x20|cmd, 0x11)
+	block := make([]byte, 12)
+	copy(block, src.To4())
+	copy(block[4:], net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(block[8:], port)
+	binary.BigEndian.PutUint16(block[10:], 443)
+	// A trailing TLV, which is skipped.
+	block = append(block, 0x04, 0x00, 0x01, 0xff)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(block)))
+	return append(b, block...)
+}
+
+func TestProxyListener_V1(t *testing.T) {
+	addr := serveProxy(t, "127.0.0.1")
+	got, err := roundTrip(t, addr, []byte("PROXY TCP4 198.51.100.4 127.0.0.1 56324 443\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "198.51.100.4:56324" {
+		t.Errorf("RemoteAddr = %q, want 198.51.100.4:56324", got)
+	}
+}
+
+func TestProxyListener_V2(t *testing.T) {
+	addr := serveProxy(t, "127.0.0.0/8")
+	got, err := roundTrip(t, addr, v2Header(1, net.IPv4(198, 51, 100, 4), 4000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != "198.51.100.4:4000" {
+		t.Errorf("RemoteAddr = %q, want 198.51.100.4:4000", got)
+	}
+
+	// LOCAL connections keep the address of the proxy.
+	got, err = roundTrip(t, addr, v2Header(0, net.IPv4(198, 51, 100, 4), 4000))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("RemoteAddr = %q, want the proxy's", got)
+	}
+}
+
+func TestProxyListener_RequiresHeaderFromTrustedPeers(t *testing.T) {
+	addr := serveProxy(t, "127.0.0.1")
+	if got, err := roundTrip(t, addr, nil); err == nil {
+		t.Errorf("request without header served with RemoteAddr %q", got)
+	}
+}
+
+func TestProxyListener_IgnoresUntrustedPeers(t *testing.T) {
+	addr := serveProxy(t, "192.0.2.0/24")
+
+	got, err := roundTrip(t, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(got, "127.0.0.1:") {
+		t.Errorf("RemoteAddr = %q, want the peer's", got)
+	}
+
+	// A header from an untrusted peer is not interpreted, so the request
+	// line is garbage.
+	if got, err := roundTrip(t, addr, []byte("PROXY TCP4 198.51.100.4 127.0.0.1 56324 443\r\n")); err == nil {
+		t.Errorf("request after untrusted header served with RemoteAddr %q", got)
+	}
+}
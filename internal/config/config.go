@@ -1,8 +1,10 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v3"
@@ -13,6 +15,9 @@ type ListenerConfig struct {
 	Address    string    `yaml:"address"`
 	TLS        TLSConfig `yaml:"tls"`
 	RedirectTo string    `yaml:"redirectTo,omitempty"`
+	// ProxyProtocol expects a PROXY protocol header on connections from
+	// trusted proxies.
+	ProxyProtocol bool `yaml:"proxyProtocol,omitempty"`
 }
 
 type Config struct {
@@ -21,12 +26,95 @@ type Config struct {
 	Clusters  []ClusterConfig  `yaml:"clusters"`
 	Routes    []RouteConfig    `yaml:"routes"`
 	Listeners []ListenerConfig `yaml:"listeners,omitempty"`
+	Admin     AdminConfig      `yaml:"admin,omitempty"`
+	RateLimit *RateLimitConfig `yaml:"rateLimit,omitempty"`
+
+	RateLimitStore *RateLimitStoreConfig `yaml:"rateLimitStore,omitempty"`
+
+	JWTProviders []JWTProviderConfig `yaml:"jwtProviders,omitempty"`
+
+	// Compression applies to routes without their own.
+	Compression *CompressionConfig `yaml:"compression,omitempty"`
+
+	// Tracing exports OpenTelemetry traces of requests; nil disables it.
+	Tracing *TracingConfig `yaml:"tracing,omitempty"`
+}
+
+// TracingConfig exports spans to an OTLP collector over HTTP or gRPC.
+// Sampler names follow OTEL_TRACES_SAMPLER: always_on, always_off,
+// traceidratio and their parentbased_ forms.
+type TracingConfig struct {
+	ServiceName string            `yaml:"serviceName,omitempty"`
+	Exporter    string            `yaml:"exporter,omitempty"`
+	Endpoint    string            `yaml:"endpoint,omitempty"`
+	Headers     map[string]string `yaml:"headers,omitempty"`
+	Timeout     time.Duration     `yaml:"timeout,omitempty"`
+	Sampler     string            `yaml:"sampler,omitempty"`
+	SampleRatio *float64          `yaml:"sampleRatio,omitempty"`
+	Propagators []string          `yaml:"propagators,omitempty"`
+}
+
+// CompressionConfig compresses responses of Types (default text and
+// structured formats) that are at least MinSize bytes, with the first of
+// Encodings the client accepts.
+type CompressionConfig struct {
+	Enabled   *bool    `yaml:"enabled,omitempty"`
+	Encodings []string `yaml:"encodings,omitempty"`
+	Types     []string `yaml:"types,omitempty"`
+	MinSize   int64    `yaml:"minSize,omitempty"`
+}
+
+// JWTProviderConfig describes an issuer of JWTs. Its keys come from a JWKS,
+// fetched from JWKSURL or read from JWKSFile, or for HS256 from a shared
+// secret.
+type JWTProviderConfig struct {
+	Name       string        `yaml:"name"`
+	Issuer     string        `yaml:"issuer,omitempty"`
+	Audience   []string      `yaml:"audience,omitempty"`
+	JWKSURL    string        `yaml:"jwksURL,omitempty"`
+	JWKSFile   string        `yaml:"jwksFile,omitempty"`
+	Secret     string        `yaml:"secret,omitempty"`
+	SecretFile string        `yaml:"secretFile,omitempty"`
+	Algorithms []string      `yaml:"algorithms,omitempty"`
+	ClockSkew  time.Duration `yaml:"clockSkew,omitempty"`
+	// Refresh is how often the JWKS is fetched again.
+	Refresh time.Duration `yaml:"refresh,omitempty"`
+}
+
+type AdminConfig struct {
+	Address string `yaml:"address,omitempty"`
 }
 
 type ServerConfig struct {
 	Address      string    `yaml:"address"`
 	TLS          TLSConfig `yaml:"tls"`
 	IPBlockCIDRS []string  `yaml:"ipBlockCIDRS,omitempty"`
+	// IPRules applies to every request; IPBlockCIDRS is added to its deny
+	// list.
+	IPRules *IPRulesConfig `yaml:"ipRules,omitempty"`
+	// IPListReload is how often IP list files are checked for changes.
+	IPListReload time.Duration `yaml:"ipListReload,omitempty"`
+	// CredentialsReload is how often htpasswd and API key files are checked
+	// for changes.
+	CredentialsReload time.Duration `yaml:"credentialsReload,omitempty"`
+
+	// TrustedProxies lists the CIDR ranges of the proxies in front of
+	// warpgate, whose forwarding headers are believed.
+	TrustedProxies []string `yaml:"trustedProxies,omitempty"`
+	// ClientIPHeader is the header the trusted proxies append the client to:
+	// X-Forwarded-For (default) or Forwarded.
+	ClientIPHeader string `yaml:"clientIPHeader,omitempty"`
+	// ProxyProtocol expects a PROXY protocol header on connections from
+	// trusted proxies to the default listener.
+	ProxyProtocol        bool          `yaml:"proxyProtocol,omitempty"`
+	ProxyProtocolTimeout time.Duration `yaml:"proxyProtocolTimeout,omitempty"`
+
+	// RequestIDHeader carries the ID of each request, generated when the
+	// client sends none (default X-Request-Id).
+	RequestIDHeader string `yaml:"requestIdHeader,omitempty"`
+	// RequestIDFormat is the format of generated request IDs: uuidv7
+	// (default) or ulid.
+	RequestIDFormat string `yaml:"requestIdFormat,omitempty"`
 }
 
 type TLSConfig struct {
@@ -36,9 +124,44 @@ type TLSConfig struct {
 }
 
 type CacheConfig struct {
-	MaxEntries   int           `yaml:"maxEntries"`
-	DefaultTTL   time.Duration `yaml:"defaultTTL"`
-	MaxBodyBytes int64         `yaml:"maxBodyBytes"`
+	MaxEntries      int                      `yaml:"maxEntries"`
+	MaxBytes        int64                    `yaml:"maxBytes"`
+	Eviction        string                   `yaml:"eviction,omitempty"`
+	Shards          int                      `yaml:"shards"`
+	DefaultTTL      time.Duration            `yaml:"defaultTTL"`
+	StatusTTL       map[string]time.Duration `yaml:"statusTTL,omitempty"`
+	CacheErrors     bool                     `yaml:"cacheErrors"`
+	MaxBodyBytes    int64                    `yaml:"maxBodyBytes"`
+	Coalesce        bool                     `yaml:"coalesce"`
+	CoalesceTimeout *time.Duration           `yaml:"coalesceTimeout,omitempty"`
+	KeepStale       *time.Duration           `yaml:"keepStale,omitempty"`
+	TagHeaders      []string                 `yaml:"tagHeaders,omitempty"`
+	StatusHeader    bool                     `yaml:"statusHeader"`
+	StatusName      string                   `yaml:"statusName,omitempty"`
+	Disk            *DiskCacheConfig         `yaml:"disk,omitempty"`
+	Redis           *RedisCacheConfig        `yaml:"redis,omitempty"`
+}
+
+// DiskCacheConfig enables a persistent cache tier on local disk behind the
+// in-memory cache.
+type DiskCacheConfig struct {
+	Path               string `yaml:"path"`
+	MaxBytes           int64  `yaml:"maxBytes"`
+	MaxEntries         int    `yaml:"maxEntries"`
+	Eviction           string `yaml:"eviction,omitempty"`
+	MemoryMaxBodyBytes int64  `yaml:"memoryMaxBodyBytes"`
+}
+
+// RedisCacheConfig replaces the in-memory cache with a cache shared between
+// instances on a Redis-compatible server.
+type RedisCacheConfig struct {
+	Address        string                `yaml:"address"`
+	Password       string                `yaml:"password,omitempty"`
+	DB             int                   `yaml:"db"`
+	Prefix         string                `yaml:"prefix"`
+	PoolSize       int                   `yaml:"poolSize"`
+	Timeout        time.Duration         `yaml:"timeout"`
+	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker,omitempty"`
 }
 
 type ClusterConfig struct {
@@ -46,6 +169,7 @@ type ClusterConfig struct {
 	Endpoints      []string              `yaml:"endpoints"`
 	HealthCheck    *HealthCheckConfig    `yaml:"healthCheck,omitempty"`
 	CircuitBreaker *CircuitBreakerConfig `yaml:"circuitBreaker,omitempty"`
+	Headers        *HeaderRulesConfig    `yaml:"headers,omitempty"`
 }
 
 type HealthCheckConfig struct {
@@ -66,11 +190,153 @@ type RouteConfig struct {
 	PathPrefix string            `yaml:"pathPrefix"`
 	Cluster    string            `yaml:"cluster"`
 	Cache      *RouteCacheConfig `yaml:"cache,omitempty"`
+	RateLimit  *RateLimitConfig  `yaml:"rateLimit,omitempty"`
+	IPRules    *IPRulesConfig    `yaml:"ipRules,omitempty"`
+	JWT        *RouteJWTConfig   `yaml:"jwt,omitempty"`
+	ExtAuth    *ExtAuthConfig    `yaml:"extAuth,omitempty"`
+	BasicAuth  *BasicAuthConfig  `yaml:"basicAuth,omitempty"`
+	APIKey     *APIKeyConfig     `yaml:"apiKey,omitempty"`
+	CORS       *CORSConfig       `yaml:"cors,omitempty"`
+
+	// Compression replaces the top-level compression for the route.
+	Compression *CompressionConfig `yaml:"compression,omitempty"`
+	// Headers edits the route's requests and responses, after the rules of
+	// its cluster.
+	Headers *HeaderRulesConfig `yaml:"headers,omitempty"`
+}
+
+// HeaderRulesConfig edits the headers of requests sent upstream and of
+// responses sent to clients.
+type HeaderRulesConfig struct {
+	Request  HeaderOpsConfig `yaml:"request,omitempty"`
+	Response HeaderOpsConfig `yaml:"response,omitempty"`
+}
+
+// HeaderOpsConfig lists header edits, applied in the order Remove, Rename,
+// Set, Add. Values of Set and Add may reference variables such as
+// ${client_ip}, ${route}, ${request_id} or ${param.<name>}.
+type HeaderOpsConfig struct {
+	Remove []string          `yaml:"remove,omitempty"`
+	Rename map[string]string `yaml:"rename,omitempty"`
+	Set    map[string]string `yaml:"set,omitempty"`
+	Add    map[string]string `yaml:"add,omitempty"`
+}
+
+// CORSConfig is the cross-origin policy of a route. AllowOrigins entries
+// are "*", exact origins, patterns such as "https://*.example.com", or
+// "regex:<expression>". Preflight requests are answered by warpgate.
+type CORSConfig struct {
+	AllowOrigins     []string      `yaml:"allowOrigins"`
+	AllowMethods     []string      `yaml:"allowMethods,omitempty"`
+	AllowHeaders     []string      `yaml:"allowHeaders,omitempty"`
+	ExposeHeaders    []string      `yaml:"exposeHeaders,omitempty"`
+	AllowCredentials bool          `yaml:"allowCredentials,omitempty"`
+	MaxAge           time.Duration `yaml:"maxAge,omitempty"`
+}
+
+// BasicAuthConfig requires HTTP Basic credentials of a user in
+// HtpasswdFile, hashed with bcrypt or argon2, and one of Users if set.
+type BasicAuthConfig struct {
+	HtpasswdFile string   `yaml:"htpasswdFile"`
+	Realm        string   `yaml:"realm,omitempty"`
+	Users        []string `yaml:"users,omitempty"`
+}
+
+// APIKeyConfig requires an API key listed in File, sent in Header or, if
+// set, in the Query parameter. The key must grant all Scopes.
+type APIKeyConfig struct {
+	File   string   `yaml:"file"`
+	Header string   `yaml:"header,omitempty"`
+	Query  string   `yaml:"query,omitempty"`
+	Scopes []string `yaml:"scopes,omitempty"`
+}
+
+// ExtAuthConfig asks the auth service behind Cluster whether to admit each
+// request, by sending it the method, PathPrefix followed by the request URI,
+// and RequestHeaders. On a 2xx answer UpstreamHeaders are copied from it to
+// the upstream request; any other answer is returned to the client.
+// Decisions are reused for CacheTTL.
+type ExtAuthConfig struct {
+	Cluster         string        `yaml:"cluster"`
+	PathPrefix      string        `yaml:"pathPrefix,omitempty"`
+	RequestHeaders  []string      `yaml:"requestHeaders,omitempty"`
+	UpstreamHeaders []string      `yaml:"upstreamHeaders,omitempty"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	CacheTTL        time.Duration `yaml:"cacheTTL,omitempty"`
+	CacheSize       int           `yaml:"cacheSize,omitempty"`
+}
+
+// RouteJWTConfig requires requests to carry a token from Provider, which
+// may be omitted if there is only one. The token must have one of the
+// listed values for each of Claims and grant all Scopes. ForwardClaims maps
+// claim names to upstream request headers.
+type RouteJWTConfig struct {
+	Provider      string              `yaml:"provider,omitempty"`
+	Claims        map[string][]string `yaml:"claims,omitempty"`
+	Scopes        []string            `yaml:"scopes,omitempty"`
+	ForwardClaims map[string]string   `yaml:"forwardClaims,omitempty"`
+}
+
+// IPRulesConfig admits only clients within Allow, if set, and rejects those
+// within Deny. Entries are CIDR ranges or addresses; the files list more of
+// them, one per line, and are reloaded when they change.
+type IPRulesConfig struct {
+	Allow      []string `yaml:"allow,omitempty"`
+	AllowFiles []string `yaml:"allowFiles,omitempty"`
+	Deny       []string `yaml:"deny,omitempty"`
+	DenyFiles  []string `yaml:"denyFiles,omitempty"`
+}
+
+// RateLimitConfig allows each client Requests per Period on average, with
+// bursts of up to Burst requests. Key selects how clients are told apart:
+// "ip", "identity", "header:<name>" or "claim:<name>". Backend is "local"
+// to enforce the limit per process or "redis" to share it through
+// RateLimitStore. Tiers override the limit for clients authenticated with an
+// API key of that tier.
+type RateLimitConfig struct {
+	Requests int                            `yaml:"requests"`
+	Period   time.Duration                  `yaml:"period"`
+	Burst    int                            `yaml:"burst,omitempty"`
+	Key      string                         `yaml:"key,omitempty"`
+	MaxKeys  int                            `yaml:"maxKeys,omitempty"`
+	Backend  string                         `yaml:"backend,omitempty"`
+	Tiers    map[string]RateLimitTierConfig `yaml:"tiers,omitempty"`
+}
+
+type RateLimitTierConfig struct {
+	Requests int           `yaml:"requests"`
+	Period   time.Duration `yaml:"period"`
+	Burst    int           `yaml:"burst,omitempty"`
+}
+
+// RateLimitStoreConfig is the Redis-compatible server shared rate limits
+// are kept on.
+type RateLimitStoreConfig struct {
+	Address  string        `yaml:"address"`
+	Password string        `yaml:"password,omitempty"`
+	DB       int           `yaml:"db"`
+	Prefix   string        `yaml:"prefix"`
+	PoolSize int           `yaml:"poolSize"`
+	Timeout  time.Duration `yaml:"timeout"`
+	Cooldown time.Duration `yaml:"cooldown"`
 }
 
 type RouteCacheConfig struct {
-	Enabled *bool          `yaml:"enabled,omitempty"`
-	TTL     *time.Duration `yaml:"ttl,omitempty"`
+	Enabled     *bool                    `yaml:"enabled,omitempty"`
+	TTL         *time.Duration           `yaml:"ttl,omitempty"`
+	StatusTTL   map[string]time.Duration `yaml:"statusTTL,omitempty"`
+	CacheErrors *bool                    `yaml:"cacheErrors,omitempty"`
+	Key         *CacheKeyConfig          `yaml:"key,omitempty"`
+}
+
+type CacheKeyConfig struct {
+	Headers           []string `yaml:"headers,omitempty"`
+	Cookies           []string `yaml:"cookies,omitempty"`
+	QueryParams       []string `yaml:"queryParams,omitempty"`
+	IgnoreQueryParams []string `yaml:"ignoreQueryParams,omitempty"`
+	IgnoreQuery       bool     `yaml:"ignoreQuery,omitempty"`
+	SortQuery         bool     `yaml:"sortQuery,omitempty"`
+	IgnoreCase        bool     `yaml:"ignoreCase,omitempty"`
 }
 
 func Load(path string) (*Config, error) {
@@ -88,14 +354,137 @@ func Load(path string) (*Config, error) {
 		cfg.Server.Address = ":8080"
 	}
 
+	if cfg.Server.ClientIPHeader == "" {
+		cfg.Server.ClientIPHeader = "X-Forwarded-For"
+	}
+
+	if cfg.Server.RequestIDHeader == "" {
+		cfg.Server.RequestIDHeader = "X-Request-Id"
+	}
+
+	if cfg.Server.IPListReload <= 0 {
+		cfg.Server.IPListReload = 10 * time.Second
+	}
+
+	if cfg.Server.CredentialsReload <= 0 {
+		cfg.Server.CredentialsReload = 10 * time.Second
+	}
+
+	if cfg.Server.ProxyProtocolTimeout <= 0 {
+		cfg.Server.ProxyProtocolTimeout = 5 * time.Second
+	}
+
 	if cfg.Cache.MaxEntries <= 0 {
 		cfg.Cache.MaxEntries = 1000
 	}
 
+	if cfg.Cache.MaxBytes <= 0 {
+		cfg.Cache.MaxBytes = 256 << 20 // 256 MiB
+	}
+
+	if cfg.Cache.Shards <= 0 {
+		cfg.Cache.Shards = 16
+	}
+
 	if cfg.Cache.MaxBodyBytes <= 0 {
 		cfg.Cache.MaxBodyBytes = 1 << 20 // 1 MiB
 	}
 
+	if cfg.Cache.CoalesceTimeout == nil {
+		d := 5 * time.Second
+		cfg.Cache.CoalesceTimeout = &d
+	}
+
+	if cfg.Cache.KeepStale == nil {
+		d := 10 * time.Minute
+		cfg.Cache.KeepStale = &d
+	}
+
+	if len(cfg.Cache.TagHeaders) == 0 {
+		cfg.Cache.TagHeaders = []string{"Surrogate-Key", "Cache-Tag"}
+	}
+
+	if cfg.Cache.StatusName == "" {
+		cfg.Cache.StatusName = "warpgate"
+	}
+
+	if r := cfg.Cache.Redis; r != nil {
+		if r.Prefix == "" {
+			r.Prefix = "warpgate:"
+		}
+		if r.PoolSize <= 0 {
+			r.PoolSize = 16
+		}
+		if r.Timeout <= 0 {
+			r.Timeout = 500 * time.Millisecond
+		}
+		if r.CircuitBreaker == nil {
+			r.CircuitBreaker = &CircuitBreakerConfig{}
+		}
+		if r.CircuitBreaker.ConsecutiveFailures <= 0 {
+			r.CircuitBreaker.ConsecutiveFailures = 5
+		}
+		if r.CircuitBreaker.Cooldown <= 0 {
+			r.CircuitBreaker.Cooldown = 10 * time.Second
+		}
+	}
+
+	if disk := cfg.Cache.Disk; disk != nil {
+		if disk.MaxBytes <= 0 {
+			disk.MaxBytes = 10 << 30 // 10 GiB
+		}
+		if disk.MemoryMaxBodyBytes <= 0 {
+			disk.MemoryMaxBodyBytes = 64 << 10 // 64 KiB
+		}
+	}
+
+	if st := cfg.RateLimitStore; st != nil {
+		if st.Prefix == "" {
+			st.Prefix = "warpgate:ratelimit:"
+		}
+		if st.PoolSize <= 0 {
+			st.PoolSize = 16
+		}
+		if st.Timeout <= 0 {
+			st.Timeout = 100 * time.Millisecond
+		}
+		if st.Cooldown <= 0 {
+			st.Cooldown = 5 * time.Second
+		}
+	}
+
+	for i := range cfg.JWTProviders {
+		p := &cfg.JWTProviders[i]
+		if p.ClockSkew <= 0 {
+			p.ClockSkew = 30 * time.Second
+		}
+		if p.Refresh <= 0 {
+			p.Refresh = 10 * time.Minute
+		}
+	}
+
+	setCompressionDefaults(cfg.Compression)
+	setTracingDefaults(cfg.Tracing)
+	setRateLimitDefaults(cfg.RateLimit)
+	for i := range cfg.Routes {
+		setCompressionDefaults(cfg.Routes[i].Compression)
+		setRateLimitDefaults(cfg.Routes[i].RateLimit)
+		if ea := cfg.Routes[i].ExtAuth; ea != nil {
+			if len(ea.RequestHeaders) == 0 {
+				ea.RequestHeaders = []string{"Authorization", "Cookie"}
+			}
+			if ea.Timeout <= 0 {
+				ea.Timeout = 5 * time.Second
+			}
+			if ea.CacheSize <= 0 {
+				ea.CacheSize = 10000
+			}
+		}
+		if ak := cfg.Routes[i].APIKey; ak != nil && ak.Header == "" {
+			ak.Header = "X-API-Key"
+		}
+	}
+
 	for i := range cfg.Clusters {
 		hc := cfg.Clusters[i].HealthCheck
 		if hc != nil {
@@ -124,9 +513,81 @@ func Load(path string) (*Config, error) {
 		}
 	}
 
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
 	return &cfg, nil
 }
 
+// validate rejects settings that cannot take effect.
+func (cfg *Config) validate() error {
+	if rl := cfg.RateLimit; rl != nil {
+		// The global limit runs before any route authenticates the request.
+		switch kind, _, _ := strings.Cut(rl.Key, ":"); strings.ToLower(strings.TrimSpace(kind)) {
+		case "claim":
+			return fmt.Errorf("rateLimit: key %q needs a route's jwt authentication; set it on a route", rl.Key)
+		case "identity":
+			return fmt.Errorf("rateLimit: key %q needs a route's authentication; set it on a route", rl.Key)
+		}
+		if len(rl.Tiers) > 0 {
+			return errors.New("rateLimit: tiers need a route's apiKey authentication; set them on a route")
+		}
+	}
+	return nil
+}
+
+func setCompressionDefaults(c *CompressionConfig) {
+	if c == nil {
+		return
+	}
+	if c.MinSize <= 0 {
+		c.MinSize = 1024
+	}
+}
+
+func setTracingDefaults(t *TracingConfig) {
+	if t == nil {
+		return
+	}
+	if t.ServiceName == "" {
+		t.ServiceName = "warpgate"
+	}
+	if t.SampleRatio == nil {
+		ratio := 1.0
+		t.SampleRatio = &ratio
+	}
+}
+
+func setRateLimitDefaults(rl *RateLimitConfig) {
+	if rl == nil {
+		return
+	}
+	if rl.Period <= 0 {
+		rl.Period = time.Second
+	}
+	if rl.Burst <= 0 {
+		rl.Burst = rl.Requests
+	}
+	if rl.Key == "" {
+		rl.Key = "ip"
+	}
+	if rl.MaxKeys <= 0 {
+		rl.MaxKeys = 100000
+	}
+	if rl.Backend == "" {
+		rl.Backend = "local"
+	}
+	for name, t := range rl.Tiers {
+		if t.Period <= 0 {
+			t.Period = rl.Period
+		}
+		if t.Burst <= 0 {
+			t.Burst = t.Requests
+		}
+		rl.Tiers[name] = t
+	}
+}
+
 func (cfg *Config) RouteCacheEnabled(rc RouteConfig) bool {
 	if rc.Cache != nil && rc.Cache.Enabled != nil {
 		return *rc.Cache.Enabled
@@ -134,9 +595,45 @@ func (cfg *Config) RouteCacheEnabled(rc RouteConfig) bool {
 	return true
 }
 
+// RouteCompression returns the compression of a route, or nil if its
+// responses are not compressed.
+func (cfg *Config) RouteCompression(rc RouteConfig) *CompressionConfig {
+	c := cfg.Compression
+	if rc.Compression != nil {
+		c = rc.Compression
+	}
+	if c == nil || (c.Enabled != nil && !*c.Enabled) {
+		return nil
+	}
+	return c
+}
+
 func (cfg *Config) RouteTTL(rc RouteConfig) time.Duration {
 	if rc.Cache != nil && rc.Cache.TTL != nil {
 		return *rc.Cache.TTL
 	}
 	return cfg.Cache.DefaultTTL
 }
+
+// RouteStatusTTL returns the status TTLs of a route: the global ones, with
+// the route's own entries taking precedence.
+func (cfg *Config) RouteStatusTTL(rc RouteConfig) map[string]time.Duration {
+	if rc.Cache == nil || len(rc.Cache.StatusTTL) == 0 {
+		return cfg.Cache.StatusTTL
+	}
+	merged := make(map[string]time.Duration, len(cfg.Cache.StatusTTL)+len(rc.Cache.StatusTTL))
+	for k, v := range cfg.Cache.StatusTTL {
+		merged[k] = v
+	}
+	for k, v := range rc.Cache.StatusTTL {
+		merged[k] = v
+	}
+	return merged
+}
+
+func (cfg *Config) RouteCacheErrors(rc RouteConfig) bool {
+	if rc.Cache != nil && rc.Cache.CacheErrors != nil {
+		return *rc.Cache.CacheErrors
+	}
+	return cfg.Cache.CacheErrors
+}
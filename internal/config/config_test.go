@@ -0,0 +1,79 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func load(t *testing.T, yaml string) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return Load(path)
+}
+
+func TestLoad_RejectsAuthKeysOnGlobalRateLimit(t *testing.T) {
+	for _, key := range []string{"claim:sub", "identity"} {
+		_, err := load(t, "rateLimit:\n  requests: 10\n  key: "+key+"\n")
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("key %s: err = %v, want a rejection", key, err)
+		}
+	}
+
+	cfg, err := load(t, "routes:\n  - name: api\n    pathPrefix: /\n    cluster: c\n    rateLimit:\n      requests: 10\n      key: claim:sub\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := cfg.Routes[0].RateLimit.Key; got != "claim:sub" {
+		t.Errorf("route key = %q", got)
+	}
+}
+
+func TestLoad_RejectsTiersOnGlobalRateLimit(t *testing.T) {
+	_, err := load(t, "rateLimit:\n  requests: 10\n  tiers:\n    gold:\n      requests: 100\n")
+	if err == nil || !strings.Contains(err.Error(), "tiers") {
+		t.Fatalf("err = %v, want a rejection of tiers", err)
+	}
+}
+
+func TestLoad_CredentialsReload(t *testing.T) {
+	cfg, err := load(t, "server:\n  ipListReload: 1m\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.CredentialsReload != 10*time.Second || cfg.Server.IPListReload != time.Minute {
+		t.Errorf("credentialsReload = %v, ipListReload = %v", cfg.Server.CredentialsReload, cfg.Server.IPListReload)
+	}
+
+	cfg, err = load(t, "server:\n  credentialsReload: 30s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.CredentialsReload != 30*time.Second {
+		t.Errorf("credentialsReload = %v, want 30s", cfg.Server.CredentialsReload)
+	}
+}
+
+func TestLoad_CacheDurations(t *testing.T) {
+	cfg, err := load(t, "cache:\n  coalesce: true\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg.Cache.CoalesceTimeout != 5*time.Second || *cfg.Cache.KeepStale != 10*time.Minute {
+		t.Errorf("defaults: coalesceTimeout = %v, keepStale = %v", *cfg.Cache.CoalesceTimeout, *cfg.Cache.KeepStale)
+	}
+
+	// Zero is kept rather than replaced by the default.
+	cfg, err = load(t, "cache:\n  coalesceTimeout: 0s\n  keepStale: 0s\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *cfg.Cache.CoalesceTimeout != 0 || *cfg.Cache.KeepStale != 0 {
+		t.Errorf("zero: coalesceTimeout = %v, keepStale = %v", *cfg.Cache.CoalesceTimeout, *cfg.Cache.KeepStale)
+	}
+}
@@ -0,0 +1,141 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"warpgate/internal/logging"
+)
+
+// JWKSOptions configures a JWKS. Exactly one of URL and File must be set.
+type JWKSOptions struct {
+	URL  string
+	File string
+	// Refresh is how often the set is fetched again (default 10m).
+	Refresh time.Duration
+	// MinRefresh is the least time between fetches triggered by tokens
+	// signed with an unknown key (default 30s), so that forged key IDs
+	// cannot hammer the issuer.
+	MinRefresh time.Duration
+	// Client fetches URL (default a client with a 10s timeout).
+	Client *http.Client
+	Logger logging.Logger
+}
+
+// JWKS is a KeySource backed by a JWK Set published by the issuer. The set
+// is refreshed periodically and as soon as a token names a key it does not
+// hold, which picks up rotated keys before the old ones are retired.
+type JWKS struct {
+	opts JWKSOptions
+	keys atomic.Pointer[[]Key]
+
+	mu        sync.Mutex
+	lastFetch time.Time
+}
+
+func NewJWKS(opts JWKSOptions) (*JWKS, error) {
+	if (opts.URL == "") == (opts.File == "") {
+		return nil, errors.New("jwks: exactly one of url and file must be set")
+	}
+	if opts.Refresh <= 0 {
+		opts.Refresh = 10 * time.Minute
+	}
+	if opts.MinRefresh <= 0 {
+		opts.MinRefresh = 30 * time.Second
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	s := &JWKS{opts: opts}
+	s.keys.Store(&[]Key{})
+	return s, nil
+}
+
+func (s *JWKS) Keys(ctx context.Context, kid string) ([]Key, error) {
+	if keys := selectKeys(*s.keys.Load(), kid); len(keys) > 0 {
+		return keys, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Another request may have fetched the key while this one waited.
+	if keys := selectKeys(*s.keys.Load(), kid); len(keys) > 0 {
+		return keys, nil
+	}
+	if time.Since(s.lastFetch) < s.opts.MinRefresh {
+		return nil, nil
+	}
+	if err := s.refresh(ctx); err != nil {
+		return nil, err
+	}
+	return selectKeys(*s.keys.Load(), kid), nil
+}
+
+// Refresh fetches the set. On error the keys held are kept.
+func (s *JWKS) Refresh(ctx context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.refresh(ctx)
+}
+
+func (s *JWKS) refresh(ctx context.Context) error {
+	s.lastFetch = time.Now()
+	data, err := s.fetch(ctx)
+	if err != nil {
+		return fmt.Errorf("jwks: %w", err)
+	}
+	keys, err := ParseJWKS(data)
+	if err != nil {
+		return err
+	}
+	s.keys.Store(&keys)
+	return nil
+}
+
+func (s *JWKS) fetch(ctx context.Context) ([]byte, error) {
+	if s.opts.File != "" {
+		return os.ReadFile(s.opts.File)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.opts.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := s.opts.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetch %s: status %d", s.opts.URL, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+// Run refreshes the set every Refresh interval until ctx is done. Failures
+// are logged and the previous keys kept.
+func (s *JWKS) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.Refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Refresh(ctx); err != nil && ctx.Err() == nil && s.opts.Logger != nil {
+				s.opts.Logger.Error("jwks refresh failed",
+					"url", s.opts.URL,
+					"file", s.opts.File,
+					"err", err,
+				)
+			}
+		}
+	}
+}
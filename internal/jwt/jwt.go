@@ -0,0 +1,155 @@
+// Package jwt verifies JSON Web Tokens signed with RS256, ES256, EdDSA or
+// HS256, against keys given inline or fetched from a JWKS.
+package jwt
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed    = errors.New("jwt: malformed token")
+	ErrAlgorithm    = errors.New("jwt: unsupported algorithm")
+	ErrUnknownKey   = errors.New("jwt: no key to verify token")
+	ErrSignature    = errors.New("jwt: invalid signature")
+	ErrExpired      = errors.New("jwt: token expired")
+	ErrNotYetValid  = errors.New("jwt: token not yet valid")
+	ErrIssuer       = errors.New("jwt: invalid issuer")
+	ErrAudience     = errors.New("jwt: invalid audience")
+	ErrMissingClaim = errors.New("jwt: missing claim")
+)
+
+// Header is the JOSE header of a token.
+type Header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+	Typ string `json:"typ,omitempty"`
+}
+
+// Claims are the claims of a token, as decoded from JSON.
+type Claims map[string]any
+
+// Token is a verified token.
+type Token struct {
+	Header Header
+	Claims Claims
+}
+
+// String returns a string or numeric claim as a string.
+func (c Claims) String(name string) (string, bool) {
+	switch v := c[name].(type) {
+	case string:
+		return v, true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	case bool:
+		return strconv.FormatBool(v), true
+	default:
+		return "", false
+	}
+}
+
+// Strings returns a claim that is a string or an array of them, such as
+// aud. Space-separated strings are not split; see Scopes.
+func (c Claims) Strings(name string) []string {
+	switch v := c[name].(type) {
+	case string:
+		return []string{v}
+	case []any:
+		out := make([]string, 0, len(v))
+		for _, e := range v {
+			if s, ok := e.(string); ok {
+				out = append(out, s)
+			}
+		}
+		return out
+	default:
+		if s, ok := c.String(name); ok {
+			return []string{s}
+		}
+		return nil
+	}
+}
+
+// Scopes returns the scopes granted by the token: the space-separated
+// "scope" claim (RFC 8693) or the "scp" claim used by some issuers.
+func (c Claims) Scopes() []string {
+	if s, ok := c["scope"].(string); ok {
+		return strings.Fields(s)
+	}
+	if s, ok := c["scp"].(string); ok {
+		return strings.Fields(s)
+	}
+	return c.Strings("scp")
+}
+
+// Time returns a NumericDate claim such as exp.
+func (c Claims) Time(name string) (time.Time, bool) {
+	v, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	sec, frac := math.Modf(v)
+	return time.Unix(int64(sec), int64(frac*1e9)), true
+}
+
+// parse splits a compact token and decodes its header and claims, leaving
+// the signature to be checked.
+func parse(raw string) (tok *Token, input string, sig []byte, err error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, "", nil, ErrMalformed
+	}
+
+	tok = &Token{}
+	if err := decodeSegment(parts[0], &tok.Header); err != nil {
+		return nil, "", nil, err
+	}
+	if err := decodeSegment(parts[1], &tok.Claims); err != nil {
+		return nil, "", nil, err
+	}
+	if tok.Claims == nil {
+		return nil, "", nil, ErrMalformed
+	}
+	sig, err = base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, "", nil, ErrMalformed
+	}
+	return tok, parts[0] + "." + parts[1], sig, nil
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return ErrMalformed
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying tok.
+func NewContext(ctx context.Context, tok *Token) context.Context {
+	return context.WithValue(ctx, contextKey{}, tok)
+}
+
+// FromContext returns the verified token stored in ctx, if any.
+func FromContext(ctx context.Context) (*Token, bool) {
+	tok, ok := ctx.Value(contextKey{}).(*Token)
+	return tok, ok
+}
+
+// claimError wraps err with the claim it concerns.
+func claimError(err error, claim string) error {
+	return fmt.Errorf("%w: %s", err, claim)
+}
@@ -0,0 +1,230 @@
+package jwt
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"warpgate/internal/jwt/jwttest"
+)
+
+func claims(extra map[string]any) map[string]any {
+	c := map[string]any{
+		"iss": "https://issuer.example",
+		"aud": "api",
+		"sub": "alice",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	for k, v := range extra {
+		c[k] = v
+	}
+	return c
+}
+
+func newVerifier(t *testing.T, keys KeySource, opts Options) *Verifier {
+	t.Helper()
+	opts.Keys = keys
+	v, err := NewVerifier(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestVerify_Algorithms(t *testing.T) {
+	iss := jwttest.NewIssuer(t)
+	keys, err := ParseJWKS(iss.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, Key{Algorithm: HS256, Key: iss.Secret})
+	v := newVerifier(t, StaticKeys(keys), Options{})
+
+	for _, alg := range []string{RS256, ES256, EdDSA, HS256} {
+		t.Run(alg, func(t *testing.T) {
+			raw := iss.Sign(alg, claims(nil))
+			tok, err := v.Verify(context.Background(), raw)
+			if err != nil {
+				t.Fatalf("Verify: %v", err)
+			}
+			if sub, _ := tok.Claims.String("sub"); sub != "alice" {
+				t.Errorf("sub = %q, want alice", sub)
+			}
+
+			// Change a character of the signature.
+			i := strings.LastIndexByte(raw, '.') + 2
+			b := []byte(raw)
+			if b[i] = 'A'; raw[i] == 'A' {
+				b[i] = 'B'
+			}
+			if _, err := v.Verify(context.Background(), string(b)); err == nil {
+				t.Error("tampered token verified")
+			}
+		})
+	}
+}
+
+func TestVerify_RejectsAlgorithmConfusion(t *testing.T) {
+	iss := jwttest.NewIssuer(t)
+	keys, err := ParseJWKS(iss.JWKS())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newVerifier(t, StaticKeys(keys), Options{Algorithms: []string{RS256}})
+
+	if _, err := v.Verify(context.Background(), iss.Sign(ES256, claims(nil))); !errors.Is(err, ErrAlgorithm) {
+		t.Errorf("ES256 token with RS256 only: err = %v, want ErrAlgorithm", err)
+	}
+
+	// An HS256 token must not verify against the bytes of a public key.
+	v = newVerifier(t, StaticKeys(keys), Options{})
+	if _, err := v.Verify(context.Background(), iss.Sign(HS256, claims(nil))); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("HS256 token without secret: err = %v, want ErrUnknownKey", err)
+	}
+
+	none := "eyJhbGciOiJub25lIn0." + strings.Split(iss.Sign(HS256, claims(nil)), ".")[1] + "."
+	if _, err := v.Verify(context.Background(), none); !errors.Is(err, ErrAlgorithm) {
+		t.Errorf("alg none: err = %v, want ErrAlgorithm", err)
+	}
+}
+
+func TestVerify_Claims(t *testing.T) {
+	iss := jwttest.NewIssuer(t)
+	v := newVerifier(t, StaticKeys{{Key: iss.Secret}}, Options{
+		Issuer:   "https://issuer.example",
+		Audience: []string{"api", "admin"},
+		Leeway:   30 * time.Second,
+	})
+	now := time.Now()
+
+	tests := []struct {
+		name   string
+		claims map[string]any
+		want   error
+	}{
+		{"valid", claims(nil), nil},
+		{"audience array", claims(map[string]any{"aud": []string{"other", "admin"}}), nil},
+		{"expired", claims(map[string]any{"exp": now.Add(-time.Minute).Unix()}), ErrExpired},
+		{"expired within leeway", claims(map[string]any{"exp": now.Add(-10 * time.Second).Unix()}), nil},
+		{"missing exp", claims(map[string]any{"exp": nil}), ErrMissingClaim},
+		{"not yet valid", claims(map[string]any{"nbf": now.Add(time.Minute).Unix()}), ErrNotYetValid},
+		{"nbf within leeway", claims(map[string]any{"nbf": now.Add(10 * time.Second).Unix()}), nil},
+		{"wrong issuer", claims(map[string]any{"iss": "https://evil.example"}), ErrIssuer},
+		{"wrong audience", claims(map[string]any{"aud": "other"}), ErrAudience},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := tt.claims
+			for k, val := range c {
+				if val == nil {
+					delete(c, k)
+				}
+			}
+			_, err := v.Verify(context.Background(), iss.Sign(HS256, c))
+			if !errors.Is(err, tt.want) || (tt.want == nil && err != nil) {
+				t.Errorf("err = %v, want %v", err, tt.want)
+			}
+		})
+	}
+
+	if _, err := v.Verify(context.Background(), "not.a-token"); !errors.Is(err, ErrMalformed) {
+		t.Errorf("malformed: err = %v", err)
+	}
+}
+
+func TestJWKS_RotationAndRateLimitedRefresh(t *testing.T) {
+	iss := jwttest.NewIssuer(t)
+	jwks, err := NewJWKS(JWKSOptions{URL: iss.URL(), MinRefresh: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := newVerifier(t, jwks, Options{Algorithms: []string{RS256}})
+	ctx := context.Background()
+
+	// The first token loads the set.
+	if _, err := v.Verify(ctx, iss.Sign(RS256, claims(nil))); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+	if iss.Fetches() != 1 {
+		t.Fatalf("fetches = %d, want 1", iss.Fetches())
+	}
+
+	// A rotated key is not fetched again within MinRefresh.
+	iss.Rotate(RS256)
+	if _, err := v.Verify(ctx, iss.Sign(RS256, claims(nil))); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("err = %v, want ErrUnknownKey", err)
+	}
+	if iss.Fetches() != 1 {
+		t.Fatalf("fetches = %d, want 1", iss.Fetches())
+	}
+
+	jwks.opts.MinRefresh = time.Nanosecond
+	if _, err := v.Verify(ctx, iss.Sign(RS256, claims(nil))); err != nil {
+		t.Fatalf("Verify after rotation: %v", err)
+	}
+	if iss.Fetches() != 2 {
+		t.Fatalf("fetches = %d, want 2", iss.Fetches())
+	}
+
+	// Known keys are served without fetching.
+	for range 3 {
+		if _, err := v.Verify(ctx, iss.Sign(RS256, claims(nil))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if iss.Fetches() != 2 {
+		t.Fatalf("fetches = %d, want 2", iss.Fetches())
+	}
+}
+
+func TestJWKS_File(t *testing.T) {
+	iss := jwttest.NewIssuer(t)
+	file := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(file, iss.JWKS(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	jwks, err := NewJWKS(JWKSOptions{File: file})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := jwks.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	v := newVerifier(t, jwks, Options{})
+	if _, err := v.Verify(context.Background(), iss.Sign(EdDSA, claims(nil))); err != nil {
+		t.Fatalf("Verify: %v", err)
+	}
+
+	if _, err := NewJWKS(JWKSOptions{}); err == nil {
+		t.Error("expected error without url or file")
+	}
+}
+
+func TestClaims(t *testing.T) {
+	c := Claims{
+		"scope": "read write",
+		"scp":   []any{"ignored"},
+		"n":     float64(42),
+		"roles": []any{"a", "b"},
+		"exp":   float64(1700000000),
+	}
+	if got := c.Scopes(); len(got) != 2 || got[1] != "write" {
+		t.Errorf("Scopes = %v", got)
+	}
+	if got, _ := c.String("n"); got != "42" {
+		t.Errorf("String(n) = %q", got)
+	}
+	if got := c.Strings("roles"); len(got) != 2 {
+		t.Errorf("Strings(roles) = %v", got)
+	}
+	if got, _ := c.Time("exp"); got.Unix() != 1700000000 {
+		t.Errorf("Time(exp) = %v", got)
+	}
+	if got := (Claims{"scp": []any{"x", "y"}}).Scopes(); len(got) != 2 {
+		t.Errorf("Scopes from scp = %v", got)
+	}
+}
@@ -0,0 +1,207 @@
+// Package jwttest provides a token issuer for tests, with a local server
+// publishing its JWK Set.
+package jwttest
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Issuer signs tokens with one current key per algorithm. Keys replaced by
+// Rotate stay published until Retire.
+type Issuer struct {
+	t testing.TB
+
+	// Secret is the HS256 key, which is not published.
+	Secret []byte
+
+	mu      sync.Mutex
+	current map[string]*key
+	keys    []*key
+	serial  int
+
+	server  *httptest.Server
+	fetches atomic.Int64
+}
+
+type key struct {
+	id   string
+	alg  string
+	priv crypto.Signer
+}
+
+// NewIssuer returns an issuer with keys for RS256, ES256 and EdDSA, whose
+// JWKS server is closed when the test ends.
+func NewIssuer(t testing.TB) *Issuer {
+	t.Helper()
+	i := &Issuer{
+		t:       t,
+		Secret:  []byte("jwttest-secret-0123456789abcdef!"),
+		current: make(map[string]*key),
+	}
+	for _, alg := range []string{"RS256", "ES256", "EdDSA"} {
+		i.Rotate(alg)
+	}
+	i.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i.fetches.Add(1)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write(i.JWKS())
+	}))
+	t.Cleanup(i.server.Close)
+	return i
+}
+
+// URL returns the address of the JWKS.
+func (i *Issuer) URL() string {
+	return i.server.URL
+}
+
+// Fetches returns how many times the JWKS was served.
+func (i *Issuer) Fetches() int {
+	return int(i.fetches.Load())
+}
+
+// Rotate makes a new key current for alg and returns its ID.
+func (i *Issuer) Rotate(alg string) string {
+	i.t.Helper()
+	var priv crypto.Signer
+	var err error
+	switch alg {
+	case "RS256":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ES256":
+		priv, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "EdDSA":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		i.t.Fatalf("jwttest: cannot rotate %s keys", alg)
+	}
+	if err != nil {
+		i.t.Fatal(err)
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.serial++
+	k := &key{id: fmt.Sprintf("%s-%d", alg, i.serial), alg: alg, priv: priv}
+	i.current[alg] = k
+	i.keys = append(i.keys, k)
+	return k.id
+}
+
+// Retire stops publishing every key but the current ones.
+func (i *Issuer) Retire() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys = i.keys[:0]
+	for _, k := range i.current {
+		i.keys = append(i.keys, k)
+	}
+}
+
+// JWKS returns the published JWK Set.
+func (i *Issuer) JWKS() []byte {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var set struct {
+		Keys []map[string]string `json:"keys"`
+	}
+	for _, k := range i.keys {
+		set.Keys = append(set.Keys, k.jwk())
+	}
+	b, err := json.Marshal(set)
+	if err != nil {
+		i.t.Fatal(err)
+	}
+	return b
+}
+
+func (k *key) jwk() map[string]string {
+	enc := base64.RawURLEncoding.EncodeToString
+	m := map[string]string{"kid": k.id, "alg": k.alg, "use": "sig"}
+	switch pub := k.priv.Public().(type) {
+	case *rsa.PublicKey:
+		m["kty"] = "RSA"
+		m["n"] = enc(pub.N.Bytes())
+		m["e"] = enc(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		m["kty"], m["crv"] = "EC", "P-256"
+		m["x"] = enc(pub.X.FillBytes(make([]byte, 32)))
+		m["y"] = enc(pub.Y.FillBytes(make([]byte, 32)))
+	case ed25519.PublicKey:
+		m["kty"], m["crv"] = "OKP", "Ed25519"
+		m["x"] = enc(pub)
+	}
+	return m
+}
+
+// Sign returns a token with claims signed by the current key for alg, which
+// may also be "HS256" to sign with Secret.
+func (i *Issuer) Sign(alg string, claims map[string]any) string {
+	i.t.Helper()
+	i.mu.Lock()
+	k := i.current[alg]
+	i.mu.Unlock()
+
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if k != nil {
+		header["kid"] = k.id
+	} else if alg != "HS256" {
+		i.t.Fatalf("jwttest: no %s key", alg)
+	}
+	input := segment(i.t, header) + "." + segment(i.t, claims)
+
+	var sig []byte
+	h := sha256.Sum256([]byte(input))
+	switch alg {
+	case "HS256":
+		mac := hmac.New(sha256.New, i.Secret)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sig = must(i.t, func() ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, k.priv.(*rsa.PrivateKey), crypto.SHA256, h[:])
+		})
+	case "ES256":
+		r, s, err := ecdsa.Sign(rand.Reader, k.priv.(*ecdsa.PrivateKey), h[:])
+		if err != nil {
+			i.t.Fatal(err)
+		}
+		sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	case "EdDSA":
+		sig = ed25519.Sign(k.priv.(ed25519.PrivateKey), []byte(input))
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func segment(t testing.TB, v any) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func must(t testing.TB, f func() ([]byte, error)) []byte {
+	b, err := f()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
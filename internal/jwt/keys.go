@@ -0,0 +1,153 @@
+package jwt
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Key is a verification key: an *rsa.PublicKey, *ecdsa.PublicKey,
+// ed25519.PublicKey or, for HS256, a []byte secret.
+type Key struct {
+	// ID matches the kid header of tokens; it may be empty.
+	ID string
+	// Algorithm restricts the key to one algorithm, if set.
+	Algorithm string
+	Key       any
+}
+
+// KeySource provides the keys that may have signed a token.
+type KeySource interface {
+	// Keys returns the candidate keys for the key ID kid, or all keys if
+	// kid is empty.
+	Keys(ctx context.Context, kid string) ([]Key, error)
+}
+
+// StaticKeys is a fixed set of keys.
+type StaticKeys []Key
+
+func (s StaticKeys) Keys(_ context.Context, kid string) ([]Key, error) {
+	return selectKeys(s, kid), nil
+}
+
+func selectKeys(keys []Key, kid string) []Key {
+	if kid == "" {
+		return keys
+	}
+	var out []Key
+	for _, k := range keys {
+		if k.ID == kid {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// jwk is a JSON Web Key (RFC 7517) of one of the supported types.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+	K   string `json:"k"`
+}
+
+// ParseJWKS parses a JWK Set. Keys that are not for signatures or of an
+// unsupported type are skipped, as a set may hold keys for other uses.
+func ParseJWKS(data []byte) ([]Key, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, fmt.Errorf("parse jwks: %w", err)
+	}
+
+	var keys []Key
+	for _, j := range set.Keys {
+		if j.Use != "" && j.Use != "sig" {
+			continue
+		}
+		k, err := j.key()
+		if errors.Is(err, errUnsupportedKey) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parse jwks: key %q: %w", j.Kid, err)
+		}
+		keys = append(keys, Key{ID: j.Kid, Algorithm: j.Alg, Key: k})
+	}
+	return keys, nil
+}
+
+var errUnsupportedKey = errors.New("unsupported key")
+
+func (j jwk) key() (any, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := decodeBigInt(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(j.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		if j.Crv != "P-256" {
+			return nil, errUnsupportedKey
+		}
+		x, err := decodeBigInt(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !elliptic.P256().IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, errUnsupportedKey
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	case "oct":
+		k, err := base64.RawURLEncoding.DecodeString(j.K)
+		if err != nil || len(k) == 0 {
+			return nil, errors.New("invalid symmetric key")
+		}
+		return k, nil
+	default:
+		return nil, errUnsupportedKey
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,186 @@
+package jwt
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+	"slices"
+	"time"
+)
+
+// Supported algorithms.
+const (
+	RS256 = "RS256"
+	ES256 = "ES256"
+	EdDSA = "EdDSA"
+	HS256 = "HS256"
+)
+
+// Options configures a Verifier.
+type Options struct {
+	Keys KeySource
+	// Algorithms lists the accepted algorithms (default all supported).
+	// Listing only the algorithms the issuer uses keeps a token from
+	// picking another one.
+	Algorithms []string
+	// Issuer, if set, must equal the iss claim.
+	Issuer string
+	// Audience, if set, must include one of the aud claim's values.
+	Audience []string
+	// Leeway is the clock skew tolerated when checking exp and nbf.
+	Leeway time.Duration
+}
+
+// Verifier checks the signature and registered claims of tokens.
+type Verifier struct {
+	keys       KeySource
+	algorithms []string
+	issuer     string
+	audience   []string
+	leeway     time.Duration
+	now        func() time.Time
+}
+
+func NewVerifier(opts Options) (*Verifier, error) {
+	if opts.Keys == nil {
+		return nil, fmt.Errorf("jwt: no keys")
+	}
+	if len(opts.Algorithms) == 0 {
+		opts.Algorithms = []string{RS256, ES256, EdDSA, HS256}
+	}
+	for _, alg := range opts.Algorithms {
+		switch alg {
+		case RS256, ES256, EdDSA, HS256:
+		default:
+			return nil, fmt.Errorf("%w %q", ErrAlgorithm, alg)
+		}
+	}
+	return &Verifier{
+		keys:       opts.Keys,
+		algorithms: opts.Algorithms,
+		issuer:     opts.Issuer,
+		audience:   opts.Audience,
+		leeway:     opts.Leeway,
+		now:        time.Now,
+	}, nil
+}
+
+// Verify parses raw and returns its token if it is signed by one of the
+// verifier's keys, has not expired and was issued for the verifier's
+// audience by its issuer. Tokens must carry exp.
+func (v *Verifier) Verify(ctx context.Context, raw string) (*Token, error) {
+	tok, input, sig, err := parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if !slices.Contains(v.algorithms, tok.Header.Alg) {
+		return nil, fmt.Errorf("%w %q", ErrAlgorithm, tok.Header.Alg)
+	}
+
+	keys, err := v.keys.Keys(ctx, tok.Header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	verified, tried := false, false
+	for _, k := range keys {
+		if k.Algorithm != "" && k.Algorithm != tok.Header.Alg {
+			continue
+		}
+		ok, usable := verifySignature(tok.Header.Alg, k.Key, []byte(input), sig)
+		tried = tried || usable
+		if ok {
+			verified = true
+			break
+		}
+	}
+	switch {
+	case verified:
+	case !tried:
+		return nil, ErrUnknownKey
+	default:
+		return nil, ErrSignature
+	}
+
+	if err := v.checkClaims(tok.Claims); err != nil {
+		return nil, err
+	}
+	return tok, nil
+}
+
+func (v *Verifier) checkClaims(c Claims) error {
+	now := v.now()
+
+	exp, ok := c.Time("exp")
+	if !ok {
+		return claimError(ErrMissingClaim, "exp")
+	}
+	if !now.Before(exp.Add(v.leeway)) {
+		return ErrExpired
+	}
+	if nbf, ok := c.Time("nbf"); ok && now.Add(v.leeway).Before(nbf) {
+		return ErrNotYetValid
+	}
+
+	if v.issuer != "" {
+		if iss, _ := c["iss"].(string); iss != v.issuer {
+			return ErrIssuer
+		}
+	}
+	if len(v.audience) > 0 {
+		aud := c.Strings("aud")
+		if !slices.ContainsFunc(v.audience, func(a string) bool { return slices.Contains(aud, a) }) {
+			return ErrAudience
+		}
+	}
+	return nil
+}
+
+// verifySignature checks sig over input with key. usable reports whether
+// key is of the type alg needs, so that a mismatch is not taken for a bad
+// signature.
+func verifySignature(alg string, key any, input, sig []byte) (ok, usable bool) {
+	switch alg {
+	case RS256:
+		k, isRSA := key.(*rsa.PublicKey)
+		if !isRSA {
+			return false, false
+		}
+		h := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) == nil, true
+	case ES256:
+		k, isEC := key.(*ecdsa.PublicKey)
+		if !isEC || k.Curve != elliptic.P256() {
+			return false, false
+		}
+		if len(sig) != 64 {
+			return false, true
+		}
+		h := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		return ecdsa.Verify(k, h[:], r, s), true
+	case EdDSA:
+		k, isEd := key.(ed25519.PublicKey)
+		if !isEd {
+			return false, false
+		}
+		return ed25519.Verify(k, input, sig), true
+	case HS256:
+		k, isSecret := key.([]byte)
+		if !isSecret {
+			return false, false
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), sig), true
+	default:
+		return false, false
+	}
+}
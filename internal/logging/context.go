@@ -0,0 +1,44 @@
+package logging
+
+import "context"
+
+type requestIDKey struct{}
+
+// WithRequestID returns a copy of ctx carrying the request ID id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID stored in ctx, or "".
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// FromContext returns l adding the request ID of ctx to every line, or l
+// itself if ctx carries none. A nil l stays nil, so callers can keep
+// checking the result.
+func FromContext(ctx context.Context, l Logger) Logger {
+	if l == nil {
+		return nil
+	}
+	id := RequestID(ctx)
+	if id == "" {
+		return l
+	}
+	return &withArgs{l: l, args: []any{"request_id", id}}
+}
+
+// withArgs is a logger adding args to every line.
+type withArgs struct {
+	l    Logger
+	args []any
+}
+
+func (w *withArgs) Info(msg string, args ...any) {
+	w.l.Info(msg, append(args[:len(args):len(args)], w.args...)...)
+}
+
+func (w *withArgs) Error(msg string, args ...any) {
+	w.l.Error(msg, append(args[:len(args):len(args)], w.args...)...)
+}
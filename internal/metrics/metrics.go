@@ -46,6 +46,160 @@ var (
 		[]string{"route"},
 	)
 
+	cacheCoalesced = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_coalesced_total",
+			Help:      "Total cache misses served from another request's in-flight upstream fetch",
+		},
+		[]string{"route"},
+	)
+
+	cacheRevalidated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_revalidations_total",
+			Help:      "Total stale cache entries confirmed by upstream with 304 Not Modified",
+		},
+		[]string{"route"},
+	)
+
+	cacheStale = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_stale_served_total",
+			Help:      "Total stale cache entries served without revalidation",
+		},
+		[]string{"route"},
+	)
+
+	cacheBypass = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_bypass_total",
+			Help:      "Total responses on cache-enabled routes that were not cached, by reason",
+		},
+		[]string{"route", "reason"},
+	)
+
+	cacheStores = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_stores_total",
+			Help:      "Total responses stored in the cache",
+		},
+		[]string{"route"},
+	)
+
+	cacheObjectSize = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "warpgate",
+			Name:      "cache_object_size_bytes",
+			Help:      "Body size of the responses stored in the cache",
+			Buckets:   prometheus.ExponentialBuckets(256, 4, 10),
+		},
+		[]string{"route"},
+	)
+
+	cacheEntries = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "warpgate",
+			Name:      "cache_entries",
+			Help:      "Number of entries held by the cache",
+		},
+		[]string{"cache"},
+	)
+
+	cacheBytes = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "warpgate",
+			Name:      "cache_bytes",
+			Help:      "Accounted size in bytes of the entries held by the cache",
+		},
+		[]string{"cache"},
+	)
+
+	cacheEvictions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_evictions_total",
+			Help:      "Total cache entries evicted, by reason",
+		},
+		[]string{"cache", "reason"},
+	)
+
+	cacheBackendErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "cache_backend_errors_total",
+			Help:      "Total failed requests to a remote cache backend",
+		},
+		[]string{"cache"},
+	)
+
+	cacheBackendOpen = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "warpgate",
+			Name:      "cache_backend_circuit_open",
+			Help:      "1 while a remote cache backend is disabled by its circuit breaker",
+		},
+		[]string{"cache"},
+	)
+
+	rateLimited = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "ratelimit_rejected_total",
+			Help:      "Total requests rejected by a rate limit",
+		},
+		[]string{"route"},
+	)
+
+	rateLimitFallback = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "ratelimit_fallback_total",
+			Help:      "Total rate limit decisions made locally because the shared store was unavailable",
+		},
+		[]string{"route"},
+	)
+
+	ipRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "ip_rejected_total",
+			Help:      "Total requests rejected by IP allow or deny rules",
+		},
+		[]string{"route", "reason"},
+	)
+
+	authRejected = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "auth_rejected_total",
+			Help:      "Total requests rejected by authentication or authorization",
+		},
+		[]string{"route", "reason"},
+	)
+
+	authenticated = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "authenticated_requests_total",
+			Help:      "Total requests admitted with valid credentials",
+		},
+		[]string{"route", "method", "tier"},
+	)
+
+	compressed = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "warpgate",
+			Name:      "compressed_responses_total",
+			Help:      "Total responses compressed by the proxy",
+		},
+		[]string{"route", "encoding"},
+	)
+
 	clusterUnhealthy = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: "warpgate",
@@ -57,7 +211,8 @@ var (
 )
 
 func Init() {
-	prometheus.MustRegister(requestTotal, requestDuration, cacheHits, cacheMisses, clusterUnhealthy)
+	prometheus.MustRegister(requestTotal, requestDuration, cacheHits, cacheMisses, cacheCoalesced, cacheRevalidated,
+		cacheStale, cacheBypass, cacheStores, cacheObjectSize, cacheEntries, cacheBytes, cacheEvictions, cacheBackendErrors, cacheBackendOpen, rateLimited, rateLimitFallback, ipRejected, authRejected, authenticated, compressed, clusterUnhealthy)
 }
 
 func Handler() http.Handler {
@@ -77,6 +232,85 @@ func IncCacheMiss(route string) {
 	cacheMisses.WithLabelValues(route).Inc()
 }
 
+func IncCacheCoalesced(route string) {
+	cacheCoalesced.WithLabelValues(route).Inc()
+}
+
+func IncCacheRevalidated(route string) {
+	cacheRevalidated.WithLabelValues(route).Inc()
+}
+
+func IncCacheStale(route string) {
+	cacheStale.WithLabelValues(route).Inc()
+}
+
+func IncCacheBypass(route, reason string) {
+	cacheBypass.WithLabelValues(route, reason).Inc()
+}
+
+// ObserveCacheStore counts a stored response and records its body size.
+func ObserveCacheStore(route string, size int64) {
+	cacheStores.WithLabelValues(route).Inc()
+	cacheObjectSize.WithLabelValues(route).Observe(float64(size))
+}
+
+// AddCacheSize adjusts the size gauges of a cache by the given deltas, so
+// that caches made of several shards can share a label.
+func AddCacheSize(cache string, entries int, bytes int64) {
+	cacheEntries.WithLabelValues(cache).Add(float64(entries))
+	cacheBytes.WithLabelValues(cache).Add(float64(bytes))
+}
+
+func IncCacheEviction(cache, reason string) {
+	cacheEvictions.WithLabelValues(cache, reason).Inc()
+}
+
+func IncCacheBackendError(cache string) {
+	cacheBackendErrors.WithLabelValues(cache).Inc()
+}
+
+func SetCacheBackendOpen(cache string, open bool) {
+	v := 0.0
+	if open {
+		v = 1
+	}
+	cacheBackendOpen.WithLabelValues(cache).Set(v)
+}
+
+func IncRateLimited(route string) {
+	rateLimited.WithLabelValues(route).Inc()
+}
+
+func IncRateLimitFallback(route string) {
+	rateLimitFallback.WithLabelValues(route).Inc()
+}
+
+// IncIPRejected counts a request rejected by IP rules; reason is "deny" or
+// "allow" for clients missing from an allowlist.
+func IncIPRejected(route, reason string) {
+	ipRejected.WithLabelValues(route, reason).Inc()
+}
+
+// IncAuthRejected counts a request rejected for missing or invalid
+// credentials, or for lacking permissions.
+func IncAuthRejected(route, reason string) {
+	authRejected.WithLabelValues(route, reason).Inc()
+}
+
+// IncAuthenticated counts a request admitted with valid credentials; method
+// is "basic", "apikey" or "jwt", and tier the client's rate limit tier or
+// "default".
+func IncAuthenticated(route, method, tier string) {
+	if tier == "" {
+		tier = "default"
+	}
+	authenticated.WithLabelValues(route, method, tier).Inc()
+}
+
+func IncCompressed(route, encoding string) {
+	compressed.WithLabelValues(route, encoding).Inc()
+}
+
 func SetClusterUnhealthy(cluster string, value float64) {
 	clusterUnhealthy.WithLabelValues(cluster).Set(value)
 }
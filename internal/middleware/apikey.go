@@ -0,0 +1,226 @@
+package middleware
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+)
+
+// APIKey is a key granted to a client.
+type APIKey struct {
+	// Name identifies the client in logs, metrics and rate limit keys.
+	Name string `yaml:"name"`
+	// Key is the key itself, or its SHA-256 digest as "sha256:<hex>" so
+	// that the file does not hold usable keys.
+	Key string `yaml:"key"`
+	// Tier selects the rate limit tier of the client.
+	Tier   string   `yaml:"tier"`
+	Scopes []string `yaml:"scopes"`
+}
+
+// APIKeys holds the keys of a YAML file of the form
+//
+//	keys:
+//	  - name: billing
+//	    key: sha256:9f86d08188...
+//	    tier: premium
+//	    scopes: [orders:read]
+//
+// Keys are looked up by digest, so lookups do not leak through timing how
+// much of a key was right.
+type APIKeys struct {
+	file   string
+	logger logging.Logger
+	keys   atomic.Pointer[map[[sha256.Size]byte]*Identity]
+
+	mu    sync.Mutex
+	stamp map[string]fileStamp
+}
+
+// NewAPIKeys loads the keys of file.
+func NewAPIKeys(file string, logger logging.Logger) (*APIKeys, error) {
+	k := &APIKeys{file: file, logger: logger}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the file again. On error the keys are left as they were.
+func (k *APIKeys) Reload() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	fi, err := os.Stat(k.file)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(k.file)
+	if err != nil {
+		return err
+	}
+	var doc struct {
+		Keys []APIKey `yaml:"keys"`
+	}
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %w", k.file, err)
+	}
+
+	keys := make(map[[sha256.Size]byte]*Identity, len(doc.Keys))
+	for i, ak := range doc.Keys {
+		if ak.Name == "" {
+			return fmt.Errorf("%s: key %d has no name", k.file, i)
+		}
+		digest, err := keyDigest(ak.Key)
+		if err != nil {
+			return fmt.Errorf("%s: key %s: %w", k.file, ak.Name, err)
+		}
+		if _, dup := keys[digest]; dup {
+			return fmt.Errorf("%s: key %s is a duplicate", k.file, ak.Name)
+		}
+		keys[digest] = &Identity{Name: ak.Name, Method: "apikey", Tier: ak.Tier, Scopes: ak.Scopes}
+	}
+
+	k.keys.Store(&keys)
+	k.stamp = map[string]fileStamp{k.file: stampOf(fi)}
+	return nil
+}
+
+func keyDigest(key string) ([sha256.Size]byte, error) {
+	var digest [sha256.Size]byte
+	if h, ok := strings.CutPrefix(key, "sha256:"); ok {
+		b, err := hex.DecodeString(h)
+		if err != nil || len(b) != sha256.Size {
+			return digest, errors.New("invalid sha256 digest")
+		}
+		copy(digest[:], b)
+		return digest, nil
+	}
+	if key == "" {
+		return digest, errors.New("empty key")
+	}
+	return sha256.Sum256([]byte(key)), nil
+}
+
+// Watch reloads the file when it changes, checking every interval until ctx
+// is done.
+func (k *APIKeys) Watch(ctx context.Context, interval time.Duration) {
+	pollEvery(ctx, interval, func() {
+		k.mu.Lock()
+		changed := filesChanged(k.stamp)
+		k.mu.Unlock()
+		if !changed {
+			return
+		}
+		if err := k.Reload(); err != nil {
+			if k.logger != nil {
+				k.logger.Error("api keys reload failed", "file", k.file, "err", err)
+			}
+			return
+		}
+		if k.logger != nil {
+			k.logger.Info("api keys reloaded", "file", k.file, "keys", len(*k.keys.Load()))
+		}
+	})
+}
+
+// Lookup returns the identity holding key.
+func (k *APIKeys) Lookup(key string) (*Identity, bool) {
+	id, ok := (*k.keys.Load())[sha256.Sum256([]byte(key))]
+	return id, ok
+}
+
+// APIKeyAuthOptions configures APIKeyAuth.
+type APIKeyAuthOptions struct {
+	// Name labels the middleware in metrics and logs.
+	Name string
+	Keys *APIKeys
+	// Header carries the key (default X-API-Key).
+	Header string
+	// Query is a query parameter also accepted to carry the key, for
+	// clients that cannot set headers.
+	Query string
+	// Scopes must all be granted to the key.
+	Scopes []string
+}
+
+type apiKeyAuth struct {
+	logger logging.Logger
+	opts   APIKeyAuthOptions
+}
+
+// APIKeyAuth constructs a middleware that admits requests carrying a known
+// API key. Requests without one, or with an unknown one, are rejected with
+// 401 Unauthorized and those whose key lacks a required scope with 403
+// Forbidden. The key is not passed to the upstream; its holder is stored in
+// the request context as an Identity.
+func APIKeyAuth(logger logging.Logger, opts APIKeyAuthOptions) (Middleware, error) {
+	if opts.Keys == nil {
+		return nil, errors.New("api key auth requires a key file")
+	}
+	if opts.Header == "" {
+		opts.Header = "X-API-Key"
+	}
+	a := &apiKeyAuth{logger: logger, opts: opts}
+	return a.middleware, nil
+}
+
+func (a *apiKeyAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(a.opts.Header)
+		if key == "" && a.opts.Query != "" {
+			key = r.URL.Query().Get(a.opts.Query)
+		}
+		if key == "" {
+			a.reject(w, r, http.StatusUnauthorized, "missing", "")
+			return
+		}
+		id, ok := a.opts.Keys.Lookup(key)
+		if !ok {
+			a.reject(w, r, http.StatusUnauthorized, "invalid", "")
+			return
+		}
+		if !id.HasScopes(a.opts.Scopes) {
+			a.reject(w, r, http.StatusForbidden, "forbidden", id.Name)
+			return
+		}
+
+		metrics.IncAuthenticated(a.opts.Name, "apikey", id.Tier)
+		r = r.Clone(WithIdentity(r.Context(), id))
+		r.Header.Del(a.opts.Header)
+		if a.opts.Query != "" {
+			q := r.URL.Query()
+			if q.Has(a.opts.Query) {
+				q.Del(a.opts.Query)
+				r.URL.RawQuery = q.Encode()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *apiKeyAuth) reject(w http.ResponseWriter, r *http.Request, status int, reason, name string) {
+	metrics.IncAuthRejected(a.opts.Name, reason)
+	if log := logging.FromContext(r.Context(), a.logger); log != nil {
+		log.Info("api key rejected",
+			"route", a.opts.Name,
+			"reason", reason,
+			"key", name,
+			"path", r.URL.Path,
+		)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
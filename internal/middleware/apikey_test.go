@@ -0,0 +1,129 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeAPIKeys(t *testing.T) *APIKeys {
+	t.Helper()
+	digest := sha256.Sum256([]byte("key-2"))
+	data := `keys:
+  - name: reporting
+    key: key-1
+    scopes: [orders:read]
+  - name: billing
+    key: sha256:` + hex.EncodeToString(digest[:]) + `
+    tier: premium
+    scopes: [orders:read, orders:write]
+`
+	file := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := NewAPIKeys(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	mw, err := APIKeyAuth(nopLogger{}, APIKeyAuthOptions{
+		Name:   "orders",
+		Keys:   writeAPIKeys(t),
+		Query:  "api_key",
+		Scopes: []string{"orders:write"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstream *http.Request
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+	}))
+
+	do := func(target, header string) int {
+		upstream = nil
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		if header != "" {
+			req.Header.Set("X-API-Key", header)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := do("/orders", "key-2"); code != http.StatusOK {
+		t.Fatalf("header key: status %d", code)
+	}
+	if upstream.Header.Get("X-API-Key") != "" {
+		t.Error("key passed upstream")
+	}
+	id, ok := IdentityFromContext(upstream.Context())
+	if !ok || id.Name != "billing" || id.Method != "apikey" || id.Tier != "premium" {
+		t.Errorf("identity %+v", id)
+	}
+
+	if code := do("/orders?api_key=key-2&page=2", ""); code != http.StatusOK {
+		t.Fatalf("query key: status %d", code)
+	}
+	if q := upstream.URL.RawQuery; q != "page=2" {
+		t.Errorf("upstream query %q, want page=2", q)
+	}
+
+	for _, tc := range []struct {
+		target, header string
+		want           int
+	}{
+		{"/orders", "", http.StatusUnauthorized},
+		{"/orders", "key-3", http.StatusUnauthorized},
+		{"/orders", "key-1", http.StatusForbidden},
+	} {
+		if code := do(tc.target, tc.header); code != tc.want || upstream != nil {
+			t.Errorf("key %q: status %d, want %d", tc.header, code, tc.want)
+		}
+	}
+}
+
+func TestRateLimit_Tiers(t *testing.T) {
+	mw, err := RateLimit(nil, RateLimitOptions{
+		Limit: Limit{Requests: 1, Period: time.Minute},
+		Key:   KeyByIdentity(),
+		Tiers: map[string]Tier{"premium": {Limit: Limit{Requests: 3, Period: time.Minute}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	allowed := func(id *Identity, n int) int {
+		ok := 0
+		for i := 0; i < n; i++ {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req = req.WithContext(WithIdentity(req.Context(), id))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code == http.StatusOK {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	if n := allowed(&Identity{Name: "billing", Method: "apikey", Tier: "premium"}, 5); n != 3 {
+		t.Errorf("premium client allowed %d requests, want 3", n)
+	}
+	if n := allowed(&Identity{Name: "reporting", Method: "apikey"}, 5); n != 1 {
+		t.Errorf("default client allowed %d requests, want 1", n)
+	}
+	if n := allowed(&Identity{Name: "other", Method: "apikey", Tier: "unknown"}, 5); n != 1 {
+		t.Errorf("client of unknown tier allowed %d requests, want 1", n)
+	}
+}
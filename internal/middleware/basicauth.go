@@ -0,0 +1,82 @@
+package middleware
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+)
+
+// BasicAuthOptions configures BasicAuth.
+type BasicAuthOptions struct {
+	// Name labels the middleware in metrics and logs.
+	Name  string
+	Users *Htpasswd
+	// Allowed restricts the route to these users; empty admits every user
+	// in the file.
+	Allowed []string
+	// Realm is sent in WWW-Authenticate challenges (default "warpgate").
+	Realm string
+}
+
+type basicAuth struct {
+	logger logging.Logger
+	opts   BasicAuthOptions
+}
+
+// BasicAuth constructs a middleware that admits requests with HTTP Basic
+// credentials of a user in an htpasswd file. Requests without valid ones are
+// rejected with 401 Unauthorized, and those of users not allowed on the
+// route with 403 Forbidden. The Authorization header is not passed to the
+// upstream; the user is stored in the request context as an Identity.
+func BasicAuth(logger logging.Logger, opts BasicAuthOptions) (Middleware, error) {
+	if opts.Users == nil {
+		return nil, errors.New("basic auth requires an htpasswd file")
+	}
+	if opts.Realm == "" {
+		opts.Realm = "warpgate"
+	}
+	a := &basicAuth{logger: logger, opts: opts}
+	return a.middleware, nil
+}
+
+func (a *basicAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok {
+			a.reject(w, r, http.StatusUnauthorized, "missing", "")
+			return
+		}
+		if !a.opts.Users.Verify(user, pass) {
+			a.reject(w, r, http.StatusUnauthorized, "invalid", user)
+			return
+		}
+		if len(a.opts.Allowed) > 0 && !slices.Contains(a.opts.Allowed, user) {
+			a.reject(w, r, http.StatusForbidden, "forbidden", user)
+			return
+		}
+
+		metrics.IncAuthenticated(a.opts.Name, "basic", "")
+		r = r.Clone(WithIdentity(r.Context(), &Identity{Name: user, Method: "basic"}))
+		r.Header.Del("Authorization")
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *basicAuth) reject(w http.ResponseWriter, r *http.Request, status int, reason, user string) {
+	metrics.IncAuthRejected(a.opts.Name, reason)
+	if log := logging.FromContext(r.Context(), a.logger); log != nil {
+		log.Info("basic auth rejected",
+			"route", a.opts.Name,
+			"reason", reason,
+			"user", user,
+			"path", r.URL.Path,
+		)
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic realm="+quote(a.opts.Realm)+`, charset="UTF-8"`)
+	}
+	http.Error(w, http.StatusText(status), status)
+}
@@ -0,0 +1,139 @@
+package middleware
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func argon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return "$argon2id$v=19$m=64,t=1,p=1$" + base64.RawStdEncoding.EncodeToString(salt) + "$" + base64.RawStdEncoding.EncodeToString(key)
+}
+
+func writeHtpasswd(t *testing.T) string {
+	t.Helper()
+	bc, err := bcrypt.GenerateFromPassword([]byte("alice-pw"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "htpasswd")
+	data := "# users\nalice:" + string(bc) + "\nbob:" + argon2Hash("bob-pw") + "\n"
+	if err := os.WriteFile(file, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestHtpasswd(t *testing.T) {
+	users, err := NewHtpasswd(writeHtpasswd(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		user, pass string
+		want       bool
+	}{
+		{"alice", "alice-pw", true},
+		{"alice", "alice-pw", true}, // remembered
+		{"alice", "bob-pw", false},
+		{"bob", "bob-pw", true},
+		{"bob", "wrong", false},
+		{"carol", "alice-pw", false},
+	} {
+		if got := users.Verify(tc.user, tc.pass); got != tc.want {
+			t.Errorf("Verify(%q, %q) = %v, want %v", tc.user, tc.pass, got, tc.want)
+		}
+	}
+
+	file := filepath.Join(t.TempDir(), "plain")
+	if err := os.WriteFile(file, []byte("alice:{SHA}abc\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewHtpasswd(file, nil); err == nil {
+		t.Error("weak hash accepted")
+	}
+}
+
+func TestHtpasswd_Reload(t *testing.T) {
+	file := writeHtpasswd(t)
+	users, err := NewHtpasswd(file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.Verify("bob", "bob-pw") {
+		t.Fatal("bob rejected")
+	}
+
+	// A changed password invalidates the remembered one.
+	if err := os.WriteFile(file, []byte("bob:"+argon2Hash("new-pw")+"\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := users.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if users.Verify("bob", "bob-pw") || !users.Verify("bob", "new-pw") {
+		t.Error("password change not picked up")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	users, err := NewHtpasswd(writeHtpasswd(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mw, err := BasicAuth(nopLogger{}, BasicAuthOptions{Name: "admin", Users: users, Allowed: []string{"alice"}, Realm: "admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstream *http.Request
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+	}))
+
+	do := func(user, pass string) *httptest.ResponseRecorder {
+		upstream = nil
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if user != "" {
+			req.SetBasicAuth(user, pass)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("alice", "alice-pw")
+	if rr.Code != http.StatusOK || upstream == nil {
+		t.Fatalf("valid credentials: status %d", rr.Code)
+	}
+	if upstream.Header.Get("Authorization") != "" {
+		t.Error("credentials passed upstream")
+	}
+	if id, ok := IdentityFromContext(upstream.Context()); !ok || id.Name != "alice" || id.Method != "basic" {
+		t.Errorf("identity %+v", id)
+	}
+
+	for _, tc := range []struct {
+		user, pass string
+		want       int
+	}{
+		{"", "", http.StatusUnauthorized},
+		{"alice", "wrong", http.StatusUnauthorized},
+		{"bob", "bob-pw", http.StatusForbidden},
+	} {
+		rr := do(tc.user, tc.pass)
+		if rr.Code != tc.want || upstream != nil {
+			t.Errorf("%s/%s: status %d, want %d", tc.user, tc.pass, rr.Code, tc.want)
+		}
+		if tc.want == http.StatusUnauthorized && rr.Header().Get("WWW-Authenticate") != `Basic realm="admin", charset="UTF-8"` {
+			t.Errorf("challenge %q", rr.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
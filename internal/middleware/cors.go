@@ -0,0 +1,310 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"warpgate/internal/logging"
+)
+
+// CORSOptions configures CORS.
+type CORSOptions struct {
+	// Name labels the middleware in logs.
+	Name string
+	// AllowOrigins lists the origins allowed to make requests: "*" for any,
+	// an exact origin such as "https://app.example.com", a pattern with "*"
+	// standing for a host name or part of one, as in "https://*.example.com",
+	// or "regex:" followed by a regular expression matched against the whole
+	// origin.
+	AllowOrigins []string
+	// AllowMethods lists the methods allowed in preflight requests (default
+	// GET, HEAD and POST); "*" allows any.
+	AllowMethods []string
+	// AllowHeaders lists the request headers allowed in preflight requests;
+	// "*" allows any.
+	AllowHeaders []string
+	// ExposeHeaders lists the response headers scripts may read, besides the
+	// CORS-safelisted ones.
+	ExposeHeaders []string
+	// AllowCredentials lets requests carry cookies and HTTP authentication.
+	// It cannot be combined with the origin "*".
+	AllowCredentials bool
+	// MaxAge is how long browsers may cache a preflight response; zero
+	// leaves it to the browser.
+	MaxAge time.Duration
+}
+
+type cors struct {
+	logger logging.Logger
+	opts   CORSOptions
+
+	anyOrigin  bool
+	origins    map[string]bool
+	patterns   []*regexp.Regexp
+	anyMethod  bool
+	anyHeader  bool
+	headers    map[string]bool
+	allowMeths string
+	expose     string
+	maxAge     string
+}
+
+// CORS constructs a middleware applying a cross-origin resource sharing
+// policy. Preflight requests are answered without reaching the upstream:
+// with 204 No Content if the origin, method and headers are allowed, and
+// 403 Forbidden otherwise. Other requests from an allowed origin get
+// Access-Control-* headers, which replace any set by the upstream.
+func CORS(logger logging.Logger, opts CORSOptions) (Middleware, error) {
+	if len(opts.AllowOrigins) == 0 {
+		return nil, errors.New("cors requires allowed origins")
+	}
+	if len(opts.AllowMethods) == 0 {
+		opts.AllowMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+	}
+
+	c := &cors{
+		logger:  logger,
+		opts:    opts,
+		origins: make(map[string]bool),
+		headers: make(map[string]bool),
+	}
+	for _, o := range opts.AllowOrigins {
+		switch {
+		case o == "*":
+			c.anyOrigin = true
+		case strings.HasPrefix(o, "regex:"):
+			re, err := regexp.Compile(`^(?:` + strings.TrimPrefix(o, "regex:") + `)$`)
+			if err != nil {
+				return nil, fmt.Errorf("origin %q: %w", o, err)
+			}
+			c.patterns = append(c.patterns, re)
+		case strings.Contains(o, "*"):
+			parts := strings.Split(strings.ToLower(o), "*")
+			for i, p := range parts {
+				parts[i] = regexp.QuoteMeta(p)
+			}
+			c.patterns = append(c.patterns, regexp.MustCompile(`^`+strings.Join(parts, `[a-z0-9-]+(?:\.[a-z0-9-]+)*`)+`$`))
+		default:
+			c.origins[strings.ToLower(o)] = true
+		}
+	}
+	if c.anyOrigin && opts.AllowCredentials {
+		return nil, errors.New(`cors cannot allow credentials for origin "*"`)
+	}
+
+	var methods []string
+	for _, m := range opts.AllowMethods {
+		if m == "*" {
+			c.anyMethod = true
+			continue
+		}
+		methods = append(methods, strings.ToUpper(m))
+	}
+	c.opts.AllowMethods = methods
+	c.allowMeths = strings.Join(methods, ", ")
+	for _, h := range opts.AllowHeaders {
+		if h == "*" {
+			c.anyHeader = true
+			continue
+		}
+		c.headers[strings.ToLower(h)] = true
+	}
+	c.expose = strings.Join(opts.ExposeHeaders, ", ")
+	if opts.MaxAge > 0 {
+		c.maxAge = strconv.FormatInt(int64(opts.MaxAge/time.Second), 10)
+	}
+	return c.middleware, nil
+}
+
+func (c *cors) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+			c.preflight(w, r, origin)
+			return
+		}
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&corsWriter{ResponseWriter: w, cors: c, origin: origin}, r)
+	})
+}
+
+func (c *cors) preflight(w http.ResponseWriter, r *http.Request, origin string) {
+	h := w.Header()
+	addVary(h, "Origin")
+	addVary(h, "Access-Control-Request-Method")
+	addVary(h, "Access-Control-Request-Headers")
+
+	method := r.Header.Get("Access-Control-Request-Method")
+	requested := requestedHeaders(r)
+	reason := ""
+	switch {
+	case !c.originAllowed(origin):
+		reason = "origin"
+	case !c.anyMethod && !slices.Contains(c.opts.AllowMethods, method):
+		reason = "method"
+	case !c.headersAllowed(requested):
+		reason = "headers"
+	}
+	if reason != "" {
+		if log := logging.FromContext(r.Context(), c.logger); log != nil {
+			log.Info("cors preflight rejected",
+				"route", c.opts.Name,
+				"reason", reason,
+				"origin", origin,
+				"path", r.URL.Path,
+			)
+		}
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	c.setOrigin(h, origin)
+	if c.anyMethod {
+		h.Set("Access-Control-Allow-Methods", method)
+	} else {
+		h.Set("Access-Control-Allow-Methods", c.allowMeths)
+	}
+	if len(requested) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(requested, ", "))
+	}
+	if c.maxAge != "" {
+		h.Set("Access-Control-Max-Age", c.maxAge)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *cors) originAllowed(origin string) bool {
+	if c.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if c.origins[origin] {
+		return true
+	}
+	for _, re := range c.patterns {
+		if re.MatchString(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cors) headersAllowed(requested []string) bool {
+	if c.anyHeader {
+		return true
+	}
+	for _, name := range requested {
+		if !c.headers[name] {
+			return false
+		}
+	}
+	return true
+}
+
+// setOrigin sets the headers granting origin access.
+func (c *cors) setOrigin(h http.Header, origin string) {
+	if c.anyOrigin {
+		h.Set("Access-Control-Allow-Origin", "*")
+	} else {
+		h.Set("Access-Control-Allow-Origin", origin)
+	}
+	if c.opts.AllowCredentials {
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+// apply replaces the CORS headers of a response to origin.
+func (c *cors) apply(h http.Header, origin string) {
+	for _, name := range []string{
+		"Access-Control-Allow-Origin",
+		"Access-Control-Allow-Credentials",
+		"Access-Control-Allow-Methods",
+		"Access-Control-Allow-Headers",
+		"Access-Control-Expose-Headers",
+		"Access-Control-Max-Age",
+	} {
+		h.Del(name)
+	}
+	if !c.anyOrigin {
+		addVary(h, "Origin")
+	}
+	if !c.originAllowed(origin) {
+		return
+	}
+	c.setOrigin(h, origin)
+	if c.expose != "" {
+		h.Set("Access-Control-Expose-Headers", c.expose)
+	}
+}
+
+// requestedHeaders returns the lowercased names of a preflight's
+// Access-Control-Request-Headers.
+func requestedHeaders(r *http.Request) []string {
+	var names []string
+	for _, v := range r.Header.Values("Access-Control-Request-Headers") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
+
+// addVary adds name to the Vary header of h unless it is already listed.
+func addVary(h http.Header, name string) {
+	for _, v := range h.Values("Vary") {
+		for _, f := range strings.Split(v, ",") {
+			if f = strings.TrimSpace(f); f == "*" || strings.EqualFold(f, name) {
+				return
+			}
+		}
+	}
+	h.Add("Vary", name)
+}
+
+// corsWriter applies the CORS headers when the response header is written,
+// after the upstream's have been copied.
+type corsWriter struct {
+	http.ResponseWriter
+	cors        *cors
+	origin      string
+	wroteHeader bool
+}
+
+func (w *corsWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.cors.apply(w.Header(), w.origin)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *corsWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *corsWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *corsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
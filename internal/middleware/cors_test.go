@@ -0,0 +1,124 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCORS_Preflight(t *testing.T) {
+	mw, err := CORS(nopLogger{}, CORSOptions{
+		Name:             "api",
+		AllowOrigins:     []string{"https://app.example.com", "https://*.example.org", `regex:https://pr-\d+\.preview\.dev`},
+		AllowMethods:     []string{"GET", "PUT"},
+		AllowHeaders:     []string{"Content-Type", "X-Request-Id"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("preflight reached the upstream")
+	}))
+
+	preflight := func(origin, method, headers string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodOptions, "/orders", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", method)
+		if headers != "" {
+			req.Header.Set("Access-Control-Request-Headers", headers)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := preflight("https://app.example.com", "PUT", "content-type, x-request-id")
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("allowed preflight: status %d", rr.Code)
+	}
+	for name, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.example.com",
+		"Access-Control-Allow-Credentials": "true",
+		"Access-Control-Allow-Methods":     "GET, PUT",
+		"Access-Control-Allow-Headers":     "content-type, x-request-id",
+		"Access-Control-Max-Age":           "600",
+	} {
+		if got := rr.Header().Get(name); got != want {
+			t.Errorf("%s = %q, want %q", name, got, want)
+		}
+	}
+
+	for _, tc := range []struct {
+		origin, method, headers string
+		want                    int
+	}{
+		{"https://a.b.example.org", "GET", "", http.StatusNoContent},
+		{"https://pr-42.preview.dev", "GET", "", http.StatusNoContent},
+		{"https://example.org", "GET", "", http.StatusForbidden},
+		{"https://evil.com", "GET", "", http.StatusForbidden},
+		{"https://pr-42.preview.dev.evil.com", "GET", "", http.StatusForbidden},
+		{"https://app.example.com", "DELETE", "", http.StatusForbidden},
+		{"https://app.example.com", "GET", "X-Admin", http.StatusForbidden},
+	} {
+		rr := preflight(tc.origin, tc.method, tc.headers)
+		if rr.Code != tc.want {
+			t.Errorf("%s %s %q: status %d, want %d", tc.origin, tc.method, tc.headers, rr.Code, tc.want)
+		}
+		if tc.want == http.StatusForbidden && rr.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("%s: rejected preflight grants access", tc.origin)
+		}
+	}
+}
+
+func TestCORS_Request(t *testing.T) {
+	mw, err := CORS(nil, CORSOptions{
+		AllowOrigins:  []string{"https://app.example.com"},
+		ExposeHeaders: []string{"X-Total-Count"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// An upstream with its own, more permissive, policy.
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("Vary", "Accept-Encoding")
+		_, _ = w.Write([]byte("ok"))
+	}))
+
+	do := func(origin string) http.Header {
+		req := httptest.NewRequest(http.MethodGet, "/orders", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Header()
+	}
+
+	hdr := do("https://app.example.com")
+	if got := hdr.Get("Access-Control-Allow-Origin"); got != "https://app.example.com" {
+		t.Errorf("Access-Control-Allow-Origin = %q", got)
+	}
+	if got := hdr.Get("Access-Control-Expose-Headers"); got != "X-Total-Count" {
+		t.Errorf("Access-Control-Expose-Headers = %q", got)
+	}
+	if got := hdr.Values("Vary"); len(got) != 2 || got[1] != "Origin" {
+		t.Errorf("Vary = %q", got)
+	}
+
+	if got := do("https://evil.com").Get("Access-Control-Allow-Origin"); got != "" {
+		t.Errorf("disallowed origin got Access-Control-Allow-Origin %q", got)
+	}
+	if got := do("").Get("Access-Control-Allow-Origin"); got != "*" {
+		t.Errorf("request without Origin changed: %q", got)
+	}
+}
+
+func TestCORS_CredentialsWithAnyOrigin(t *testing.T) {
+	if _, err := CORS(nil, CORSOptions{AllowOrigins: []string{"*"}, AllowCredentials: true}); err == nil {
+		t.Error("credentials allowed for any origin")
+	}
+}
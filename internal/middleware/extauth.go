@@ -0,0 +1,310 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net/http"
+	"net/textproto"
+	"sync"
+	"time"
+
+	"warpgate/internal/clientip"
+	"warpgate/internal/cluster"
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+)
+
+// maxDenyBody bounds the body of a denying response kept to relay it.
+const maxDenyBody = 64 << 10
+
+// ExtAuthOptions configures ExtAuth.
+type ExtAuthOptions struct {
+	// Name labels the middleware in metrics and logs.
+	Name string
+	// Cluster is the auth service, whose endpoints are picked and reported
+	// on like those of any upstream.
+	Cluster   cluster.Cluster
+	Transport http.RoundTripper
+	// PathPrefix is prepended to the request path in the subrequest.
+	PathPrefix string
+	// RequestHeaders are copied to the subrequest (default Authorization
+	// and Cookie).
+	RequestHeaders []string
+	// UpstreamHeaders are copied from an allowing response to the upstream
+	// request. Incoming values of these headers are removed, so clients
+	// cannot set them.
+	UpstreamHeaders []string
+	// Timeout bounds the subrequest (default 5s).
+	Timeout time.Duration
+	// CacheTTL is how long a decision is reused for requests with the same
+	// method, URI and request headers; zero disables caching.
+	CacheTTL time.Duration
+	// CacheSize bounds the number of cached decisions (default 10000).
+	CacheSize int
+}
+
+type extAuth struct {
+	logger logging.Logger
+	opts   ExtAuthOptions
+	cache  *decisionCache
+}
+
+// decision is the outcome of a subrequest: allowed with headers for the
+// upstream, or denied with the response to relay.
+type decision struct {
+	allowed bool
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+// ExtAuth constructs a middleware that asks an auth service whether to
+// admit each request. The service receives a subrequest with the method and
+// URI of the request, the selected headers and X-Forwarded-* headers, but
+// no body. A 2xx response admits the request; any other is returned to the
+// client as is. Requests are rejected with 503 Service Unavailable if the
+// service cannot be reached.
+func ExtAuth(logger logging.Logger, opts ExtAuthOptions) (Middleware, error) {
+	if opts.Cluster == nil {
+		return nil, errors.New("ext auth requires a cluster")
+	}
+	if opts.Transport == nil {
+		opts.Transport = http.DefaultTransport
+	}
+	if len(opts.RequestHeaders) == 0 {
+		opts.RequestHeaders = []string{"Authorization", "Cookie"}
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 5 * time.Second
+	}
+	if opts.CacheSize <= 0 {
+		opts.CacheSize = 10000
+	}
+
+	a := &extAuth{logger: logger, opts: opts}
+	if opts.CacheTTL > 0 {
+		a.cache = &decisionCache{
+			entries: make(map[[sha256.Size]byte]cachedDecision),
+			max:     opts.CacheSize,
+		}
+	}
+	return a.middleware, nil
+}
+
+func (a *extAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := a.cacheKey(r)
+		d, ok := a.cache.get(key)
+		if !ok {
+			var err error
+			d, err = a.check(r)
+			if err != nil {
+				metrics.IncAuthRejected(a.opts.Name, "error")
+				if log := logging.FromContext(r.Context(), a.logger); log != nil {
+					log.Error("ext auth failed",
+						"route", a.opts.Name,
+						"cluster", a.opts.Cluster.Name(),
+						"err", err,
+					)
+				}
+				http.Error(w, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+				return
+			}
+			if d.status < 500 {
+				a.cache.put(key, d, a.opts.CacheTTL)
+			}
+		}
+
+		if !d.allowed {
+			metrics.IncAuthRejected(a.opts.Name, "denied")
+			if log := logging.FromContext(r.Context(), a.logger); log != nil {
+				log.Info("ext auth denied",
+					"route", a.opts.Name,
+					"status", d.status,
+					"path", r.URL.Path,
+				)
+			}
+			h := w.Header()
+			for k, vv := range d.header {
+				h[k] = vv
+			}
+			w.WriteHeader(d.status)
+			_, _ = w.Write(d.body)
+			return
+		}
+
+		if len(a.opts.UpstreamHeaders) > 0 {
+			r = r.Clone(r.Context())
+			for _, name := range a.opts.UpstreamHeaders {
+				r.Header.Del(name)
+				for _, v := range d.header.Values(name) {
+					r.Header.Add(name, v)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// check sends the subrequest for r to an endpoint of the auth cluster.
+func (a *extAuth) check(r *http.Request) (decision, error) {
+	ep, err := a.opts.Cluster.PickEndpoint()
+	if err != nil {
+		return decision{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), a.opts.Timeout)
+	defer cancel()
+
+	u := *ep.URL
+	u.Path = a.opts.PathPrefix + r.URL.Path
+	u.RawPath = ""
+	u.RawQuery = r.URL.RawQuery
+	sub, err := http.NewRequestWithContext(ctx, r.Method, u.String(), nil)
+	if err != nil {
+		return decision{}, err
+	}
+	for _, name := range a.opts.RequestHeaders {
+		for _, v := range r.Header.Values(name) {
+			sub.Header.Add(name, v)
+		}
+	}
+	if addr := clientip.FromRequest(r); addr.IsValid() {
+		sub.Header.Set("X-Forwarded-For", addr.String())
+	}
+	sub.Header.Set("X-Forwarded-Proto", forwardedProto(r))
+	sub.Header.Set("X-Forwarded-Host", r.Host)
+	sub.Header.Set("X-Forwarded-Method", r.Method)
+	sub.Header.Set("X-Forwarded-Uri", r.URL.RequestURI())
+
+	resp, err := a.opts.Transport.RoundTrip(sub)
+	if err != nil {
+		a.opts.Cluster.ReportFailure(ep)
+		return decision{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		a.opts.Cluster.ReportFailure(ep)
+	} else {
+		a.opts.Cluster.ReportSuccess(ep)
+	}
+
+	d := decision{
+		allowed: resp.StatusCode >= 200 && resp.StatusCode < 300,
+		status:  resp.StatusCode,
+		header:  make(http.Header),
+	}
+	if d.allowed {
+		for _, name := range a.opts.UpstreamHeaders {
+			name = textproto.CanonicalMIMEHeaderKey(name)
+			if vv := resp.Header[name]; len(vv) > 0 {
+				d.header[name] = vv
+			}
+		}
+		return d, nil
+	}
+
+	d.body, err = io.ReadAll(io.LimitReader(resp.Body, maxDenyBody))
+	if err != nil {
+		return decision{}, err
+	}
+	for k, vv := range resp.Header {
+		switch k {
+		case "Connection", "Keep-Alive", "Transfer-Encoding", "Content-Length", "Trailer", "Upgrade":
+			continue
+		}
+		d.header[k] = vv
+	}
+	return d, nil
+}
+
+// forwardedProto returns the X-Forwarded-Proto sent to the auth service.
+func forwardedProto(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// cacheKey identifies the requests that get the same decision: those with
+// the same method, URI and headers sent to the auth service, X-Forwarded-*
+// included, as the service may decide by client address or scheme. It is a
+// hash, so credentials are not held in memory.
+func (a *extAuth) cacheKey(r *http.Request) [sha256.Size]byte {
+	if a.cache == nil {
+		return [sha256.Size]byte{}
+	}
+	var b bytes.Buffer
+	b.WriteString(r.Method)
+	b.WriteByte(0)
+	b.WriteString(r.Host)
+	b.WriteByte(0)
+	b.WriteString(r.URL.RequestURI())
+	b.WriteByte(0)
+	if addr := clientip.FromRequest(r); addr.IsValid() {
+		b.WriteString(addr.String())
+	}
+	b.WriteByte(0)
+	b.WriteString(forwardedProto(r))
+	for _, name := range a.opts.RequestHeaders {
+		for _, v := range r.Header.Values(name) {
+			b.WriteByte(0)
+			b.WriteString(name)
+			b.WriteByte(':')
+			b.WriteString(v)
+		}
+	}
+	return sha256.Sum256(b.Bytes())
+}
+
+// decisionCache holds decisions for a short time. A nil cache holds none.
+type decisionCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]cachedDecision
+	max     int
+}
+
+type cachedDecision struct {
+	decision
+	expires time.Time
+}
+
+func (c *decisionCache) get(key [sha256.Size]byte) (decision, bool) {
+	if c == nil {
+		return decision{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[key]
+	if !ok || time.Now().After(e.expires) {
+		return decision{}, false
+	}
+	return e.decision, true
+}
+
+func (c *decisionCache) put(key [sha256.Size]byte, d decision, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.entries) >= c.max {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		for k := range c.entries {
+			if len(c.entries) < c.max {
+				break
+			}
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedDecision{decision: d, expires: now.Add(ttl)}
+}
@@ -0,0 +1,175 @@
+package middleware
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"warpgate/internal/cluster"
+)
+
+func newAuthCluster(t *testing.T, h http.HandlerFunc) cluster.Cluster {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return cluster.NewRoundRobinCluster("auth", []*cluster.Endpoint{{URL: u}}, nil,
+		&cluster.CircuitBreakerConfig{ConsecutiveFailures: 1, Cooldown: time.Minute})
+}
+
+func TestExtAuth(t *testing.T) {
+	var calls atomic.Int32
+	var sub *http.Request
+	cl := newAuthCluster(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		sub = r
+		switch r.Header.Get("Authorization") {
+		case "Bearer good":
+			w.Header().Set("X-User", "alice")
+			w.Header().Set("X-Other", "not forwarded")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="corp"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = io.WriteString(w, "log in first")
+		}
+	})
+
+	mw, err := ExtAuth(nopLogger{}, ExtAuthOptions{
+		Name:            "api",
+		Cluster:         cl,
+		PathPrefix:      "/check",
+		UpstreamHeaders: []string{"X-User"},
+		CacheTTL:        time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upstream *http.Request
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r
+	}))
+
+	do := func(auth string) *httptest.ResponseRecorder {
+		upstream = nil
+		req := httptest.NewRequest(http.MethodPost, "http://example.com/orders?id=7", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", auth)
+		req.Header.Set("X-User", "mallory")
+		req.Header.Set("X-Secret", "not sent")
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("Bearer good")
+	if rr.Code != http.StatusOK || upstream == nil {
+		t.Fatalf("allowed request: status %d", rr.Code)
+	}
+	if got := upstream.Header.Get("X-User"); got != "alice" {
+		t.Errorf("upstream X-User = %q, want alice", got)
+	}
+	if got := upstream.Header.Get("X-Other"); got != "" {
+		t.Errorf("unselected header copied: %q", got)
+	}
+	if sub.Method != http.MethodPost || sub.URL.RequestURI() != "/check/orders?id=7" {
+		t.Errorf("subrequest %s %s", sub.Method, sub.URL.RequestURI())
+	}
+	if sub.Header.Get("X-Secret") != "" || sub.Header.Get("X-Forwarded-For") != "192.0.2.1" || sub.Header.Get("X-Forwarded-Uri") != "/orders?id=7" {
+		t.Errorf("subrequest headers %v", sub.Header)
+	}
+
+	rr = do("Bearer bad")
+	if rr.Code != http.StatusUnauthorized || upstream != nil {
+		t.Fatalf("denied request: status %d", rr.Code)
+	}
+	if rr.Body.String() != "log in first" || rr.Header().Get("WWW-Authenticate") != `Bearer realm="corp"` {
+		t.Errorf("auth response not relayed: %q %v", rr.Body.String(), rr.Header())
+	}
+
+	// Both decisions are cached.
+	do("Bearer good")
+	do("Bearer bad")
+	if n := calls.Load(); n != 2 {
+		t.Errorf("auth service called %d times, want 2", n)
+	}
+}
+
+func TestExtAuth_CacheKeyIncludesForwardedHeaders(t *testing.T) {
+	var calls atomic.Int32
+	cl := newAuthCluster(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if r.Header.Get("X-Forwarded-For") == "192.0.2.1" && r.Header.Get("X-Forwarded-Proto") == "https" {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusForbidden)
+	})
+	mw, err := ExtAuth(nopLogger{}, ExtAuthOptions{Name: "api", Cluster: cl, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func(remoteAddr string, https bool) int {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = remoteAddr
+		req.Header.Set("Authorization", "Bearer same")
+		if https {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := do("192.0.2.1:1234", true); code != http.StatusOK {
+		t.Fatalf("allowed address: status %d", code)
+	}
+	// The cached decision for the first address is not reused for others,
+	// nor for plain HTTP.
+	if code := do("198.51.100.7:1234", true); code != http.StatusForbidden {
+		t.Errorf("other address: status %d, want 403", code)
+	}
+	if code := do("192.0.2.1:1234", false); code != http.StatusForbidden {
+		t.Errorf("plain HTTP: status %d, want 403", code)
+	}
+	if code := do("192.0.2.1:1234", true); code != http.StatusOK {
+		t.Errorf("allowed address again: status %d", code)
+	}
+	if n := calls.Load(); n != 3 {
+		t.Errorf("auth service called %d times, want 3", n)
+	}
+}
+
+func TestExtAuth_Unavailable(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusInternalServerError)
+	cl := newAuthCluster(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(int(status.Load()))
+	})
+	mw, err := ExtAuth(nopLogger{}, ExtAuthOptions{Name: "api", Cluster: cl, CacheTTL: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	do := func() int {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+		return rr.Code
+	}
+
+	// An error of the service is relayed but not cached, and opens the
+	// circuit of its endpoint.
+	if code := do(); code != http.StatusInternalServerError {
+		t.Fatalf("status %d, want 500", code)
+	}
+	status.Store(http.StatusOK)
+	if code := do(); code != http.StatusServiceUnavailable {
+		t.Fatalf("status %d with open circuit, want 503", code)
+	}
+}
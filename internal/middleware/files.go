@@ -0,0 +1,43 @@
+package middleware
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	mod  time.Time
+	size int64
+}
+
+func stampOf(fi os.FileInfo) fileStamp {
+	return fileStamp{fi.ModTime(), fi.Size()}
+}
+
+// filesChanged reports whether any of the files no longer has the version
+// recorded in stamps.
+func filesChanged(stamps map[string]fileStamp) bool {
+	for f, st := range stamps {
+		fi, err := os.Stat(f)
+		if err != nil || stampOf(fi) != st {
+			return true
+		}
+	}
+	return false
+}
+
+// pollEvery calls fn every interval until ctx is done.
+func pollEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"warpgate/internal/logging"
+)
+
+// maxVerified bounds the number of credentials remembered as verified.
+const maxVerified = 10000
+
+// Htpasswd holds the users of an htpasswd file, whose passwords are hashed
+// with bcrypt ($2y$, as written by htpasswd -B) or argon2 in PHC format
+// ($argon2id$v=19$m=...,t=...,p=...$salt$hash). Other schemes are rejected,
+// since they are too cheap to brute-force.
+//
+// Hashing is deliberately slow, so credentials that verified are
+// remembered, by a digest that includes the stored hash: changing a user's
+// password in the file forgets them.
+type Htpasswd struct {
+	file   string
+	logger logging.Logger
+	users  atomic.Pointer[map[string]string]
+
+	mu    sync.Mutex
+	stamp map[string]fileStamp
+
+	verifiedMu sync.Mutex
+	verified   map[[sha256.Size]byte]struct{}
+}
+
+// NewHtpasswd loads the users of file.
+func NewHtpasswd(file string, logger logging.Logger) (*Htpasswd, error) {
+	h := &Htpasswd{
+		file:     file,
+		logger:   logger,
+		verified: make(map[[sha256.Size]byte]struct{}),
+	}
+	if err := h.Reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Reload reads the file again. On error the users are left as they were.
+func (h *Htpasswd) Reload() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	f, err := os.Open(h.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	users := make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		user, hash, ok := strings.Cut(line, ":")
+		if !ok || user == "" {
+			return fmt.Errorf("%s:%d: expected user:hash", h.file, n)
+		}
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "$argon2") {
+			return fmt.Errorf("%s:%d: unsupported hash for user %q, use bcrypt or argon2", h.file, n, user)
+		}
+		users[user] = hash
+	}
+	if err := sc.Err(); err != nil {
+		return fmt.Errorf("%s: %w", h.file, err)
+	}
+
+	h.users.Store(&users)
+	h.stamp = map[string]fileStamp{h.file: stampOf(fi)}
+	return nil
+}
+
+// Watch reloads the file when it changes, checking every interval until ctx
+// is done.
+func (h *Htpasswd) Watch(ctx context.Context, interval time.Duration) {
+	pollEvery(ctx, interval, func() {
+		h.mu.Lock()
+		changed := filesChanged(h.stamp)
+		h.mu.Unlock()
+		if !changed {
+			return
+		}
+		if err := h.Reload(); err != nil {
+			if h.logger != nil {
+				h.logger.Error("htpasswd reload failed", "file", h.file, "err", err)
+			}
+			return
+		}
+		if h.logger != nil {
+			h.logger.Info("htpasswd reloaded", "file", h.file, "users", len(*h.users.Load()))
+		}
+	})
+}
+
+// Verify reports whether password is the password of user.
+func (h *Htpasswd) Verify(user, password string) bool {
+	hash, ok := (*h.users.Load())[user]
+	if !ok {
+		// Spend as long as for a known user, so that timing does not tell
+		// which users exist.
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+
+	digest := sha256.Sum256([]byte(hash + "\x00" + password))
+	h.verifiedMu.Lock()
+	_, seen := h.verified[digest]
+	h.verifiedMu.Unlock()
+	if seen {
+		return true
+	}
+
+	if !checkPassword(hash, password) {
+		return false
+	}
+	h.verifiedMu.Lock()
+	if len(h.verified) >= maxVerified {
+		clear(h.verified)
+	}
+	h.verified[digest] = struct{}{}
+	h.verifiedMu.Unlock()
+	return true
+}
+
+var dummyHash = sync.OnceValue(func() []byte {
+	b, _ := bcrypt.GenerateFromPassword([]byte("warpgate"), bcrypt.DefaultCost)
+	return b
+})
+
+func checkPassword(hash, password string) bool {
+	if strings.HasPrefix(hash, "$2") {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	ok, err := checkArgon2(hash, password)
+	return err == nil && ok
+}
+
+// checkArgon2 checks password against an argon2i or argon2id hash in PHC
+// format.
+func checkArgon2(hash, password string) (bool, error) {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[2] != "v=19" {
+		return false, errors.New("malformed argon2 hash")
+	}
+	var mem uint32
+	var iter uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &mem, &iter, &threads); err != nil {
+		return false, fmt.Errorf("malformed argon2 parameters: %w", err)
+	}
+	if iter == 0 || threads == 0 {
+		return false, errors.New("argon2 time and parallelism must be positive")
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return false, err
+	}
+	want, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return false, err
+	}
+
+	var got []byte
+	switch parts[1] {
+	case "argon2id":
+		got = argon2.IDKey([]byte(password), salt, iter, mem, threads, uint32(len(want)))
+	case "argon2i":
+		got = argon2.Key([]byte(password), salt, iter, mem, threads, uint32(len(want)))
+	default:
+		return false, fmt.Errorf("unsupported argon2 variant %q", parts[1])
+	}
+	return subtle.ConstantTimeCompare(got, want) == 1, nil
+}
@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"context"
+	"slices"
+)
+
+// Identity is the client authenticated by one of the auth middlewares.
+type Identity struct {
+	// Name is the user name, API key name or token subject.
+	Name string
+	// Method is how the client authenticated: "basic", "apikey" or "jwt".
+	Method string
+	// Tier selects the rate limit tier of the client, if any.
+	Tier   string
+	Scopes []string
+}
+
+// HasScopes reports whether the identity was granted every one of scopes.
+func (id *Identity) HasScopes(scopes []string) bool {
+	for _, s := range scopes {
+		if !slices.Contains(id.Scopes, s) {
+			return false
+		}
+	}
+	return true
+}
+
+type identityKey struct{}
+
+// WithIdentity returns a copy of ctx carrying id.
+func WithIdentity(ctx context.Context, id *Identity) context.Context {
+	return context.WithValue(ctx, identityKey{}, id)
+}
+
+// IdentityFromContext returns the identity stored in ctx, if any.
+func IdentityFromContext(ctx context.Context) (*Identity, bool) {
+	id, ok := ctx.Value(identityKey{}).(*Identity)
+	return id, ok
+}
+
+// IdentityName returns the name of the identity stored in ctx, or "" for
+// anonymous requests.
+func IdentityName(ctx context.Context) string {
+	if id, ok := IdentityFromContext(ctx); ok {
+		return id.Name
+	}
+	return ""
+}
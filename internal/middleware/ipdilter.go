@@ -1,15 +1,49 @@
 package middleware
 
 import (
-	"net"
 	"net/http"
-	"strings"
+
+	"warpgate/internal/clientip"
 	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
 )
 
 type ipFilter struct {
 	logger logging.Logger
-	nets   []*net.IPNet
+	name   string
+	allow  *IPList
+	deny   *IPList
+}
+
+// IPRulesOptions configures IPRules.
+type IPRulesOptions struct {
+	// Name labels the rules in metrics and logs (default "global").
+	Name string
+	// Allow, if set, admits only the clients it contains.
+	Allow *IPList
+	// Deny rejects the clients it contains, even if allowed.
+	Deny *IPList
+}
+
+// IPRules constructs a middleware that rejects requests with 403 Forbidden
+// unless their client IP is allowed and not denied. Clients whose address is
+// unknown pass unless there is an allowlist.
+func IPRules(logger logging.Logger, opts IPRulesOptions) Middleware {
+	if opts.Allow == nil && opts.Deny == nil {
+		return func(next http.Handler) http.Handler {
+			return next
+		}
+	}
+	if opts.Name == "" {
+		opts.Name = "global"
+	}
+	f := &ipFilter{
+		logger: logger,
+		name:   opts.Name,
+		allow:  opts.Allow,
+		deny:   opts.Deny,
+	}
+	return f.middleware
 }
 
 // IPFilter constructs a middleware that blocks requests from client IPs
@@ -21,62 +55,38 @@ func IPFilter(logger logging.Logger, cidrs []string) (Middleware, error) {
 		}, nil
 	}
 
-	var nets []*net.IPNet
-	for _, c := range cidrs {
-		_, ipnet, err := net.ParseCIDR(c)
-		if err != nil {
-			return nil, err
-		}
-		nets = append(nets, ipnet)
-	}
-
-	f := &ipFilter{
-		logger: logger,
-		nets:   nets,
+	deny, err := NewIPList("global", cidrs, nil, logger)
+	if err != nil {
+		return nil, err
 	}
-
-	return f.middleware, nil
+	return IPRules(logger, IPRulesOptions{Deny: deny}), nil
 }
 
 func (f *ipFilter) middleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		clientIP := f.extractClientIP(r)
-		if clientIP == nil {
+		clientIP := clientip.FromRequest(r)
+
+		reason := ""
+		switch {
+		case f.deny != nil && f.deny.Contains(clientIP):
+			reason = "deny"
+		case f.allow != nil && !f.allow.Contains(clientIP):
+			reason = "allow"
+		}
+		if reason == "" {
 			next.ServeHTTP(w, r)
 			return
 		}
 
-		for _, n := range f.nets {
-			if n.Contains(clientIP) {
-				if f.logger != nil {
-					f.logger.Info("ip blocked",
-						"ip", clientIP.String(),
-						"path", r.URL.Path,
-					)
-				}
-				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
-				return
-			}
+		metrics.IncIPRejected(f.name, reason)
+		if log := logging.FromContext(r.Context(), f.logger); log != nil {
+			log.Info("ip blocked",
+				"ip", clientIP.String(),
+				"rule", f.name,
+				"reason", reason,
+				"path", r.URL.Path,
+			)
 		}
-
-		next.ServeHTTP(w, r)
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
 	})
 }
-
-func (f *ipFilter) extractClientIP(r *http.Request) net.IP {
-	if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
-		parts := strings.Split(xff, ",")
-		if len(parts) > 0 {
-			ipStr := strings.TrimSpace(parts[0])
-			if ip := net.ParseIP(ipStr); ip != nil {
-				return ip
-			}
-		}
-	}
-
-	host, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return net.ParseIP(r.RemoteAddr)
-	}
-	return net.ParseIP(host)
-}
@@ -4,6 +4,8 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
+
+	"warpgate/internal/clientip"
 )
 
 type nopLogger struct{}
@@ -68,3 +70,35 @@ func TestIPFilter_AllowedNonBlockedIP(t *testing.T) {
 		t.Fatalf("expected status 200, got %d", rr.Code)
 	}
 }
+
+func TestIPFilter_IgnoresSpoofedForwardedFor(t *testing.T) {
+	mw, err := IPFilter(nopLogger{}, []string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatalf("IPFilter error: %v", err)
+	}
+	resolver, err := clientip.NewResolver(clientip.Options{TrustedProxies: []string{"192.0.2.0/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := resolver.Middleware(mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	// A blocked client claiming to forward for someone else.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "10.1.2.3:12345"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 for spoofed header, got %d", rr.Code)
+	}
+
+	// A blocked client behind a trusted proxy.
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.RemoteAddr = "192.0.2.10:12345"
+	req.Header.Set("X-Forwarded-For", "198.51.100.1, 10.1.2.3")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Fatalf("expected status 403 behind trusted proxy, got %d", rr.Code)
+	}
+}
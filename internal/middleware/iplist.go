@@ -0,0 +1,237 @@
+package middleware
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"warpgate/internal/logging"
+)
+
+// IPList is a set of CIDR ranges, given inline or loaded from files with one
+// range or address per line ('#' starts a comment). The files can be
+// watched and the list swapped when they change, without dropping requests.
+//
+// Lookups go through a binary trie, so they cost at most one step per
+// address bit however many ranges the list holds.
+type IPList struct {
+	name   string
+	inline []netip.Prefix
+	files  []string
+	logger logging.Logger
+
+	trie atomic.Pointer[ipTrie]
+
+	mu    sync.Mutex
+	stamp map[string]fileStamp
+}
+
+// NewIPList returns a list of cidrs and the ranges in files. name labels the
+// list in logs.
+func NewIPList(name string, cidrs, files []string, logger logging.Logger) (*IPList, error) {
+	l := &IPList{
+		name:   name,
+		files:  files,
+		logger: logger,
+		stamp:  make(map[string]fileStamp),
+	}
+	for _, c := range cidrs {
+		p, err := parseIPPrefix(c)
+		if err != nil {
+			return nil, err
+		}
+		l.inline = append(l.inline, p)
+	}
+	if err := l.Reload(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Contains reports whether addr is within one of the list's ranges.
+func (l *IPList) Contains(addr netip.Addr) bool {
+	return l.trie.Load().contains(addr)
+}
+
+// Len returns the number of ranges in the list.
+func (l *IPList) Len() int {
+	return l.trie.Load().n
+}
+
+// Reload reads the list's files again. On error the list is left as it was.
+func (l *IPList) Reload() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.reload()
+}
+
+func (l *IPList) reload() error {
+	t := &ipTrie{}
+	for _, p := range l.inline {
+		t.insert(p)
+	}
+	stamps := make(map[string]fileStamp, len(l.files))
+	for _, f := range l.files {
+		st, err := loadIPFile(f, t)
+		if err != nil {
+			return err
+		}
+		stamps[f] = st
+	}
+	l.trie.Store(t)
+	l.stamp = stamps
+	return nil
+}
+
+// Watch checks the list's files every interval until ctx is done, and
+// reloads the list when any of them changed. Failed reloads are logged and
+// retried at the next check.
+func (l *IPList) Watch(ctx context.Context, interval time.Duration) {
+	if len(l.files) == 0 {
+		return
+	}
+	pollEvery(ctx, interval, l.reloadChanged)
+}
+
+func (l *IPList) reloadChanged() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if !filesChanged(l.stamp) {
+		return
+	}
+
+	if err := l.reload(); err != nil {
+		if l.logger != nil {
+			l.logger.Error("ip list reload failed",
+				"list", l.name,
+				"err", err,
+			)
+		}
+		return
+	}
+	if l.logger != nil {
+		l.logger.Info("ip list reloaded",
+			"list", l.name,
+			"ranges", l.trie.Load().n,
+		)
+	}
+}
+
+// loadIPFile adds the ranges in file to t and returns the version read.
+func loadIPFile(file string, t *ipTrie) (fileStamp, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return fileStamp{}, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return fileStamp{}, err
+	}
+
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		p, err := parseIPPrefix(line)
+		if err != nil {
+			return fileStamp{}, fmt.Errorf("%s:%d: %w", file, n, err)
+		}
+		t.insert(p)
+	}
+	if err := sc.Err(); err != nil {
+		return fileStamp{}, fmt.Errorf("%s: %w", file, err)
+	}
+	return stampOf(fi), nil
+}
+
+// parseIPPrefix parses a CIDR range, or an address standing for itself.
+func parseIPPrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		a, err := netip.ParseAddr(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("invalid IP range %q", s)
+		}
+		a = a.Unmap()
+		return netip.PrefixFrom(a, a.BitLen()), nil
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid IP range %q", s)
+	}
+	if a := p.Addr(); a.Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(a.Unmap(), p.Bits()-96)
+	}
+	return p.Masked(), nil
+}
+
+// ipTrie is a binary trie of prefixes, one per address family. A node
+// marked end covers every address below it, so prefixes inside another are
+// not stored.
+type ipTrie struct {
+	v4, v6 *trieNode
+	n      int
+}
+
+type trieNode struct {
+	child [2]*trieNode
+	end   bool
+}
+
+func (t *ipTrie) insert(p netip.Prefix) {
+	root := &t.v6
+	if p.Addr().Is4() {
+		root = &t.v4
+	}
+	if *root == nil {
+		*root = &trieNode{}
+	}
+	t.n++
+
+	b := p.Addr().AsSlice()
+	n := *root
+	for i := 0; i < p.Bits(); i++ {
+		if n.end {
+			return
+		}
+		bit := b[i/8] >> (7 - i%8) & 1
+		if n.child[bit] == nil {
+			n.child[bit] = &trieNode{}
+		}
+		n = n.child[bit]
+	}
+	n.end = true
+	n.child = [2]*trieNode{}
+}
+
+func (t *ipTrie) contains(a netip.Addr) bool {
+	if !a.IsValid() {
+		return false
+	}
+	a = a.Unmap()
+	n := t.v6
+	if a.Is4() {
+		n = t.v4
+	}
+	b := a.AsSlice()
+	for i := 0; n != nil; i++ {
+		if n.end {
+			return true
+		}
+		if i == len(b)*8 {
+			return false
+		}
+		n = n.child[b[i/8]>>(7-i%8)&1]
+	}
+	return false
+}
@@ -0,0 +1,189 @@
+package middleware
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func randomAddr(r *rand.Rand, v4 bool) netip.Addr {
+	if v4 {
+		var b [4]byte
+		for i := range b {
+			b[i] = byte(r.IntN(256))
+		}
+		return netip.AddrFrom4(b)
+	}
+	var b [16]byte
+	for i := range b {
+		b[i] = byte(r.IntN(256))
+	}
+	return netip.AddrFrom16(b)
+}
+
+func TestIPTrie_MatchesLinearScan(t *testing.T) {
+	r := rand.New(rand.NewPCG(1, 2))
+
+	var prefixes []netip.Prefix
+	trie := &ipTrie{}
+	for i := 0; i < 2000; i++ {
+		v4 := i%2 == 0
+		a := randomAddr(r, v4)
+		p, _ := a.Prefix(8 + r.IntN(a.BitLen()-7))
+		prefixes = append(prefixes, p)
+		trie.insert(p)
+	}
+
+	for i := 0; i < 20000; i++ {
+		a := randomAddr(r, i%2 == 0)
+		if i%3 == 0 {
+			// Probe inside a known range, not only at random.
+			p := prefixes[r.IntN(len(prefixes))]
+			if p.Addr().Is4() == a.Is4() {
+				b, c := p.Addr().AsSlice(), a.AsSlice()
+				for j := 0; j < p.Bits(); j++ {
+					mask := byte(1) << (7 - j%8)
+					c[j/8] = c[j/8]&^mask | b[j/8]&mask
+				}
+				a, _ = netip.AddrFromSlice(c)
+			}
+		}
+
+		want := false
+		for _, p := range prefixes {
+			if p.Contains(a) {
+				want = true
+				break
+			}
+		}
+		if got := trie.contains(a); got != want {
+			t.Fatalf("contains(%s) = %v, want %v", a, got, want)
+		}
+	}
+}
+
+func TestIPList(t *testing.T) {
+	l, err := NewIPList("test", []string{"10.0.0.0/8", "192.0.2.1", "2001:db8::/32", "::ffff:198.51.100.0/120"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for addr, want := range map[string]bool{
+		"10.200.0.1":       true,
+		"11.0.0.1":         false,
+		"192.0.2.1":        true,
+		"192.0.2.2":        false,
+		"2001:db8:1::1":    true,
+		"2001:db9::1":      false,
+		"::ffff:10.0.0.1":  true,
+		"198.51.100.77":    true,
+		"::ffff:192.0.2.2": false,
+	} {
+		if got := l.Contains(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("Contains(%s) = %v, want %v", addr, got, want)
+		}
+	}
+	if l.Contains(netip.Addr{}) {
+		t.Error("invalid address matched")
+	}
+
+	if _, err := NewIPList("test", []string{"10.0.0.0/40"}, nil, nil); err == nil {
+		t.Error("expected error for invalid range")
+	}
+}
+
+func TestIPList_ReloadsChangedFiles(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "deny.txt")
+	write := func(content string, mod time.Time) {
+		t.Helper()
+		if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, mod, mod); err != nil {
+			t.Fatal(err)
+		}
+	}
+	start := time.Now().Add(-time.Hour)
+	write("# office\n203.0.113.0/24\n\n198.51.100.7 # vpn\n", start)
+
+	l, err := NewIPList("test", nil, []string{file}, nopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.Len() != 2 || !l.Contains(netip.MustParseAddr("198.51.100.7")) {
+		t.Fatalf("unexpected initial list of %d ranges", l.Len())
+	}
+
+	write("192.0.2.0/24\n", start.Add(time.Minute))
+	l.reloadChanged()
+	if l.Contains(netip.MustParseAddr("198.51.100.7")) || !l.Contains(netip.MustParseAddr("192.0.2.9")) {
+		t.Fatal("list not reloaded after change")
+	}
+
+	// A broken file leaves the list as it was.
+	write("192.0.2.0/24\nnot-an-ip\n", start.Add(2*time.Minute))
+	l.reloadChanged()
+	if !l.Contains(netip.MustParseAddr("192.0.2.9")) {
+		t.Fatal("broken file replaced the list")
+	}
+
+	if _, err := NewIPList("test", nil, []string{file}, nil); err == nil {
+		t.Error("expected error loading a broken file")
+	}
+}
+
+func TestIPRules_AllowAndDeny(t *testing.T) {
+	allow, err := NewIPList("allow", []string{"10.0.0.0/8"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deny, err := NewIPList("deny", []string{"10.6.6.0/24"}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := IPRules(nopLogger{}, IPRulesOptions{Name: "admin", Allow: allow, Deny: deny})(
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	for remote, want := range map[string]int{
+		"10.1.2.3:1000":    http.StatusOK,
+		"10.6.6.6:1000":    http.StatusForbidden,
+		"192.0.2.1:1000":   http.StatusForbidden,
+		"not an address":   http.StatusForbidden,
+		"[::1]:1000":       http.StatusForbidden,
+		"10.255.0.1:65535": http.StatusOK,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/admin", nil)
+		req.RemoteAddr = remote
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != want {
+			t.Errorf("client %s: status %d, want %d", remote, rr.Code, want)
+		}
+	}
+}
+
+func BenchmarkIPList_Contains(b *testing.B) {
+	r := rand.New(rand.NewPCG(1, 2))
+	var cidrs []string
+	for i := 0; i < 50000; i++ {
+		p, _ := randomAddr(r, true).Prefix(16 + r.IntN(17))
+		cidrs = append(cidrs, p.String())
+	}
+	l, err := NewIPList("bench", cidrs, nil, nil)
+	if err != nil {
+		b.Fatal(err)
+	}
+	addrs := make([]netip.Addr, 1024)
+	for i := range addrs {
+		addrs[i] = randomAddr(r, true)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		l.Contains(addrs[i%len(addrs)])
+	}
+}
@@ -0,0 +1,188 @@
+package middleware
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+
+	"golang.org/x/net/http/httpguts"
+
+	"warpgate/internal/jwt"
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+)
+
+// JWTAuthOptions configures JWTAuth.
+type JWTAuthOptions struct {
+	// Name labels the middleware in metrics and logs.
+	Name     string
+	Verifier *jwt.Verifier
+	// Claims maps claim names to accepted values. For each, the token's
+	// claim must be one of them, or contain one of them if it is an array.
+	Claims map[string][]string
+	// Scopes must all be granted by the token.
+	Scopes []string
+	// ForwardClaims maps claim names to the request headers they are copied
+	// to for the upstream. Incoming values of these headers are removed, so
+	// clients cannot set them.
+	ForwardClaims map[string]string
+	// Realm is sent in WWW-Authenticate challenges (default "warpgate").
+	Realm string
+}
+
+type jwtAuth struct {
+	logger logging.Logger
+	opts   JWTAuthOptions
+}
+
+// JWTAuth constructs a middleware that admits requests carrying a valid
+// bearer token. Requests without one, or with an invalid one, are rejected
+// with 401 Unauthorized and those whose token lacks a required claim or
+// scope with 403 Forbidden, with challenges as in RFC 6750. The verified
+// token is stored in the request context, see jwt.FromContext, along with
+// an Identity for its subject.
+func JWTAuth(logger logging.Logger, opts JWTAuthOptions) (Middleware, error) {
+	if opts.Verifier == nil {
+		return nil, errors.New("jwt auth requires a verifier")
+	}
+	if opts.Realm == "" {
+		opts.Realm = "warpgate"
+	}
+	a := &jwtAuth{logger: logger, opts: opts}
+	return a.middleware, nil
+}
+
+func (a *jwtAuth) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, ok := bearerToken(r)
+		if !ok {
+			a.reject(w, r, http.StatusUnauthorized, "missing", "", nil)
+			return
+		}
+
+		tok, err := a.opts.Verifier.Verify(r.Context(), raw)
+		if err != nil {
+			a.reject(w, r, http.StatusUnauthorized, "invalid", `error="invalid_token", error_description=`+quote(describe(err)), err)
+			return
+		}
+		if claim, ok := a.checkClaims(tok.Claims); !ok {
+			err := fmt.Errorf("claim %s not accepted", claim)
+			a.reject(w, r, http.StatusForbidden, "forbidden", `error="insufficient_scope", error_description=`+quote(err.Error()), err)
+			return
+		}
+		if missing := a.missingScopes(tok.Claims); len(missing) > 0 {
+			err := fmt.Errorf("missing scopes %s", strings.Join(missing, " "))
+			a.reject(w, r, http.StatusForbidden, "forbidden", `error="insufficient_scope", scope=`+quote(strings.Join(a.opts.Scopes, " ")), err)
+			return
+		}
+
+		sub, _ := tok.Claims.String("sub")
+		metrics.IncAuthenticated(a.opts.Name, "jwt", "")
+		ctx := jwt.NewContext(r.Context(), tok)
+		r = r.WithContext(WithIdentity(ctx, &Identity{Name: sub, Method: "jwt", Scopes: tok.Claims.Scopes()}))
+		if len(a.opts.ForwardClaims) > 0 {
+			r = r.Clone(r.Context())
+			for claim, header := range a.opts.ForwardClaims {
+				r.Header.Del(header)
+				if v, ok := claimHeaderValue(tok.Claims[claim]); ok && httpguts.ValidHeaderFieldValue(v) {
+					r.Header.Set(header, v)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// checkClaims returns the first required claim the token fails.
+func (a *jwtAuth) checkClaims(c jwt.Claims) (string, bool) {
+	for name, accepted := range a.opts.Claims {
+		values := c.Strings(name)
+		if !slices.ContainsFunc(values, func(v string) bool { return slices.Contains(accepted, v) }) {
+			return name, false
+		}
+	}
+	return "", true
+}
+
+func (a *jwtAuth) missingScopes(c jwt.Claims) []string {
+	if len(a.opts.Scopes) == 0 {
+		return nil
+	}
+	granted := c.Scopes()
+	var missing []string
+	for _, s := range a.opts.Scopes {
+		if !slices.Contains(granted, s) {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+func (a *jwtAuth) reject(w http.ResponseWriter, r *http.Request, status int, reason, params string, err error) {
+	metrics.IncAuthRejected(a.opts.Name, reason)
+	if log := logging.FromContext(r.Context(), a.logger); log != nil {
+		args := []any{
+			"route", a.opts.Name,
+			"reason", reason,
+			"path", r.URL.Path,
+		}
+		if err != nil {
+			args = append(args, "err", err)
+		}
+		log.Info("jwt rejected", args...)
+	}
+
+	challenge := "Bearer realm=" + quote(a.opts.Realm)
+	if params != "" {
+		challenge += ", " + params
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	http.Error(w, http.StatusText(status), status)
+}
+
+// bearerToken returns the token of a bearer Authorization header.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// describe returns the message of a verification error for the client,
+// without details such as why keys could not be fetched.
+func describe(err error) string {
+	for _, known := range []error{jwt.ErrMalformed, jwt.ErrAlgorithm, jwt.ErrUnknownKey, jwt.ErrSignature,
+		jwt.ErrExpired, jwt.ErrNotYetValid, jwt.ErrIssuer, jwt.ErrAudience, jwt.ErrMissingClaim} {
+		if errors.Is(err, known) {
+			return strings.TrimPrefix(err.Error(), "jwt: ")
+		}
+	}
+	return "token could not be verified"
+}
+
+func quote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// claimHeaderValue renders a claim for a header: scalars as is, arrays
+// comma-separated and objects as JSON.
+func claimHeaderValue(v any) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case []any:
+		return strings.Join(jwt.Claims{"v": v}.Strings("v"), ","), true
+	case map[string]any:
+		b, err := json.Marshal(v)
+		return string(b), err == nil
+	default:
+		return jwt.Claims{"v": v}.String("v")
+	}
+}
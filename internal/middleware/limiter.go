@@ -0,0 +1,122 @@
+package middleware
+
+import (
+	"context"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+const limiterShards = 16
+
+// LocalLimiter implements Limit in memory with the generic cell rate
+// algorithm (GCRA), a token bucket that stores a single timestamp per key:
+// the theoretical arrival time (TAT) at which the key's bucket is full again.
+//
+// A key whose TAT has passed is indistinguishable from one never seen, so
+// idle keys are dropped without changing any decision. Keys are swept
+// lazily; beyond maxKeys, arbitrary keys are dropped, which only makes the
+// limiter more lenient towards them.
+type LocalLimiter struct {
+	limit  Limit
+	seed   maphash.Seed
+	shards [limiterShards]limiterShard
+	maxPer int
+	now    func() time.Time
+}
+
+type limiterShard struct {
+	mu        sync.Mutex
+	tat       map[string]int64
+	lastSweep int64
+}
+
+// sweepInterval bounds how often a shard is swept for idle keys.
+const sweepInterval = 10 * time.Second
+
+// NewLocalLimiter returns a limiter holding at most maxKeys keys (default
+// 100000).
+func NewLocalLimiter(limit Limit, maxKeys int) *LocalLimiter {
+	if maxKeys <= 0 {
+		maxKeys = 100000
+	}
+	l := &LocalLimiter{
+		limit:  limit.withDefaults(),
+		seed:   maphash.MakeSeed(),
+		maxPer: max(maxKeys/limiterShards, 1),
+		now:    time.Now,
+	}
+	for i := range l.shards {
+		l.shards[i].tat = make(map[string]int64)
+	}
+	return l
+}
+
+func (l *LocalLimiter) Allow(_ context.Context, key string) Decision {
+	now := l.now().UnixNano()
+	s := &l.shards[maphash.String(l.seed, key)%limiterShards]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now-s.lastSweep >= int64(sweepInterval) || len(s.tat) >= l.maxPer {
+		s.sweep(now, l.maxPer)
+	}
+
+	tat, d := gcra(l.limit, s.tat[key], now)
+	if d.Allowed {
+		s.tat[key] = tat
+	}
+	return d
+}
+
+// Len returns the number of keys held.
+func (l *LocalLimiter) Len() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.mu.Lock()
+		n += len(s.tat)
+		s.mu.Unlock()
+	}
+	return n
+}
+
+// sweep drops idle keys, and arbitrary ones if the shard is still full.
+func (s *limiterShard) sweep(now int64, maxKeys int) {
+	s.lastSweep = now
+	for k, tat := range s.tat {
+		if tat <= now {
+			delete(s.tat, k)
+		}
+	}
+	for k := range s.tat {
+		if len(s.tat) < maxKeys {
+			break
+		}
+		delete(s.tat, k)
+	}
+}
+
+// gcra decides on a request arriving at now for a key whose theoretical
+// arrival time is tat (zero for a new key), and returns the key's new TAT.
+// Times are in nanoseconds.
+func gcra(l Limit, tat, now int64) (int64, Decision) {
+	interval := int64(l.interval())
+	tolerance := interval * int64(l.Burst)
+
+	tat = max(tat, now)
+	newTat := tat + interval
+	allowAt := newTat - tolerance
+
+	d := Decision{Limit: l.Burst}
+	if now < allowAt {
+		d.RetryAfter = time.Duration(allowAt - now)
+		d.Reset = time.Duration(tat - now)
+		return tat, d
+	}
+	d.Allowed = true
+	d.Remaining = int((now - allowAt) / interval)
+	d.Reset = time.Duration(newTat - now)
+	return newTat, d
+}
@@ -0,0 +1,258 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"warpgate/internal/clientip"
+	"warpgate/internal/jwt"
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+)
+
+// Limit allows Requests per Period on average, with bursts of up to Burst
+// requests.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+	// Burst is the capacity of the bucket (default Requests).
+	Burst int
+}
+
+func (l Limit) withDefaults() Limit {
+	if l.Period <= 0 {
+		l.Period = time.Second
+	}
+	if l.Burst <= 0 {
+		l.Burst = l.Requests
+	}
+	return l
+}
+
+// interval is the time it takes for one request to be replenished.
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Requests)
+}
+
+// Decision is a limiter's verdict on one request.
+type Decision struct {
+	Allowed bool
+	// Limit is the bucket capacity and Remaining the requests left in it.
+	Limit     int
+	Remaining int
+	// RetryAfter is how long a rejected client should wait.
+	RetryAfter time.Duration
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+}
+
+// Limiter decides whether a request identified by key may proceed.
+type Limiter interface {
+	Allow(ctx context.Context, key string) Decision
+}
+
+// KeyFunc identifies the client a request is counted against.
+type KeyFunc func(r *http.Request) string
+
+// RateLimitOptions configures RateLimit.
+type RateLimitOptions struct {
+	// Name labels the limit in metrics and logs (default "global").
+	Name  string
+	Limit Limit
+	// Key identifies clients (default KeyByIP).
+	Key KeyFunc
+	// Limiter holds the per-client state (default a LocalLimiter for Limit).
+	Limiter Limiter
+	// Tiers holds the limits of clients whose Identity has a tier, by tier
+	// name. Clients of other tiers get Limit.
+	Tiers map[string]Tier
+}
+
+// Tier is the limit of a tier of clients.
+type Tier struct {
+	Limit Limit
+	// Limiter holds the per-client state of the tier (default a
+	// LocalLimiter for Limit).
+	Limiter Limiter
+}
+
+// tierLimiter is a limiter with the RateLimit-Policy of its limit.
+type tierLimiter struct {
+	limiter Limiter
+	policy  string
+}
+
+type rateLimiter struct {
+	logger logging.Logger
+	name   string
+	key    KeyFunc
+	base   tierLimiter
+	tiers  map[string]tierLimiter
+}
+
+// RateLimit constructs a middleware that rejects clients exceeding a limit
+// with 429 Too Many Requests. Every response carries RateLimit-Limit,
+// RateLimit-Remaining and RateLimit-Reset headers, and rejections also
+// carry Retry-After.
+func RateLimit(logger logging.Logger, opts RateLimitOptions) (Middleware, error) {
+	if opts.Limit.Requests <= 0 {
+		return nil, fmt.Errorf("rate limit requests must be positive, got %d", opts.Limit.Requests)
+	}
+	opts.Limit = opts.Limit.withDefaults()
+	if opts.Name == "" {
+		opts.Name = "global"
+	}
+	if opts.Key == nil {
+		opts.Key = KeyByIP()
+	}
+	if opts.Limiter == nil {
+		opts.Limiter = NewLocalLimiter(opts.Limit, 0)
+	}
+
+	rl := &rateLimiter{
+		logger: logger,
+		name:   opts.Name,
+		key:    opts.Key,
+		base:   tierLimiter{limiter: opts.Limiter, policy: policy(opts.Limit)},
+		tiers:  make(map[string]tierLimiter, len(opts.Tiers)),
+	}
+	for name, t := range opts.Tiers {
+		if t.Limit.Requests <= 0 {
+			return nil, fmt.Errorf("rate limit tier %s: requests must be positive, got %d", name, t.Limit.Requests)
+		}
+		t.Limit = t.Limit.withDefaults()
+		if t.Limiter == nil {
+			t.Limiter = NewLocalLimiter(t.Limit, 0)
+		}
+		rl.tiers[name] = tierLimiter{limiter: t.Limiter, policy: policy(t.Limit)}
+	}
+	return rl.middleware, nil
+}
+
+func policy(l Limit) string {
+	return fmt.Sprintf("%d;w=%d", l.Requests, int64(math.Ceil(l.Period.Seconds())))
+}
+
+// tier returns the limiter for the client of r.
+func (rl *rateLimiter) tier(r *http.Request) tierLimiter {
+	if id, ok := IdentityFromContext(r.Context()); ok && id.Tier != "" {
+		if t, ok := rl.tiers[id.Tier]; ok {
+			return t
+		}
+	}
+	return rl.base
+}
+
+func (rl *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := rl.key(r)
+		t := rl.tier(r)
+		d := t.limiter.Allow(r.Context(), key)
+
+		h := w.Header()
+		h.Set("RateLimit-Policy", t.policy)
+		h.Set("RateLimit-Limit", strconv.Itoa(d.Limit))
+		h.Set("RateLimit-Remaining", strconv.Itoa(d.Remaining))
+		h.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(d.Reset), 10))
+
+		if !d.Allowed {
+			metrics.IncRateLimited(rl.name)
+			if log := logging.FromContext(r.Context(), rl.logger); log != nil {
+				log.Info("rate limited",
+					"limit", rl.name,
+					"key", key,
+					"path", r.URL.Path,
+				)
+			}
+			h.Set("Retry-After", strconv.FormatInt(max(ceilSeconds(d.RetryAfter), 1), 10))
+			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+// ParseRateLimitKey parses a key specification: "ip", "identity",
+// "header:<name>" or "claim:<name>".
+func ParseRateLimitKey(spec string) (KeyFunc, error) {
+	kind, arg, _ := strings.Cut(spec, ":")
+	switch strings.ToLower(strings.TrimSpace(kind)) {
+	case "", "ip":
+		return KeyByIP(), nil
+	case "identity":
+		return KeyByIdentity(), nil
+	case "header":
+		if arg = strings.TrimSpace(arg); arg == "" {
+			return nil, fmt.Errorf("rate limit key %q: missing header name", spec)
+		}
+		return KeyByHeader(arg), nil
+	case "claim":
+		if arg = strings.TrimSpace(arg); arg == "" {
+			return nil, fmt.Errorf("rate limit key %q: missing claim name", spec)
+		}
+		return KeyByClaim(arg), nil
+	default:
+		return nil, fmt.Errorf("unknown rate limit key %q", spec)
+	}
+}
+
+// KeyByIP keys requests by client address.
+func KeyByIP() KeyFunc {
+	return func(r *http.Request) string {
+		return "ip:" + remoteIP(r)
+	}
+}
+
+// KeyByIdentity keys requests by the client authenticated by an auth
+// middleware earlier in the chain. Anonymous requests are keyed by IP.
+func KeyByIdentity() KeyFunc {
+	return func(r *http.Request) string {
+		if id, ok := IdentityFromContext(r.Context()); ok && id.Name != "" {
+			return "id:" + id.Method + ":" + id.Name
+		}
+		return "ip:" + remoteIP(r)
+	}
+}
+
+// KeyByHeader keys requests by the value of a header, such as an API key.
+// Requests without it are keyed by IP.
+func KeyByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		if v := r.Header.Get(name); v != "" {
+			return "header:" + v
+		}
+		return "ip:" + remoteIP(r)
+	}
+}
+
+// KeyByClaim keys requests by a claim of the JWT verified by JWTAuth, which
+// must therefore run before the limiter. Requests without a verified token
+// carrying the claim are keyed by IP: an unverified token is never trusted,
+// as a client could choose its key by forging one.
+func KeyByClaim(claim string) KeyFunc {
+	return func(r *http.Request) string {
+		if tok, ok := jwt.FromContext(r.Context()); ok {
+			if v, _ := tok.Claims.String(claim); v != "" {
+				return "claim:" + v
+			}
+		}
+		return "ip:" + remoteIP(r)
+	}
+}
+
+// remoteIP returns the client address resolved for r.
+func remoteIP(r *http.Request) string {
+	if addr := clientip.FromRequest(r); addr.IsValid() {
+		return addr.String()
+	}
+	return r.RemoteAddr
+}
@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"warpgate/internal/jwt"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestLimiter(limit Limit, maxKeys int) (*LocalLimiter, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	l := NewLocalLimiter(limit, maxKeys)
+	l.now = clock.now
+	return l, clock
+}
+
+func TestLocalLimiter_GCRA(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Requests: 10, Period: time.Second, Burst: 3}, 0)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		d := l.Allow(ctx, "a")
+		if !d.Allowed || d.Remaining != 2-i || d.Limit != 3 {
+			t.Fatalf("request %d: %+v, want allowed with %d remaining", i, d, 2-i)
+		}
+	}
+	d := l.Allow(ctx, "a")
+	if d.Allowed {
+		t.Fatalf("burst exceeded but allowed: %+v", d)
+	}
+	if d.RetryAfter != 100*time.Millisecond || d.Reset != 300*time.Millisecond {
+		t.Errorf("retry after %v, reset %v; want 100ms, 300ms", d.RetryAfter, d.Reset)
+	}
+
+	if d := l.Allow(ctx, "b"); !d.Allowed {
+		t.Errorf("other key limited: %+v", d)
+	}
+
+	clock.advance(100 * time.Millisecond)
+	if d := l.Allow(ctx, "a"); !d.Allowed || d.Remaining != 0 {
+		t.Errorf("after one interval: %+v, want allowed with 0 remaining", d)
+	}
+	if d := l.Allow(ctx, "a"); d.Allowed {
+		t.Errorf("second request after one interval allowed: %+v", d)
+	}
+
+	clock.advance(time.Second)
+	if d := l.Allow(ctx, "a"); !d.Allowed || d.Remaining != 2 {
+		t.Errorf("after refill: %+v, want allowed with 2 remaining", d)
+	}
+}
+
+func TestLocalLimiter_EvictsIdleKeys(t *testing.T) {
+	l, clock := newTestLimiter(Limit{Requests: 1, Period: time.Second}, 1000)
+	ctx := context.Background()
+
+	for i := 0; i < 500; i++ {
+		l.Allow(ctx, fmt.Sprint("key-", i))
+	}
+	if n := l.Len(); n != 500 {
+		t.Fatalf("Len = %d, want 500", n)
+	}
+
+	// Shards are swept as they are used; enough keys reach all of them.
+	clock.advance(sweepInterval)
+	for i := 0; i < 400; i++ {
+		l.Allow(ctx, fmt.Sprint("new-", i))
+	}
+	if n := l.Len(); n != 400 {
+		t.Errorf("Len after idle keys expired = %d, want 400", n)
+	}
+
+	for i := 0; i < 5000; i++ {
+		l.Allow(ctx, fmt.Sprint("flood-", i))
+	}
+	if n := l.Len(); n > 1000 {
+		t.Errorf("Len = %d, want at most maxKeys", n)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	limiter, _ := newTestLimiter(Limit{Requests: 2, Period: time.Minute}, 0)
+	mw, err := RateLimit(nopLogger{}, RateLimitOptions{
+		Limit:   Limit{Requests: 2, Period: time.Minute},
+		Limiter: limiter,
+	})
+	if err != nil {
+		t.Fatalf("RateLimit error: %v", err)
+	}
+	h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	do := func(addr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := do("10.0.0.1:1234")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	for k, want := range map[string]string{
+		"RateLimit-Policy":    "2;w=60",
+		"RateLimit-Limit":     "2",
+		"RateLimit-Remaining": "1",
+		"RateLimit-Reset":     "30",
+	} {
+		if got := rr.Header().Get(k); got != want {
+			t.Errorf("%s = %q, want %q", k, got, want)
+		}
+	}
+
+	do("10.0.0.1:1235")
+	rr = do("10.0.0.1:1236")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", rr.Code)
+	}
+	if got := rr.Header().Get("Retry-After"); got != "30" {
+		t.Errorf("Retry-After = %q, want 30", got)
+	}
+	if got := rr.Header().Get("RateLimit-Remaining"); got != "0" {
+		t.Errorf("RateLimit-Remaining = %q, want 0", got)
+	}
+
+	if rr := do("10.0.0.2:1234"); rr.Code != http.StatusOK {
+		t.Errorf("other client: expected 200, got %d", rr.Code)
+	}
+}
+
+func TestRateLimit_RejectsInvalidLimit(t *testing.T) {
+	if _, err := RateLimit(nil, RateLimitOptions{}); err == nil {
+		t.Error("expected an error for a zero limit")
+	}
+}
+
+func TestRateLimitKeys(t *testing.T) {
+	token := func(payload string) string {
+		enc := base64.RawURLEncoding
+		return "Bearer " + enc.EncodeToString([]byte(`{"alg":"none"}`)) + "." + enc.EncodeToString([]byte(payload)) + ".sig"
+	}
+
+	tests := []struct {
+		spec     string
+		header   http.Header
+		verified jwt.Claims
+		want     string
+	}{
+		{"ip", nil, nil, "ip:192.0.2.1"},
+		{"header:X-API-Key", http.Header{"X-Api-Key": {"k1"}}, nil, "header:k1"},
+		{"header:X-API-Key", nil, nil, "ip:192.0.2.1"},
+		{"claim:sub", nil, jwt.Claims{"sub": "alice"}, "claim:alice"},
+		{"claim:tenant", nil, jwt.Claims{"tenant": float64(42)}, "claim:42"},
+		{"claim:tenant", nil, jwt.Claims{"sub": "alice"}, "ip:192.0.2.1"},
+		// Tokens that JWTAuth has not verified are ignored.
+		{"claim:sub", http.Header{"Authorization": {token(`{"sub":"alice"}`)}}, nil, "ip:192.0.2.1"},
+		{"claim:sub", http.Header{"Authorization": {"Bearer garbage"}}, nil, "ip:192.0.2.1"},
+		{"claim:sub", http.Header{"Authorization": {"Basic dXNlcjpwYXNz"}}, nil, "ip:192.0.2.1"},
+	}
+	for _, tt := range tests {
+		key, err := ParseRateLimitKey(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseRateLimitKey(%q): %v", tt.spec, err)
+		}
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+		req.RemoteAddr = "192.0.2.1:5555"
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		if tt.verified != nil {
+			req = req.WithContext(jwt.NewContext(req.Context(), &jwt.Token{Claims: tt.verified}))
+		}
+		if got := key(req); got != tt.want {
+			t.Errorf("%s with %v %v: key = %q, want %q", tt.spec, tt.header, tt.verified, got, tt.want)
+		}
+	}
+
+	for _, bad := range []string{"header:", "claim", "cookie:x"} {
+		if _, err := ParseRateLimitKey(bad); err == nil {
+			t.Errorf("ParseRateLimitKey(%q): expected error", bad)
+		}
+	}
+}
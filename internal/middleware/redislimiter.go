@@ -0,0 +1,158 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"warpgate/internal/logging"
+	"warpgate/internal/metrics"
+	"warpgate/internal/resp"
+)
+
+// gcraScript runs the algorithm of gcra on the server, so that every replica shares a
+// key's state and decisions are atomic. Times are microseconds of the
+// server's clock, which spares replicas from agreeing on the time.
+//
+// KEYS[1] is the key; ARGV[1] the emission interval and ARGV[2] the burst.
+// The reply is {allowed, remaining, retry after, reset}.
+const gcraScript = `
+if redis.replicate_commands then redis.replicate_commands() end
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local tat = tonumber(redis.call('GET', KEYS[1]) or now)
+if tat < now then tat = now end
+local new_tat = tat + interval
+local allow_at = new_tat - interval * burst
+if now < allow_at then
+  return {0, 0, allow_at - now, tat - now}
+end
+redis.call('SET', KEYS[1], new_tat, 'PX', math.ceil((new_tat - now) / 1000))
+return {1, math.floor((now - allow_at) / interval), 0, new_tat - now}
+`
+
+var sharedGCRA = resp.NewScript(gcraScript)
+
+// RedisLimiterOptions configures a RedisLimiter.
+type RedisLimiterOptions struct {
+	// Name labels the limiter in metrics and logs, and separates its keys
+	// from those of other limits.
+	Name string
+	// Prefix is prepended to every key (default "warpgate:ratelimit:").
+	Prefix string
+	// Fallback decides while the server is unreachable (default a
+	// LocalLimiter for the same limit).
+	Fallback Limiter
+	// Cooldown is how long the fallback is used after a failure before the
+	// server is tried again (default 5s).
+	Cooldown time.Duration
+	Logger   logging.Logger
+}
+
+// RedisLimiter enforces a limit shared by every warpgate instance using the
+// same Redis-compatible server, rather than one per process.
+//
+// When the server fails, decisions are made by a local fallback limiter for
+// a cooldown, so requests are neither rejected nor delayed by the outage.
+// The fallback enforces the limit per process.
+type RedisLimiter struct {
+	client   *resp.Client
+	limit    Limit
+	name     string
+	prefix   string
+	fallback Limiter
+	cooldown time.Duration
+	logger   logging.Logger
+
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func NewRedisLimiter(client *resp.Client, limit Limit, opts RedisLimiterOptions) *RedisLimiter {
+	limit = limit.withDefaults()
+	if opts.Prefix == "" {
+		opts.Prefix = "warpgate:ratelimit:"
+	}
+	if opts.Fallback == nil {
+		opts.Fallback = NewLocalLimiter(limit, 0)
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = 5 * time.Second
+	}
+	return &RedisLimiter{
+		client:   client,
+		limit:    limit,
+		name:     opts.Name,
+		prefix:   opts.Prefix + opts.Name + ":",
+		fallback: opts.Fallback,
+		cooldown: opts.Cooldown,
+		logger:   opts.Logger,
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string) Decision {
+	if l.down() {
+		metrics.IncRateLimitFallback(l.name)
+		return l.fallback.Allow(ctx, key)
+	}
+
+	v, err := sharedGCRA.Run(ctx, l.client, []string{l.prefix + key},
+		l.limit.interval().Microseconds(), l.limit.Burst)
+	var d Decision
+	if err == nil {
+		d, err = l.decision(v)
+	}
+	if err != nil {
+		if ctx.Err() == nil {
+			l.fail(err)
+		}
+		metrics.IncRateLimitFallback(l.name)
+		return l.fallback.Allow(ctx, key)
+	}
+	return d
+}
+
+func (l *RedisLimiter) decision(v any) (Decision, error) {
+	reply, ok := v.([]any)
+	if !ok || len(reply) != 4 {
+		return Decision{}, fmt.Errorf("unexpected script reply %v", v)
+	}
+	var n [4]int64
+	for i, r := range reply {
+		if n[i], ok = r.(int64); !ok {
+			return Decision{}, fmt.Errorf("unexpected script reply %v", v)
+		}
+	}
+	return Decision{
+		Allowed:    n[0] == 1,
+		Limit:      l.limit.Burst,
+		Remaining:  int(n[1]),
+		RetryAfter: time.Duration(n[2]) * time.Microsecond,
+		Reset:      time.Duration(n[3]) * time.Microsecond,
+	}, nil
+}
+
+func (l *RedisLimiter) down() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return time.Now().Before(l.downUntil)
+}
+
+// fail switches to the fallback for the cooldown.
+func (l *RedisLimiter) fail(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Now().Before(l.downUntil) {
+		return
+	}
+	l.downUntil = time.Now().Add(l.cooldown)
+	if l.logger != nil {
+		l.logger.Error("rate limit store unavailable, limiting locally",
+			"limit", l.name,
+			"err", err,
+		)
+	}
+}
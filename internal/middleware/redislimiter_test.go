@@ -0,0 +1,116 @@
+package middleware
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"warpgate/internal/resp"
+	"warpgate/internal/resp/resptest"
+)
+
+// emulateGCRA stands in for gcraScript on the test server.
+func emulateGCRA(tx *resptest.Tx, keys, args []string) any {
+	interval, _ := strconv.ParseInt(args[0], 10, 64)
+	burst, _ := strconv.ParseInt(args[1], 10, 64)
+	now := tx.Now().UnixMicro()
+
+	tat := now
+	if v, ok := tx.Get(keys[0]); ok {
+		tat, _ = strconv.ParseInt(string(v), 10, 64)
+	}
+	tat = max(tat, now)
+	newTat := tat + interval
+	allowAt := newTat - interval*burst
+	if now < allowAt {
+		return []any{int64(0), int64(0), allowAt - now, tat - now}
+	}
+	ttl := time.Duration(newTat-now) * time.Microsecond
+	tx.Set(keys[0], []byte(strconv.FormatInt(newTat, 10)), ttl)
+	return []any{int64(1), (now - allowAt) / interval, int64(0), newTat - now}
+}
+
+type countingLimiter struct {
+	calls int
+}
+
+func (l *countingLimiter) Allow(context.Context, string) Decision {
+	l.calls++
+	return Decision{Allowed: true, Limit: 1, Remaining: 1}
+}
+
+func TestRedisLimiter_SharedAcrossInstances(t *testing.T) {
+	srv := resptest.NewServer(t)
+	srv.HandleScript(gcraScript, emulateGCRA)
+
+	limit := Limit{Requests: 3, Period: time.Minute}
+	newReplica := func() *RedisLimiter {
+		c := resp.NewClient(resp.Options{Addr: srv.Addr()})
+		t.Cleanup(func() { c.Close() })
+		return NewRedisLimiter(c, limit, RedisLimiterOptions{Name: "api"})
+	}
+	a, b := newReplica(), newReplica()
+	ctx := context.Background()
+
+	for i, l := range []*RedisLimiter{a, b, a} {
+		d := l.Allow(ctx, "ip:10.0.0.1")
+		if !d.Allowed || d.Remaining != 2-i || d.Limit != 3 {
+			t.Fatalf("request %d: %+v, want allowed with %d remaining", i, d, 2-i)
+		}
+	}
+	d := b.Allow(ctx, "ip:10.0.0.1")
+	if d.Allowed {
+		t.Fatalf("shared limit exceeded but allowed: %+v", d)
+	}
+	if d.RetryAfter < 19*time.Second || d.RetryAfter > 20*time.Second {
+		t.Errorf("RetryAfter = %v, want about 20s", d.RetryAfter)
+	}
+	if d := a.Allow(ctx, "ip:10.0.0.2"); !d.Allowed {
+		t.Errorf("other key limited: %+v", d)
+	}
+
+	keys := srv.Keys()
+	if len(keys) != 2 || keys[0] != "warpgate:ratelimit:api:ip:10.0.0.1" {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	if ttl := srv.TTL(keys[0]); ttl <= 0 || ttl > time.Minute {
+		t.Errorf("key TTL = %v, want up to the time until the bucket is full", ttl)
+	}
+}
+
+func TestRedisLimiter_FallsBackWhenUnreachable(t *testing.T) {
+	srv := resptest.NewServer(t)
+	srv.HandleScript(gcraScript, emulateGCRA)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr(), DialTimeout: 100 * time.Millisecond})
+	defer c.Close()
+
+	fallback := &countingLimiter{}
+	l := NewRedisLimiter(c, Limit{Requests: 1, Period: time.Minute}, RedisLimiterOptions{
+		Name:     "api",
+		Fallback: fallback,
+		Cooldown: 50 * time.Millisecond,
+	})
+	ctx := context.Background()
+
+	if d := l.Allow(ctx, "k"); !d.Allowed || fallback.calls != 0 {
+		t.Fatalf("first request: %+v, fallback calls %d", d, fallback.calls)
+	}
+
+	srv.Close()
+	for i := 0; i < 3; i++ {
+		if d := l.Allow(ctx, "k"); !d.Allowed {
+			t.Errorf("request %d during outage rejected: %+v", i, d)
+		}
+	}
+	if fallback.calls != 3 {
+		t.Errorf("fallback calls = %d, want 3", fallback.calls)
+	}
+	if !l.down() {
+		t.Error("expected the store to be skipped during the cooldown")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if l.down() {
+		t.Error("expected the store to be retried after the cooldown")
+	}
+}
@@ -0,0 +1,157 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"warpgate/internal/logging"
+)
+
+// Request ID formats.
+const (
+	RequestIDUUIDv7 = "uuidv7"
+	RequestIDULID   = "ulid"
+)
+
+// RequestIDOptions configures RequestID.
+type RequestIDOptions struct {
+	// Header carries the request ID (default X-Request-Id).
+	Header string
+	// Format is the format of generated IDs, RequestIDUUIDv7 (the default)
+	// or RequestIDULID.
+	Format string
+}
+
+// maxRequestIDLen bounds the IDs accepted from clients.
+const maxRequestIDLen = 128
+
+// RequestID constructs a middleware giving every request an ID. The ID in
+// the request's header is kept if it is a plausible one; otherwise a new ID
+// is generated and replaces it, so that it is forwarded upstream. The ID is
+// returned to the client in the same header and stored in the request
+// context, where logging.FromContext finds it.
+func RequestID(opts RequestIDOptions) (Middleware, error) {
+	if opts.Header == "" {
+		opts.Header = "X-Request-Id"
+	}
+	var generate func() string
+	switch opts.Format {
+	case "", RequestIDUUIDv7:
+		generate = NewUUIDv7
+	case RequestIDULID:
+		generate = NewULID
+	default:
+		return nil, fmt.Errorf("unknown request ID format %q", opts.Format)
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			id := r.Header.Get(opts.Header)
+			if !validRequestID(id) {
+				id = generate()
+				r.Header.Set(opts.Header, id)
+			}
+			w.Header().Set(opts.Header, id)
+			next.ServeHTTP(&requestIDWriter{ResponseWriter: w, header: opts.Header, id: id},
+				r.WithContext(logging.WithRequestID(r.Context(), id)))
+		})
+	}, nil
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+// requestIDWriter keeps the request ID as the only value of its header,
+// whatever the upstream sends.
+type requestIDWriter struct {
+	http.ResponseWriter
+	header      string
+	id          string
+	wroteHeader bool
+}
+
+func (w *requestIDWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		w.Header().Set(w.header, w.id)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *requestIDWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *requestIDWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *requestIDWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// NewUUIDv7 returns a random UUID of version 7 (RFC 9562), whose leading
+// bits are the current Unix time in milliseconds, so that IDs sort by time.
+func NewUUIDv7() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(u[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(u[2:], uint32(ms))
+	u[6] = u[6]&0x0f | 0x70
+	u[8] = u[8]&0x3f | 0x80
+
+	var b [36]byte
+	hex.Encode(b[0:8], u[0:4])
+	b[8] = '-'
+	hex.Encode(b[9:13], u[4:6])
+	b[13] = '-'
+	hex.Encode(b[14:18], u[6:8])
+	b[18] = '-'
+	hex.Encode(b[19:23], u[8:10])
+	b[23] = '-'
+	hex.Encode(b[24:], u[10:])
+	return string(b[:])
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a ULID: 48 bits of Unix time in milliseconds followed by
+// 80 random bits, in Crockford's base32.
+func NewULID() string {
+	var u [16]byte
+	rand.Read(u[6:])
+	ms := uint64(time.Now().UnixMilli())
+	binary.BigEndian.PutUint16(u[0:], uint16(ms>>32))
+	binary.BigEndian.PutUint32(u[2:], uint32(ms))
+
+	hi, lo := binary.BigEndian.Uint64(u[:8]), binary.BigEndian.Uint64(u[8:])
+	var b [26]byte
+	for i := 25; i >= 0; i-- {
+		b[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(b[:])
+}
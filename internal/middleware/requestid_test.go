@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+
+	"warpgate/internal/logging"
+)
+
+type recordingLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *recordingLogger) Info(msg string, args ...any)  { l.record(msg, args) }
+func (l *recordingLogger) Error(msg string, args ...any) { l.record(msg, args) }
+
+func (l *recordingLogger) record(msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.lines = append(l.lines, msg+" "+fmt.Sprintln(args...))
+}
+
+func TestRequestID(t *testing.T) {
+	uuidv7 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ulid := regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Z]{25}$`)
+
+	for _, tc := range []struct {
+		format string
+		re     *regexp.Regexp
+	}{{"", uuidv7}, {RequestIDULID, ulid}} {
+		mw, err := RequestID(RequestIDOptions{Format: tc.format})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var upstream, fromCtx string
+		h := mw(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			upstream = r.Header.Get("X-Request-Id")
+			fromCtx = logging.RequestID(r.Context())
+			w.Header().Set("X-Request-Id", "from-upstream")
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		serve := func(id string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if id != "" {
+				req.Header.Set("X-Request-Id", id)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			return rr
+		}
+
+		rr := serve("")
+		id := rr.Header().Get("X-Request-Id")
+		if !tc.re.MatchString(id) {
+			t.Errorf("%q: generated ID %q", tc.format, id)
+		}
+		if upstream != id || fromCtx != id {
+			t.Errorf("%q: upstream %q, context %q, response %q", tc.format, upstream, fromCtx, id)
+		}
+		if next := serve("").Header().Get("X-Request-Id"); next == id {
+			t.Errorf("%q: ID %q generated twice", tc.format, id)
+		}
+
+		if got := serve("abc-123").Header().Get("X-Request-Id"); got != "abc-123" || upstream != "abc-123" {
+			t.Errorf("%q: client ID not kept: response %q, upstream %q", tc.format, got, upstream)
+		}
+		if got := serve("bad id\x7f"); !tc.re.MatchString(got.Header().Get("X-Request-Id")) {
+			t.Errorf("%q: invalid client ID kept: %q", tc.format, got.Header().Get("X-Request-Id"))
+		}
+	}
+
+	if _, err := RequestID(RequestIDOptions{Format: "snowflake"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
+
+func TestRequestID_Logs(t *testing.T) {
+	logger := &recordingLogger{}
+	rid, err := RequestID(RequestIDOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err := IPFilter(logger, []string{"192.0.2.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := Chain(http.NotFoundHandler(), rid, filter)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:1234"
+	req.Header.Set("X-Request-Id", "req-1")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(logger.lines) != 1 || !strings.Contains(logger.lines[0], "request_id req-1") {
+		t.Errorf("log lines %q", logger.lines)
+	}
+}
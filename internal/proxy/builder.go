@@ -1,18 +1,29 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"slices"
 	"strings"
+	"time"
+
+	"warpgate/internal/admin"
 	"warpgate/internal/cache"
+	"warpgate/internal/clientip"
 	"warpgate/internal/cluster"
 	"warpgate/internal/config"
+	"warpgate/internal/jwt"
 	"warpgate/internal/logging"
 	"warpgate/internal/metrics"
 	"warpgate/internal/middleware"
+	"warpgate/internal/resp"
+	"warpgate/internal/tracing"
 	"warpgate/internal/upstream"
 )
 
@@ -20,11 +31,52 @@ type ListenerServer struct {
 	Name   string
 	Server *http.Server
 	TLS    config.TLSConfig
+
+	// ProxyProtocol expects a PROXY protocol header from the proxies
+	// trusted by ClientIP.
+	ProxyProtocol        bool
+	ProxyProtocolTimeout time.Duration
+	ClientIP             *clientip.Resolver
+}
+
+// Listen opens the listener's socket for Server.Serve or Server.ServeTLS.
+func (ls *ListenerServer) Listen() (net.Listener, error) {
+	addr := ls.Server.Addr
+	if addr == "" {
+		addr = ":http"
+		if ls.TLS.Enabled {
+			addr = ":https"
+		}
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if ls.ProxyProtocol {
+		return clientip.NewProxyListener(ln, ls.ClientIP, ls.ProxyProtocolTimeout), nil
+	}
+	return ln, nil
 }
 
 type Builder struct {
 	cfg    *config.Config
 	logger logging.Logger
+
+	// limitStore is the client of the shared rate limit store, created for
+	// the first limit using it.
+	limitStore *resp.Client
+	// clientIP is the resolver shared by the director, middlewares and
+	// listeners.
+	clientIP *clientip.Resolver
+	// verifiers holds the verifier of each JWT provider, created for the
+	// first route using it.
+	verifiers map[string]*jwt.Verifier
+	// clusters and transport are those of the engine, which external
+	// authorization shares.
+	clusters  map[string]cluster.Cluster
+	transport http.RoundTripper
+	// tracing exports the spans of requests, if configured.
+	tracing *tracing.Provider
 }
 
 func NewBuilder(cfg *config.Config, logger logging.Logger) *Builder {
@@ -35,51 +87,195 @@ func NewBuilder(cfg *config.Config, logger logging.Logger) *Builder {
 }
 
 func (b *Builder) Build(ctx context.Context) ([]*ListenerServer, error) {
-	clusters, err := b.buildClusters(ctx)
+	engine, err := b.BuildEngine(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	routes := b.buildRoutes()
-	director := NewSimpleDirector(routes)
-
-	transport := upstream.NewTransport()
-	memcache := cache.NewInMemoryCache(b.cfg.Cache.MaxEntries)
-
-	engine := NewEngine(director, memcache, transport, clusters, b.logger)
-	engine.MaxCacheBodySize = b.cfg.Cache.MaxBodyBytes
-
-	var mws []middleware.Middleware
+	resolver, err := b.clientIPResolver()
+	if err != nil {
+		return nil, err
+	}
+	requestID, err := middleware.RequestID(middleware.RequestIDOptions{
+		Header: b.cfg.Server.RequestIDHeader,
+		Format: b.cfg.Server.RequestIDFormat,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
+	mws := []middleware.Middleware{requestID, resolver.Middleware}
+	if b.tracing != nil {
+		mws = append(mws, b.tracing.Middleware)
+	}
 
+	rules := b.cfg.Server.IPRules
 	if len(b.cfg.Server.IPBlockCIDRS) > 0 {
-		ipMw, err := middleware.IPFilter(b.logger, b.cfg.Server.IPBlockCIDRS)
+		merged := config.IPRulesConfig{}
+		if rules != nil {
+			merged = *rules
+		}
+		merged.Deny = append(append([]string(nil), b.cfg.Server.IPBlockCIDRS...), merged.Deny...)
+		rules = &merged
+	}
+	if rules != nil {
+		ipMw, err := b.buildIPRules(ctx, "global", rules)
 		if err != nil {
-			return nil, fmt.Errorf("invalid ipBlockCIDRs: %w", err)
+			return nil, fmt.Errorf("invalid ipRules: %w", err)
 		}
 		mws = append(mws, ipMw)
 	}
 
+	if b.cfg.RateLimit != nil {
+		rlMw, err := b.buildRateLimit("global", b.cfg.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rateLimit: %w", err)
+		}
+		mws = append(mws, rlMw)
+	}
+
 	var appHandler http.Handler = engine
+	if d, ok := engine.Director.(*SimpleDirector); ok {
+		appHandler = RouteHandler(d, engine)
+	}
 	appHandler = middleware.Chain(appHandler, mws...)
 
 	mux := http.NewServeMux()
 	mux.Handle("/metrics", metrics.Handler())
 	mux.Handle("/", appHandler)
 
+	var listeners []*ListenerServer
 	if len(b.cfg.Listeners) == 0 {
-		return []*ListenerServer{
+		listeners = []*ListenerServer{
 			{
 				Name: "default",
 				Server: &http.Server{
 					Addr:    b.cfg.Server.Address,
 					Handler: mux,
 				},
-				TLS: b.cfg.Server.TLS,
+				TLS:                  b.cfg.Server.TLS,
+				ProxyProtocol:        b.cfg.Server.ProxyProtocol,
+				ProxyProtocolTimeout: b.cfg.Server.ProxyProtocolTimeout,
+				ClientIP:             resolver,
 			},
-		}, nil
+		}
+	} else {
+		listeners, err = b.buildListeners(mux)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, ls := range listeners {
+		if ls.ProxyProtocol && len(b.cfg.Server.TrustedProxies) == 0 {
+			return nil, fmt.Errorf("listener %q: proxyProtocol requires server.trustedProxies", ls.Name)
+		}
 	}
 
-	return b.buildListeners(mux)
+	if b.cfg.Admin.Address != "" {
+		listeners = append(listeners, &ListenerServer{
+			Name: "admin",
+			Server: &http.Server{
+				Addr:    b.cfg.Admin.Address,
+				Handler: admin.New(engine, engine, b.logger),
+			},
+		})
+	}
+
+	return listeners, nil
+}
+
+// BuildEngine builds the proxy engine with its clusters and cache, without
+// the listeners and middlewares around it.
+func (b *Builder) BuildEngine(ctx context.Context) (*Engine, error) {
+	clusters, err := b.buildClusters(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = upstream.NewTransport()
+	if t := b.cfg.Tracing; t != nil {
+		b.tracing, err = tracing.New(ctx, tracing.Options{
+			ServiceName: t.ServiceName,
+			Exporter:    t.Exporter,
+			Endpoint:    t.Endpoint,
+			Headers:     t.Headers,
+			Timeout:     t.Timeout,
+			Sampler:     t.Sampler,
+			SampleRatio: *t.SampleRatio,
+			Propagators: t.Propagators,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid tracing config: %w", err)
+		}
+		transport = b.tracing.Transport(transport)
+	}
+	b.clusters, b.transport = clusters, transport
+
+	routes, err := b.buildRoutes(ctx)
+	if err != nil {
+		return nil, err
+	}
+	director := NewSimpleDirector(routes)
+	if director.ClientIP, err = b.clientIPResolver(); err != nil {
+		return nil, err
+	}
+
+	memcache, err := b.buildCache()
+	if err != nil {
+		return nil, fmt.Errorf("invalid cache config: %w", err)
+	}
+
+	engine := NewEngine(director, memcache, transport, clusters, b.logger)
+	engine.MaxCacheBodySize = b.cfg.Cache.MaxBodyBytes
+	engine.Coalesce = b.cfg.Cache.Coalesce
+	engine.CoalesceTimeout = *b.cfg.Cache.CoalesceTimeout
+	engine.KeepStale = *b.cfg.Cache.KeepStale
+	engine.TagHeaders = b.cfg.Cache.TagHeaders
+	if b.cfg.Cache.StatusHeader {
+		engine.CacheStatus = b.cfg.Cache.StatusName
+	}
+	if b.tracing != nil {
+		engine.Tracer = b.tracing.Tracer()
+	}
+	for _, c := range b.cfg.Clusters {
+		if c.Headers == nil {
+			continue
+		}
+		rules, err := headerRules(c.Headers)
+		if err != nil {
+			return nil, fmt.Errorf("invalid headers for cluster %s: %w", c.Name, err)
+		}
+		if engine.ClusterHeaders == nil {
+			engine.ClusterHeaders = make(map[string]*HeaderRules)
+		}
+		engine.ClusterHeaders[c.Name] = rules
+	}
+
+	return engine, nil
+}
+
+// Shutdown exports the spans not yet sent to the collector, if tracing is
+// configured.
+func (b *Builder) Shutdown(ctx context.Context) error {
+	if b.tracing == nil {
+		return nil
+	}
+	return b.tracing.Shutdown(ctx)
+}
+
+// clientIPResolver returns the resolver for server.trustedProxies, creating
+// it on first use.
+func (b *Builder) clientIPResolver() (*clientip.Resolver, error) {
+	if b.clientIP != nil {
+		return b.clientIP, nil
+	}
+	r, err := clientip.NewResolver(clientip.Options{
+		TrustedProxies: b.cfg.Server.TrustedProxies,
+		Header:         b.cfg.Server.ClientIPHeader,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid server config: %w", err)
+	}
+	b.clientIP = r
+	return r, nil
 }
 
 func (b *Builder) buildClusters(ctx context.Context) (map[string]cluster.Cluster, error) {
@@ -125,17 +321,358 @@ func (b *Builder) buildClusters(ctx context.Context) (map[string]cluster.Cluster
 	return clusters, nil
 }
 
-func (b *Builder) buildRoutes() []SimpleRoute {
+func (b *Builder) buildRoutes(ctx context.Context) ([]SimpleRoute, error) {
 	var routes []SimpleRoute
 	for _, r := range b.cfg.Routes {
+		if err := validPrefix(r.PathPrefix); err != nil {
+			return nil, fmt.Errorf("invalid pathPrefix for route %s: %w", r.Name, err)
+		}
+		statusTTL, err := ParseStatusTTL(b.cfg.RouteStatusTTL(r))
+		if err != nil {
+			return nil, fmt.Errorf("invalid statusTTL for route %s: %w", r.Name, err)
+		}
+		mws, err := b.buildRouteMiddlewares(ctx, r)
+		if err != nil {
+			return nil, err
+		}
+		var compression *CompressionPolicy
+		if c := b.cfg.RouteCompression(r); c != nil {
+			compression, err = NewCompressionPolicy(slices.Clone(c.Encodings), c.Types, c.MinSize)
+			if err != nil {
+				return nil, fmt.Errorf("invalid compression for route %s: %w", r.Name, err)
+			}
+		}
+		var headers *HeaderRules
+		if r.Headers != nil {
+			if headers, err = headerRules(r.Headers); err != nil {
+				return nil, fmt.Errorf("invalid headers for route %s: %w", r.Name, err)
+			}
+		}
 		routes = append(routes, SimpleRoute{
+			Name:         r.Name,
 			Prefix:       r.PathPrefix,
 			ClusterName:  r.Cluster,
 			CacheEnabled: b.cfg.RouteCacheEnabled(r),
 			CacheTTL:     b.cfg.RouteTTL(r),
+			StatusTTL:    statusTTL,
+			CacheErrors:  b.cfg.RouteCacheErrors(r),
+			CacheKey:     cacheKeyPolicy(r.Cache),
+			Compression:  compression,
+			Headers:      headers,
+			Middlewares:  mws,
 		})
 	}
-	return routes
+	return routes, nil
+}
+
+// headerRules compiles the header rules of a route or cluster.
+func headerRules(c *config.HeaderRulesConfig) (*HeaderRules, error) {
+	ops := func(o config.HeaderOpsConfig) HeaderOps {
+		return HeaderOps{Remove: o.Remove, Rename: o.Rename, Set: o.Set, Add: o.Add}
+	}
+	return NewHeaderRules(ops(c.Request), ops(c.Response))
+}
+
+// buildRouteMiddlewares returns the middlewares configured for a route, in
+// the order they apply.
+func (b *Builder) buildRouteMiddlewares(ctx context.Context, r config.RouteConfig) ([]middleware.Middleware, error) {
+	name := r.Name
+	if name == "" {
+		name = r.PathPrefix
+	}
+
+	var mws []middleware.Middleware
+	if r.IPRules != nil {
+		mw, err := b.buildIPRules(ctx, name, r.IPRules)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ipRules for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	if c := r.CORS; c != nil {
+		mw, err := middleware.CORS(b.logger, middleware.CORSOptions{
+			Name:             name,
+			AllowOrigins:     c.AllowOrigins,
+			AllowMethods:     c.AllowMethods,
+			AllowHeaders:     c.AllowHeaders,
+			ExposeHeaders:    c.ExposeHeaders,
+			AllowCredentials: c.AllowCredentials,
+			MaxAge:           c.MaxAge,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid cors for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	if r.JWT != nil {
+		mw, err := b.buildJWTAuth(ctx, name, r.JWT)
+		if err != nil {
+			return nil, fmt.Errorf("invalid jwt for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	if r.ExtAuth != nil {
+		mw, err := b.buildExtAuth(name, r.ExtAuth)
+		if err != nil {
+			return nil, fmt.Errorf("invalid extAuth for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	if r.BasicAuth != nil {
+		users, err := middleware.NewHtpasswd(r.BasicAuth.HtpasswdFile, b.logger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid basicAuth for route %s: %w", name, err)
+		}
+		go users.Watch(ctx, b.cfg.Server.CredentialsReload)
+		mw, err := middleware.BasicAuth(b.logger, middleware.BasicAuthOptions{
+			Name:    name,
+			Users:   users,
+			Allowed: r.BasicAuth.Users,
+			Realm:   r.BasicAuth.Realm,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid basicAuth for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	if r.APIKey != nil {
+		keys, err := middleware.NewAPIKeys(r.APIKey.File, b.logger)
+		if err != nil {
+			return nil, fmt.Errorf("invalid apiKey for route %s: %w", name, err)
+		}
+		go keys.Watch(ctx, b.cfg.Server.CredentialsReload)
+		mw, err := middleware.APIKeyAuth(b.logger, middleware.APIKeyAuthOptions{
+			Name:   name,
+			Keys:   keys,
+			Header: r.APIKey.Header,
+			Query:  r.APIKey.Query,
+			Scopes: r.APIKey.Scopes,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("invalid apiKey for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	if r.RateLimit != nil {
+		mw, err := b.buildRateLimit(name, r.RateLimit)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rateLimit for route %s: %w", name, err)
+		}
+		mws = append(mws, mw)
+	}
+	return mws, nil
+}
+
+// buildIPRules loads the lists of rc and watches their files until ctx is
+// done.
+func (b *Builder) buildIPRules(ctx context.Context, name string, rc *config.IPRulesConfig) (middleware.Middleware, error) {
+	list := func(kind string, cidrs, files []string) (*middleware.IPList, error) {
+		if len(cidrs) == 0 && len(files) == 0 {
+			return nil, nil
+		}
+		l, err := middleware.NewIPList(name+" "+kind, cidrs, files, b.logger)
+		if err != nil {
+			return nil, err
+		}
+		go l.Watch(ctx, b.cfg.Server.IPListReload)
+		return l, nil
+	}
+
+	allow, err := list("allow", rc.Allow, rc.AllowFiles)
+	if err != nil {
+		return nil, err
+	}
+	deny, err := list("deny", rc.Deny, rc.DenyFiles)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.IPRules(b.logger, middleware.IPRulesOptions{
+		Name:  name,
+		Allow: allow,
+		Deny:  deny,
+	}), nil
+}
+
+func (b *Builder) buildJWTAuth(ctx context.Context, name string, rc *config.RouteJWTConfig) (middleware.Middleware, error) {
+	v, err := b.jwtVerifier(ctx, rc.Provider)
+	if err != nil {
+		return nil, err
+	}
+	return middleware.JWTAuth(b.logger, middleware.JWTAuthOptions{
+		Name:          name,
+		Verifier:      v,
+		Claims:        rc.Claims,
+		Scopes:        rc.Scopes,
+		ForwardClaims: rc.ForwardClaims,
+	})
+}
+
+// jwtVerifier returns the verifier of the named provider, or of the only
+// one if name is empty. A JWKS is loaded and then refreshed until ctx is
+// done; an issuer that cannot be reached yet is retried when tokens arrive.
+func (b *Builder) jwtVerifier(ctx context.Context, name string) (*jwt.Verifier, error) {
+	var pc *config.JWTProviderConfig
+	for i := range b.cfg.JWTProviders {
+		p := &b.cfg.JWTProviders[i]
+		if p.Name == name || (name == "" && len(b.cfg.JWTProviders) == 1) {
+			pc = p
+			break
+		}
+	}
+	if pc == nil {
+		return nil, fmt.Errorf("unknown jwt provider %q", name)
+	}
+	if v, ok := b.verifiers[pc.Name]; ok {
+		return v, nil
+	}
+
+	var keys jwt.KeySource
+	secret := []byte(pc.Secret)
+	if pc.SecretFile != "" {
+		data, err := os.ReadFile(pc.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("jwt provider %s: %w", pc.Name, err)
+		}
+		secret = bytes.TrimSpace(data)
+	}
+	switch {
+	case len(secret) > 0 && (pc.JWKSURL != "" || pc.JWKSFile != ""):
+		return nil, fmt.Errorf("jwt provider %s: secret and jwks cannot be combined", pc.Name)
+	case len(secret) > 0:
+		keys = jwt.StaticKeys{{Algorithm: jwt.HS256, Key: secret}}
+	default:
+		jwks, err := jwt.NewJWKS(jwt.JWKSOptions{
+			URL:     pc.JWKSURL,
+			File:    pc.JWKSFile,
+			Refresh: pc.Refresh,
+			Logger:  b.logger,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("jwt provider %s: %w", pc.Name, err)
+		}
+		if err := jwks.Refresh(ctx); err != nil {
+			if pc.JWKSFile != "" {
+				return nil, fmt.Errorf("jwt provider %s: %w", pc.Name, err)
+			}
+			if b.logger != nil {
+				b.logger.Error("jwks fetch failed", "provider", pc.Name, "err", err)
+			}
+		}
+		go jwks.Run(ctx)
+		keys = jwks
+	}
+
+	v, err := jwt.NewVerifier(jwt.Options{
+		Keys:       keys,
+		Algorithms: pc.Algorithms,
+		Issuer:     pc.Issuer,
+		Audience:   pc.Audience,
+		Leeway:     pc.ClockSkew,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("jwt provider %s: %w", pc.Name, err)
+	}
+	if b.verifiers == nil {
+		b.verifiers = make(map[string]*jwt.Verifier)
+	}
+	b.verifiers[pc.Name] = v
+	return v, nil
+}
+
+func (b *Builder) buildExtAuth(name string, rc *config.ExtAuthConfig) (middleware.Middleware, error) {
+	cl, ok := b.clusters[rc.Cluster]
+	if !ok {
+		return nil, fmt.Errorf("unknown cluster %q", rc.Cluster)
+	}
+	return middleware.ExtAuth(b.logger, middleware.ExtAuthOptions{
+		Name:            name,
+		Cluster:         cl,
+		Transport:       b.transport,
+		PathPrefix:      rc.PathPrefix,
+		RequestHeaders:  rc.RequestHeaders,
+		UpstreamHeaders: rc.UpstreamHeaders,
+		Timeout:         rc.Timeout,
+		CacheTTL:        rc.CacheTTL,
+		CacheSize:       rc.CacheSize,
+	})
+}
+
+func (b *Builder) buildRateLimit(name string, rc *config.RateLimitConfig) (middleware.Middleware, error) {
+	key, err := middleware.ParseRateLimitKey(rc.Key)
+	if err != nil {
+		return nil, err
+	}
+	limit := middleware.Limit{Requests: rc.Requests, Period: rc.Period, Burst: rc.Burst}
+	limiter, err := b.limiter(name, limit, rc)
+	if err != nil {
+		return nil, err
+	}
+
+	tiers := make(map[string]middleware.Tier, len(rc.Tiers))
+	for tier, tc := range rc.Tiers {
+		tl := middleware.Limit{Requests: tc.Requests, Period: tc.Period, Burst: tc.Burst}
+		l, err := b.limiter(name+":"+tier, tl, rc)
+		if err != nil {
+			return nil, err
+		}
+		tiers[tier] = middleware.Tier{Limit: tl, Limiter: l}
+	}
+
+	return middleware.RateLimit(b.logger, middleware.RateLimitOptions{
+		Name:    name,
+		Limit:   limit,
+		Key:     key,
+		Limiter: limiter,
+		Tiers:   tiers,
+	})
+}
+
+// limiter returns a limiter for limit on the backend of rc.
+func (b *Builder) limiter(name string, limit middleware.Limit, rc *config.RateLimitConfig) (middleware.Limiter, error) {
+	var limiter middleware.Limiter = middleware.NewLocalLimiter(limit, rc.MaxKeys)
+	switch rc.Backend {
+	case "local":
+		return limiter, nil
+	case "redis":
+		st := b.cfg.RateLimitStore
+		if st == nil {
+			return nil, errors.New("backend redis requires rateLimitStore")
+		}
+		if b.limitStore == nil {
+			b.limitStore = resp.NewClient(resp.Options{
+				Addr:     st.Address,
+				Password: st.Password,
+				DB:       st.DB,
+				PoolSize: st.PoolSize,
+				Timeout:  st.Timeout,
+			})
+		}
+		return middleware.NewRedisLimiter(b.limitStore, limit, middleware.RedisLimiterOptions{
+			Name:     name,
+			Prefix:   st.Prefix,
+			Fallback: limiter,
+			Cooldown: st.Cooldown,
+			Logger:   b.logger,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", rc.Backend)
+	}
+}
+
+func cacheKeyPolicy(rc *config.RouteCacheConfig) *CacheKeyPolicy {
+	if rc == nil || rc.Key == nil {
+		return nil
+	}
+	k := rc.Key
+	return &CacheKeyPolicy{
+		Headers:           k.Headers,
+		Cookies:           k.Cookies,
+		QueryParams:       k.QueryParams,
+		IgnoreQueryParams: k.IgnoreQueryParams,
+		IgnoreQuery:       k.IgnoreQuery,
+		SortQuery:         k.SortQuery,
+		IgnoreCase:        k.IgnoreCase,
+	}
 }
 
 func (b *Builder) buildListeners(mux http.Handler) ([]*ListenerServer, error) {
@@ -165,9 +702,12 @@ func (b *Builder) buildListeners(mux http.Handler) ([]*ListenerServer, error) {
 		}
 
 		listeners = append(listeners, &ListenerServer{
-			Name:   lst.Name,
-			Server: srv,
-			TLS:    lst.TLS,
+			Name:                 lst.Name,
+			Server:               srv,
+			TLS:                  lst.TLS,
+			ProxyProtocol:        lst.ProxyProtocol,
+			ProxyProtocolTimeout: b.cfg.Server.ProxyProtocolTimeout,
+			ClientIP:             b.clientIP,
 		})
 	}
 
@@ -202,3 +742,58 @@ func extractPort(addr string) string {
 	}
 	return addr[idx+1:]
 }
+
+// buildCache creates the in-memory cache, sharded unless shards is 1, and
+// layers it over a disk cache when one is configured. A Redis cache replaces
+// both.
+func (b *Builder) buildCache() (cache.Cache, error) {
+	if rc := b.cfg.Cache.Redis; rc != nil {
+		if b.cfg.Cache.Disk != nil {
+			return nil, errors.New("cache.redis and cache.disk cannot be combined")
+		}
+		client := resp.NewClient(resp.Options{
+			Addr:     rc.Address,
+			Password: rc.Password,
+			DB:       rc.DB,
+			PoolSize: rc.PoolSize,
+			Timeout:  rc.Timeout,
+		})
+		opts := cache.RedisOptions{Prefix: rc.Prefix}
+		if cb := rc.CircuitBreaker; cb != nil {
+			opts.ConsecutiveFailures = cb.ConsecutiveFailures
+			opts.Cooldown = cb.Cooldown
+		}
+		return cache.NewRedisCache(client, opts), nil
+	}
+
+	opts := cache.Options{
+		MaxEntries: b.cfg.Cache.MaxEntries,
+		MaxBytes:   b.cfg.Cache.MaxBytes,
+		Policy:     cache.Policy(b.cfg.Cache.Eviction),
+	}
+	var mem cache.Cache
+	var err error
+	if b.cfg.Cache.Shards > 1 {
+		mem, err = cache.NewShardedCache(b.cfg.Cache.Shards, opts)
+	} else {
+		mem, err = cache.NewInMemoryCacheWithOptions(opts)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	dc := b.cfg.Cache.Disk
+	if dc == nil {
+		return mem, nil
+	}
+	disk, err := cache.NewDiskCache(cache.DiskOptions{
+		Dir:        dc.Path,
+		MaxEntries: dc.MaxEntries,
+		MaxBytes:   dc.MaxBytes,
+		Policy:     cache.Policy(dc.Eviction),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("disk cache: %w", err)
+	}
+	return cache.NewTieredCache(mem, disk, dc.MemoryMaxBodyBytes), nil
+}
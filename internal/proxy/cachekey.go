@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// varyKeySeparator joins a primary cache key and the request header values
+// selecting one of its variants.
+const varyKeySeparator = "|vary|"
+
+// CacheKeyPolicy customizes how a route's cache key is composed. The zero
+// value (and a nil policy) uses the method, scheme, host and request URI.
+type CacheKeyPolicy struct {
+	// Headers and Cookies name request headers and cookies whose values are
+	// appended to the key, escaped so that no value can pass for another
+	// component.
+	Headers []string
+	Cookies []string
+
+	// QueryParams, when non-empty, restricts the query string in the key to
+	// these parameters. IgnoreQueryParams drops the named parameters and
+	// IgnoreQuery drops the query string altogether.
+	QueryParams       []string
+	IgnoreQueryParams []string
+	IgnoreQuery       bool
+
+	// SortQuery orders query parameters so that permutations share a key.
+	SortQuery bool
+
+	// IgnoreCase lowercases the path and query string.
+	IgnoreCase bool
+}
+
+// Key returns the cache key for req.
+func (p *CacheKeyPolicy) Key(req *http.Request) string {
+	if p == nil {
+		return cacheKeyFromRequest(req)
+	}
+
+	scheme := req.URL.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	query := p.query(req.URL)
+	if p.IgnoreCase {
+		path = strings.ToLower(path)
+		query = strings.ToLower(query)
+	}
+
+	var b strings.Builder
+	b.WriteString(req.Method)
+	b.WriteString(" ")
+	b.WriteString(scheme)
+	b.WriteString("://")
+	b.WriteString(strings.ToLower(req.Host))
+	b.WriteString(path)
+	if query != "" {
+		b.WriteString("?")
+		b.WriteString(query)
+	}
+
+	for _, name := range p.Headers {
+		b.WriteString("|h:")
+		b.WriteString(http.CanonicalHeaderKey(name))
+		b.WriteString("=")
+		b.WriteString(url.QueryEscape(normalizeHeaderValues(req.Header.Values(name))))
+	}
+	for _, name := range p.Cookies {
+		b.WriteString("|c:")
+		b.WriteString(url.QueryEscape(name))
+		b.WriteString("=")
+		if c, err := req.Cookie(name); err == nil {
+			b.WriteString(url.QueryEscape(c.Value))
+		}
+	}
+	return b.String()
+}
+
+func (p *CacheKeyPolicy) query(u *url.URL) string {
+	if p.IgnoreQuery || u.RawQuery == "" {
+		return ""
+	}
+	if len(p.QueryParams) == 0 && len(p.IgnoreQueryParams) == 0 && !p.SortQuery {
+		return u.RawQuery
+	}
+
+	values := u.Query()
+	if len(p.QueryParams) > 0 {
+		kept := make(url.Values, len(p.QueryParams))
+		for _, name := range p.QueryParams {
+			if v, ok := values[name]; ok {
+				kept[name] = v
+			}
+		}
+		values = kept
+	}
+	for _, name := range p.IgnoreQueryParams {
+		delete(values, name)
+	}
+
+	if !p.SortQuery {
+		// Keep the client's parameter order, dropping what was filtered out.
+		var parts []string
+		for _, part := range strings.Split(u.RawQuery, "&") {
+			name, _, _ := strings.Cut(part, "=")
+			if unescaped, err := url.QueryUnescape(name); err == nil {
+				name = unescaped
+			}
+			if _, ok := values[name]; ok {
+				parts = append(parts, part)
+			}
+		}
+		return strings.Join(parts, "&")
+	}
+
+	// url.Values.Encode sorts by key; sort repeated values as well.
+	for _, v := range values {
+		sort.Strings(v)
+	}
+	return values.Encode()
+}
+
+// varyHeaders returns the canonical, sorted request header names listed in
+// the response's Vary header.
+func varyHeaders(h http.Header) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, v := range h.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			name = http.CanonicalHeaderKey(strings.TrimSpace(name))
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// varyAny reports whether the response varies on "*", i.e. on something
+// outside the request headers, which makes it uncacheable.
+func varyAny(h http.Header) bool {
+	for _, name := range varyHeaders(h) {
+		if name == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// variantKey derives the secondary key for the variant of primary selected by
+// the values of the given request headers.
+func variantKey(primary string, names []string, reqHeader http.Header) string {
+	var b strings.Builder
+	b.WriteString(primary)
+	b.WriteString(varyKeySeparator)
+	for i, name := range names {
+		if i > 0 {
+			b.WriteString("&")
+		}
+		b.WriteString(name)
+		b.WriteString("=")
+		b.WriteString(url.QueryEscape(normalizeHeaderValues(reqHeader.Values(name))))
+	}
+	return b.String()
+}
+
+// sameVariant reports whether two requests select the same variant of a
+// response that varies on names.
+func sameVariant(names []string, a, b http.Header) bool {
+	for _, name := range names {
+		if normalizeHeaderValues(a.Values(name)) != normalizeHeaderValues(b.Values(name)) {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeHeaderValues joins header field values into a canonical list form
+// so that insignificant whitespace does not create distinct variants.
+func normalizeHeaderValues(values []string) string {
+	var parts []string
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				parts = append(parts, strings.Join(strings.Fields(part), " "))
+			}
+		}
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,125 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"warpgate/internal/proxy"
+)
+
+func TestCacheKeyPolicy_Query(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *proxy.CacheKeyPolicy
+		a, b   string
+		same   bool
+	}{
+		{"DefaultKeepsOrder", nil, "/p?a=1&b=2", "/p?b=2&a=1", false},
+		{"SortQuery", &proxy.CacheKeyPolicy{SortQuery: true}, "/p?a=1&b=2", "/p?b=2&a=1", true},
+		{"IgnoreParams", &proxy.CacheKeyPolicy{IgnoreQueryParams: []string{"utm_source"}}, "/p?a=1&utm_source=x", "/p?a=1", true},
+		{"IncludeParams", &proxy.CacheKeyPolicy{QueryParams: []string{"page"}}, "/p?page=2&session=abc", "/p?session=def&page=2", true},
+		{"IncludeParamsStillDistinguishes", &proxy.CacheKeyPolicy{QueryParams: []string{"page"}}, "/p?page=2", "/p?page=3", false},
+		{"IgnoreQuery", &proxy.CacheKeyPolicy{IgnoreQuery: true}, "/p?a=1", "/p?a=2", true},
+		{"IgnoreCase", &proxy.CacheKeyPolicy{IgnoreCase: true}, "/Docs/Index?Q=A", "/docs/index?q=a", true},
+		{"CaseSensitiveByDefault", &proxy.CacheKeyPolicy{}, "/Docs", "/docs", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ka := tt.policy.Key(httptest.NewRequest(http.MethodGet, "http://example.com"+tt.a, nil))
+			kb := tt.policy.Key(httptest.NewRequest(http.MethodGet, "http://example.com"+tt.b, nil))
+			if (ka == kb) != tt.same {
+				t.Errorf("keys %q and %q: same=%v, want %v", ka, kb, ka == kb, tt.same)
+			}
+		})
+	}
+}
+
+func TestCacheKeyPolicy_HeadersAndCookies(t *testing.T) {
+	p := &proxy.CacheKeyPolicy{Headers: []string{"X-Tenant"}, Cookies: []string{"region"}}
+
+	req := func(tenant, region string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/p", nil)
+		r.Header.Set("X-Tenant", tenant)
+		r.AddCookie(&http.Cookie{Name: "region", Value: region})
+		r.AddCookie(&http.Cookie{Name: "session", Value: tenant + region})
+		return r
+	}
+
+	if p.Key(req("acme", "eu")) != p.Key(req("acme", "eu")) {
+		t.Error("expected identical requests to share a key")
+	}
+	if p.Key(req("acme", "eu")) == p.Key(req("globex", "eu")) {
+		t.Error("expected tenant header to be part of the key")
+	}
+	if p.Key(req("acme", "eu")) == p.Key(req("acme", "us")) {
+		t.Error("expected region cookie to be part of the key")
+	}
+
+	// Values cannot forge the separators of other components.
+	p = &proxy.CacheKeyPolicy{Headers: []string{"X-Tenant"}, Cookies: []string{"a", "b"}}
+	raw := func(tenant, cookie string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://example.com/p", nil)
+		r.Header.Set("X-Tenant", tenant)
+		r.Header.Set("Cookie", cookie)
+		return r
+	}
+	if p.Key(raw("t", "a=1|c:b=2")) == p.Key(raw("t", "a=1; b=2|c:b=")) {
+		t.Error("cookie value containing a separator collides with another cookie")
+	}
+	if p.Key(raw("t|c:a=1", "")) == p.Key(raw("t", "a=1|c:a=")) {
+		t.Error("header value containing a separator collides with a cookie")
+	}
+}
+
+func TestEngine_VaryStoresVariants(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		h := make(http.Header)
+		h.Set("Vary", "Accept-Language")
+		return newResponse(http.StatusOK, h, strings.NewReader("lang="+r.Header.Get("Accept-Language"))), nil
+	})
+	e := newTestEngine(t, tr)
+
+	get := func(lang string) string {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/greeting", nil)
+		req.Header.Set("Accept-Language", lang)
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, req)
+		return rr.Body.String()
+	}
+
+	for i := 0; i < 2; i++ {
+		if got := get("en"); got != "lang=en" {
+			t.Fatalf("en: got %q", got)
+		}
+		if got := get("fr"); got != "lang=fr" {
+			t.Fatalf("fr: got %q", got)
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected one fetch per variant, got %d", got)
+	}
+}
+
+func TestEngine_VaryStarIsNotCached(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		h := make(http.Header)
+		h.Set("Vary", "*")
+		return newResponse(http.StatusOK, h, strings.NewReader("x")), nil
+	})
+	e := newTestEngine(t, tr)
+
+	for i := 0; i < 2; i++ {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/any", nil))
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected Vary: * responses to bypass the cache, got %d fetches", got)
+	}
+}
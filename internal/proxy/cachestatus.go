@@ -0,0 +1,106 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cacheStatus describes how the cache handled a request, as reported in the
+// Cache-Status response header (RFC 9211).
+type cacheStatus struct {
+	// hit is set when the response was served from the cache without going
+	// upstream.
+	hit bool
+	// fwd is why the request went upstream: "bypass", "method", "uri-miss",
+	// "vary-miss", "miss", "request" or "stale".
+	fwd string
+	// fwdStatus is the status of the upstream response, if any.
+	fwdStatus int
+	// ttl is the remaining freshness of the response, negative once stale.
+	ttl    time.Duration
+	hasTTL bool
+	// stored is set when the upstream response is being stored.
+	stored bool
+	// collapsed is set when the response was shared with another request's
+	// upstream fetch.
+	collapsed bool
+}
+
+// member formats the status as a list member for the cache called name.
+func (s cacheStatus) member(name string) string {
+	var b strings.Builder
+	b.WriteString(sfToken(name))
+	if s.hit {
+		b.WriteString("; hit")
+	} else if s.fwd != "" {
+		b.WriteString("; fwd=")
+		b.WriteString(s.fwd)
+		if s.fwdStatus != 0 {
+			b.WriteString("; fwd-status=")
+			b.WriteString(strconv.Itoa(s.fwdStatus))
+		}
+	}
+	if s.hasTTL {
+		b.WriteString("; ttl=")
+		b.WriteString(strconv.FormatInt(int64(s.ttl.Round(time.Second)/time.Second), 10))
+	}
+	if s.stored {
+		b.WriteString("; stored")
+	}
+	if s.collapsed {
+		b.WriteString("; collapsed")
+	}
+	return b.String()
+}
+
+// setCacheStatus appends the engine's member to the Cache-Status header, after
+// those of the caches closer to the origin. It does nothing unless the
+// engine has a CacheStatus name.
+func (e *Engine) setCacheStatus(h http.Header, s cacheStatus) {
+	if e.CacheStatus == "" {
+		return
+	}
+	h.Add("Cache-Status", s.member(e.CacheStatus))
+}
+
+// sfToken returns s as a structured field token if it is one, and as a
+// quoted string otherwise (RFC 8941, 3.3).
+func sfToken(s string) string {
+	if isSFToken(s) {
+		return s
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 0x20 || c > 0x7e {
+			continue
+		}
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+func isSFToken(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '*':
+		case i == 0:
+			return false
+		case c >= '0' && c <= '9', strings.IndexByte("!#$%&'+-.^_`|~:/", c) >= 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+)
+
+var (
+	errFlightAbandoned = errors.New("upstream fetch abandoned")
+	errFlightTooLarge  = errors.New("upstream body too large to share")
+)
+
+// flight is a single in-progress upstream fetch that concurrent requests for
+// the same cache key can attach to. The leader publishes the response head
+// once it is known and then appends body chunks as they arrive, so waiters
+// can stream the body without waiting for the fetch to complete.
+type flight struct {
+	mu      sync.Mutex
+	ready   chan struct{}
+	changed chan struct{}
+
+	// reqHeader is the leader's request header, used to check that a
+	// response carrying Vary suits a waiter's request.
+	reqHeader http.Header
+	// max bounds the body buffered for waiters, when positive. A body of
+	// unknown length that outgrows it is dropped and the flight fails, as
+	// the response could not be cached either.
+	max int64
+
+	published bool
+	shared    bool
+	status    int
+	header    http.Header
+	body      []byte
+	done      bool
+	err       error
+}
+
+func newFlight() *flight {
+	return &flight{
+		ready:   make(chan struct{}),
+		changed: make(chan struct{}),
+	}
+}
+
+// publish records the response head. When shared is false waiters must not
+// be served this response and should fetch upstream themselves.
+func (f *flight) publish(status int, header http.Header, shared bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.published {
+		return
+	}
+	f.published = true
+	f.shared = shared
+	f.status = status
+	f.header = header
+	close(f.ready)
+}
+
+// abandon releases waiters without a response, e.g. on upstream error.
+func (f *flight) abandon() {
+	f.publish(0, nil, false)
+	f.finish(errFlightAbandoned)
+}
+
+func (f *flight) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return len(p), nil
+	}
+	if f.max > 0 && int64(len(f.body)+len(p)) > f.max {
+		f.body = nil
+		f.done = true
+		f.err = errFlightTooLarge
+	} else {
+		f.body = append(f.body, p...)
+	}
+	f.notifyLocked()
+	return len(p), nil
+}
+
+func (f *flight) finish(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.done {
+		return
+	}
+	f.done = true
+	f.err = err
+	f.notifyLocked()
+}
+
+func (f *flight) notifyLocked() {
+	close(f.changed)
+	f.changed = make(chan struct{})
+}
+
+// next blocks until body bytes beyond off are available and returns them.
+// It returns a nil slice once the fetch has completed and everything has
+// been read.
+func (f *flight) next(ctx context.Context, off int) ([]byte, error) {
+	for {
+		f.mu.Lock()
+		if off < len(f.body) {
+			chunk := f.body[off:]
+			f.mu.Unlock()
+			return chunk, nil
+		}
+		if f.done {
+			err := f.err
+			f.mu.Unlock()
+			return nil, err
+		}
+		ch := f.changed
+		f.mu.Unlock()
+
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// flightGroup tracks in-progress fetches by cache key.
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// join returns the flight for key and whether the caller is its leader and
+// therefore responsible for fetching upstream and calling done.
+func (g *flightGroup) join(key string) (*flight, bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		return f, false
+	}
+	f := newFlight()
+	g.flights[key] = f
+	return f, true
+}
+
+// done detaches the flight from key so later requests start a new fetch (or,
+// more likely, find the response in the cache).
+func (g *flightGroup) done(key string, f *flight) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Content codings the proxy can apply.
+const (
+	EncodingGzip     = "gzip"
+	EncodingBrotli   = "br"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
+)
+
+// DefaultCompressibleTypes are the media types compressed when a policy does
+// not list its own.
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/json",
+	"application/*+json",
+	"application/javascript",
+	"application/xml",
+	"application/*+xml",
+	"application/wasm",
+	"image/svg+xml",
+}
+
+// CompressionPolicy decides how a route's responses are compressed. The
+// encoding is negotiated from Accept-Encoding when the request arrives, and
+// the request is then treated as if it only accepted that encoding: it is
+// what is asked of the upstream, and what selects the cached variant, so
+// that each encoding is stored once however clients spell their header.
+type CompressionPolicy struct {
+	// Encodings lists the codings to offer, in order of preference for
+	// clients that accept several equally (default br, zstd, gzip).
+	Encodings []string
+	// Types lists the media types to compress; "*" in a subtype matches any
+	// run of characters, as in "text/*" or "application/*+json" (default
+	// DefaultCompressibleTypes).
+	Types []string
+	// MinSize is the smallest body compressed, when its length is known.
+	MinSize int64
+}
+
+// NewCompressionPolicy returns a policy for encodings, types and minSize,
+// with defaults for empty lists.
+func NewCompressionPolicy(encodings, types []string, minSize int64) (*CompressionPolicy, error) {
+	if len(encodings) == 0 {
+		encodings = []string{EncodingBrotli, EncodingZstd, EncodingGzip}
+	}
+	for i, enc := range encodings {
+		enc = strings.ToLower(strings.TrimSpace(enc))
+		switch enc {
+		case EncodingGzip, EncodingBrotli, EncodingZstd:
+		default:
+			return nil, fmt.Errorf("unsupported encoding %q", enc)
+		}
+		encodings[i] = enc
+	}
+	if len(types) == 0 {
+		types = DefaultCompressibleTypes
+	}
+	return &CompressionPolicy{Encodings: encodings, Types: types, MinSize: minSize}, nil
+}
+
+// Negotiate returns the encoding to respond with to a request carrying
+// acceptEncoding: the supported coding with the highest quality value,
+// ties going to the one listed first in Encodings, or identity.
+func (p *CompressionPolicy) Negotiate(acceptEncoding string) string {
+	q := make(map[string]float64)
+	wildcard := -1.0
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		quality := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+			if err != nil {
+				continue
+			}
+			quality = f
+		}
+		if name == "*" {
+			wildcard = quality
+		} else {
+			q[name] = quality
+		}
+	}
+
+	best, bestQ := EncodingIdentity, 0.0
+	for _, enc := range p.Encodings {
+		v, ok := q[enc]
+		if !ok {
+			v = wildcard
+		}
+		if v > bestQ {
+			best, bestQ = enc, v
+		}
+	}
+	return best
+}
+
+// compressible reports whether contentType is one of the policy's types.
+func (p *CompressionPolicy) compressible(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range p.Types {
+		if matchMediaType(strings.ToLower(pattern), mediaType) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMediaType matches a media type against a pattern in which "*" stands
+// for any run of characters.
+func matchMediaType(pattern, mediaType string) bool {
+	prefix, suffix, wild := strings.Cut(pattern, "*")
+	if !wild {
+		return pattern == mediaType
+	}
+	return len(mediaType) >= len(prefix)+len(suffix) &&
+		strings.HasPrefix(mediaType, prefix) && strings.HasSuffix(mediaType, suffix)
+}
+
+// apply compresses resp with enc, the encoding negotiated for req, if the
+// response qualifies. Responses that could have been compressed for another
+// client get Vary: Accept-Encoding, whether or not they are. It returns
+// whether the body was replaced.
+func (p *CompressionPolicy) apply(req *http.Request, resp *http.Response, enc string) bool {
+	switch {
+	case req.Method == http.MethodHead,
+		resp.StatusCode < http.StatusOK,
+		resp.StatusCode == http.StatusNoContent,
+		resp.StatusCode == http.StatusPartialContent,
+		resp.StatusCode == http.StatusNotModified,
+		resp.ContentLength >= 0 && resp.ContentLength < max(p.MinSize, 1),
+		parseCacheControl(resp.Header.Values("Cache-Control")).has("no-transform"),
+		!p.compressible(resp.Header.Get("Content-Type")):
+		return false
+	}
+	addVary(resp.Header, "Accept-Encoding")
+	if ce := resp.Header.Get("Content-Encoding"); enc == EncodingIdentity || (ce != "" && ce != EncodingIdentity) {
+		return false
+	}
+
+	resp.Header.Set("Content-Encoding", enc)
+	resp.Header.Del("Content-Length")
+	resp.ContentLength = -1
+	// The compressed body is a different representation, so validators of
+	// the original can only match it weakly.
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		resp.Header.Set("ETag", "W/"+etag)
+	}
+	resp.Body = newCompressedBody(resp.Body, enc)
+	return true
+}
+
+// keepWeakETag keeps the weak ETag given to a compressed response when the
+// upstream confirms it with the strong one in a 304 Not Modified.
+func keepWeakETag(stale, update http.Header) {
+	if etag := update.Get("ETag"); etag != "" && stale.Get("ETag") == "W/"+etag {
+		update.Set("ETag", "W/"+etag)
+	}
+}
+
+// addVary adds name to the Vary header of h unless it is already listed.
+func addVary(h http.Header, name string) {
+	names := varyHeaders(h)
+	if slices.Contains(names, "*") || slices.Contains(names, http.CanonicalHeaderKey(name)) {
+		return
+	}
+	h.Add("Vary", name)
+}
+
+// encoder is a compressing writer that can be reused for another stream.
+type encoder interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+var encoderPools = map[string]*sync.Pool{
+	EncodingGzip: {New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, 5)
+		return w
+	}},
+	EncodingBrotli: {New: func() any {
+		return brotli.NewWriterLevel(nil, 4)
+	}},
+	EncodingZstd: {New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1), zstd.WithWindowSize(1<<20))
+		return w
+	}},
+}
+
+// compressedBody is a response body compressed as it is read. The upstream
+// body is read and compressed in a goroutine; whenever a read returns less
+// than a full buffer, meaning the upstream paused, as it does between
+// server-sent events, the encoder is flushed so that what was sent so far
+// reaches the client.
+type compressedBody struct {
+	*io.PipeReader
+	src io.ReadCloser
+}
+
+func newCompressedBody(src io.ReadCloser, enc string) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pool := encoderPools[enc]
+		w := pool.Get().(encoder)
+		w.Reset(pw)
+
+		buf := make([]byte, 32<<10)
+		var err error
+		for err == nil {
+			var n int
+			n, err = src.Read(buf)
+			if n > 0 {
+				if _, werr := w.Write(buf[:n]); werr != nil {
+					err = werr
+				} else if n < len(buf) {
+					err = w.Flush()
+				}
+			}
+		}
+		if err == io.EOF {
+			err = w.Close()
+		}
+		pw.CloseWithError(err)
+		if err == nil {
+			pool.Put(w)
+		}
+	}()
+	return &compressedBody{PipeReader: pr, src: src}
+}
+
+func (b *compressedBody) Close() error {
+	b.PipeReader.Close()
+	return b.src.Close()
+}
@@ -0,0 +1,245 @@
+package proxy_test
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+
+	"warpgate/internal/cache"
+	"warpgate/internal/cluster"
+	"warpgate/internal/proxy"
+)
+
+func TestCompressionPolicy_Negotiate(t *testing.T) {
+	p, err := proxy.NewCompressionPolicy(nil, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ accept, want string }{
+		{"", "identity"},
+		{"gzip", "gzip"},
+		{"gzip, deflate, br", "br"},
+		{"gzip;q=1.0, br;q=0.5", "gzip"},
+		{"zstd, gzip", "zstd"},
+		{"br;q=0, *", "zstd"},
+		{"*;q=0", "identity"},
+		{"deflate", "identity"},
+		{"GZIP ; q=0.8", "gzip"},
+	} {
+		if got := p.Negotiate(tc.accept); got != tc.want {
+			t.Errorf("Negotiate(%q) = %q, want %q", tc.accept, got, tc.want)
+		}
+	}
+
+	if _, err := proxy.NewCompressionPolicy([]string{"deflate"}, nil, 0); err == nil {
+		t.Error("unsupported encoding accepted")
+	}
+}
+
+func newCompressingEngine(t *testing.T, tr proxy.Transport) *proxy.Engine {
+	t.Helper()
+	u, _ := url.Parse("http://backend")
+	clusters := map[string]cluster.Cluster{
+		"backend": cluster.NewRoundRobinCluster("backend", []*cluster.Endpoint{{URL: u}}, nil, nil),
+	}
+	policy, err := proxy.NewCompressionPolicy(nil, nil, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute, Compression: policy},
+	})
+	return proxy.NewEngine(d, cache.NewInMemoryCache(100), tr, clusters, nil)
+}
+
+func decode(t *testing.T, encoding string, body io.Reader) string {
+	t.Helper()
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case "br":
+		r = brotli.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		r = body
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("decode %s: %v", encoding, err)
+	}
+	return string(b)
+}
+
+func TestEngine_CompressesAndCachesVariants(t *testing.T) {
+	payload := `{"items":[` + strings.Repeat(`{"id":1,"name":"widget"},`, 100) + `{}]}`
+	var mu sync.Mutex
+	var asked []string
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		mu.Lock()
+		asked = append(asked, r.Header.Get("Accept-Encoding"))
+		mu.Unlock()
+		h := http.Header{}
+		h.Set("Content-Type", "application/json; charset=utf-8")
+		h.Set("Cache-Control", "max-age=60")
+		h.Set("ETag", `"v1"`)
+		resp := newResponse(http.StatusOK, h, strings.NewReader(payload))
+		resp.ContentLength = int64(len(payload))
+		return resp, nil
+	})
+	e := newCompressingEngine(t, tr)
+
+	get := func(accept string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/items", nil)
+		if accept != "" {
+			req.Header.Set("Accept-Encoding", accept)
+		}
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for _, tc := range []struct {
+		accept, encoding string
+		upstreamCalls    int
+	}{
+		{"gzip, deflate, br", "br", 1},
+		{"br;q=1, gzip;q=0.5", "br", 1}, // same variant, from the cache
+		{"gzip", "gzip", 2},
+		{"zstd", "zstd", 3},
+		{"", "", 4},
+		{"deflate", "", 4}, // identity, from the cache
+	} {
+		rr := get(tc.accept)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("%q: status %d", tc.accept, rr.Code)
+		}
+		h := rr.Header()
+		if got := h.Get("Content-Encoding"); got != tc.encoding {
+			t.Errorf("%q: Content-Encoding %q, want %q", tc.accept, got, tc.encoding)
+		}
+		if got := h.Get("Vary"); got != "Accept-Encoding" {
+			t.Errorf("%q: Vary %q", tc.accept, got)
+		}
+		if tc.encoding != "" && (h.Get("ETag") != `W/"v1"` || h.Get("Content-Length") != "") {
+			t.Errorf("%q: ETag %q, Content-Length %q", tc.accept, h.Get("ETag"), h.Get("Content-Length"))
+		}
+		if body := decode(t, tc.encoding, rr.Body); body != payload {
+			t.Errorf("%q: body of %d bytes differs", tc.accept, len(body))
+		}
+		mu.Lock()
+		calls := len(asked)
+		mu.Unlock()
+		if calls != tc.upstreamCalls {
+			t.Errorf("%q: %d upstream calls, want %d", tc.accept, calls, tc.upstreamCalls)
+		}
+	}
+	if want := []string{"br", "gzip", "zstd", ""}; strings.Join(asked, ",") != strings.Join(want, ",") {
+		t.Errorf("upstream asked for %q, want %q", asked, want)
+	}
+}
+
+func TestEngine_SkipsIneligibleResponses(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		body   string
+	}{
+		{"small", http.Header{"Content-Type": {"text/plain"}}, "short"},
+		{"type", http.Header{"Content-Type": {"image/png"}}, strings.Repeat("x", 1000)},
+		{"encoded", http.Header{"Content-Type": {"text/plain"}, "Content-Encoding": {"gzip"}}, strings.Repeat("x", 1000)},
+		{"no-transform", http.Header{"Content-Type": {"text/plain"}, "Cache-Control": {"no-transform"}}, strings.Repeat("x", 1000)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := newCompressingEngine(t, transportFunc(func(r *http.Request) (*http.Response, error) {
+				resp := newResponse(http.StatusOK, tc.header.Clone(), strings.NewReader(tc.body))
+				resp.ContentLength = int64(len(tc.body))
+				return resp, nil
+			}))
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/"+tc.name, nil)
+			req.Header.Set("Accept-Encoding", "br")
+			rr := httptest.NewRecorder()
+			e.ServeHTTP(rr, req)
+			if got := rr.Header().Get("Content-Encoding"); got != tc.header.Get("Content-Encoding") {
+				t.Errorf("Content-Encoding %q", got)
+			}
+			if rr.Body.String() != tc.body {
+				t.Errorf("body changed")
+			}
+		})
+	}
+}
+
+func TestEngine_CompressedStreamFlushes(t *testing.T) {
+	pr, pw := io.Pipe()
+	e := newCompressingEngine(t, transportFunc(func(r *http.Request) (*http.Response, error) {
+		h := http.Header{"Content-Type": {"text/event-stream"}, "Cache-Control": {"no-store"}}
+		resp := newResponse(http.StatusOK, h, pr)
+		resp.ContentLength = -1
+		return resp, nil
+	}))
+	srv := httptest.NewServer(e)
+	defer srv.Close()
+	defer pw.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/events", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := (&http.Transport{DisableCompression: true}).RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Content-Encoding %q", resp.Header.Get("Content-Encoding"))
+	}
+
+	// Each event must arrive while the stream is still open.
+	events := make(chan string)
+	go func() {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			close(events)
+			return
+		}
+		sc := bufio.NewScanner(zr)
+		for sc.Scan() {
+			if line := sc.Text(); line != "" {
+				events <- line
+			}
+		}
+		close(events)
+	}()
+	for _, ev := range []string{"data: one", "data: two"} {
+		if _, err := io.WriteString(pw, ev+"\n\n"); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case got := <-events:
+			if got != ev {
+				t.Fatalf("event %q, want %q", got, ev)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatalf("event %q not flushed", ev)
+		}
+	}
+}
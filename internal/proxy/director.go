@@ -2,67 +2,174 @@ package proxy
 
 import (
 	"fmt"
-	"net"
 	"net/http"
 	"strings"
 	"time"
+
+	"warpgate/internal/clientip"
+	"warpgate/internal/middleware"
 )
 
 type SimpleRoute struct {
+	// Name labels the route in metrics; it defaults to the prefix.
+	Name         string
 	Prefix       string
 	ClusterName  string
 	CacheEnabled bool
 	CacheTTL     time.Duration
+	StatusTTL    StatusTTL
+	CacheErrors  bool
+	CacheKey     *CacheKeyPolicy
+	// Compression compresses the route's responses; nil disables it.
+	Compression *CompressionPolicy
+	// Headers edits the route's requests and responses; nil leaves them as
+	// they are.
+	Headers *HeaderRules
+	// Middlewares wrap the engine for requests matching the route.
+	Middlewares []middleware.Middleware
 }
 
 type SimpleDirector struct {
 	Routes []SimpleRoute
+	// ClientIP decides whose forwarding headers are passed on; nil trusts
+	// no proxy.
+	ClientIP *clientip.Resolver
 }
 
 func NewSimpleDirector(routes []SimpleRoute) *SimpleDirector {
 	return &SimpleDirector{Routes: routes}
 }
 
-func (d *SimpleDirector) Direct(req *http.Request) (*http.Request, RouteMetadata, error) {
-	var route *SimpleRoute
+// match returns the index of the first route matching path, or -1, and the
+// path parameters it matched.
+func (d *SimpleDirector) match(path string) (int, map[string]string) {
 	for i := range d.Routes {
-		if strings.HasPrefix(req.URL.Path, d.Routes[i].Prefix) {
-			route = &d.Routes[i]
-			break
+		if params, ok := matchPrefix(d.Routes[i].Prefix, path); ok {
+			return i, params
 		}
 	}
-	if route == nil {
-		return nil, RouteMetadata{}, fmt.Errorf("no route for path %s", req.URL.Path)
+	return -1, nil
+}
+
+// matchPrefix reports whether path starts with prefix, in which a "{name}"
+// segment matches any one non-empty segment of path, and returns the
+// values matched by such segments.
+func matchPrefix(prefix, path string) (map[string]string, bool) {
+	if !strings.Contains(prefix, "{") {
+		return nil, strings.HasPrefix(path, prefix)
 	}
+	var params map[string]string
+	for {
+		i := strings.IndexByte(prefix, '{')
+		if i < 0 {
+			return params, strings.HasPrefix(path, prefix)
+		}
+		if !strings.HasPrefix(path, prefix[:i]) {
+			return nil, false
+		}
+		path = path[i:]
+		j := strings.IndexByte(prefix[i:], '}')
+		name := prefix[i+1 : i+j]
+		prefix = prefix[i+j+1:]
 
-	outReq := req.Clone(req.Context())
-	rawAddr := req.RemoteAddr
-	if strings.Contains(rawAddr, "://") {
-		if parts := strings.SplitN(rawAddr, "://", 2); len(parts) == 2 {
-			rawAddr = parts[1]
+		end := strings.IndexByte(path, '/')
+		if end < 0 {
+			end = len(path)
 		}
+		if end == 0 {
+			return nil, false
+		}
+		if params == nil {
+			params = make(map[string]string)
+		}
+		params[name] = path[:end]
+		path = path[end:]
 	}
-	clientIp := ""
-	if host, _, err := net.SplitHostPort(rawAddr); err == nil {
-		clientIp = host
-	} else if strings.Contains(err.Error(), "missing port in address") {
-		clientIp = req.RemoteAddr
-	}
+}
 
-	if clientIp != "" {
-		prior := req.Header.Get("X-Forwarded-For")
-		if prior != "" {
-			outReq.Header.Set("X-Forwarded-For", prior+", "+clientIp)
-		} else {
-			outReq.Header.Set("X-Forwarded-For", clientIp)
+// validPrefix checks the "{name}" segments of a route prefix.
+func validPrefix(prefix string) error {
+	for _, seg := range strings.Split(prefix, "/") {
+		open, close := strings.Count(seg, "{"), strings.Count(seg, "}")
+		if open == 0 && close == 0 {
+			continue
 		}
+		if open != 1 || close != 1 || len(seg) < 3 || seg[0] != '{' || seg[len(seg)-1] != '}' {
+			return fmt.Errorf("path parameter %q must be a whole segment", seg)
+		}
+	}
+	return nil
+}
+
+func (d *SimpleDirector) Direct(req *http.Request) (*http.Request, RouteMetadata, error) {
+	i, params := d.match(req.URL.Path)
+	if i < 0 {
+		return nil, RouteMetadata{}, fmt.Errorf("no route for path %s", req.URL.Path)
 	}
+	route := &d.Routes[i]
+
+	outReq := req.Clone(req.Context())
+	d.forwardedFor(req, outReq)
 
+	name := route.Name
+	if name == "" {
+		name = route.Prefix
+	}
 	meta := RouteMetadata{
-		RouteName:    route.Prefix,
+		RouteName:    name,
 		ClusterName:  route.ClusterName,
 		CacheEnabled: route.CacheEnabled,
 		CacheTTL:     route.CacheTTL,
+		StatusTTL:    route.StatusTTL,
+		CacheErrors:  route.CacheErrors,
+		CacheKey:     route.CacheKey,
+		Compression:  route.Compression,
+		Headers:      route.Headers,
+		PathParams:   params,
 	}
 	return outReq, meta, nil
 }
+
+// forwardedFor appends the peer of req to the X-Forwarded-For of outReq.
+// The forwarding headers of peers that are not trusted proxies were made
+// up by the client and are dropped, so the upstream sees the same client
+// as warpgate does.
+func (d *SimpleDirector) forwardedFor(req, outReq *http.Request) {
+	peer := clientip.Peer(req)
+	if !d.ClientIP.Trusted(peer) {
+		outReq.Header.Del("X-Forwarded-For")
+		outReq.Header.Del("Forwarded")
+		if peer.IsValid() {
+			outReq.Header.Set("X-Forwarded-For", peer.String())
+		}
+		return
+	}
+
+	if prior := strings.Join(req.Header.Values("X-Forwarded-For"), ", "); prior != "" {
+		outReq.Header.Set("X-Forwarded-For", prior+", "+peer.String())
+	} else {
+		outReq.Header.Set("X-Forwarded-For", peer.String())
+	}
+}
+
+// RouteHandler applies the middlewares of the route matching each request
+// before passing it to next, which is normally the engine directed by d.
+// Requests matching no route go straight to next.
+func RouteHandler(d *SimpleDirector, next http.Handler) http.Handler {
+	handlers := make([]http.Handler, len(d.Routes))
+	wrapped := false
+	for i, r := range d.Routes {
+		handlers[i] = middleware.Chain(next, r.Middlewares...)
+		wrapped = wrapped || len(r.Middlewares) > 0
+	}
+	if !wrapped {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if i, _ := d.match(r.URL.Path); i >= 0 {
+			handlers[i].ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
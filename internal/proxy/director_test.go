@@ -2,8 +2,12 @@ package proxy_test
 
 import (
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
+	"warpgate/internal/clientip"
+	"warpgate/internal/middleware"
 	"warpgate/internal/proxy"
 )
 
@@ -83,6 +87,11 @@ func TestSimpleDirector_XForwarwardedFor_Appending(t *testing.T) {
 	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
 		{Prefix: "/", ClusterName: "default"},
 	})
+	resolver, err := clientip.NewResolver(clientip.Options{TrustedProxies: []string{"172.16.0.0/12"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.ClientIP = resolver
 
 	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
 	req.Header.Set("X-Forwarded-For", "192.168.1.1, 10.0.0.5")
@@ -115,3 +124,107 @@ func TestSimpleDirector_XForwarwardedFor_Appending(t *testing.T) {
 		t.Errorf("X-Forwarded-For scheme sanitization failed.\nExpected: %q\nGot:\t%q", expected3, got)
 	}
 }
+
+func TestSimpleDirector_XForwardedFor_DropsUntrusted(t *testing.T) {
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/", ClusterName: "default"},
+	})
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	req.Header.Set("Forwarded", "for=1.2.3.4")
+	req.RemoteAddr = "203.0.113.7:40000"
+
+	outReq, _, err := d.Direct(req)
+	if err != nil {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if got := outReq.Header.Get("X-Forwarded-For"); got != "203.0.113.7" {
+		t.Errorf("expected spoofed X-Forwarded-For to be replaced, got %q", got)
+	}
+	if got := outReq.Header.Get("Forwarded"); got != "" {
+		t.Errorf("expected Forwarded to be dropped, got %q", got)
+	}
+}
+
+func TestSimpleDirector_RouteName(t *testing.T) {
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Name: "users", Prefix: "/api/users", ClusterName: "users_cluster"},
+		{Prefix: "/api", ClusterName: "api_cluster"},
+	})
+
+	for path, want := range map[string]string{"/api/users/1": "users", "/api/orders": "/api"} {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		_, meta, err := d.Direct(req)
+		if err != nil {
+			t.Fatalf("unexpected error %v", err)
+		}
+		if meta.RouteName != want {
+			t.Errorf("%s: expected RouteName=%s, got %q", path, want, meta.RouteName)
+		}
+	}
+}
+
+func TestRouteHandler_AppliesRouteMiddlewares(t *testing.T) {
+	tag := func(name string) middleware.Middleware {
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Add("X-Route-Middleware", name)
+				next.ServeHTTP(w, r)
+			})
+		}
+	}
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/api", ClusterName: "api_cluster", Middlewares: []middleware.Middleware{tag("a"), tag("b")}},
+		{Prefix: "/static", ClusterName: "static_cluster"},
+	})
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	h := proxy.RouteHandler(d, next)
+
+	for path, want := range map[string]string{"/api/x": "a,b", "/static/x": "", "/other": ""} {
+		rr := httptest.NewRecorder()
+		h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil))
+		if got := strings.Join(rr.Header().Values("X-Route-Middleware"), ","); got != want {
+			t.Errorf("%s: middlewares %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestSimpleDirector_PathParams(t *testing.T) {
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Name: "orders", Prefix: "/tenants/{tenant}/orders/{id}", ClusterName: "orders"},
+		{Name: "tenants", Prefix: "/tenants/{tenant}/", ClusterName: "tenants"},
+	})
+
+	for _, tc := range []struct {
+		path, route string
+		params      map[string]string
+	}{
+		{"/tenants/acme/orders/42/items", "orders", map[string]string{"tenant": "acme", "id": "42"}},
+		{"/tenants/acme/users", "tenants", map[string]string{"tenant": "acme"}},
+		{"/tenants//users", "", nil},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, "http://example.com"+tc.path, nil)
+		_, meta, err := d.Direct(req)
+		if tc.route == "" {
+			if err == nil {
+				t.Errorf("%s: matched route %q", tc.path, meta.RouteName)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", tc.path, err)
+		}
+		if meta.RouteName != tc.route {
+			t.Errorf("%s: route %q, want %q", tc.path, meta.RouteName, tc.route)
+		}
+		if len(meta.PathParams) != len(tc.params) {
+			t.Errorf("%s: params %v, want %v", tc.path, meta.PathParams, tc.params)
+		}
+		for k, v := range tc.params {
+			if meta.PathParams[k] != v {
+				t.Errorf("%s: param %s = %q, want %q", tc.path, k, meta.PathParams[k], v)
+			}
+		}
+	}
+}
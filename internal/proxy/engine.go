@@ -1,18 +1,29 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+
 	"warpgate/internal/cache"
+	"warpgate/internal/clientip"
 	"warpgate/internal/cluster"
 	"warpgate/internal/logging"
 	"warpgate/internal/metrics"
+	"warpgate/internal/middleware"
+	"warpgate/internal/warm"
 )
 
 type Director interface {
@@ -24,8 +35,27 @@ type RouteMetadata struct {
 	ClusterName  string
 	CacheEnabled bool
 	CacheTTL     time.Duration
+	StatusTTL    StatusTTL
+	CacheErrors  bool
+	CacheKey     *CacheKeyPolicy
+	Compression  *CompressionPolicy
+	// Headers edits the route's requests and responses; nil leaves them as
+	// they are.
+	Headers *HeaderRules
+	// PathParams holds the values matched by "{name}" segments of the
+	// route's prefix.
+	PathParams map[string]string
 }
 
+const (
+	defaultCoalesceTimeout = 5 * time.Second
+	defaultKeepStale       = 10 * time.Minute
+
+	// statusClientClosedRequest is recorded for requests the client gave up
+	// on before a response was sent (nginx's 499).
+	statusClientClosedRequest = 499
+)
+
 type Transport interface {
 	RoundTrip(*http.Request) (*http.Response, error)
 }
@@ -37,6 +67,36 @@ type Engine struct {
 	MaxCacheBodySize int64
 	Logger           logging.Logger
 	Clusters         map[string]cluster.Cluster
+
+	// Coalesce collapses concurrent cache misses for the same key into a
+	// single upstream fetch. Waiters give up after CoalesceTimeout, unless
+	// it is zero, and go upstream themselves.
+	Coalesce        bool
+	CoalesceTimeout time.Duration
+
+	// KeepStale is how long an expired response with validators stays cached
+	// so it can be revalidated upstream instead of fetched again. Zero keeps
+	// none.
+	KeepStale time.Duration
+
+	// TagHeaders are the response headers carrying surrogate keys that
+	// cached entries are tagged with for purging.
+	TagHeaders []string
+
+	// CacheStatus names this cache in the Cache-Status response header
+	// (RFC 9211). The header is not sent when it is empty.
+	CacheStatus string
+
+	// Tracer records the spans of the steps of each request; nil records
+	// none.
+	Tracer trace.Tracer
+
+	// ClusterHeaders edits the requests sent to, and responses received
+	// from, each cluster, before the rules of the route.
+	ClusterHeaders map[string]*HeaderRules
+
+	flights flightGroup
+	passes  passSet
 }
 
 func NewEngine(d Director, c cache.Cache, t Transport, clusters map[string]cluster.Cluster, l logging.Logger) *Engine {
@@ -47,6 +107,9 @@ func NewEngine(d Director, c cache.Cache, t Transport, clusters map[string]clust
 		MaxCacheBodySize: 1 << 20,
 		Logger:           l,
 		Clusters:         clusters,
+		CoalesceTimeout:  defaultCoalesceTimeout,
+		KeepStale:        defaultKeepStale,
+		TagHeaders:       []string{"Surrogate-Key", "Cache-Tag"},
 	}
 }
 
@@ -54,31 +117,178 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
 	start := time.Now()
 
+	_, span := e.startSpan(ctx, "director")
 	outReq, meta, err := e.Director.Direct(req)
+	if err == nil {
+		span.SetAttributes(attribute.String("warpgate.route", meta.RouteName), attribute.String("warpgate.cluster", meta.ClusterName))
+	}
+	endSpan(span, err)
+
+	routeLabel := meta.RouteName
+	if routeLabel == "" {
+		routeLabel = meta.ClusterName
+	}
 	if err != nil {
 		http.Error(rw, err.Error(), http.StatusBadGateway)
-		if e.Logger != nil {
-			e.Logger.Error("director error",
+		if log := e.logger(ctx); log != nil {
+			log.Error("director error",
 				"method", req.Method,
 				"path", req.URL.Path,
 				"err", err,
 			)
 		}
-		metrics.ObserveRequest(meta.ClusterName, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
+		metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
 		return
 	}
 
+	if e.Tracer != nil {
+		span := trace.SpanFromContext(ctx)
+		span.SetName(req.Method + " " + routeLabel)
+		span.SetAttributes(semconv.HTTPRoute(meta.RouteName))
+	}
+
 	cl, ok := e.Clusters[meta.ClusterName]
 	if !ok {
 		http.Error(rw, fmt.Sprintf("no such cluster: %s", meta.ClusterName), http.StatusBadGateway)
-		metrics.ObserveRequest(meta.ClusterName, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
+		metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
 		return
 	}
 
+	// The request is handled as if it accepted only the negotiated encoding,
+	// upstream and in the cache; see CompressionPolicy.
+	var encoding string
+	if meta.Compression != nil {
+		encoding = meta.Compression.Negotiate(strings.Join(req.Header.Values("Accept-Encoding"), ","))
+		req = req.Clone(ctx)
+		req.Header.Set("Accept-Encoding", encoding)
+		if encoding == EncodingIdentity {
+			outReq.Header.Del("Accept-Encoding")
+		} else {
+			outReq.Header.Set("Accept-Encoding", encoding)
+		}
+	}
+
+	var rules []*HeaderRules
+	if r := e.ClusterHeaders[meta.ClusterName]; r != nil {
+		rules = append(rules, r)
+	}
+	if meta.Headers != nil {
+		rules = append(rules, meta.Headers)
+	}
+	if len(rules) > 0 {
+		vars := &headerVars{req: req, meta: &meta, start: start}
+		for _, r := range rules {
+			r.request.apply(outReq.Header, vars)
+		}
+		rw = &headerRulesWriter{ResponseWriter: rw, rules: rules, vars: vars}
+	}
+
+	cacheableMethod := outReq.Method == http.MethodGet || outReq.Method == http.MethodHead
+
+	reqCC := parseCacheControl(req.Header.Values("Cache-Control"))
+
+	var key, storeKey string
+	// passRange is set for range requests for an object that could not be
+	// stored last time: they are forwarded as they are.
+	var passRange bool
+	var fl *flight
+	var stale *cache.CachedResponse
+	cs := cacheStatus{fwd: "bypass"}
+	if meta.CacheEnabled && cacheableMethod && e.Cache != nil && !reqCC.has("no-store") {
+		key = meta.CacheKey.Key(outReq)
+		var cached *cache.CachedResponse
+		var ok bool
+		_, span := e.startSpan(ctx, "cache lookup")
+		cached, storeKey, ok = e.lookup(ctx, key, req.Header)
+		span.SetAttributes(attribute.Bool("warpgate.cache.found", ok))
+		span.End()
+		cs.fwd = "uri-miss"
+		if storeKey != key {
+			cs.fwd = "vary-miss"
+		}
+		if ok {
+			now := time.Now()
+			noCache := requestNoCache(req, reqCC)
+			if !noCache && satisfies(cached, reqCC, now) {
+				if err := e.serveCached(rw, req, cached, cacheStatus{hit: true}, routeLabel, start, "cache hit"); err == nil {
+					metrics.IncCacheHit(routeLabel)
+					if !cached.Fresh(now) {
+						metrics.IncCacheStale(routeLabel)
+					}
+					return
+				}
+				// The stored body is gone; drop the entry and fetch it again.
+				e.Cache.Delete(ctx, storeKey)
+				ok = false
+				cs.fwd = "miss"
+			}
+			if ok {
+				cs.fwd = "request"
+				if !noCache && !cached.Fresh(now) {
+					cs.fwd = "stale"
+				}
+			}
+			if ok && cached.HasValidators() {
+				stale = cached
+			}
+		}
+		metrics.IncCacheMiss(routeLabel)
+
+		if reqCC.has("only-if-cached") {
+			e.setCacheStatus(rw.Header(), cs)
+			http.Error(rw, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+			metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(http.StatusGatewayTimeout), time.Since(start))
+			return
+		}
+
+		passRange = req.Method == http.MethodGet && outReq.Header.Get("Range") != "" && e.passes.has(key)
+		if e.Coalesce && !passRange {
+			f, leader := e.flights.join(storeKey)
+			if leader {
+				fl = f
+				fl.reqHeader = cloneHeader(req.Header)
+				defer e.flights.done(storeKey, f)
+				defer f.abandon()
+			} else if ok := e.serveFromFlight(ctx, rw, req, f, cs, routeLabel, start); ok {
+				return
+			}
+		}
+	} else if meta.CacheEnabled && e.Cache != nil {
+		reason := "method"
+		cs.fwd = "method"
+		if cacheableMethod {
+			reason = "no-store"
+			cs.fwd = "request"
+		}
+		metrics.IncCacheBypass(routeLabel, reason)
+	}
+
+	// A response that may be cached must suit every client, so the client's
+	// own validators are not sent upstream; those of a stale entry are set
+	// below.
+	if key != "" && !passRange {
+		outReq.Header.Del("If-None-Match")
+		outReq.Header.Del("If-Modified-Since")
+	}
+
+	// Range requests that may be cached are fetched in full, so that the
+	// object can be stored; the range is cut from the response as it streams.
+	var rangeHeader string
+	if key != "" && !passRange && req.Method == http.MethodGet && outReq.Header.Get("Range") != "" {
+		rangeHeader = outReq.Header.Get("Range")
+		outReq.Header.Del("Range")
+		outReq.Header.Del("If-Range")
+	}
+
+	_, span = e.startSpan(ctx, "select endpoint")
 	endpoint, err := cl.PickEndpoint()
+	if err == nil {
+		span.SetAttributes(attribute.String("warpgate.endpoint", endpoint.URL.String()))
+	}
+	endSpan(span, err)
 	if err != nil {
 		http.Error(rw, fmt.Sprintf("no available endpoint in cluster: %s", meta.ClusterName), http.StatusBadGateway)
-		metrics.ObserveRequest(meta.ClusterName, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
+		metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
 		return
 	}
 
@@ -88,13 +298,8 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	outReq.Host = targetUrl.Host
 	outReq.RequestURI = ""
 
-	cacheableMethod := outReq.Method == http.MethodGet || outReq.Method == http.MethodHead
-	routeLabel := meta.ClusterName
-
-	if meta.CacheEnabled && cacheableMethod {
-		if ok := e.serveFromCache(ctx, rw, outReq, routeLabel, start); ok {
-			return
-		}
+	if stale != nil {
+		setValidators(outReq, stale)
 	}
 
 	resp, err := e.Transport.RoundTrip(outReq)
@@ -102,8 +307,8 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		cl.ReportFailure(endpoint)
 
 		http.Error(rw, err.Error(), http.StatusBadGateway)
-		if e.Logger != nil {
-			e.Logger.Error("upstream error",
+		if log := e.logger(ctx); log != nil {
+			log.Error("upstream error",
 				"method", outReq.Method,
 				"url", outReq.URL.String(),
 				"err", err,
@@ -122,7 +327,72 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		cl.ReportSuccess(endpoint)
 	}
 
+	if stale != nil && statusCode == http.StatusNotModified {
+		if meta.Compression != nil {
+			keepWeakETag(stale.Header, resp.Header)
+		}
+		refreshed, kept := e.refresh(ctx, req, storeKey, stale, resp.Header, meta)
+		if !kept {
+			defer e.Cache.Delete(ctx, storeKey)
+		}
+		if fl != nil {
+			fl.publish(refreshed.StatusCode, cloneHeader(refreshed.Header), true)
+			fl.finish(copyBody(fl, refreshed))
+		}
+		metrics.IncCacheRevalidated(routeLabel)
+		rs := cacheStatus{fwd: "stale", fwdStatus: statusCode, stored: kept}
+		if err := e.serveCached(rw, req, refreshed, rs, routeLabel, start, "cache revalidated"); err != nil {
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(http.StatusBadGateway), time.Since(start))
+		}
+		return
+	}
+
+	if meta.Compression != nil && meta.Compression.apply(req, resp, encoding) {
+		defer resp.Body.Close()
+		metrics.IncCompressed(routeLabel, encoding)
+	}
+
+	var shared bool
+	var cw cache.Writer
+	if key != "" && !passRange {
+		reason := bypassReason(req, resp, meta.ttlPolicy())
+		if reason == "" {
+			shared = true
+			expiry := computeExpiry(resp, meta.ttlPolicy())
+			if expiry.IsZero() {
+				shared = false
+				reason = "no-freshness"
+			} else if e.MaxCacheBodySize <= 0 || resp.ContentLength <= e.MaxCacheBodySize {
+				cw = e.store(ctx, key, req.Header, e.newCacheEntry(statusCode, cloneHeader(resp.Header), nil, expiry))
+			} else {
+				// Waiters fetch an object too large to store themselves,
+				// rather than have the flight buffer all of it.
+				shared = false
+				reason = "size"
+			}
+		}
+		if reason != "" {
+			metrics.IncCacheBypass(routeLabel, reason)
+			// Credentials make this request uncacheable, not the object.
+			if reason != "authorization" {
+				e.passes.add(key)
+			}
+		}
+	}
+	cs.fwdStatus = statusCode
+	cs.stored = cw != nil
+	if fl != nil {
+		fl.max = e.MaxCacheBodySize
+		fl.publish(statusCode, cloneHeader(resp.Header), shared)
+	}
+	sink := &bodySink{cache: cw}
+	if shared {
+		sink.flight = fl
+	}
+
 	copyHeader(rw.Header(), resp.Header)
+	e.setCacheStatus(rw.Header(), cs)
 
 	trailerKeys := make([]string, 0, len(resp.Trailer))
 	for k := range resp.Trailer {
@@ -132,19 +402,42 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		rw.Header().Set("Trailer", strings.Join(trailerKeys, ","))
 	}
 
-	rw.WriteHeader(resp.StatusCode)
+	// A range request fetched in full is answered with the requested range
+	// when it is a single satisfiable one and the size is known; otherwise
+	// the full response is sent, which a client must accept.
+	var out io.Writer = rw
+	if rangeHeader != "" && statusCode == http.StatusOK && resp.ContentLength >= 0 &&
+		ifRangeMatches(req, resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")) {
+		if ranges, err := parseRange(rangeHeader, resp.ContentLength); err == nil && len(ranges) == 1 {
+			rw.Header().Set("Content-Range", ranges[0].contentRange(resp.ContentLength))
+			rw.Header().Set("Content-Length", strconv.FormatInt(ranges[0].length, 10))
+			statusCode = http.StatusPartialContent
+			out = &rangeWriter{w: rw, r: ranges[0], stop: cw == nil && sink.flight == nil}
+		}
+	}
+
+	rw.WriteHeader(statusCode)
 
+	// Streamed responses are pushed to the client every 10ms. Writes and
+	// flushes are serialized, as the ResponseWriter is not safe for
+	// concurrent use.
 	flusher, _ := rw.(http.Flusher)
+	var mu sync.Mutex
+	out = &lockedWriter{mu: &mu, w: out}
 
 	done := make(chan struct{})
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		ticker := time.NewTicker(10 * time.Millisecond)
 		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				if flusher != nil {
+					mu.Lock()
 					flusher.Flush()
+					mu.Unlock()
 				}
 			case <-done:
 				return
@@ -152,39 +445,30 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		}
 	}()
 
-	var buf *bytes.Buffer
-	var key string
-	shouldCache := meta.CacheEnabled && cacheableMethod && isCacheableResponse(resp)
-	if shouldCache {
-		expiry := computeExpiry(resp, meta.CacheTTL)
-		if expiry.IsZero() {
-			shouldCache = false
-		} else {
-			buf = &bytes.Buffer{}
-			key = cacheKeyFromRequest(outReq)
-		}
+	_, copyErr := io.Copy(out, io.TeeReader(resp.Body, sink))
+	close(done)
+	<-stopped
+	if copyErr == errRangeCompleted {
+		copyErr = nil
 	}
-
-	var reader io.Reader = resp.Body
-	if shouldCache {
-		reader = io.TeeReader(resp.Body, buf)
+	if fl != nil {
+		fl.finish(copyErr)
 	}
 
-	_, copyErr := io.Copy(rw, reader)
-
 	for k, values := range resp.Trailer {
 		for _, v := range values {
 			rw.Header().Set(k, v)
 		}
 	}
-	close(done)
 
 	duration := time.Since(start)
 	metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(statusCode), duration)
-	if e.Logger != nil {
-		e.Logger.Info("proxy request",
+	if log := e.logger(ctx); log != nil {
+		log.Info("proxy request",
 			"method", req.Method,
 			"path", req.URL.Path,
+			"client", clientip.FromRequest(req),
+			"identity", middleware.IdentityName(req.Context()),
 			"status", statusCode,
 			"upstream", routeLabel,
 			"cacheEnabled", meta.CacheEnabled,
@@ -192,109 +476,427 @@ func (e *Engine) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		)
 	}
 
-	if shouldCache && copyErr == nil && e.Cache != nil {
-		if int64(buf.Len()) <= e.MaxCacheBodySize {
-			expiry := computeExpiry(resp, meta.CacheTTL)
-			if !expiry.IsZero() {
-				e.Cache.Set(ctx, key, &cache.CachedResponse{
-					StatusCode: resp.StatusCode,
-					Header:     cloneHeader(resp.Header),
-					Body:       buf.Bytes(),
-					ExpiresAt:  expiry,
-				})
+	if sink.tooLarge {
+		metrics.IncCacheBypass(routeLabel, "size")
+		e.passes.add(key)
+	}
+	if sink.cache != nil {
+		if copyErr == nil {
+			if sink.cache.Commit() == nil {
+				e.passes.remove(key)
+				metrics.ObserveCacheStore(routeLabel, sink.n)
 			}
+		} else {
+			sink.cache.Abort()
 		}
 	}
 }
 
-func (e *Engine) serveFromCache(ctx context.Context, rw http.ResponseWriter, req *http.Request, routeLabel string, start time.Time) bool {
-	if e.Cache == nil {
-		return false
+// lockedWriter writes to w holding mu.
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// bodySink receives a copy of an upstream response body for the waiters of
+// a coalesced fetch and for the cache. Failing to cache the body, typically
+// because it turned out too large, only stops the cache write.
+type bodySink struct {
+	flight *flight
+	cache  cache.Writer
+	// n counts the bytes written to the cache.
+	n        int64
+	tooLarge bool
+}
+
+func (s *bodySink) Write(p []byte) (int, error) {
+	if s.flight != nil {
+		_, _ = s.flight.Write(p)
 	}
+	if s.cache != nil {
+		if _, err := s.cache.Write(p); err != nil {
+			s.cache.Abort()
+			s.cache = nil
+			s.tooLarge = errors.Is(err, cache.ErrTooLarge)
+		} else {
+			s.n += int64(len(p))
+		}
+	}
+	return len(p), nil
+}
 
-	key := cacheKeyFromRequest(req)
+// lookup finds the cached response for key, following the variant index of
+// responses that carry Vary. It also returns the key the response is (or
+// would be) stored under.
+func (e *Engine) lookup(ctx context.Context, key string, reqHeader http.Header) (*cache.CachedResponse, string, bool) {
 	cached, ok := e.Cache.Get(ctx, key)
-	if !ok {
-		metrics.IncCacheMiss(routeLabel)
-		return false
+	if !ok || len(cached.Vary) == 0 {
+		return cached, key, ok
 	}
+	storeKey := variantKey(key, cached.Vary, reqHeader)
+	cached, ok = e.Cache.Get(ctx, storeKey)
+	return cached, storeKey, ok
+}
 
+// store begins caching entry for the primary key and returns the writer its
+// body is streamed to. Responses carrying Vary are stored under a secondary
+// key for the request's variant; once the body is committed, an index entry
+// under the primary key records which request headers select the variant.
+func (e *Engine) store(ctx context.Context, key string, reqHeader http.Header, entry *cache.CachedResponse) cache.Writer {
+	names := varyHeaders(entry.Header)
+	if len(names) == 0 {
+		return cache.NewWriter(ctx, e.Cache, key, entry, e.MaxCacheBodySize)
+	}
+	return &indexingWriter{
+		Writer: cache.NewWriter(ctx, e.Cache, variantKey(key, names, reqHeader), entry, e.MaxCacheBodySize),
+		index: func() {
+			e.Cache.Set(ctx, key, &cache.CachedResponse{
+				Vary:      names,
+				ExpiresAt: entry.ExpiresAt,
+				KeepUntil: entry.KeepUntil,
+			})
+		},
+	}
+}
+
+// indexingWriter stores a variant index entry after committing the variant.
+type indexingWriter struct {
+	cache.Writer
+	index func()
+}
+
+func (w *indexingWriter) Commit() error {
+	if err := w.Writer.Commit(); err != nil {
+		return err
+	}
+	w.index()
+	return nil
+}
+
+// serveCached writes a cached response, answering with 304 Not Modified
+// when the client's conditional headers match it. It fails without writing
+// anything if the cached body cannot be opened.
+func (e *Engine) serveCached(rw http.ResponseWriter, req *http.Request, cached *cache.CachedResponse, cs cacheStatus, routeLabel string, start time.Time, msg string) error {
+	status := cached.StatusCode
+	var body io.ReadSeekCloser
+	if notModified(req, cached) {
+		status = http.StatusNotModified
+	} else if req.Method != http.MethodHead {
+		var err error
+		if body, err = cached.Open(); err != nil {
+			if log := e.logger(req.Context()); log != nil {
+				log.Error("cached body unavailable",
+					"method", req.Method,
+					"path", req.URL.Path,
+					"err", err,
+				)
+			}
+			return err
+		}
+		defer body.Close()
+	}
+
+	now := time.Now()
 	copyHeader(rw.Header(), cached.Header)
-	rw.WriteHeader(cached.StatusCode)
-	_, _ = rw.Write(cached.Body)
+	rw.Header().Set("Age", strconv.FormatInt(int64(cached.Age(now)/time.Second), 10))
+	if !cached.ExpiresAt.IsZero() {
+		cs.ttl, cs.hasTTL = cached.ExpiresAt.Sub(now), true
+	}
+	e.setCacheStatus(rw.Header(), cs)
+
+	if cached.StatusCode == http.StatusOK && rw.Header().Get("Accept-Ranges") == "" {
+		rw.Header().Set("Accept-Ranges", "bytes")
+	}
+
+	var ranges []byteRange
+	var rangeErr error = errInvalidRange
+	if status == http.StatusOK && req.Method == http.MethodGet && req.Header.Get("Range") != "" &&
+		ifRangeMatches(req, cached.ETag, cached.LastModified) {
+		ranges, rangeErr = parseRange(req.Header.Get("Range"), cached.Size())
+	}
+
+	switch {
+	case status == http.StatusNotModified:
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(status)
+	case rangeErr == nil:
+		status = http.StatusPartialContent
+		_ = writeRanges(rw, body, ranges, cached.Size())
+	case rangeErr == errUnsatisfiable:
+		status = http.StatusRequestedRangeNotSatisfiable
+		rw.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", cached.Size()))
+		rw.Header().Del("Content-Length")
+		rw.WriteHeader(status)
+	default:
+		rw.WriteHeader(status)
+		if body != nil {
+			_, _ = io.Copy(rw, body)
+		}
+	}
 
 	duration := time.Since(start)
-	metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(cached.StatusCode), duration)
-	metrics.IncCacheHit(routeLabel)
+	metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(status), duration)
 
-	if e.Logger != nil {
-		e.Logger.Info("cache hit",
+	if log := e.logger(req.Context()); log != nil {
+		log.Info(msg,
 			"method", req.Method,
 			"path", req.URL.Path,
-			"status", cached.StatusCode,
+			"client", clientip.FromRequest(req),
+			"identity", middleware.IdentityName(req.Context()),
+			"status", status,
 			"upstream", routeLabel,
 			"duration_ms", duration.Milliseconds(),
 		)
 	}
-	return true
+	return nil
 }
 
-func copyHeader(dst, src http.Header) {
-	for k, values := range src {
-		for _, v := range values {
-			dst.Add(k, v)
-		}
+// copyBody writes the body of a cached response to w.
+func copyBody(w io.Writer, cached *cache.CachedResponse) error {
+	body, err := cached.Open()
+	if err != nil {
+		return err
 	}
+	defer body.Close()
+	_, err = io.Copy(w, body)
+	return err
 }
 
-func cloneHeader(src http.Header) http.Header {
-	dst := make(http.Header, len(src))
-	for k, values := range src {
-		for _, v := range values {
-			dst.Add(k, v)
+// refresh updates a stale entry after upstream confirmed it with 304 Not
+// Modified and stores it again if it is still cacheable. Otherwise it reports
+// false and the caller removes the entry once the response has been served,
+// as its body may only be readable while it is cached.
+func (e *Engine) refresh(ctx context.Context, req *http.Request, key string, stale *cache.CachedResponse, update http.Header, meta RouteMetadata) (*cache.CachedResponse, bool) {
+	header := mergeNotModified(stale.Header, update)
+	resp := &http.Response{StatusCode: stale.StatusCode, Header: header}
+
+	var expiry time.Time
+	if isCacheableResponse(req, resp, meta.ttlPolicy()) {
+		expiry = computeExpiry(resp, meta.ttlPolicy())
+	}
+	if expiry.IsZero() {
+		uncached := &cache.CachedResponse{
+			StatusCode:   stale.StatusCode,
+			Header:       header,
+			ETag:         header.Get("ETag"),
+			LastModified: header.Get("Last-Modified"),
 		}
+		uncached.ShareBody(stale)
+		return uncached, false
 	}
-	return dst
-}
 
-func cacheKeyFromRequest(req *http.Request) string {
-	u := *req.URL
-	return req.Method + " " + u.Scheme + "://" + req.Host + u.RequestURI()
+	refreshed := e.newCacheEntry(stale.StatusCode, header, nil, expiry)
+	refreshed.ShareBody(stale)
+	e.Cache.Set(ctx, key, refreshed)
+	return refreshed, true
 }
 
-func isCacheableResponse(resp *http.Response) bool {
-	if resp.StatusCode != http.StatusOK {
-		return false
+// serveFromFlight waits for another request's in-progress fetch of the same
+// key and streams its response as it arrives. It returns false if the caller
+// should go upstream itself: the wait timed out, the fetch failed, or the
+// response turned out not to be shareable. If the fetch fails once the
+// response has started, the handler is aborted with http.ErrAbortHandler.
+func (e *Engine) serveFromFlight(ctx context.Context, rw http.ResponseWriter, req *http.Request, f *flight, cs cacheStatus, routeLabel string, start time.Time) bool {
+	var expired <-chan time.Time
+	if e.CoalesceTimeout > 0 {
+		timer := time.NewTimer(e.CoalesceTimeout)
+		defer timer.Stop()
+		expired = timer.C
 	}
 
-	cc := resp.Header.Get("Cache-Control")
-	ccLower := strings.ToLower(cc)
-	if strings.Contains(ccLower, "no-store") {
+	select {
+	case <-f.ready:
+	case <-expired:
+		return false
+	case <-ctx.Done():
+		// The client went away while waiting for the response head.
+		metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(statusClientClosedRequest), time.Since(start))
+		if log := e.logger(ctx); log != nil {
+			log.Info("coalesced request",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"client", clientip.FromRequest(req),
+				"identity", middleware.IdentityName(req.Context()),
+				"status", statusClientClosedRequest,
+				"upstream", routeLabel,
+				"err", ctx.Err(),
+			)
+		}
+		return true
+	}
+	if !f.shared {
 		return false
 	}
-	if strings.Contains(ccLower, "private") {
+	if names := varyHeaders(f.header); len(names) > 0 && !sameVariant(names, req.Header, f.reqHeader) {
 		return false
 	}
+
+	copyHeader(rw.Header(), f.header)
+	cs.fwdStatus = f.status
+	cs.collapsed = true
+	e.setCacheStatus(rw.Header(), cs)
+	rw.WriteHeader(f.status)
+
+	flusher, _ := rw.(http.Flusher)
+
+	var off int
+	var err error
+	for {
+		var chunk []byte
+		chunk, err = f.next(ctx, off)
+		if len(chunk) == 0 {
+			break
+		}
+		if _, err = rw.Write(chunk); err != nil {
+			break
+		}
+		off += len(chunk)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	duration := time.Since(start)
+	metrics.ObserveRequest(routeLabel, req.Method, fmt.Sprint(f.status), duration)
+	metrics.IncCacheCoalesced(routeLabel)
+
+	if log := e.logger(ctx); log != nil {
+		if err != nil {
+			log.Error("coalesced request",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"client", clientip.FromRequest(req),
+				"identity", middleware.IdentityName(req.Context()),
+				"upstream", routeLabel,
+				"err", err,
+			)
+		} else {
+			log.Info("coalesced request",
+				"method", req.Method,
+				"path", req.URL.Path,
+				"client", clientip.FromRequest(req),
+				"identity", middleware.IdentityName(req.Context()),
+				"status", f.status,
+				"upstream", routeLabel,
+				"duration_ms", duration.Milliseconds(),
+			)
+		}
+	}
+	if err != nil {
+		// The head has been sent, so the only way to tell the client its
+		// response is incomplete is to break the connection.
+		panic(http.ErrAbortHandler)
+	}
 	return true
 }
 
-func computeExpiry(resp *http.Response, routeTTL time.Duration) time.Time {
-	now := time.Now()
+// PurgeURL removes the cached responses for rawURL, including every
+// variant and every method, and returns how many entries were removed.
+// rawURL is normalized by the cache key policy of its route and matched
+// literally.
+func (e *Engine) PurgeURL(ctx context.Context, rawURL string) int {
+	if e.Cache == nil {
+		return 0
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return 0
+	}
+	var policy *CacheKeyPolicy
+	if e.Director != nil {
+		if _, meta, err := e.Director.Direct(req); err == nil && meta.CacheKey != nil {
+			// Header and cookie components follow the URL after a "|",
+			// which the patterns below match anyway.
+			p := *meta.CacheKey
+			p.Headers, p.Cookies = nil, nil
+			policy = &p
+		}
+	}
+	_, u, _ := strings.Cut(policy.Key(req), " ")
+	return e.PurgePattern(ctx, cache.EscapePattern(u))
+}
 
-	cc := resp.Header.Get("Cache-Control")
-	for _, part := range strings.Split(cc, ",") {
-		part = strings.TrimSpace(part)
-		if strings.HasPrefix(strings.ToLower(part), "max-age=") {
-			val := strings.TrimPrefix(part, "max-age=")
-			if secs, err := time.ParseDuration(val + "s"); err == nil {
-				return now.Add(secs)
-			}
+// PurgePattern removes the cached responses whose URL matches pattern, where
+// '*' matches any run of characters and '\' escapes the character after it.
+func (e *Engine) PurgePattern(ctx context.Context, pattern string) int {
+	if e.Cache == nil {
+		return 0
+	}
+	// Keys are "METHOD URL", optionally followed by "|"-separated key
+	// components and variant selectors.
+	n := e.Cache.DeleteMatching(ctx, "* "+pattern)
+	n += e.Cache.DeleteMatching(ctx, "* "+pattern+"|*")
+	return n
+}
+
+// PurgeTag removes the cached responses tagged with tag.
+func (e *Engine) PurgeTag(ctx context.Context, tag string) int {
+	if e.Cache == nil {
+		return 0
+	}
+	return e.Cache.DeleteTagged(ctx, tag)
+}
+
+// Warm fetches urls through the engine so that their responses are cached.
+func (e *Engine) Warm(ctx context.Context, urls []string, opts warm.Options) warm.Report {
+	return warm.Run(ctx, e, urls, opts)
+}
+
+// startSpan starts a span of the request of ctx, or a span recording
+// nothing if the engine has no tracer.
+func (e *Engine) startSpan(ctx context.Context, name string) (context.Context, trace.Span) {
+	if e.Tracer == nil {
+		return ctx, noop.Span{}
+	}
+	return e.Tracer.Start(ctx, name)
+}
+
+// endSpan ends span, marking it failed if err is not nil.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// logger returns the engine's logger for the request of ctx.
+func (e *Engine) logger(ctx context.Context) logging.Logger {
+	return logging.FromContext(ctx, e.Logger)
+}
+
+func copyHeader(dst, src http.Header) {
+	for k, values := range src {
+		for _, v := range values {
+			dst.Add(k, v)
 		}
 	}
+}
 
-	if routeTTL > 0 {
-		return now.Add(routeTTL)
+func cloneHeader(src http.Header) http.Header {
+	dst := make(http.Header, len(src))
+	for k, values := range src {
+		for _, v := range values {
+			dst.Add(k, v)
+		}
 	}
+	return dst
+}
 
-	return time.Time{}
+func cacheKeyFromRequest(req *http.Request) string {
+	u := *req.URL
+	scheme := u.Scheme
+	if scheme == "" {
+		scheme = "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+	}
+	return req.Method + " " + scheme + "://" + req.Host + u.RequestURI()
 }
@@ -0,0 +1,943 @@
+package proxy_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"warpgate/internal/cache"
+	"warpgate/internal/cluster"
+	"warpgate/internal/proxy"
+	"warpgate/internal/warm"
+)
+
+type transportFunc func(*http.Request) (*http.Response, error)
+
+func (f transportFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func newTestEngine(t *testing.T, tr proxy.Transport) *proxy.Engine {
+	t.Helper()
+	u, err := url.Parse("http://backend")
+	if err != nil {
+		t.Fatalf("parse url: %v", err)
+	}
+	clusters := map[string]cluster.Cluster{
+		"backend": cluster.NewRoundRobinCluster("backend", []*cluster.Endpoint{{URL: u}}, nil, nil),
+	}
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute},
+	})
+	return proxy.NewEngine(d, cache.NewInMemoryCache(100), tr, clusters, nil)
+}
+
+func newResponse(status int, header http.Header, body io.Reader) *http.Response {
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &http.Response{
+		StatusCode: status,
+		Header:     header,
+		Body:       io.NopCloser(body),
+	}
+}
+
+func TestEngine_CoalescesConcurrentMisses(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		<-release
+		return newResponse(http.StatusOK, nil, strings.NewReader("shared body")), nil
+	})
+
+	e := newTestEngine(t, tr)
+	e.Coalesce = true
+
+	const n = 5
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	codes := make([]int, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/popular", nil))
+			codes[i] = rr.Code
+			bodies[i] = rr.Body.String()
+		}(i)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected 1 upstream fetch, got %d", got)
+	}
+	for i := 0; i < n; i++ {
+		if codes[i] != http.StatusOK || bodies[i] != "shared body" {
+			t.Errorf("request %d: got %d %q", i, codes[i], bodies[i])
+		}
+	}
+}
+
+func TestEngine_CoalescedWaitersStreamBody(t *testing.T) {
+	pr, pw := io.Pipe()
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		return newResponse(http.StatusOK, nil, pr), nil
+	})
+
+	e := newTestEngine(t, tr)
+	e.Coalesce = true
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/stream", nil))
+	}()
+
+	if _, err := pw.Write([]byte("first,")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	waiterBody := make(chan string, 1)
+	wr, ww := io.Pipe()
+	go func() {
+		rw := &streamRecorder{ResponseRecorder: httptest.NewRecorder(), w: ww}
+		e.ServeHTTP(rw, httptest.NewRequest(http.MethodGet, "http://example.com/stream", nil))
+		ww.Close()
+	}()
+
+	// The waiter must see the first chunk before the upstream finishes.
+	buf := make([]byte, len("first,"))
+	if _, err := io.ReadFull(wr, buf); err != nil {
+		t.Fatalf("read first chunk: %v", err)
+	}
+	if string(buf) != "first," {
+		t.Fatalf("unexpected first chunk %q", buf)
+	}
+	go func() {
+		b, _ := io.ReadAll(wr)
+		waiterBody <- string(b)
+	}()
+
+	_, _ = pw.Write([]byte("second"))
+	pw.Close()
+	<-leaderDone
+
+	if got := <-waiterBody; got != "second" {
+		t.Fatalf("expected rest of body %q, got %q", "second", got)
+	}
+}
+
+func TestEngine_CoalesceFallsBackForUncacheableResponse(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		if calls.Add(1) == 1 {
+			<-release
+		}
+		h := make(http.Header)
+		h.Set("Cache-Control", "private")
+		return newResponse(http.StatusOK, h, strings.NewReader("mine")), nil
+	})
+
+	e := newTestEngine(t, tr)
+	e.Coalesce = true
+
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/private", nil))
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected each request to fetch a private response itself, got %d fetches", got)
+	}
+}
+
+// messageLogger records the messages and arguments logged.
+type messageLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *messageLogger) Info(msg string, args ...any)  { l.log(msg, args) }
+func (l *messageLogger) Error(msg string, args ...any) { l.log(msg, args) }
+
+func (l *messageLogger) log(msg string, args []any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintln(append([]any{msg}, args...)...))
+}
+
+func TestEngine_CoalesceWaiterCancelledIsLogged(t *testing.T) {
+	release := make(chan struct{})
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		<-release
+		return newResponse(http.StatusOK, nil, strings.NewReader("late")), nil
+	})
+	e := newTestEngine(t, tr)
+	e.Coalesce = true
+	logger := &messageLogger{}
+	e.Logger = logger
+
+	leaderDone := make(chan struct{})
+	go func() {
+		defer close(leaderDone)
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/slow", nil))
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waiterDone := make(chan struct{})
+	go func() {
+		defer close(waiterDone)
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/slow", nil).WithContext(ctx)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	<-waiterDone
+	close(release)
+	<-leaderDone
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var found bool
+	for _, l := range logger.logs {
+		if strings.HasPrefix(l, "coalesced request ") && strings.Contains(l, " status 499 ") {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("cancelled waiter not logged: %q", logger.logs)
+	}
+}
+
+func TestEngine_CoalesceDoesNotBufferOversizedBody(t *testing.T) {
+	payload := strings.Repeat("x", 64<<10)
+
+	t.Run("known length", func(t *testing.T) {
+		var calls atomic.Int32
+		release := make(chan struct{})
+		tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+			if calls.Add(1) == 1 {
+				<-release
+			}
+			h := http.Header{"Cache-Control": {"max-age=60"}}
+			resp := newResponse(http.StatusOK, h, strings.NewReader(payload))
+			resp.ContentLength = int64(len(payload))
+			return resp, nil
+		})
+		e := newTestEngine(t, tr)
+		e.Coalesce = true
+		e.MaxCacheBodySize = 1 << 10
+
+		var wg sync.WaitGroup
+		bodies := make([]string, 2)
+		for i := range bodies {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				rr := httptest.NewRecorder()
+				e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/big", nil))
+				bodies[i] = rr.Body.String()
+			}(i)
+		}
+		time.Sleep(50 * time.Millisecond)
+		close(release)
+		wg.Wait()
+
+		if got := calls.Load(); got != 2 {
+			t.Fatalf("expected the waiter to fetch the oversized body itself, got %d fetches", got)
+		}
+		for i, b := range bodies {
+			if b != payload {
+				t.Errorf("request %d: got %d bytes", i, len(b))
+			}
+		}
+	})
+
+	t.Run("unknown length", func(t *testing.T) {
+		pr, pw := io.Pipe()
+		tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+			resp := newResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, pr)
+			resp.ContentLength = -1
+			return resp, nil
+		})
+		e := newTestEngine(t, tr)
+		e.Coalesce = true
+		e.MaxCacheBodySize = 1 << 10
+
+		leader := httptest.NewRecorder()
+		leaderDone := make(chan struct{})
+		go func() {
+			defer close(leaderDone)
+			e.ServeHTTP(leader, httptest.NewRequest(http.MethodGet, "http://example.com/big", nil))
+		}()
+		if _, err := pw.Write([]byte("x")); err != nil {
+			t.Fatal(err)
+		}
+
+		waiter := httptest.NewRecorder()
+		waiterDone := make(chan struct{})
+		var aborted any
+		go func() {
+			defer close(waiterDone)
+			defer func() { aborted = recover() }()
+			e.ServeHTTP(waiter, httptest.NewRequest(http.MethodGet, "http://example.com/big", nil))
+		}()
+		time.Sleep(50 * time.Millisecond)
+		io.WriteString(pw, payload[1:])
+		pw.Close()
+		<-leaderDone
+		<-waiterDone
+
+		if leader.Body.String() != payload {
+			t.Errorf("leader got %d bytes", leader.Body.Len())
+		}
+		// The waiter was sent the head before the body outgrew the limit;
+		// its response must break rather than end short.
+		if aborted != http.ErrAbortHandler {
+			t.Errorf("waiter served %d bytes without being aborted (recovered %v)", waiter.Body.Len(), aborted)
+		}
+		if waiter.Body.Len() > 1<<10 {
+			t.Errorf("waiter was served %d bytes buffered beyond the limit", waiter.Body.Len())
+		}
+	})
+}
+
+func TestEngine_RevalidatesStaleEntry(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		h := make(http.Header)
+		h.Set("ETag", `"v1"`)
+		if calls.Add(1) == 1 {
+			h.Set("Cache-Control", "max-age=0")
+			return newResponse(http.StatusOK, h, strings.NewReader("payload")), nil
+		}
+		if got := r.Header.Get("If-None-Match"); got != `"v1"` {
+			t.Errorf("expected revalidation with If-None-Match %q, got %q", `"v1"`, got)
+		}
+		h.Set("Cache-Control", "max-age=60")
+		return newResponse(http.StatusNotModified, h, http.NoBody), nil
+	})
+
+	e := newTestEngine(t, tr)
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "payload" {
+			t.Fatalf("request %d: got %d %q", i, rr.Code, rr.Body.String())
+		}
+		if i == 1 && rr.Header().Get("Cache-Control") != "max-age=60" {
+			t.Errorf("expected refreshed Cache-Control, got %q", rr.Header().Get("Cache-Control"))
+		}
+	}
+
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected fetch and one revalidation, got %d upstream calls", got)
+	}
+}
+
+func TestEngine_ServesAndRevalidatesDiskCache(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		h := make(http.Header)
+		h.Set("ETag", `"v1"`)
+		if calls.Add(1) == 1 {
+			h.Set("Cache-Control", "max-age=0")
+			return newResponse(http.StatusOK, h, strings.NewReader("large asset")), nil
+		}
+		h.Set("Cache-Control", "max-age=60")
+		return newResponse(http.StatusNotModified, h, http.NoBody), nil
+	})
+
+	disk, err := cache.NewDiskCache(cache.DiskOptions{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("NewDiskCache: %v", err)
+	}
+	e := newTestEngine(t, tr)
+	e.Cache = cache.NewTieredCache(cache.NewInMemoryCache(100), disk, 4)
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/asset", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != "large asset" {
+			t.Fatalf("request %d: got %d %q", i, rr.Code, rr.Body.String())
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected fetch and one revalidation, got %d upstream calls", got)
+	}
+	if disk.Len() != 1 {
+		t.Errorf("disk cache holds %d entries, want 1", disk.Len())
+	}
+}
+
+func TestEngine_AnswersClientConditionalFromCache(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		h := make(http.Header)
+		h.Set("ETag", `W/"abc"`)
+		h.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+		return newResponse(http.StatusOK, h, strings.NewReader("payload")), nil
+	})
+
+	e := newTestEngine(t, tr)
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil)
+	req.Header.Set("If-None-Match", `"other", "abc"`)
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for matching If-None-Match, got %d", rr.Code)
+	}
+	if rr.Body.Len() != 0 {
+		t.Errorf("expected empty body on 304, got %q", rr.Body.String())
+	}
+	if rr.Header().Get("ETag") != `W/"abc"` {
+		t.Errorf("expected ETag on 304, got %q", rr.Header().Get("ETag"))
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil)
+	req.Header.Set("If-Modified-Since", "Tue, 03 Jan 2006 15:04:05 GMT")
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotModified {
+		t.Fatalf("expected 304 for If-Modified-Since after Last-Modified, got %d", rr.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/doc", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "payload" {
+		t.Fatalf("expected full response for non-matching ETag, got %d %q", rr.Code, rr.Body.String())
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected conditionals to be answered from cache, got %d upstream calls", got)
+	}
+}
+
+func TestEngine_AgeAndRequestDirectives(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		h := make(http.Header)
+		h.Set("Cache-Control", "max-age=600")
+		h.Set("Age", "100")
+		return newResponse(http.StatusOK, h, strings.NewReader("payload")), nil
+	})
+	e := newTestEngine(t, tr)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/x", nil)
+	req.Header.Set("Cache-Control", "only-if-cached")
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Fatalf("expected 504 for only-if-cached miss, got %d", rr.Code)
+	}
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/x", nil))
+
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/x", nil))
+	if got := rr.Header().Get("Age"); got != "100" {
+		t.Errorf("expected Age 100 on hit, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/x", nil)
+	req.Header.Set("Cache-Control", "max-age=50")
+	e.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := calls.Load(); got != 2 {
+		t.Fatalf("expected request max-age below entry age to go upstream, got %d fetches", got)
+	}
+}
+
+func TestEngine_PurgeURLAndTag(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		h := make(http.Header)
+		h.Set("Vary", "Accept-Language")
+		h.Set("Surrogate-Key", "page "+strings.TrimPrefix(r.URL.Path, "/"))
+		return newResponse(http.StatusOK, h, strings.NewReader("x")), nil
+	})
+	e := newTestEngine(t, tr)
+
+	get := func(path, lang string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.Header.Set("Accept-Language", lang)
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for _, lang := range []string{"en", "fr"} {
+		get("/a", lang)
+		get("/b", lang)
+	}
+	if got := calls.Load(); got != 4 {
+		t.Fatalf("expected 4 fetches to fill the cache, got %d", got)
+	}
+
+	if n := e.PurgeURL(context.Background(), "http://example.com/a"); n != 3 {
+		t.Fatalf("PurgeURL removed %d entries, want 2 variants and the index", n)
+	}
+	get("/a", "en")
+	get("/b", "en")
+	if got := calls.Load(); got != 5 {
+		t.Fatalf("expected only the purged URL to be refetched, got %d fetches", got)
+	}
+
+	if n := e.PurgeTag(context.Background(), "b"); n != 2 {
+		t.Fatalf("PurgeTag removed %d entries, want 2", n)
+	}
+	get("/b", "fr")
+	if got := calls.Load(); got != 6 {
+		t.Fatalf("expected tagged URL to be refetched, got %d fetches", got)
+	}
+}
+
+func TestEngine_PurgeURLIsNormalizedAndLiteral(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return newResponse(http.StatusOK, nil, strings.NewReader("x")), nil
+	})
+	u, _ := url.Parse("http://backend")
+	clusters := map[string]cluster.Cluster{
+		"backend": cluster.NewRoundRobinCluster("backend", []*cluster.Endpoint{{URL: u}}, nil, nil),
+	}
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/norm/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute,
+			CacheKey: &proxy.CacheKeyPolicy{Headers: []string{"X-Tenant"}, SortQuery: true, IgnoreCase: true}},
+		{Prefix: "/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute},
+	})
+	e := proxy.NewEngine(d, cache.NewInMemoryCache(100), tr, clusters, nil)
+
+	get := func(path string) {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com"+path, nil)
+		req.Header.Set("X-Tenant", "t1")
+		e.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	for _, path := range []string{"/norm/Page?b=2&a=1", "/a*", "/ab"} {
+		get(path)
+	}
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected 3 fetches to fill the cache, got %d", got)
+	}
+
+	if n := e.PurgeURL(context.Background(), "http://Example.com/norm/PAGE?a=1&b=2"); n != 1 {
+		t.Fatalf("PurgeURL removed %d entries of the normalized URL, want 1", n)
+	}
+	if n := e.PurgeURL(context.Background(), "http://example.com/a*"); n != 1 {
+		t.Fatalf("PurgeURL removed %d entries of a URL with '*', want 1", n)
+	}
+	get("/ab")
+	if got := calls.Load(); got != 3 {
+		t.Fatalf("expected /ab to survive the purge of /a*, got %d fetches", got)
+	}
+	get("/norm/page?a=1&b=2")
+	get("/a*")
+	if got := calls.Load(); got != 5 {
+		t.Fatalf("expected purged URLs to be refetched, got %d fetches", got)
+	}
+}
+
+// streamRecorder forwards body writes to w so tests can observe them as they
+// happen.
+type streamRecorder struct {
+	*httptest.ResponseRecorder
+	w io.Writer
+}
+
+func (s *streamRecorder) Write(p []byte) (int, error) {
+	return s.w.Write(p)
+}
+
+func TestEngine_ServesRangesFromCache(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		h := make(http.Header)
+		h.Set("Content-Type", "text/plain")
+		h.Set("ETag", `"v1"`)
+		return newResponse(http.StatusOK, h, strings.NewReader("0123456789")), nil
+	})
+	e := newTestEngine(t, tr)
+
+	get := func(header map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+		for k, v := range header {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, req)
+		return rr
+	}
+
+	get(nil)
+
+	rr := get(map[string]string{"Range": "bytes=2-5"})
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "2345" {
+		t.Fatalf("single range: got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 2-5/10" {
+		t.Errorf("Content-Range = %q", got)
+	}
+	if got := rr.Header().Get("Content-Length"); got != "4" {
+		t.Errorf("Content-Length = %q", got)
+	}
+
+	rr = get(map[string]string{"Range": "bytes=0-1,-2"})
+	if rr.Code != http.StatusPartialContent {
+		t.Fatalf("multi range: got %d", rr.Code)
+	}
+	mediaType, params, err := mime.ParseMediaType(rr.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("multi range Content-Type = %q", rr.Header().Get("Content-Type"))
+	}
+	mr := multipart.NewReader(rr.Body, params["boundary"])
+	for _, want := range []struct{ body, contentRange string }{{"01", "bytes 0-1/10"}, {"89", "bytes 8-9/10"}} {
+		part, err := mr.NextPart()
+		if err != nil {
+			t.Fatalf("NextPart: %v", err)
+		}
+		body, _ := io.ReadAll(part)
+		if string(body) != want.body || part.Header.Get("Content-Range") != want.contentRange ||
+			part.Header.Get("Content-Type") != "text/plain" {
+			t.Errorf("part = %q %v, want %q %q", body, part.Header, want.body, want.contentRange)
+		}
+	}
+	if _, err := mr.NextPart(); err != io.EOF {
+		t.Errorf("expected two parts, got %v", err)
+	}
+
+	rr = get(map[string]string{"Range": "bytes=20-"})
+	if rr.Code != http.StatusRequestedRangeNotSatisfiable || rr.Header().Get("Content-Range") != "bytes */10" {
+		t.Errorf("unsatisfiable range: got %d %q", rr.Code, rr.Header().Get("Content-Range"))
+	}
+
+	rr = get(map[string]string{"Range": "bytes=2-5", "If-Range": `"v0"`})
+	if rr.Code != http.StatusOK || rr.Body.String() != "0123456789" {
+		t.Errorf("If-Range mismatch: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected ranges served from cache, got %d upstream calls", got)
+	}
+}
+
+func TestEngine_RangeMissFetchesFullObject(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		if r.Header.Get("Range") != "" {
+			t.Errorf("cacheable range request forwarded with Range %q", r.Header.Get("Range"))
+		}
+		resp := newResponse(http.StatusOK, nil, strings.NewReader("0123456789"))
+		resp.ContentLength = 10
+		return resp, nil
+	})
+	e := newTestEngine(t, tr)
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+	req.Header.Set("Range", "bytes=3-4")
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "34" {
+		t.Fatalf("got %d %q, want 206 %q", rr.Code, rr.Body.String(), "34")
+	}
+	if got := rr.Header().Get("Content-Range"); got != "bytes 3-4/10" {
+		t.Errorf("Content-Range = %q", got)
+	}
+
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/file", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "0123456789" {
+		t.Fatalf("full request: got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("expected the full object to be cached by the range request, got %d upstream calls", got)
+	}
+}
+
+func TestEngine_RangeForwardedForUncacheableObject(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		length int64
+	}{
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 10},
+		{"oversized", nil, 10},
+		{"oversized stream", nil, -1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var ranges []string
+			tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+				ranges = append(ranges, r.Header.Get("Range"))
+				if rg := r.Header.Get("Range"); rg != "" {
+					h := tc.header.Clone()
+					if h == nil {
+						h = make(http.Header)
+					}
+					h.Set("Content-Range", "bytes 3-4/10")
+					resp := newResponse(http.StatusPartialContent, h, strings.NewReader("34"))
+					resp.ContentLength = 2
+					return resp, nil
+				}
+				resp := newResponse(http.StatusOK, tc.header.Clone(), strings.NewReader("0123456789"))
+				resp.ContentLength = tc.length
+				return resp, nil
+			})
+			e := newTestEngine(t, tr)
+			e.MaxCacheBodySize = 5
+
+			get := func() *httptest.ResponseRecorder {
+				req := httptest.NewRequest(http.MethodGet, "http://example.com/file", nil)
+				req.Header.Set("Range", "bytes=3-4")
+				rr := httptest.NewRecorder()
+				e.ServeHTTP(rr, req)
+				return rr
+			}
+
+			// The first range request cannot know the object will not be
+			// stored and fetches all of it; the next one passes Range on.
+			get()
+			rr := get()
+			if rr.Code != http.StatusPartialContent || rr.Body.String() != "34" {
+				t.Fatalf("got %d %q, want 206 %q", rr.Code, rr.Body.String(), "34")
+			}
+			if want := []string{"", "bytes=3-4"}; !slices.Equal(ranges, want) {
+				t.Errorf("upstream saw Range %q, want %q", ranges, want)
+			}
+		})
+	}
+}
+
+func TestEngine_AbortsCachingOversizedStream(t *testing.T) {
+	var calls atomic.Int32
+	body := strings.Repeat("x", 100)
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		resp := newResponse(http.StatusOK, nil, strings.NewReader(body))
+		resp.ContentLength = -1
+		return resp, nil
+	})
+	e := newTestEngine(t, tr)
+	e.MaxCacheBodySize = 64
+
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/big", nil))
+		if rr.Code != http.StatusOK || rr.Body.String() != body {
+			t.Fatalf("request %d: got %d, %d bytes", i, rr.Code, rr.Body.Len())
+		}
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("oversized body was cached: %d upstream calls", got)
+	}
+}
+
+func TestEngine_CacheStatusHeader(t *testing.T) {
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		h := http.Header{"Cache-Control": {"max-age=60"}}
+		if r.URL.Path == "/cdn" {
+			h.Set("Cache-Status", "origin-cache; hit")
+		}
+		return newResponse(http.StatusOK, h, strings.NewReader("body")), nil
+	})
+	e := newTestEngine(t, tr)
+	e.CacheStatus = "warpgate"
+
+	do := func(method, target string, header http.Header) []string {
+		t.Helper()
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, req)
+		return rr.Header().Values("Cache-Status")
+	}
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		header http.Header
+		want   []string
+	}{
+		{"miss", http.MethodGet, "http://example.com/a", nil, []string{"warpgate; fwd=uri-miss; fwd-status=200; stored"}},
+		{"hit", http.MethodGet, "http://example.com/a", nil, []string{"warpgate; hit; ttl=60"}},
+		{"no-cache", http.MethodGet, "http://example.com/a", http.Header{"Cache-Control": {"no-cache"}}, []string{"warpgate; fwd=request; fwd-status=200; stored"}},
+		{"no-store", http.MethodGet, "http://example.com/a", http.Header{"Cache-Control": {"no-store"}}, []string{"warpgate; fwd=request; fwd-status=200"}},
+		{"method", http.MethodPost, "http://example.com/a", nil, []string{"warpgate; fwd=method; fwd-status=200"}},
+		{"upstream cache", http.MethodGet, "http://example.com/cdn", nil, []string{"origin-cache; hit", "warpgate; fwd=uri-miss; fwd-status=200; stored"}},
+		{"upstream cache hit", http.MethodGet, "http://example.com/cdn", nil, []string{"origin-cache; hit", "warpgate; hit; ttl=60"}},
+	}
+	for _, tt := range tests {
+		got := do(tt.method, tt.target, tt.header)
+		if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+			t.Errorf("%s: Cache-Status = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	e.CacheStatus = ""
+	if got := do(http.MethodGet, "http://example.com/a", nil); len(got) != 0 {
+		t.Errorf("Cache-Status sent while disabled: %q", got)
+	}
+}
+
+func TestEngine_CacheStatusStaleRevalidation(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		if calls.Add(1) > 1 && r.Header.Get("If-None-Match") == `"v1"` {
+			return newResponse(http.StatusNotModified, http.Header{"Cache-Control": {"max-age=30"}}, strings.NewReader("")), nil
+		}
+		h := http.Header{"Cache-Control": {"max-age=0"}, "Etag": {`"v1"`}}
+		return newResponse(http.StatusOK, h, strings.NewReader("body")), nil
+	})
+	e := newTestEngine(t, tr)
+	e.CacheStatus = "warpgate"
+
+	e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/s", nil))
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/s", nil))
+	if got, want := rr.Header().Get("Cache-Status"), "warpgate; fwd=stale; fwd-status=304; ttl=30; stored"; got != want {
+		t.Errorf("Cache-Status = %q, want %q", got, want)
+	}
+	if rr.Body.String() != "body" {
+		t.Errorf("body = %q, want %q", rr.Body.String(), "body")
+	}
+}
+
+func TestEngine_NegativeCaching(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		status := http.StatusNotFound
+		if r.URL.Path == "/down" {
+			status = http.StatusServiceUnavailable
+		}
+		return newResponse(status, nil, strings.NewReader(http.StatusText(status))), nil
+	})
+
+	statusTTL, err := proxy.ParseStatusTTL(map[string]time.Duration{"404": 10 * time.Second, "5xx": time.Second})
+	if err != nil {
+		t.Fatalf("ParseStatusTTL: %v", err)
+	}
+	e := newTestEngine(t, tr)
+	e.Director = proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute, StatusTTL: statusTTL},
+	})
+
+	for i := 0; i < 3; i++ {
+		rr := httptest.NewRecorder()
+		e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/missing", nil))
+		if rr.Code != http.StatusNotFound {
+			t.Fatalf("status = %d, want 404", rr.Code)
+		}
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream calls for 404 = %d, want 1", got)
+	}
+
+	calls.Store(0)
+	for i := 0; i < 2; i++ {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/down", nil))
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream calls for 503 without cacheErrors = %d, want 2", got)
+	}
+}
+
+func TestEngine_StatusTTLDoesNotStoreNotModified(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			return newResponse(http.StatusNotModified, nil, strings.NewReader("")), nil
+		}
+		h := make(http.Header)
+		h.Set("ETag", `"v1"`)
+		return newResponse(http.StatusOK, h, strings.NewReader("body")), nil
+	})
+
+	statusTTL, err := proxy.ParseStatusTTL(map[string]time.Duration{"3xx": time.Hour})
+	if err != nil {
+		t.Fatalf("ParseStatusTTL: %v", err)
+	}
+	e := newTestEngine(t, tr)
+	e.Director = proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Prefix: "/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute, StatusTTL: statusTTL},
+	})
+
+	// A conditional miss is fetched in full, so that it can be cached.
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/page", nil)
+	req.Header.Set("If-None-Match", `"v1"`)
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || rr.Body.String() != "body" {
+		t.Fatalf("conditional miss: got %d %q", rr.Code, rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/page", nil))
+	if rr.Code != http.StatusOK || rr.Body.String() != "body" {
+		t.Fatalf("unconditional request: got %d %q", rr.Code, rr.Body.String())
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("upstream calls = %d, want 1", got)
+	}
+}
+
+func TestEngine_WarmPopulatesCache(t *testing.T) {
+	var calls atomic.Int32
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		calls.Add(1)
+		return newResponse(http.StatusOK, nil, strings.NewReader("page "+r.URL.Path)), nil
+	})
+	e := newTestEngine(t, tr)
+
+	report := e.Warm(context.Background(), []string{"http://example.com/a", "http://example.com/b"}, warm.Options{Concurrency: 2})
+	if report.Succeeded != 2 {
+		t.Fatalf("warm report: %+v", report)
+	}
+
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "http://example.com/b", nil))
+	if rr.Body.String() != "page /b" {
+		t.Errorf("body = %q, want %q", rr.Body.String(), "page /b")
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("upstream calls = %d, want 2", got)
+	}
+}
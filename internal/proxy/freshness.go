@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"warpgate/internal/cache"
+)
+
+// maxHeuristicFreshness caps the lifetime assigned to responses that carry
+// no explicit freshness information.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// heuristicStatuses are the status codes that are cacheable by default, so a
+// shared cache may assign them a heuristic lifetime (RFC 9110, 15.1).
+var heuristicStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// understoodStatuses are the status codes the cache knows how to store. The
+// ones not in heuristicStatuses need explicit freshness to be cached.
+var understoodStatuses = map[int]bool{
+	http.StatusFound:             true,
+	http.StatusSeeOther:          true,
+	http.StatusTemporaryRedirect: true,
+}
+
+// cacheControl holds parsed Cache-Control directives keyed by lowercase name.
+type cacheControl map[string]string
+
+func parseCacheControl(values []string) cacheControl {
+	cc := make(cacheControl)
+	for _, v := range values {
+		for _, part := range strings.Split(v, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, val, _ := strings.Cut(part, "=")
+			name = strings.ToLower(strings.TrimSpace(name))
+			val = strings.Trim(strings.TrimSpace(val), `"`)
+			if _, dup := cc[name]; !dup {
+				cc[name] = val
+			}
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(name string) bool {
+	_, ok := cc[name]
+	return ok
+}
+
+// seconds returns a delta-seconds directive. A present but malformed value
+// is treated as zero, which errs on the side of staleness.
+func (cc cacheControl) seconds(name string) (time.Duration, bool) {
+	v, ok := cc[name]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// requestNoCache reports whether the request asks for a validated response.
+func requestNoCache(req *http.Request, cc cacheControl) bool {
+	if cc.has("no-cache") {
+		return true
+	}
+	return len(cc) == 0 && strings.EqualFold(req.Header.Get("Pragma"), "no-cache")
+}
+
+// isCacheableResponse decides whether a shared cache may store resp, which
+// was received for req (RFC 9111, 3), under the route's policy.
+func isCacheableResponse(req *http.Request, resp *http.Response, p ttlPolicy) bool {
+	return bypassReason(req, resp, p) == ""
+}
+
+// bypassReason returns why a shared cache may not store resp, or "" if it
+// may. The reasons are used as metric labels.
+func bypassReason(req *http.Request, resp *http.Response, p ttlPolicy) string {
+	if resp.StatusCode >= 500 && !p.cacheErrors {
+		return "error"
+	}
+	_, hasStatusTTL := p.status.lookup(resp.StatusCode)
+	if !heuristicStatuses[resp.StatusCode] && !understoodStatuses[resp.StatusCode] && !hasStatusTTL {
+		return "status"
+	}
+	if varyAny(resp.Header) {
+		return "vary"
+	}
+
+	if parseCacheControl(req.Header.Values("Cache-Control")).has("no-store") {
+		return "no-store"
+	}
+
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if cc.has("no-store") {
+		return "no-store"
+	}
+	if cc.has("private") {
+		return "private"
+	}
+
+	if req.Header.Get("Authorization") != "" &&
+		!cc.has("public") && !cc.has("s-maxage") && !cc.has("must-revalidate") {
+		return "authorization"
+	}
+
+	if heuristicStatuses[resp.StatusCode] || hasStatusTTL || cc.has("public") ||
+		cc.has("s-maxage") || cc.has("max-age") || resp.Header.Get("Expires") != "" {
+		return ""
+	}
+	return "status"
+}
+
+// computeExpiry returns when resp stops being fresh, accounting for the age
+// it already had on arrival. It returns the zero time if the response has no
+// usable freshness lifetime.
+func computeExpiry(resp *http.Response, p ttlPolicy) time.Time {
+	now := time.Now()
+
+	cc := parseCacheControl(resp.Header.Values("Cache-Control"))
+	if cc.has("no-cache") {
+		// Storable, but must be revalidated before every use.
+		return now
+	}
+
+	lifetime, ok := freshnessLifetime(resp, cc, p, now)
+	if !ok {
+		return time.Time{}
+	}
+	return now.Add(lifetime - responseAge(resp.Header, now))
+}
+
+// freshnessLifetime implements RFC 9111, 4.2.1 for a shared cache, with the
+// route's status TTLs, and its TTL for 200 responses, standing in for the
+// origin's silence.
+func freshnessLifetime(resp *http.Response, cc cacheControl, p ttlPolicy, now time.Time) (time.Duration, bool) {
+	if d, ok := cc.seconds("s-maxage"); ok {
+		return d, true
+	}
+	if d, ok := cc.seconds("max-age"); ok {
+		return d, true
+	}
+	if exp := resp.Header.Get("Expires"); exp != "" {
+		t, err := http.ParseTime(exp)
+		if err != nil {
+			// An invalid Expires means the response is already stale.
+			return 0, true
+		}
+		return t.Sub(responseDate(resp.Header, now)), true
+	}
+
+	if d, ok := p.status.lookup(resp.StatusCode); ok {
+		return d, true
+	}
+	if p.route > 0 && resp.StatusCode == http.StatusOK {
+		return p.route, true
+	}
+
+	if heuristicStatuses[resp.StatusCode] || cc.has("public") {
+		if lm, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+			if since := responseDate(resp.Header, now).Sub(lm); since > 0 {
+				return min(since/10, maxHeuristicFreshness), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func responseDate(h http.Header, now time.Time) time.Time {
+	if t, err := http.ParseTime(h.Get("Date")); err == nil {
+		return t
+	}
+	return now
+}
+
+// responseAge is the age a response already had when it was received: the
+// larger of its Age header and the time elapsed since its Date.
+func responseAge(h http.Header, now time.Time) time.Duration {
+	var age time.Duration
+	if n, err := strconv.ParseInt(h.Get("Age"), 10, 64); err == nil && n > 0 {
+		age = time.Duration(n) * time.Second
+	}
+	if date, err := http.ParseTime(h.Get("Date")); err == nil {
+		if apparent := now.Sub(date); apparent > age {
+			age = apparent
+		}
+	}
+	return age
+}
+
+// mustRevalidate reports whether a stale response may never be served
+// without successful revalidation.
+func mustRevalidate(h http.Header) bool {
+	cc := parseCacheControl(h.Values("Cache-Control"))
+	return cc.has("must-revalidate") || cc.has("proxy-revalidate") || cc.has("s-maxage")
+}
+
+// satisfies reports whether cached may be served for a request carrying the
+// given Cache-Control directives without contacting upstream.
+func satisfies(cached *cache.CachedResponse, cc cacheControl, now time.Time) bool {
+	if d, ok := cc.seconds("max-age"); ok && cached.Age(now) > d {
+		return false
+	}
+	if d, ok := cc.seconds("min-fresh"); ok && !cached.ExpiresAt.IsZero() && cached.ExpiresAt.Sub(now) < d {
+		return false
+	}
+	if cached.Fresh(now) {
+		return true
+	}
+	if cached.MustRevalidate {
+		return false
+	}
+	if v, ok := cc["max-stale"]; ok {
+		if v == "" {
+			return true
+		}
+		d, _ := cc.seconds("max-stale")
+		return now.Sub(cached.ExpiresAt) <= d
+	}
+	return false
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"warpgate/internal/cache"
+)
+
+func TestComputeExpiry(t *testing.T) {
+	now := time.Now()
+	date := now.UTC().Format(http.TimeFormat)
+
+	tests := []struct {
+		name    string
+		status  int
+		header  map[string]string
+		ttl     time.Duration
+		want    time.Duration
+		noFresh bool
+	}{
+		{"MaxAge", 200, map[string]string{"Cache-Control": "max-age=60"}, 0, 60 * time.Second, false},
+		{"MaxAgeCaseInsensitive", 200, map[string]string{"Cache-Control": "Public, MAX-AGE=60"}, 0, 60 * time.Second, false},
+		{"SMaxAgeWins", 200, map[string]string{"Cache-Control": "max-age=10, s-maxage=120"}, 0, 120 * time.Second, false},
+		{"AgeReducesLifetime", 200, map[string]string{"Cache-Control": "max-age=60", "Age": "20"}, 0, 40 * time.Second, false},
+		{"Expires", 200, map[string]string{"Date": date, "Expires": now.Add(90 * time.Second).UTC().Format(http.TimeFormat)}, 0, 90 * time.Second, false},
+		{"InvalidExpiresIsStale", 200, map[string]string{"Expires": "0"}, 0, 0, false},
+		{"NoCacheIsStale", 200, map[string]string{"Cache-Control": "no-cache, max-age=60"}, 0, 0, false},
+		{"RouteTTL", 200, nil, 30 * time.Second, 30 * time.Second, false},
+		{"ExplicitBeatsRouteTTL", 200, map[string]string{"Cache-Control": "max-age=5"}, 30 * time.Second, 5 * time.Second, false},
+		{"Heuristic404", 404, map[string]string{"Date": date, "Last-Modified": now.Add(-100 * time.Minute).UTC().Format(http.TimeFormat)}, 0, 10 * time.Minute, false},
+		{"HeuristicCapped", 301, map[string]string{"Date": date, "Last-Modified": now.Add(-1000 * 24 * time.Hour).UTC().Format(http.TimeFormat)}, 0, maxHeuristicFreshness, false},
+		{"NoFreshnessInfo", 404, nil, 30 * time.Second, 0, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+			for k, v := range tt.header {
+				resp.Header.Set(k, v)
+			}
+			got := computeExpiry(resp, ttlPolicy{route: tt.ttl})
+			if tt.noFresh {
+				if !got.IsZero() {
+					t.Fatalf("expected no freshness, got expiry in %v", time.Until(got))
+				}
+				return
+			}
+			if got.IsZero() {
+				t.Fatal("expected an expiry, got none")
+			}
+			if d := time.Until(got) - tt.want; d > 2*time.Second || d < -2*time.Second {
+				t.Errorf("expiry in %v, want about %v", time.Until(got), tt.want)
+			}
+		})
+	}
+}
+
+func TestIsCacheableResponse(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		cc     string
+		auth   bool
+		reqCC  string
+		want   bool
+	}{
+		{"Plain200", 200, "", false, "", true},
+		{"NoStore", 200, "no-store", false, "", false},
+		{"Private", 200, "private", false, "", false},
+		{"RequestNoStore", 200, "max-age=60", false, "no-store", false},
+		{"AuthorizationWithoutPermission", 200, "max-age=60", true, "", false},
+		{"AuthorizationPublic", 200, "public, max-age=60", true, "", true},
+		{"AuthorizationSMaxAge", 200, "s-maxage=60", true, "", true},
+		{"AuthorizationMustRevalidate", 200, "max-age=60, must-revalidate", true, "", true},
+		{"Heuristic410", 410, "", false, "", true},
+		{"FoundNeedsExplicit", 302, "", false, "", false},
+		{"FoundWithMaxAge", 302, "max-age=60", false, "", true},
+		{"ServerError", 500, "max-age=60", false, "", false},
+		{"Partial", 206, "max-age=60", false, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			if tt.auth {
+				req.Header.Set("Authorization", "Bearer x")
+			}
+			if tt.reqCC != "" {
+				req.Header.Set("Cache-Control", tt.reqCC)
+			}
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+			if tt.cc != "" {
+				resp.Header.Set("Cache-Control", tt.cc)
+			}
+			if got := isCacheableResponse(req, resp, ttlPolicy{}); got != tt.want {
+				t.Errorf("isCacheableResponse = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSatisfies(t *testing.T) {
+	now := time.Now()
+	fresh := &cache.CachedResponse{StoredAt: now.Add(-30 * time.Second), ExpiresAt: now.Add(30 * time.Second)}
+	stale := &cache.CachedResponse{StoredAt: now.Add(-90 * time.Second), ExpiresAt: now.Add(-30 * time.Second)}
+	strict := &cache.CachedResponse{StoredAt: now.Add(-90 * time.Second), ExpiresAt: now.Add(-30 * time.Second), MustRevalidate: true}
+
+	tests := []struct {
+		name   string
+		cached *cache.CachedResponse
+		reqCC  string
+		want   bool
+	}{
+		{"Fresh", fresh, "", true},
+		{"Stale", stale, "", false},
+		{"MaxAgeTooOld", fresh, "max-age=10", false},
+		{"MaxAgeOK", fresh, "max-age=60", true},
+		{"MinFresh", fresh, "min-fresh=60", false},
+		{"MaxStaleUnbounded", stale, "max-stale", true},
+		{"MaxStaleWithin", stale, "max-stale=60", true},
+		{"MaxStaleExceeded", stale, "max-stale=10", false},
+		{"MustRevalidateIgnoresMaxStale", strict, "max-stale", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc := parseCacheControl([]string{tt.reqCC})
+			if got := satisfies(tt.cached, cc, now); got != tt.want {
+				t.Errorf("satisfies = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package proxy
+
+import (
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"warpgate/internal/clientip"
+	"warpgate/internal/logging"
+)
+
+// HeaderOps describes edits to a set of headers. They apply in the order
+// Remove, Rename, Set, Add. Values of Set and Add may reference variables
+// as ${name}:
+//
+//	${client_ip}      the resolved client address
+//	${route}          the route name
+//	${cluster}        the cluster name
+//	${method}         the request method
+//	${host}           the request host
+//	${path}           the request path
+//	${request_id}     the request ID
+//	${request_start}  when warpgate received the request, in Unix microseconds
+//	${param.<name>}   a path parameter matched by the route's prefix
+//	${header.<name>}  a header of the client's request
+type HeaderOps struct {
+	Remove []string
+	// Rename maps old header names to new ones.
+	Rename map[string]string
+	Set    map[string]string
+	Add    map[string]string
+}
+
+// HeaderRules edits the headers of requests sent upstream and of responses
+// sent to clients.
+type HeaderRules struct {
+	request  compiledOps
+	response compiledOps
+}
+
+// NewHeaderRules compiles the edits of requests and responses.
+func NewHeaderRules(request, response HeaderOps) (*HeaderRules, error) {
+	req, err := compileOps(request)
+	if err != nil {
+		return nil, fmt.Errorf("request: %w", err)
+	}
+	resp, err := compileOps(response)
+	if err != nil {
+		return nil, fmt.Errorf("response: %w", err)
+	}
+	return &HeaderRules{request: req, response: resp}, nil
+}
+
+type compiledOps struct {
+	remove []string
+	rename [][2]string
+	set    []headerValue
+	add    []headerValue
+}
+
+type headerValue struct {
+	name string
+	tmpl headerTemplate
+}
+
+func compileOps(ops HeaderOps) (compiledOps, error) {
+	var c compiledOps
+	for _, name := range ops.Remove {
+		c.remove = append(c.remove, http.CanonicalHeaderKey(name))
+	}
+	for _, from := range slices.Sorted(maps.Keys(ops.Rename)) {
+		c.rename = append(c.rename, [2]string{http.CanonicalHeaderKey(from), http.CanonicalHeaderKey(ops.Rename[from])})
+	}
+	values := func(m map[string]string) ([]headerValue, error) {
+		var out []headerValue
+		for _, name := range slices.Sorted(maps.Keys(m)) {
+			tmpl, err := parseHeaderTemplate(m[name])
+			if err != nil {
+				return nil, fmt.Errorf("header %s: %w", name, err)
+			}
+			out = append(out, headerValue{name: http.CanonicalHeaderKey(name), tmpl: tmpl})
+		}
+		return out, nil
+	}
+	var err error
+	if c.set, err = values(ops.Set); err != nil {
+		return c, err
+	}
+	if c.add, err = values(ops.Add); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+func (c *compiledOps) apply(h http.Header, v *headerVars) {
+	for _, name := range c.remove {
+		h.Del(name)
+	}
+	for _, r := range c.rename {
+		if vv, ok := h[r[0]]; ok {
+			delete(h, r[0])
+			h[r[1]] = vv
+		}
+	}
+	for _, hv := range c.set {
+		if s, ok := hv.tmpl.render(v); ok {
+			h.Set(hv.name, s)
+		}
+	}
+	for _, hv := range c.add {
+		if s, ok := hv.tmpl.render(v); ok {
+			h.Add(hv.name, s)
+		}
+	}
+}
+
+// headerTemplate is a header value made of literal text and variables.
+type headerTemplate []templatePart
+
+type templatePart struct {
+	literal string
+	// variable is the name of the variable, if the part is one.
+	variable string
+}
+
+var headerVariables = map[string]bool{
+	"client_ip": true, "route": true, "cluster": true, "method": true, "host": true,
+	"path": true, "request_id": true, "request_start": true,
+}
+
+func parseHeaderTemplate(s string) (headerTemplate, error) {
+	var t headerTemplate
+	for s != "" {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			t = append(t, templatePart{literal: s})
+			break
+		}
+		if i > 0 {
+			t = append(t, templatePart{literal: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("unterminated variable in %q", s)
+		}
+		name := s[i+2 : i+j]
+		param, isParam := strings.CutPrefix(name, "param.")
+		header, isHeader := strings.CutPrefix(name, "header.")
+		if !headerVariables[name] && !(isParam && param != "") && !(isHeader && header != "") {
+			return nil, fmt.Errorf("unknown variable ${%s}", name)
+		}
+		t = append(t, templatePart{variable: name})
+		s = s[i+j+1:]
+	}
+	return t, nil
+}
+
+// render returns the value of the template for a request. It reports false
+// if the value would not be a valid header value.
+func (t headerTemplate) render(v *headerVars) (string, bool) {
+	var b strings.Builder
+	for _, p := range t {
+		if p.variable == "" {
+			b.WriteString(p.literal)
+		} else {
+			b.WriteString(v.lookup(p.variable))
+		}
+	}
+	s := b.String()
+	return s, !strings.ContainsAny(s, "\r\n\x00")
+}
+
+// headerVars are the values header templates are rendered with.
+type headerVars struct {
+	req   *http.Request
+	meta  *RouteMetadata
+	start time.Time
+}
+
+func (v *headerVars) lookup(name string) string {
+	switch name {
+	case "client_ip":
+		if addr := clientip.FromRequest(v.req); addr.IsValid() {
+			return addr.String()
+		}
+		return ""
+	case "route":
+		return v.meta.RouteName
+	case "cluster":
+		return v.meta.ClusterName
+	case "method":
+		return v.req.Method
+	case "host":
+		return v.req.Host
+	case "path":
+		return v.req.URL.Path
+	case "request_id":
+		if id := logging.RequestID(v.req.Context()); id != "" {
+			return id
+		}
+		return v.req.Header.Get("X-Request-Id")
+	case "request_start":
+		return strconv.FormatInt(v.start.UnixMicro(), 10)
+	}
+	if p, ok := strings.CutPrefix(name, "param."); ok {
+		return v.meta.PathParams[p]
+	}
+	if h, ok := strings.CutPrefix(name, "header."); ok {
+		return v.req.Header.Get(h)
+	}
+	return ""
+}
+
+// headerRulesWriter applies response header rules when the header is
+// written.
+type headerRulesWriter struct {
+	http.ResponseWriter
+	rules       []*HeaderRules
+	vars        *headerVars
+	wroteHeader bool
+}
+
+func (w *headerRulesWriter) WriteHeader(code int) {
+	if !w.wroteHeader && code >= http.StatusOK {
+		w.wroteHeader = true
+		for _, r := range w.rules {
+			r.response.apply(w.Header(), w.vars)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *headerRulesWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerRulesWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *headerRulesWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
@@ -0,0 +1,107 @@
+package proxy_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"warpgate/internal/cluster"
+	"warpgate/internal/proxy"
+)
+
+func TestNewHeaderRules_RejectsUnknownVariables(t *testing.T) {
+	for _, v := range []string{"${nope}", "${param.}", "${route"} {
+		if _, err := proxy.NewHeaderRules(proxy.HeaderOps{Set: map[string]string{"X-Test": v}}, proxy.HeaderOps{}); err == nil {
+			t.Errorf("%q accepted", v)
+		}
+	}
+}
+
+func TestEngine_HeaderRules(t *testing.T) {
+	var upstream http.Header
+	tr := transportFunc(func(r *http.Request) (*http.Response, error) {
+		upstream = r.Header.Clone()
+		h := http.Header{}
+		h.Set("Server", "backend/1.0")
+		h.Set("X-Internal-Id", "abc")
+		h.Set("Content-Type", "text/plain")
+		return newResponse(http.StatusOK, h, strings.NewReader("ok")), nil
+	})
+
+	clusterRules, err := proxy.NewHeaderRules(
+		proxy.HeaderOps{Set: map[string]string{"X-Cluster": "${cluster}"}},
+		proxy.HeaderOps{Remove: []string{"Server"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	routeRules, err := proxy.NewHeaderRules(
+		proxy.HeaderOps{
+			Remove: []string{"Cookie"},
+			Rename: map[string]string{"X-Token": "Authorization"},
+			Set: map[string]string{
+				"X-Tenant":        "${param.tenant}",
+				"X-Client":        "${client_ip} via ${route}",
+				"X-Request-Start": "t=${request_start}",
+				"X-Echoed":        "${header.X-Echo}",
+			},
+		},
+		proxy.HeaderOps{
+			Rename: map[string]string{"X-Internal-Id": "X-Upstream-Id"},
+			Set:    map[string]string{"X-Content-Type-Options": "nosniff"},
+			Add:    map[string]string{"X-Served-For": "${param.tenant}"},
+		},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse("http://backend")
+	clusters := map[string]cluster.Cluster{
+		"backend": cluster.NewRoundRobinCluster("backend", []*cluster.Endpoint{{URL: u}}, nil, nil),
+	}
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Name: "tenant", Prefix: "/t/{tenant}/", ClusterName: "backend", Headers: routeRules},
+	})
+	e := proxy.NewEngine(d, nil, tr, clusters, nil)
+	e.ClusterHeaders = map[string]*proxy.HeaderRules{"backend": clusterRules}
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/t/acme/items", nil)
+	req.RemoteAddr = "192.0.2.7:5000"
+	req.Header.Set("Cookie", "session=1")
+	req.Header.Set("X-Token", "Bearer t")
+	req.Header.Set("X-Echo", "a\r\nInjected: 1")
+	rr := httptest.NewRecorder()
+	e.ServeHTTP(rr, req)
+
+	for name, want := range map[string]string{
+		"X-Cluster":     "backend",
+		"Cookie":        "",
+		"X-Token":       "",
+		"Authorization": "Bearer t",
+		"X-Tenant":      "acme",
+		"X-Client":      "192.0.2.7 via tenant",
+		"X-Echoed":      "",
+	} {
+		if got := upstream.Get(name); got != want {
+			t.Errorf("upstream %s = %q, want %q", name, got, want)
+		}
+	}
+	if got := upstream.Get("X-Request-Start"); !strings.HasPrefix(got, "t=") || len(got) < 10 {
+		t.Errorf("upstream X-Request-Start = %q", got)
+	}
+
+	for name, want := range map[string]string{
+		"Server":                 "",
+		"X-Internal-Id":          "",
+		"X-Upstream-Id":          "abc",
+		"X-Content-Type-Options": "nosniff",
+		"X-Served-For":           "acme",
+	} {
+		if got := rr.Header().Get(name); got != want {
+			t.Errorf("response %s = %q, want %q", name, got, want)
+		}
+	}
+}
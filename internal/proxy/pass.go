@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// passTTL is how long a key stays uncacheable after a response for it
+	// could not be stored, in case the object changes.
+	passTTL = 5 * time.Minute
+	// maxPassKeys bounds the keys remembered.
+	maxPassKeys = 10000
+)
+
+// passSet remembers the cache keys whose last response could not be stored,
+// so that range requests for them are forwarded as they are instead of
+// fetching the whole object for a cache that will not keep it.
+type passSet struct {
+	mu   sync.Mutex
+	keys map[string]time.Time
+}
+
+// add marks key uncacheable for passTTL.
+func (s *passSet) add(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if s.keys == nil {
+		s.keys = make(map[string]time.Time)
+	}
+	if _, ok := s.keys[key]; !ok && len(s.keys) >= maxPassKeys {
+		for k, exp := range s.keys {
+			if now.After(exp) {
+				delete(s.keys, k)
+			}
+		}
+		for k := range s.keys {
+			if len(s.keys) < maxPassKeys {
+				break
+			}
+			delete(s.keys, k)
+		}
+	}
+	s.keys[key] = now.Add(passTTL)
+}
+
+// has reports whether key was marked uncacheable less than passTTL ago.
+func (s *passSet) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.keys[key]
+	if ok && time.Now().After(exp) {
+		delete(s.keys, key)
+		return false
+	}
+	return ok
+}
+
+// remove forgets key, once a response for it has been stored.
+func (s *passSet) remove(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, key)
+}
@@ -0,0 +1,182 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// maxRanges bounds the ranges served for one request; requests asking for
+// more are answered with the full response.
+const maxRanges = 16
+
+var (
+	errInvalidRange   = errors.New("invalid range")
+	errUnsatisfiable  = errors.New("range not satisfiable")
+	errRangeCompleted = errors.New("range completed")
+)
+
+// byteRange is a satisfiable range of a representation.
+type byteRange struct {
+	start  int64
+	length int64
+}
+
+func (r byteRange) contentRange(size int64) string {
+	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
+}
+
+// parseRange parses a Range header against a representation of the given
+// size (RFC 9110, 14.2). Unsatisfiable ranges are dropped; errUnsatisfiable
+// is returned if none is left. errInvalidRange means the header should be
+// ignored.
+func parseRange(header string, size int64) ([]byteRange, error) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return nil, errInvalidRange
+	}
+
+	var ranges []byteRange
+	n := 0
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if n++; n > maxRanges {
+			return nil, errInvalidRange
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return nil, errInvalidRange
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		if first == "" {
+			// Suffix range: the last n bytes.
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return nil, errInvalidRange
+			}
+			if n == 0 || size == 0 {
+				continue
+			}
+			n = min(n, size)
+			ranges = append(ranges, byteRange{start: size - n, length: n})
+			continue
+		}
+
+		start, err := strconv.ParseInt(first, 10, 64)
+		if err != nil || start < 0 {
+			return nil, errInvalidRange
+		}
+		end := size - 1
+		if last != "" {
+			if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+				return nil, errInvalidRange
+			}
+			end = min(end, size-1)
+		}
+		if start >= size {
+			continue
+		}
+		ranges = append(ranges, byteRange{start: start, length: end - start + 1})
+	}
+
+	if n == 0 {
+		return nil, errInvalidRange
+	}
+	if len(ranges) == 0 {
+		return nil, errUnsatisfiable
+	}
+	return ranges, nil
+}
+
+// ifRangeMatches reports whether the request's If-Range precondition, if
+// any, holds for a representation with the given validators. An entity tag
+// must match strongly; a date must equal Last-Modified exactly.
+func ifRangeMatches(req *http.Request, etag, lastModified string) bool {
+	cond := req.Header.Get("If-Range")
+	if cond == "" {
+		return true
+	}
+	if strings.HasPrefix(cond, `"`) || strings.HasPrefix(cond, "W/") {
+		return etag != "" && cond == etag && !strings.HasPrefix(etag, "W/")
+	}
+	return lastModified != "" && cond == lastModified
+}
+
+// writeRanges answers with 206 Partial Content for the given ranges of body,
+// as a multipart/byteranges payload if there is more than one. The headers
+// of the full response are already set on rw.
+func writeRanges(rw http.ResponseWriter, body io.ReadSeeker, ranges []byteRange, size int64) error {
+	h := rw.Header()
+	if len(ranges) == 1 {
+		r := ranges[0]
+		h.Set("Content-Range", r.contentRange(size))
+		h.Set("Content-Length", strconv.FormatInt(r.length, 10))
+		rw.WriteHeader(http.StatusPartialContent)
+		if _, err := body.Seek(r.start, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := io.CopyN(rw, body, r.length)
+		return err
+	}
+
+	mw := multipart.NewWriter(rw)
+	contentType := h.Get("Content-Type")
+	h.Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	h.Del("Content-Length")
+	rw.WriteHeader(http.StatusPartialContent)
+
+	for _, r := range ranges {
+		part := make(textproto.MIMEHeader)
+		if contentType != "" {
+			part.Set("Content-Type", contentType)
+		}
+		part.Set("Content-Range", r.contentRange(size))
+		pw, err := mw.CreatePart(part)
+		if err != nil {
+			return err
+		}
+		if _, err := body.Seek(r.start, io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.CopyN(pw, body, r.length); err != nil {
+			return err
+		}
+	}
+	return mw.Close()
+}
+
+// rangeWriter passes on the bytes of a stream that fall inside one range and
+// discards the rest. Once past the range it fails with errRangeCompleted if
+// stop is set, so that the rest of the stream need not be read.
+type rangeWriter struct {
+	w    io.Writer
+	r    byteRange
+	off  int64
+	stop bool
+}
+
+func (w *rangeWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	start, end := w.r.start, w.r.start+w.r.length
+	lo := max(start-w.off, 0)
+	hi := min(end-w.off, int64(n))
+	w.off += int64(n)
+	if lo < hi {
+		if _, err := w.w.Write(p[lo:hi]); err != nil {
+			return 0, err
+		}
+	}
+	if w.stop && w.off >= end {
+		return n, errRangeCompleted
+	}
+	return n, nil
+}
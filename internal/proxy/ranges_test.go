@@ -0,0 +1,80 @@
+package proxy
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header string
+		want   []byteRange
+		err    error
+	}{
+		{"bytes=0-4", []byteRange{{0, 5}}, nil},
+		{"bytes=5-", []byteRange{{5, 5}}, nil},
+		{"bytes=-3", []byteRange{{7, 3}}, nil},
+		{"bytes=-20", []byteRange{{0, 10}}, nil},
+		{"bytes=8-20", []byteRange{{8, 2}}, nil},
+		{"bytes=0-0, 2-3 ,-1", []byteRange{{0, 1}, {2, 2}, {9, 1}}, nil},
+		{"bytes=20-30, 2-3", []byteRange{{2, 2}}, nil},
+		{"bytes=10-", nil, errUnsatisfiable},
+		{"bytes=-0", nil, errUnsatisfiable},
+		{"bytes=5-2", nil, errInvalidRange},
+		{"bytes=a-b", nil, errInvalidRange},
+		{"items=0-1", nil, errInvalidRange},
+		{"bytes=", nil, errInvalidRange},
+		{"bytes=0-1,2-3,4-5,6-7,8-9,0-1,2-3,4-5,6-7,8-9,0-1,2-3,4-5,6-7,8-9,0-1,2-3", nil, errInvalidRange},
+	}
+	for _, tt := range tests {
+		got, err := parseRange(tt.header, 10)
+		if err != tt.err || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseRange(%q) = %v, %v; want %v, %v", tt.header, got, err, tt.want, tt.err)
+		}
+	}
+}
+
+func TestIfRangeMatches(t *testing.T) {
+	const lm = "Mon, 02 Jan 2006 15:04:05 GMT"
+	tests := []struct {
+		ifRange, etag string
+		want          bool
+	}{
+		{"", `"v1"`, true},
+		{`"v1"`, `"v1"`, true},
+		{`"v2"`, `"v1"`, false},
+		{`W/"v1"`, `W/"v1"`, false},
+		{`"v1"`, `W/"v1"`, false},
+		{lm, `"v1"`, true},
+		{"Tue, 03 Jan 2006 15:04:05 GMT", `"v1"`, false},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.ifRange != "" {
+			req.Header.Set("If-Range", tt.ifRange)
+		}
+		if got := ifRangeMatches(req, tt.etag, lm); got != tt.want {
+			t.Errorf("ifRangeMatches(%q, %q) = %v, want %v", tt.ifRange, tt.etag, got, tt.want)
+		}
+	}
+}
+
+func TestRangeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &rangeWriter{w: &buf, r: byteRange{start: 3, length: 4}, stop: true}
+	for _, chunk := range []string{"01", "234", "56"} {
+		_, err := w.Write([]byte(chunk))
+		if chunk == "56" {
+			if err != errRangeCompleted {
+				t.Fatalf("expected errRangeCompleted at the end of the range, got %v", err)
+			}
+		} else if err != nil {
+			t.Fatalf("Write(%q): %v", chunk, err)
+		}
+	}
+	if buf.String() != "3456" {
+		t.Errorf("rangeWriter passed %q, want %q", buf.String(), "3456")
+	}
+}
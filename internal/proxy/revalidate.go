@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"warpgate/internal/cache"
+)
+
+// setValidators turns req into a conditional request for the stale entry,
+// replacing any conditionals the client sent.
+func setValidators(req *http.Request, stale *cache.CachedResponse) {
+	req.Header.Del("If-None-Match")
+	req.Header.Del("If-Modified-Since")
+	if stale.ETag != "" {
+		req.Header.Set("If-None-Match", stale.ETag)
+	}
+	if stale.LastModified != "" {
+		req.Header.Set("If-Modified-Since", stale.LastModified)
+	}
+}
+
+// mergeNotModified returns the stored header updated with the fields carried
+// by a 304 response.
+func mergeNotModified(stored, update http.Header) http.Header {
+	merged := cloneHeader(stored)
+	for k, values := range update {
+		if k == "Content-Length" {
+			continue
+		}
+		merged[k] = append([]string(nil), values...)
+	}
+	return merged
+}
+
+// notModified reports whether the client's conditional headers match the
+// cached response, in which case it can be answered with 304.
+func notModified(req *http.Request, cached *cache.CachedResponse) bool {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		return false
+	}
+
+	if inm := req.Header.Values("If-None-Match"); len(inm) > 0 {
+		return cached.ETag != "" && etagMatches(strings.Join(inm, ","), cached.ETag)
+	}
+
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || cached.LastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	modified, err := http.ParseTime(cached.LastModified)
+	if err != nil {
+		return false
+	}
+	return !modified.After(since)
+}
+
+// etagMatches applies the weak comparison used for If-None-Match against a
+// comma separated list of entity tags.
+func etagMatches(list, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// newCacheEntry builds the entry stored for a response, keeping it past
+// expiry for KeepStale when it carries validators.
+func (e *Engine) newCacheEntry(status int, header http.Header, body []byte, expiry time.Time) *cache.CachedResponse {
+	now := time.Now()
+	entry := &cache.CachedResponse{
+		StatusCode:     status,
+		Header:         header,
+		Body:           body,
+		ExpiresAt:      expiry,
+		ETag:           header.Get("ETag"),
+		LastModified:   header.Get("Last-Modified"),
+		StoredAt:       now,
+		InitialAge:     responseAge(header, now),
+		MustRevalidate: mustRevalidate(header),
+		Tags:           responseTags(header, e.TagHeaders),
+	}
+	if entry.HasValidators() && e.KeepStale > 0 {
+		entry.KeepUntil = expiry.Add(e.KeepStale)
+	}
+	return entry
+}
+
+// responseTags collects the surrogate keys from the given headers. Values may
+// be separated by spaces (Surrogate-Key) or commas (Cache-Tag).
+func responseTags(h http.Header, names []string) []string {
+	var tags []string
+	for _, name := range names {
+		for _, v := range h.Values(name) {
+			tags = append(tags, strings.FieldsFunc(v, func(r rune) bool {
+				return r == ',' || r == ' ' || r == '\t'
+			})...)
+		}
+	}
+	return tags
+}
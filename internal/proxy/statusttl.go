@@ -0,0 +1,78 @@
+package proxy
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// StatusTTL holds the lifetimes a route gives responses that carry no
+// explicit freshness, by status code or by status class. It makes statuses
+// such as 404 or 503 cacheable, so that requests for missing or failing
+// resources do not all reach upstream.
+type StatusTTL struct {
+	codes   map[int]time.Duration
+	classes map[int]time.Duration
+}
+
+// ParseStatusTTL builds a StatusTTL from entries keyed by a status code
+// ("404") or a class ("5xx"). A code takes precedence over its class.
+func ParseStatusTTL(m map[string]time.Duration) (StatusTTL, error) {
+	var s StatusTTL
+	for k, ttl := range m {
+		if ttl < 0 {
+			return StatusTTL{}, fmt.Errorf("negative ttl for status %q", k)
+		}
+		key := strings.ToLower(strings.TrimSpace(k))
+		if len(key) == 3 && strings.HasSuffix(key, "xx") && key[0] >= '1' && key[0] <= '5' {
+			if s.classes == nil {
+				s.classes = make(map[int]time.Duration)
+			}
+			s.classes[int(key[0]-'0')] = ttl
+			continue
+		}
+		code, err := strconv.Atoi(key)
+		if err != nil || code < 100 || code > 599 {
+			return StatusTTL{}, fmt.Errorf("invalid status %q", k)
+		}
+		if s.codes == nil {
+			s.codes = make(map[int]time.Duration)
+		}
+		s.codes[code] = ttl
+	}
+	return s, nil
+}
+
+// uncacheableStatus reports whether status describes an exchange rather
+// than the resource (1xx, 206, 304), so that no configured lifetime applies.
+func uncacheableStatus(status int) bool {
+	return status < 200 || status == http.StatusPartialContent || status == http.StatusNotModified
+}
+
+// lookup returns the lifetime configured for status.
+func (s StatusTTL) lookup(status int) (time.Duration, bool) {
+	if uncacheableStatus(status) {
+		return 0, false
+	}
+	if ttl, ok := s.codes[status]; ok {
+		return ttl, true
+	}
+	ttl, ok := s.classes[status/100]
+	return ttl, ok
+}
+
+// ttlPolicy is the part of a route's configuration that decides which
+// responses are cached and for how long when upstream does not say.
+type ttlPolicy struct {
+	// route is the lifetime of 200 responses.
+	route  time.Duration
+	status StatusTTL
+	// cacheErrors allows 5xx responses to be stored.
+	cacheErrors bool
+}
+
+func (m RouteMetadata) ttlPolicy() ttlPolicy {
+	return ttlPolicy{route: m.CacheTTL, status: m.StatusTTL, cacheErrors: m.CacheErrors}
+}
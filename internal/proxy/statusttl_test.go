@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestParseStatusTTL(t *testing.T) {
+	s, err := ParseStatusTTL(map[string]time.Duration{
+		"404": 10 * time.Second,
+		"4xx": time.Second,
+		"5XX": 2 * time.Second,
+		"1xx": time.Hour,
+		"2xx": time.Hour,
+		"3xx": time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("ParseStatusTTL: %v", err)
+	}
+
+	tests := []struct {
+		status int
+		want   time.Duration
+		ok     bool
+	}{
+		{404, 10 * time.Second, true},
+		{410, time.Second, true},
+		{503, 2 * time.Second, true},
+		{200, time.Hour, true},
+		{301, time.Hour, true},
+		{100, 0, false},
+		{206, 0, false},
+		{304, 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := s.lookup(tt.status)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("lookup(%d) = %v, %v; want %v, %v", tt.status, got, ok, tt.want, tt.ok)
+		}
+	}
+
+	for _, bad := range []string{"6xx", "abc", "99", "40x"} {
+		if _, err := ParseStatusTTL(map[string]time.Duration{bad: time.Second}); err == nil {
+			t.Errorf("ParseStatusTTL(%q): expected error", bad)
+		}
+	}
+	if _, err := ParseStatusTTL(map[string]time.Duration{"404": -time.Second}); err == nil {
+		t.Error("ParseStatusTTL: expected error for negative ttl")
+	}
+}
+
+func TestStatusTTLPolicy(t *testing.T) {
+	status, err := ParseStatusTTL(map[string]time.Duration{"404": 10 * time.Second, "5xx": time.Second})
+	if err != nil {
+		t.Fatalf("ParseStatusTTL: %v", err)
+	}
+	withErrors := ttlPolicy{route: time.Minute, status: status, cacheErrors: true}
+	noErrors := ttlPolicy{route: time.Minute, status: status}
+
+	tests := []struct {
+		name    string
+		status  int
+		cc      string
+		policy  ttlPolicy
+		want    string
+		expires time.Duration
+	}{
+		{"NegativeCache404", 404, "", noErrors, "", 10 * time.Second},
+		{"ExplicitBeatsStatusTTL", 404, "max-age=60", noErrors, "", 60 * time.Second},
+		{"RouteTTLFor200", 200, "", noErrors, "", time.Minute},
+		{"ErrorsNotCached", 503, "", noErrors, "error", 0},
+		{"ErrorsNotCachedDespiteMaxAge", 503, "max-age=60", noErrors, "error", 0},
+		{"ErrorsCached", 503, "", withErrors, "", time.Second},
+		{"UnderstoodOnlyWithTTL", 500, "", ttlPolicy{cacheErrors: true}, "status", 0},
+		{"NoStoreStillWins", 404, "no-store", noErrors, "no-store", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+			resp := &http.Response{StatusCode: tt.status, Header: make(http.Header)}
+			if tt.cc != "" {
+				resp.Header.Set("Cache-Control", tt.cc)
+			}
+			if got := bypassReason(req, resp, tt.policy); got != tt.want {
+				t.Fatalf("bypassReason = %q, want %q", got, tt.want)
+			}
+			if tt.want != "" {
+				return
+			}
+			got := computeExpiry(resp, tt.policy)
+			if d := time.Until(got) - tt.expires; d > 2*time.Second || d < -2*time.Second {
+				t.Errorf("expiry in %v, want about %v", time.Until(got), tt.expires)
+			}
+		})
+	}
+}
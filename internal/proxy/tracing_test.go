@@ -0,0 +1,70 @@
+package proxy_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+
+	"warpgate/internal/cache"
+	"warpgate/internal/cluster"
+	"warpgate/internal/proxy"
+	"warpgate/internal/tracing"
+)
+
+func TestEngine_Spans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	p, err := tracing.NewWithExporter(exporter, tracing.Options{Sampler: tracing.SamplerAlwaysOn})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var traceparent string
+	tr := p.Transport(transportFunc(func(r *http.Request) (*http.Response, error) {
+		traceparent = r.Header.Get("Traceparent")
+		return newResponse(http.StatusOK, http.Header{"Cache-Control": {"max-age=60"}}, strings.NewReader("ok")), nil
+	}))
+	u, _ := url.Parse("http://backend")
+	clusters := map[string]cluster.Cluster{
+		"backend": cluster.NewRoundRobinCluster("backend", []*cluster.Endpoint{{URL: u}}, nil, nil),
+	}
+	d := proxy.NewSimpleDirector([]proxy.SimpleRoute{
+		{Name: "items", Prefix: "/", ClusterName: "backend", CacheEnabled: true, CacheTTL: time.Minute},
+	})
+	e := proxy.NewEngine(d, cache.NewInMemoryCache(10), tr, clusters, nil)
+	e.Tracer = p.Tracer()
+
+	p.Middleware(e).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "http://example.com/items", nil))
+	defer p.Shutdown(context.Background())
+	if err := p.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+	root, ok := byName["GET items"]
+	if !ok {
+		t.Fatalf("no request span among %d spans", len(spans))
+	}
+	for _, name := range []string{"director", "cache lookup", "select endpoint", "upstream GET"} {
+		s, ok := byName[name]
+		if !ok {
+			t.Errorf("no %q span", name)
+			continue
+		}
+		if s.Parent.SpanID() != root.SpanContext.SpanID() {
+			t.Errorf("%q is not a child of the request span", name)
+		}
+	}
+	if !strings.Contains(traceparent, root.SpanContext.TraceID().String()) {
+		t.Errorf("upstream traceparent %q", traceparent)
+	}
+}
@@ -0,0 +1,303 @@
+// Package resp is a small client for the Redis serialization protocol
+// (RESP2). It covers what warpgate needs to use Redis, or any server speaking
+// its protocol, as a shared store: commands, pipelines and a connection pool.
+package resp
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Error is an error reply sent by the server. It leaves the connection
+// usable, unlike network and protocol errors.
+type Error string
+
+func (e Error) Error() string { return string(e) }
+
+// ErrPoolTimeout is returned when no connection became available before the
+// command's context was done.
+var ErrPoolTimeout = errors.New("resp: timed out waiting for a connection")
+
+// Options configures a Client.
+type Options struct {
+	// Addr is the server's host:port.
+	Addr string
+	// Password, when set, is sent with AUTH on every new connection.
+	Password string
+	// DB selects the database on every new connection.
+	DB int
+	// PoolSize bounds the number of open connections (default 16).
+	PoolSize int
+	// DialTimeout bounds connecting to the server (default 1s).
+	DialTimeout time.Duration
+	// Timeout bounds each command's round trip unless the context has an
+	// earlier deadline (default 500ms).
+	Timeout time.Duration
+}
+
+// Client is a pool of connections to one server. It is safe for concurrent
+// use.
+type Client struct {
+	opts  Options
+	slots chan struct{}
+	idle  chan *conn
+}
+
+type conn struct {
+	nc net.Conn
+	r  *bufio.Reader
+	w  *bufio.Writer
+}
+
+func NewClient(opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 16
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = time.Second
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 500 * time.Millisecond
+	}
+	return &Client{
+		opts:  opts,
+		slots: make(chan struct{}, opts.PoolSize),
+		idle:  make(chan *conn, opts.PoolSize),
+	}
+}
+
+// Do sends one command and returns its reply: a string for simple strings,
+// []byte for bulk strings, int64 for integers, []any for arrays and nil for
+// null replies. Error replies are returned as an Error.
+func (c *Client) Do(ctx context.Context, args ...any) (any, error) {
+	replies, err := c.Pipeline(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	if err, ok := replies[0].(Error); ok {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+// Pipeline sends several commands in one round trip and returns their
+// replies in order. Error replies are returned in place, as Error values.
+func (c *Client) Pipeline(ctx context.Context, cmds ...[]any) ([]any, error) {
+	cn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	replies, err := cn.roundTrip(ctx, c.opts.Timeout, cmds)
+	c.put(cn, err)
+	return replies, err
+}
+
+// Close closes the idle connections. Connections in use are closed when
+// they are returned.
+func (c *Client) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			_ = cn.nc.Close()
+			<-c.slots
+		default:
+			return nil
+		}
+	}
+}
+
+func (c *Client) get(ctx context.Context) (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ErrPoolTimeout
+	}
+
+	cn, err := c.dial(ctx)
+	if err != nil {
+		<-c.slots
+		return nil, err
+	}
+	return cn, nil
+}
+
+// put returns cn to the pool, or closes it if err left it in an unknown
+// state.
+func (c *Client) put(cn *conn, err error) {
+	if err != nil {
+		_ = cn.nc.Close()
+		<-c.slots
+		return
+	}
+	c.idle <- cn
+}
+
+func (c *Client) dial(ctx context.Context) (*conn, error) {
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{
+		nc: nc,
+		r:  bufio.NewReader(nc),
+		w:  bufio.NewWriter(nc),
+	}
+
+	var setup [][]any
+	if c.opts.Password != "" {
+		setup = append(setup, []any{"AUTH", c.opts.Password})
+	}
+	if c.opts.DB != 0 {
+		setup = append(setup, []any{"SELECT", c.opts.DB})
+	}
+	if len(setup) > 0 {
+		replies, err := cn.roundTrip(ctx, c.opts.Timeout, setup)
+		if err == nil {
+			for _, r := range replies {
+				if rerr, ok := r.(Error); ok {
+					err = rerr
+					break
+				}
+			}
+		}
+		if err != nil {
+			_ = nc.Close()
+			return nil, fmt.Errorf("resp: connection setup: %w", err)
+		}
+	}
+	return cn, nil
+}
+
+func (cn *conn) roundTrip(ctx context.Context, timeout time.Duration, cmds [][]any) ([]any, error) {
+	deadline := time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := cn.nc.SetDeadline(deadline); err != nil {
+		return nil, err
+	}
+
+	for _, cmd := range cmds {
+		if err := writeCommand(cn.w, cmd); err != nil {
+			return nil, err
+		}
+	}
+	if err := cn.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	for i := range replies {
+		r, err := readReply(cn.r)
+		if err != nil {
+			return nil, err
+		}
+		replies[i] = r
+	}
+	return replies, nil
+}
+
+func writeCommand(w *bufio.Writer, args []any) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, a := range args {
+		var b []byte
+		switch v := a.(type) {
+		case string:
+			b = []byte(v)
+		case []byte:
+			b = v
+		case int:
+			b = strconv.AppendInt(nil, int64(v), 10)
+		case int64:
+			b = strconv.AppendInt(nil, v, 10)
+		case float64:
+			b = strconv.AppendFloat(nil, v, 'f', -1, 64)
+		default:
+			return fmt.Errorf("resp: unsupported argument type %T", a)
+		}
+		fmt.Fprintf(w, "$%d\r\n", len(b))
+		w.Write(b)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readReply reads one reply. Nested error replies inside arrays are returned
+// as Error values.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("resp: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return string(line[1:]), nil
+	case '-':
+		return Error(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(string(line[1:]), 10, 64)
+	case '$':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("resp: invalid bulk length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(string(line[1:]))
+		if err != nil {
+			return nil, fmt.Errorf("resp: invalid array length: %w", err)
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		arr := make([]any, n)
+		for i := range arr {
+			if arr[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return arr, nil
+	default:
+		return nil, fmt.Errorf("resp: unexpected reply type %q", line[0])
+	}
+}
+
+func readLine(r *bufio.Reader) ([]byte, error) {
+	line, err := r.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errors.New("resp: malformed line")
+	}
+	return line[:len(line)-2], nil
+}
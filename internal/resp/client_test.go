@@ -0,0 +1,139 @@
+package resp_test
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+
+	"warpgate/internal/resp"
+	"warpgate/internal/resp/resptest"
+)
+
+func TestClient_Do(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr(), Password: "secret", DB: 1})
+	defer c.Close()
+	ctx := context.Background()
+
+	if v, err := c.Do(ctx, "SET", "k", []byte("v\r\n1"), "PX", 1000); err != nil || v != "OK" {
+		t.Fatalf("SET = %v, %v", v, err)
+	}
+	if v, err := c.Do(ctx, "GET", "k"); err != nil || string(v.([]byte)) != "v\r\n1" {
+		t.Fatalf("GET = %v, %v", v, err)
+	}
+	if v, err := c.Do(ctx, "GET", "missing"); err != nil || v != nil {
+		t.Fatalf("GET missing = %v, %v", v, err)
+	}
+	if v, err := c.Do(ctx, "DEL", "k", "missing"); err != nil || v != int64(1) {
+		t.Fatalf("DEL = %v, %v", v, err)
+	}
+
+	_, err := c.Do(ctx, "NOSUCHCOMMAND")
+	var rerr resp.Error
+	if !errors.As(err, &rerr) {
+		t.Fatalf("expected server error reply, got %v", err)
+	}
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		t.Fatalf("connection unusable after error reply: %v", err)
+	}
+}
+
+func TestClient_Pipeline(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr()})
+	defer c.Close()
+
+	replies, err := c.Pipeline(context.Background(),
+		[]any{"SADD", "s", "a", "b"},
+		[]any{"GET", "s"},
+		[]any{"SMEMBERS", "s"},
+	)
+	if err != nil {
+		t.Fatalf("Pipeline: %v", err)
+	}
+	if replies[0] != int64(2) {
+		t.Errorf("SADD = %v, want 2", replies[0])
+	}
+	if _, ok := replies[1].(resp.Error); !ok {
+		t.Errorf("GET on a set = %v, want an error reply", replies[1])
+	}
+	if members, ok := replies[2].([]any); !ok || len(members) != 2 {
+		t.Errorf("SMEMBERS = %v", replies[2])
+	}
+}
+
+func TestClient_PoolBoundsConnections(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr(), PoolSize: 2, Password: "x"})
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if _, err := c.Do(context.Background(), "PING"); err != nil {
+					t.Errorf("PING: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if n := srv.Commands("AUTH"); n > 2 {
+		t.Errorf("opened %d connections, pool size 2", n)
+	}
+}
+
+func TestClient_ServerDown(t *testing.T) {
+	srv := resptest.NewServer(t)
+	c := resp.NewClient(resp.Options{Addr: srv.Addr()})
+	defer c.Close()
+	ctx := context.Background()
+
+	if _, err := c.Do(ctx, "PING"); err != nil {
+		t.Fatalf("PING: %v", err)
+	}
+	srv.Close()
+	if _, err := c.Do(ctx, "PING"); err == nil {
+		t.Fatal("expected an error once the server is gone")
+	}
+	if _, err := c.Do(ctx, "PING"); err == nil {
+		t.Fatal("expected an error once the server is gone")
+	}
+}
+
+func TestScript_Run(t *testing.T) {
+	srv := resptest.NewServer(t)
+	const src = "return redis.call('INCRBY', KEYS[1], ARGV[1])"
+	srv.HandleScript(src, func(tx *resptest.Tx, keys, args []string) any {
+		v, _ := tx.Get(keys[0])
+		n, _ := strconv.ParseInt(string(v), 10, 64)
+		d, _ := strconv.ParseInt(args[0], 10, 64)
+		n += d
+		tx.Set(keys[0], []byte(strconv.FormatInt(n, 10)), 0)
+		return n
+	})
+
+	c := resp.NewClient(resp.Options{Addr: srv.Addr()})
+	defer c.Close()
+	script := resp.NewScript(src)
+	ctx := context.Background()
+
+	for i, want := range []int64{2, 4, 6} {
+		v, err := script.Run(ctx, c, []string{"counter"}, 2)
+		if err != nil || v != want {
+			t.Fatalf("run %d = %v, %v; want %d", i, v, err, want)
+		}
+	}
+	if n := srv.Commands("EVAL"); n != 1 {
+		t.Errorf("EVAL sent %d times, want once", n)
+	}
+	if n := srv.Commands("EVALSHA"); n != 3 {
+		t.Errorf("EVALSHA sent %d times, want 3", n)
+	}
+}
@@ -0,0 +1,455 @@
+// Package resptest provides an in-process server speaking the Redis protocol
+// for tests. It implements the subset of commands warpgate uses, with
+// in-memory data.
+package resptest
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type value struct {
+	str      []byte
+	set      map[string]struct{}
+	expireAt time.Time
+}
+
+// Server is a fake Redis server listening on a local port.
+type Server struct {
+	ln net.Listener
+
+	mu       sync.Mutex
+	data     map[string]*value
+	conns    map[net.Conn]struct{}
+	commands map[string]int
+	scripts  map[string]ScriptFunc
+	loaded   map[string]bool
+	closed   bool
+}
+
+// ScriptFunc emulates a Lua script, which the server cannot run. It is
+// called with the server locked, so it runs atomically like a script.
+type ScriptFunc func(tx *Tx, keys, args []string) any
+
+// Tx gives a ScriptFunc access to string keys. Replies may be nil, string
+// (a status reply), []byte, int64 or []any.
+type Tx struct {
+	s   *Server
+	now time.Time
+}
+
+// Now returns the server time.
+func (tx *Tx) Now() time.Time { return tx.now }
+
+// Get returns the value of a string key.
+func (tx *Tx) Get(key string) ([]byte, bool) {
+	v, ok := tx.s.data[key]
+	if !ok || !v.live(tx.now) || v.set != nil {
+		return nil, false
+	}
+	return v.str, true
+}
+
+// Set stores a string key, expiring after ttl unless it is zero.
+func (tx *Tx) Set(key string, val []byte, ttl time.Duration) {
+	v := &value{str: val}
+	if ttl > 0 {
+		v.expireAt = tx.now.Add(ttl)
+	}
+	tx.s.data[key] = v
+}
+
+// SAdd adds member to the set at key, creating it without expiry.
+func (tx *Tx) SAdd(key, member string) {
+	v, ok := tx.s.data[key]
+	if !ok || !v.live(tx.now) || v.set == nil {
+		v = &value{set: make(map[string]struct{})}
+		tx.s.data[key] = v
+	}
+	v.set[member] = struct{}{}
+}
+
+// TTL returns the remaining time to live of key, zero if it has none, and
+// whether the key exists.
+func (tx *Tx) TTL(key string) (time.Duration, bool) {
+	v, ok := tx.s.data[key]
+	if !ok || !v.live(tx.now) {
+		return 0, false
+	}
+	if v.expireAt.IsZero() {
+		return 0, true
+	}
+	return v.expireAt.Sub(tx.now), true
+}
+
+// Expire sets the time to live of key; zero removes its expiry.
+func (tx *Tx) Expire(key string, ttl time.Duration) {
+	v, ok := tx.s.data[key]
+	if !ok || !v.live(tx.now) {
+		return
+	}
+	v.expireAt = time.Time{}
+	if ttl > 0 {
+		v.expireAt = tx.now.Add(ttl)
+	}
+}
+
+// NewServer starts a server that is closed when the test ends.
+func NewServer(t testing.TB) *Server {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("resptest: listen: %v", err)
+	}
+	s := &Server{
+		ln:       ln,
+		data:     make(map[string]*value),
+		conns:    make(map[net.Conn]struct{}),
+		commands: make(map[string]int),
+		scripts:  make(map[string]ScriptFunc),
+		loaded:   make(map[string]bool),
+	}
+	go s.serve()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and drops its connections, simulating an outage.
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	_ = s.ln.Close()
+	for c := range s.conns {
+		_ = c.Close()
+	}
+}
+
+// Keys returns the live keys, sorted.
+func (s *Server) Keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	var keys []string
+	for k, v := range s.data {
+		if v.live(now) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// TTL returns the remaining time to live of key, or zero if it has none.
+func (s *Server) TTL(key string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	v, ok := s.data[key]
+	if !ok || v.expireAt.IsZero() {
+		return 0
+	}
+	return time.Until(v.expireAt)
+}
+
+// HandleScript makes fn the implementation of the Lua script src. Scripts
+// must be sent with EVAL before EVALSHA finds them, as with a real server.
+func (s *Server) HandleScript(src string, fn ScriptFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.scripts[scriptSHA(src)] = fn
+}
+
+func scriptSHA(src string) string {
+	sum := sha1.Sum([]byte(src))
+	return hex.EncodeToString(sum[:])
+}
+
+// Commands returns how many times the named command was received.
+func (s *Server) Commands(name string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[strings.ToUpper(name)]
+}
+
+func (v *value) live(now time.Time) bool {
+	return v.expireAt.IsZero() || now.Before(v.expireAt)
+}
+
+func (s *Server) serve() {
+	for {
+		c, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			_ = c.Close()
+			return
+		}
+		s.conns[c] = struct{}{}
+		s.mu.Unlock()
+		go s.handle(c)
+	}
+}
+
+func (s *Server) handle(c net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+		_ = c.Close()
+	}()
+
+	r := bufio.NewReader(c)
+	w := bufio.NewWriter(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		writeReply(w, s.exec(args))
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+type errReply string
+
+func (s *Server) exec(args []string) any {
+	if len(args) == 0 {
+		return errReply("ERR empty command")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := strings.ToUpper(args[0])
+	s.commands[name]++
+	now := time.Now()
+	get := func(key string) *value {
+		v, ok := s.data[key]
+		if !ok || !v.live(now) {
+			delete(s.data, key)
+			return nil
+		}
+		return v
+	}
+
+	switch name {
+	case "PING":
+		return "PONG"
+	case "AUTH", "SELECT":
+		return "OK"
+	case "GET":
+		v := get(args[1])
+		if v == nil {
+			return nil
+		}
+		if v.set != nil {
+			return errReply("WRONGTYPE Operation against a key holding the wrong kind of value")
+		}
+		return v.str
+	case "SET":
+		v := &value{str: []byte(args[2])}
+		for i := 3; i+1 < len(args); i += 2 {
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				return errReply("ERR value is not an integer or out of range")
+			}
+			switch strings.ToUpper(args[i]) {
+			case "PX":
+				v.expireAt = now.Add(time.Duration(n) * time.Millisecond)
+			case "EX":
+				v.expireAt = now.Add(time.Duration(n) * time.Second)
+			}
+		}
+		s.data[args[1]] = v
+		return "OK"
+	case "DEL":
+		n := int64(0)
+		for _, k := range args[1:] {
+			if get(k) != nil {
+				delete(s.data, k)
+				n++
+			}
+		}
+		return n
+	case "PEXPIRE":
+		v := get(args[1])
+		if v == nil {
+			return int64(0)
+		}
+		ms, _ := strconv.ParseInt(args[2], 10, 64)
+		v.expireAt = now.Add(time.Duration(ms) * time.Millisecond)
+		return int64(1)
+	case "SADD":
+		v := get(args[1])
+		if v == nil {
+			v = &value{set: make(map[string]struct{})}
+			s.data[args[1]] = v
+		}
+		n := int64(0)
+		for _, m := range args[2:] {
+			if _, ok := v.set[m]; !ok {
+				v.set[m] = struct{}{}
+				n++
+			}
+		}
+		return n
+	case "SMEMBERS":
+		v := get(args[1])
+		var members []any
+		if v != nil {
+			for m := range v.set {
+				members = append(members, []byte(m))
+			}
+		}
+		return members
+	case "SCAN":
+		// The whole key space is returned in one batch.
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []any
+		for k := range s.data {
+			if get(k) != nil && match(pattern, k) {
+				keys = append(keys, []byte(k))
+			}
+		}
+		return []any{[]byte("0"), keys}
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return errReply("ERR wrong number of arguments")
+		}
+		sha := args[1]
+		if name == "EVAL" {
+			sha = scriptSHA(args[1])
+			s.loaded[sha] = true
+		} else if !s.loaded[sha] {
+			return errReply("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		fn, ok := s.scripts[sha]
+		if !ok {
+			return errReply("ERR resptest: script not emulated")
+		}
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 || 3+n > len(args) {
+			return errReply("ERR Number of keys can't be greater than number of args")
+		}
+		return fn(&Tx{s: s, now: now}, args[3:3+n], args[3+n:])
+	default:
+		return errReply(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+	}
+}
+
+// match implements glob-style matching with '*', '?' and '\' escapes.
+func match(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if match(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, s = pattern[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		hdr, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(hdr, "$") {
+			return nil, errors.New("resptest: expected bulk string")
+		}
+		size, err := strconv.Atoi(strings.TrimRight(hdr[1:], "\r\n"))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		args[i] = string(buf[:size])
+	}
+	return args, nil
+}
+
+func writeReply(w *bufio.Writer, v any) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteString("$-1\r\n")
+	case string:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case errReply:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case []byte:
+		fmt.Fprintf(w, "$%d\r\n", len(v))
+		w.Write(v)
+		w.WriteString("\r\n")
+	case []any:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, e := range v {
+			writeReply(w, e)
+		}
+	}
+}
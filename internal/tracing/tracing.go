@@ -0,0 +1,328 @@
+// Package tracing exports OpenTelemetry traces of proxied requests.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.39.0"
+	"go.opentelemetry.io/otel/trace"
+
+	"warpgate/internal/clientip"
+	"warpgate/internal/logging"
+)
+
+// Exporters.
+const (
+	ExporterOTLPHTTP = "otlphttp"
+	ExporterOTLPGRPC = "otlpgrpc"
+)
+
+// Samplers, named as in OTEL_TRACES_SAMPLER.
+const (
+	SamplerAlwaysOn                = "always_on"
+	SamplerAlwaysOff               = "always_off"
+	SamplerTraceIDRatio            = "traceidratio"
+	SamplerParentBasedAlwaysOn     = "parentbased_always_on"
+	SamplerParentBasedAlwaysOff    = "parentbased_always_off"
+	SamplerParentBasedTraceIDRatio = "parentbased_traceidratio"
+)
+
+// Options configures New.
+type Options struct {
+	// ServiceName is the service.name of the spans (default warpgate).
+	ServiceName string
+	// Exporter is ExporterOTLPHTTP (the default) or ExporterOTLPGRPC.
+	Exporter string
+	// Endpoint is the URL of the collector (default http://localhost:4318
+	// for HTTP, http://localhost:4317 for gRPC). An http URL disables TLS.
+	Endpoint string
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+	// Timeout bounds each export (default 10s).
+	Timeout time.Duration
+	// Sampler decides which traces are recorded (default
+	// SamplerParentBasedTraceIDRatio).
+	Sampler string
+	// SampleRatio is the fraction of traces recorded by the ratio samplers.
+	SampleRatio float64
+	// Propagators lists the formats trace context is read from and written
+	// to upstream: "tracecontext", "baggage", "b3" (single header) or
+	// "b3multi" (default tracecontext, baggage and b3).
+	Propagators []string
+}
+
+// Provider creates the spans of warpgate and exports them.
+type Provider struct {
+	tp         *sdktrace.TracerProvider
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New returns a provider exporting spans as configured by opts.
+func New(ctx context.Context, opts Options) (*Provider, error) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 10 * time.Second
+	}
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch opts.Exporter {
+	case "", ExporterOTLPHTTP:
+		if opts.Endpoint == "" {
+			opts.Endpoint = "http://localhost:4318"
+		}
+		exporter, err = otlptracehttp.New(ctx,
+			otlptracehttp.WithEndpointURL(strings.TrimSuffix(opts.Endpoint, "/")+"/v1/traces"),
+			otlptracehttp.WithHeaders(opts.Headers),
+			otlptracehttp.WithTimeout(opts.Timeout),
+		)
+	case ExporterOTLPGRPC:
+		if opts.Endpoint == "" {
+			opts.Endpoint = "http://localhost:4317"
+		}
+		exporter, err = otlptracegrpc.New(ctx,
+			otlptracegrpc.WithEndpointURL(opts.Endpoint),
+			otlptracegrpc.WithHeaders(opts.Headers),
+			otlptracegrpc.WithTimeout(opts.Timeout),
+		)
+	default:
+		return nil, fmt.Errorf("unknown exporter %q", opts.Exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("exporter: %w", err)
+	}
+	p, err := NewWithExporter(exporter, opts)
+	if err != nil {
+		exporter.Shutdown(ctx)
+		return nil, err
+	}
+	return p, nil
+}
+
+// NewWithExporter returns a provider batching spans to exporter; the
+// exporter options of opts are ignored.
+func NewWithExporter(exporter sdktrace.SpanExporter, opts Options) (*Provider, error) {
+	if opts.ServiceName == "" {
+		opts.ServiceName = "warpgate"
+	}
+	sampler, err := newSampler(opts.Sampler, opts.SampleRatio)
+	if err != nil {
+		return nil, err
+	}
+	propagator, err := newPropagator(opts.Propagators)
+	if err != nil {
+		return nil, err
+	}
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(semconv.ServiceName(opts.ServiceName)))
+	if err != nil {
+		return nil, fmt.Errorf("resource: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sampler),
+		sdktrace.WithResource(res),
+	)
+	return &Provider{
+		tp:         tp,
+		tracer:     tp.Tracer("warpgate"),
+		propagator: propagator,
+	}, nil
+}
+
+func newSampler(name string, ratio float64) (sdktrace.Sampler, error) {
+	switch name {
+	case SamplerAlwaysOn:
+		return sdktrace.AlwaysSample(), nil
+	case SamplerAlwaysOff:
+		return sdktrace.NeverSample(), nil
+	case SamplerTraceIDRatio:
+		return sdktrace.TraceIDRatioBased(ratio), nil
+	case SamplerParentBasedAlwaysOn:
+		return sdktrace.ParentBased(sdktrace.AlwaysSample()), nil
+	case SamplerParentBasedAlwaysOff:
+		return sdktrace.ParentBased(sdktrace.NeverSample()), nil
+	case "", SamplerParentBasedTraceIDRatio:
+		return sdktrace.ParentBased(sdktrace.TraceIDRatioBased(ratio)), nil
+	}
+	return nil, fmt.Errorf("unknown sampler %q", name)
+}
+
+func newPropagator(names []string) (propagation.TextMapPropagator, error) {
+	if len(names) == 0 {
+		names = []string{"tracecontext", "baggage", "b3"}
+	}
+	var props []propagation.TextMapPropagator
+	for _, name := range names {
+		switch strings.ToLower(name) {
+		case "tracecontext":
+			props = append(props, propagation.TraceContext{})
+		case "baggage":
+			props = append(props, propagation.Baggage{})
+		case "b3":
+			props = append(props, b3.New(b3.WithInjectEncoding(b3.B3SingleHeader)))
+		case "b3multi":
+			props = append(props, b3.New(b3.WithInjectEncoding(b3.B3MultipleHeader)))
+		default:
+			return nil, fmt.Errorf("unknown propagator %q", name)
+		}
+	}
+	return propagation.NewCompositeTextMapPropagator(props...), nil
+}
+
+// Tracer returns the tracer of warpgate's spans.
+func (p *Provider) Tracer() trace.Tracer {
+	return p.tracer
+}
+
+// ForceFlush exports the spans ended so far.
+func (p *Provider) ForceFlush(ctx context.Context) error {
+	return p.tp.ForceFlush(ctx)
+}
+
+// Shutdown exports the spans still buffered and stops the provider.
+func (p *Provider) Shutdown(ctx context.Context) error {
+	return p.tp.Shutdown(ctx)
+}
+
+// Middleware starts the span of each request, continuing the trace of the
+// client if its headers carry one.
+func (p *Provider) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := p.propagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		attrs := []attribute.KeyValue{
+			semconv.HTTPRequestMethodKey.String(r.Method),
+			semconv.URLPath(r.URL.Path),
+			semconv.URLScheme(scheme),
+			semconv.ServerAddress(r.Host),
+			semconv.UserAgentOriginal(r.UserAgent()),
+		}
+		if addr := clientip.FromRequest(r); addr.IsValid() {
+			attrs = append(attrs, semconv.ClientAddress(addr.String()))
+		}
+		if id := logging.RequestID(ctx); id != "" {
+			attrs = append(attrs, attribute.String("warpgate.request_id", id))
+		}
+		ctx, span := p.tracer.Start(ctx, r.Method,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(attrs...),
+		)
+		defer span.End()
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r.WithContext(ctx))
+		if sw.status == 0 {
+			sw.status = http.StatusOK
+		}
+		span.SetAttributes(semconv.HTTPResponseStatusCode(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+	})
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 && code >= http.StatusOK {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusWriter) Flush() {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Transport returns a round tripper giving each request sent through next
+// its own client span, so that every attempt is traced, and passing the
+// trace context on in the request headers. The span ends when the response
+// body is closed.
+func (p *Provider) Transport(next http.RoundTripper) http.RoundTripper {
+	return &transport{next: next, p: p}
+}
+
+type transport struct {
+	next http.RoundTripper
+	p    *Provider
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, span := t.p.tracer.Start(req.Context(), "upstream "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			semconv.HTTPRequestMethodKey.String(req.Method),
+			semconv.URLFull(req.URL.Redacted()),
+			semconv.ServerAddress(req.URL.Hostname()),
+		),
+	)
+	req = req.Clone(ctx)
+	t.p.propagator.Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	span.SetAttributes(semconv.HTTPResponseStatusCode(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(resp.StatusCode))
+	}
+	if resp.Body == nil || resp.Body == http.NoBody {
+		span.End()
+		return resp, nil
+	}
+	resp.Body = &spanBody{ReadCloser: resp.Body, span: span}
+	return resp, nil
+}
+
+// spanBody ends a span when the body it wraps is closed.
+type spanBody struct {
+	io.ReadCloser
+	span trace.Span
+	once sync.Once
+}
+
+func (b *spanBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { b.span.End() })
+	return err
+}
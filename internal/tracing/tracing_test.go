@@ -0,0 +1,223 @@
+package tracing
+
+import (
+	"context"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// collector is an in-process OTLP trace receiver.
+type collector struct {
+	collectortrace.UnimplementedTraceServiceServer
+
+	mu    sync.Mutex
+	spans []*tracepb.Span
+}
+
+func (c *collector) Export(_ context.Context, req *collectortrace.ExportTraceServiceRequest) (*collectortrace.ExportTraceServiceResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, rs := range req.ResourceSpans {
+		for _, ss := range rs.ScopeSpans {
+			c.spans = append(c.spans, ss.Spans...)
+		}
+	}
+	return &collectortrace.ExportTraceServiceResponse{}, nil
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req collectortrace.ExportTraceServiceRequest
+	if err := proto.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	resp, _ := c.Export(r.Context(), &req)
+	b, _ := proto.Marshal(resp)
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.Write(b)
+}
+
+func (c *collector) byName() map[string]*tracepb.Span {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := make(map[string]*tracepb.Span)
+	for _, s := range c.spans {
+		m[s.Name] = s
+	}
+	return m
+}
+
+func startHTTPCollector(t *testing.T) (*collector, string) {
+	c := &collector{}
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return c, srv.URL
+}
+
+func startGRPCCollector(t *testing.T) (*collector, string) {
+	c := &collector{}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer()
+	collectortrace.RegisterTraceServiceServer(srv, c)
+	go srv.Serve(ln)
+	t.Cleanup(srv.Stop)
+	return c, "http://" + ln.Addr().String()
+}
+
+const (
+	parentTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	parentSpanID  = "00f067aa0ba902b7"
+)
+
+// serve sends a request continuing the trace of parentTraceID through the
+// provider's middleware to a handler calling upstream through its
+// transport, and returns the headers the upstream received.
+func serve(t *testing.T, p *Provider, header http.Header) http.Header {
+	t.Helper()
+	var upstreamHeader http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamHeader = r.Header.Clone()
+		io.WriteString(w, "ok")
+	}))
+	defer upstream.Close()
+
+	client := &http.Client{Transport: p.Transport(http.DefaultTransport)}
+	h := p.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(r.Context(), http.MethodGet, upstream.URL+"/items", nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(w, resp.Body)
+		resp.Body.Close()
+	}))
+
+	req := httptest.NewRequest(http.MethodGet, "http://example.com/items", nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if err := p.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	return upstreamHeader
+}
+
+func TestProvider_Exporters(t *testing.T) {
+	for _, tc := range []struct {
+		exporter string
+		start    func(*testing.T) (*collector, string)
+	}{
+		{ExporterOTLPHTTP, startHTTPCollector},
+		{ExporterOTLPGRPC, startGRPCCollector},
+	} {
+		t.Run(tc.exporter, func(t *testing.T) {
+			c, endpoint := tc.start(t)
+			p, err := New(context.Background(), Options{Exporter: tc.exporter, Endpoint: endpoint, SampleRatio: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			upstream := serve(t, p, http.Header{
+				"Traceparent": {"00-" + parentTraceID + "-" + parentSpanID + "-01"},
+			})
+
+			if tp := upstream.Get("Traceparent"); !strings.HasPrefix(tp, "00-"+parentTraceID+"-") {
+				t.Errorf("upstream traceparent %q", tp)
+			}
+			if b3 := upstream.Get("B3"); !strings.HasPrefix(b3, parentTraceID+"-") {
+				t.Errorf("upstream b3 %q", b3)
+			}
+
+			spans := c.byName()
+			server, client := spans["GET"], spans["upstream GET"]
+			if server == nil || client == nil {
+				t.Fatalf("spans %v", spans)
+			}
+			if got := hex.EncodeToString(server.TraceId); got != parentTraceID {
+				t.Errorf("trace ID %s", got)
+			}
+			if got := hex.EncodeToString(server.ParentSpanId); got != parentSpanID {
+				t.Errorf("server span parent %s", got)
+			}
+			if string(client.ParentSpanId) != string(server.SpanId) {
+				t.Error("upstream span is not a child of the request span")
+			}
+			if server.Kind != tracepb.Span_SPAN_KIND_SERVER || client.Kind != tracepb.Span_SPAN_KIND_CLIENT {
+				t.Errorf("kinds %v, %v", server.Kind, client.Kind)
+			}
+		})
+	}
+}
+
+func TestProvider_B3AndSampling(t *testing.T) {
+	c, endpoint := startHTTPCollector(t)
+	p, err := New(context.Background(), Options{
+		Endpoint:    endpoint,
+		Sampler:     SamplerParentBasedTraceIDRatio,
+		SampleRatio: 0,
+		Propagators: []string{"b3multi"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A sampled B3 parent is followed despite the ratio of 0.
+	upstream := serve(t, p, http.Header{
+		"X-B3-Traceid": {parentTraceID},
+		"X-B3-Spanid":  {parentSpanID},
+		"X-B3-Sampled": {"1"},
+	})
+	if got := upstream.Get("X-B3-Traceid"); got != parentTraceID {
+		t.Errorf("upstream X-B3-TraceId %q", got)
+	}
+	if upstream.Get("Traceparent") != "" {
+		t.Error("traceparent sent without its propagator")
+	}
+	if len(c.byName()) != 2 {
+		t.Errorf("spans %v", c.byName())
+	}
+
+	// Root traces are not sampled.
+	c2, endpoint := startHTTPCollector(t)
+	p, err = New(context.Background(), Options{Endpoint: endpoint, SampleRatio: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, p, nil)
+	if len(c2.byName()) != 0 {
+		t.Errorf("unsampled spans exported: %v", c2.byName())
+	}
+}
+
+func TestNew_RejectsUnknownOptions(t *testing.T) {
+	for _, opts := range []Options{
+		{Exporter: "zipkin"},
+		{Sampler: "sometimes"},
+		{Propagators: []string{"jaeger"}},
+	} {
+		if p, err := New(context.Background(), opts); err == nil {
+			p.Shutdown(context.Background())
+			t.Errorf("%+v accepted", opts)
+		}
+	}
+}
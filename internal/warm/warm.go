@@ -0,0 +1,250 @@
+// Package warm pre-fetches URLs through the proxy so that their responses
+// are cached before clients ask for them, e.g. right after a deploy.
+package warm
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options bounds the load a warm-up puts on upstream.
+type Options struct {
+	// Concurrency is the number of URLs fetched at once (default 8).
+	Concurrency int
+	// Rate limits how many fetches start per second; zero means no limit.
+	Rate float64
+	// Timeout bounds each fetch (default 30s).
+	Timeout time.Duration
+}
+
+// Result is the outcome of warming one URL.
+type Result struct {
+	URL         string `json:"url"`
+	Status      int    `json:"status,omitempty"`
+	Bytes       int64  `json:"bytes"`
+	DurationMs  int64  `json:"durationMs"`
+	CacheStatus string `json:"cacheStatus,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// OK reports whether the URL was fetched with a successful status.
+func (r Result) OK() bool {
+	return r.Error == "" && r.Status > 0 && r.Status < 400
+}
+
+// Report lists the results of a warm-up in the order the URLs were given.
+type Report struct {
+	Total     int      `json:"total"`
+	Succeeded int      `json:"succeeded"`
+	Failed    int      `json:"failed"`
+	Results   []Result `json:"results"`
+}
+
+// Run fetches each URL with a GET request served by h, which is expected to
+// be the proxy engine, so that cacheable responses are stored in its cache.
+// It returns once every URL has been fetched or ctx is done.
+func Run(ctx context.Context, h http.Handler, urls []string, opts Options) Report {
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 30 * time.Second
+	}
+
+	results := make([]Result, len(urls))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for range min(opts.Concurrency, len(urls)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = fetch(ctx, h, urls[i], opts.Timeout)
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	next := 0
+dispatch:
+	for ; next < len(urls); next++ {
+		if tick != nil && next > 0 {
+			select {
+			case <-tick:
+			case <-ctx.Done():
+				break dispatch
+			}
+		}
+		select {
+		case jobs <- next:
+		case <-ctx.Done():
+			break dispatch
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for i := next; i < len(urls); i++ {
+		results[i] = Result{URL: urls[i], Error: ctx.Err().Error()}
+	}
+
+	report := Report{Total: len(urls), Results: results}
+	for _, r := range results {
+		if r.OK() {
+			report.Succeeded++
+		} else {
+			report.Failed++
+		}
+	}
+	return report
+}
+
+func fetch(ctx context.Context, h http.Handler, rawURL string, timeout time.Duration) Result {
+	res := Result{URL: rawURL}
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		res.Error = "invalid URL"
+		return res
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	start := time.Now()
+	w := &discardWriter{header: make(http.Header)}
+	h.ServeHTTP(w, req)
+
+	res.Status = w.status
+	if res.Status == 0 {
+		res.Status = http.StatusOK
+	}
+	res.Bytes = w.n
+	res.DurationMs = time.Since(start).Milliseconds()
+	res.CacheStatus = lastMember(w.header.Values("Cache-Status"))
+	if err := ctx.Err(); err != nil {
+		res.Error = err.Error()
+	}
+	return res
+}
+
+// lastMember returns the last member of a list header, which for
+// Cache-Status is the one added by the proxy itself.
+func lastMember(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	v := values[len(values)-1]
+	if i := strings.LastIndexByte(v, ','); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// discardWriter is the ResponseWriter of a warm-up request. The body is
+// only counted.
+type discardWriter struct {
+	header http.Header
+	status int
+	n      int64
+}
+
+func (w *discardWriter) Header() http.Header { return w.header }
+
+func (w *discardWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+func (w *discardWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// ParseList reads the URLs to warm, either from a sitemap (a <urlset>
+// document) or from plain text with one URL per line, where blank lines
+// and lines starting with '#' are ignored. Duplicates are dropped.
+func ParseList(r io.Reader) ([]string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimSpace(data)
+
+	var urls []string
+	if bytes.HasPrefix(data, []byte("<")) {
+		if urls, err = parseSitemap(data); err != nil {
+			return nil, err
+		}
+	} else {
+		for _, line := range strings.Split(string(data), "\n") {
+			line = strings.TrimSpace(line)
+			if line != "" && !strings.HasPrefix(line, "#") {
+				urls = append(urls, line)
+			}
+		}
+	}
+
+	seen := make(map[string]bool, len(urls))
+	out := urls[:0]
+	for _, u := range urls {
+		if !seen[u] {
+			seen[u] = true
+			out = append(out, u)
+		}
+	}
+	return out, nil
+}
+
+type sitemap struct {
+	XMLName xml.Name
+	URLs    []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+}
+
+func parseSitemap(data []byte) ([]string, error) {
+	var sm sitemap
+	if err := xml.Unmarshal(data, &sm); err != nil {
+		return nil, fmt.Errorf("parse sitemap: %w", err)
+	}
+	switch sm.XMLName.Local {
+	case "urlset":
+	case "sitemapindex":
+		return nil, errors.New("sitemap index files are not supported; warm the sitemaps it lists")
+	default:
+		return nil, fmt.Errorf("parse sitemap: unexpected <%s> element", sm.XMLName.Local)
+	}
+
+	urls := make([]string, 0, len(sm.URLs))
+	for _, u := range sm.URLs {
+		if loc := strings.TrimSpace(u.Loc); loc != "" {
+			urls = append(urls, loc)
+		}
+	}
+	return urls, nil
+}
@@ -0,0 +1,127 @@
+package warm
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	var inFlight, peak atomic.Int32
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+
+		if r.URL.Path == "/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Cache-Status", "origin; hit, warpgate; fwd=uri-miss; stored")
+		w.Write([]byte("hello"))
+	})
+
+	urls := []string{
+		"http://example.com/a",
+		"http://example.com/missing",
+		"http://example.com/b",
+		"not a url",
+		"https://example.com/c",
+	}
+	report := Run(context.Background(), h, urls, Options{Concurrency: 2})
+
+	if report.Total != 5 || report.Succeeded != 3 || report.Failed != 2 {
+		t.Fatalf("report = %d total, %d ok, %d failed; want 5, 3, 2", report.Total, report.Succeeded, report.Failed)
+	}
+	for i, r := range report.Results {
+		if r.URL != urls[i] {
+			t.Errorf("result %d is for %q, want %q", i, r.URL, urls[i])
+		}
+	}
+	if r := report.Results[0]; r.Status != http.StatusOK || r.Bytes != 5 || r.CacheStatus != "warpgate; fwd=uri-miss; stored" {
+		t.Errorf("unexpected result %+v", r)
+	}
+	if r := report.Results[1]; r.Status != http.StatusNotFound || r.OK() {
+		t.Errorf("unexpected result for missing URL %+v", r)
+	}
+	if r := report.Results[3]; r.Error != "invalid URL" {
+		t.Errorf("unexpected result for invalid URL %+v", r)
+	}
+	if p := peak.Load(); p > 2 {
+		t.Errorf("peak concurrency = %d, want at most 2", p)
+	}
+}
+
+func TestRun_Rate(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	urls := []string{"http://example.com/1", "http://example.com/2", "http://example.com/3", "http://example.com/4"}
+
+	start := time.Now()
+	report := Run(context.Background(), h, urls, Options{Concurrency: 4, Rate: 50})
+	if report.Succeeded != 4 {
+		t.Fatalf("succeeded = %d, want 4", report.Succeeded)
+	}
+	// Three intervals of 20ms separate the four fetches.
+	if d := time.Since(start); d < 55*time.Millisecond {
+		t.Errorf("warm-up took %v, want at least 60ms at 50/s", d)
+	}
+}
+
+func TestRun_Canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { cancel() })
+
+	report := Run(ctx, h, []string{"http://example.com/1", "http://example.com/2", "http://example.com/3"}, Options{Concurrency: 1})
+	if report.Failed != 3 {
+		t.Fatalf("failed = %d, want 3: %+v", report.Failed, report.Results)
+	}
+	for _, r := range report.Results {
+		if r.Error == "" {
+			t.Errorf("expected an error for %s", r.URL)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	text := `
+# product pages
+http://example.com/a
+http://example.com/b
+
+http://example.com/a
+`
+	urls, err := ParseList(strings.NewReader(text))
+	if err != nil {
+		t.Fatalf("ParseList: %v", err)
+	}
+	if got := strings.Join(urls, " "); got != "http://example.com/a http://example.com/b" {
+		t.Errorf("urls = %q", got)
+	}
+
+	sitemap := `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>https://example.com/</loc><lastmod>2024-01-01</lastmod></url>
+  <url><loc> https://example.com/about </loc></url>
+</urlset>`
+	urls, err = ParseList(strings.NewReader(sitemap))
+	if err != nil {
+		t.Fatalf("ParseList(sitemap): %v", err)
+	}
+	if got := strings.Join(urls, " "); got != "https://example.com/ https://example.com/about" {
+		t.Errorf("sitemap urls = %q", got)
+	}
+
+	index := `<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><sitemap><loc>https://example.com/s1.xml</loc></sitemap></sitemapindex>`
+	if _, err := ParseList(strings.NewReader(index)); err == nil {
+		t.Error("expected an error for a sitemap index")
+	}
+}